@@ -0,0 +1,239 @@
+// Package accesslog writes one record per forwarded connection when it is closed,
+// records go to a size rotated file or syslog in text or json lines
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tutils/tnet/counter"
+)
+
+// Format is format of access log records
+type Format string
+
+// access log formats
+const (
+	FormatText Format = "text" // logfmt key=value pairs
+	FormatJSON Format = "json" // json lines
+)
+
+// ParseFormat parses text or json
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatText, FormatJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid access log format %q, expected text or json", s)
+}
+
+// close reasons shared by proxy and agent, client is the side accepted by proxy
+const (
+	ReasonClientClosed  = "client closed"
+	ReasonTargetClosed  = "target closed"
+	ReasonTunnelBroken  = "tunnel broken"
+	ReasonKilled        = "killed"
+	ReasonQuotaExceeded = "quota exceeded"
+)
+
+// Logger writes access log records to w, it is safe for concurrent use,
+// all methods do nothing on nil Logger
+type Logger struct {
+	format Format
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// New creates logger writing records to w in format, text by default
+func New(w io.Writer, format Format) *Logger {
+	if format == "" {
+		format = FormatText
+	}
+	return &Logger{
+		format: format,
+		w:      w,
+	}
+}
+
+// Close closes underlying writer if it is an io.Closer
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Conn is a forwarded connection
+type Conn struct {
+	Role     string // proxy or agent
+	TunID    int64
+	ConnID   int64
+	Client   string // client address on proxy, local address connecting to target on agent
+	Target   string
+	Peer     string // remote address of tunnel
+	Identity string // identity of tunnel peer authenticated by transport, empty if not authenticated
+}
+
+// Record is access log record of a forwarded connection, it is safe for concurrent use,
+// all methods do nothing on nil Record
+type Record struct {
+	conn  Conn
+	start time.Time
+
+	l       *Logger
+	mu      sync.Mutex
+	traffic *counter.Traffic
+	reason  string
+	closed  bool
+}
+
+// Open starts record of conn, it returns nil Record if l is nil
+func (l *Logger) Open(conn Conn) *Record {
+	if l == nil {
+		return nil
+	}
+	return &Record{
+		conn:  conn,
+		start: time.Now(),
+		l:     l,
+	}
+}
+
+// SetClient sets client address which is known after the record is opened
+func (r *Record) SetClient(client string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conn.Client = client
+}
+
+// SetTraffic sets traffic of the connection counted by accounting, bytes of record are read from it when closed
+func (r *Record) SetTraffic(t *counter.Traffic) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.traffic = t
+}
+
+// SetReason sets why the connection is closed, the first reason is kept
+func (r *Record) SetReason(reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reason == "" {
+		r.reason = reason
+	}
+}
+
+// Close writes the record once, reason is set if it has not been set
+func (r *Record) Close(reason string) error {
+	if r == nil {
+		return nil
+	}
+	r.SetReason(reason)
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	upload, download := r.traffic.Bytes()
+	e := entry{
+		Time:     r.start,
+		Role:     r.conn.Role,
+		TunID:    r.conn.TunID,
+		ConnID:   r.conn.ConnID,
+		Client:   r.conn.Client,
+		Target:   r.conn.Target,
+		Peer:     r.conn.Peer,
+		Identity: r.conn.Identity,
+		Upload:   upload,
+		Download: download,
+		Duration: time.Since(r.start).Seconds(),
+		Reason:   r.reason,
+	}
+	r.mu.Unlock()
+	return r.l.write(&e)
+}
+
+// entry is a written record
+type entry struct {
+	Time     time.Time `json:"time"`
+	Role     string    `json:"role"`
+	TunID    int64     `json:"tunId"`
+	ConnID   int64     `json:"connId"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target"`
+	Peer     string    `json:"peer"`
+	Identity string    `json:"identity,omitempty"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+	Duration float64   `json:"duration"` // seconds
+	Reason   string    `json:"reason"`
+}
+
+func (l *Logger) write(e *entry) error {
+	var line []byte
+	if l.format == FormatJSON {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		line = append(b, '\n')
+	} else {
+		line = []byte(e.text())
+	}
+	// a record is a single write, it is a single message of syslog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+// text formats entry in logfmt
+func (e *entry) text() string {
+	var b strings.Builder
+	b.WriteString("time=")
+	b.WriteString(e.Time.Format(time.RFC3339Nano))
+	writeField(&b, "role", e.Role)
+	writeField(&b, "conn", fmt.Sprintf("%d:%d", e.TunID, e.ConnID))
+	writeField(&b, "client", e.Client)
+	writeField(&b, "target", e.Target)
+	writeField(&b, "peer", e.Peer)
+	if e.Identity != "" {
+		writeField(&b, "identity", e.Identity)
+	}
+	writeField(&b, "upload", strconv.FormatInt(e.Upload, 10))
+	writeField(&b, "download", strconv.FormatInt(e.Download, 10))
+	writeField(&b, "duration", strconv.FormatFloat(e.Duration, 'f', 3, 64))
+	writeField(&b, "reason", e.Reason)
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func writeField(b *strings.Builder, key string, value string) {
+	b.WriteByte(' ')
+	b.WriteString(key)
+	b.WriteByte('=')
+	if value == "" || strings.ContainsAny(value, " =\"\\\n") {
+		value = strconv.Quote(value)
+	}
+	b.WriteString(value)
+}
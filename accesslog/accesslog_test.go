@@ -0,0 +1,125 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tutils/tnet/counter"
+)
+
+type testCounter struct {
+	value int64
+}
+
+func (c *testCounter) Value() int64              { return c.value }
+func (c *testCounter) IncreaceRatePerSec() int64 { return 0 }
+func (c *testCounter) Add(bytes int64)           { c.value += bytes }
+
+func newTestCounter() counter.Counter {
+	return &testCounter{}
+}
+
+func TestRecordText(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, FormatText)
+	r := l.Open(Conn{Role: "proxy", TunID: 3, ConnID: 7, Client: "127.0.0.1:5000", Target: "10.0.0.2:22", Peer: "1.2.3.4:8080"})
+	acct := counter.NewAccounting(newTestCounter).Open(3, 7, "10.0.0.2:22")
+	r.SetTraffic(acct.Traffic())
+	acct.Upload(10)
+	acct.Download(200)
+	acct.Download(5)
+	r.SetReason(ReasonClientClosed)
+	r.Close(ReasonTunnelBroken) // the first reason is kept
+	r.Close(ReasonKilled)       // written once
+
+	line := b.String()
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("expected one line, got %q", line)
+	}
+	for _, s := range []string{" role=proxy ", " conn=3:7 ", " client=127.0.0.1:5000 ", " target=10.0.0.2:22 ",
+		" peer=1.2.3.4:8080 ", " upload=10 ", " download=205 ", ` reason="client closed"`} {
+		if !strings.Contains(line, s) {
+			t.Errorf("%q not found in %q", s, line)
+		}
+	}
+	if strings.Contains(line, "identity=") {
+		t.Errorf("empty identity is written in %q", line)
+	}
+}
+
+func TestRecordJSON(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, FormatJSON)
+	r := l.Open(Conn{Role: "agent", TunID: 1, ConnID: 2, Target: "db:5432", Identity: "proxy-1"})
+	r.SetClient("127.0.0.1:40000")
+	acct := counter.NewAccounting(newTestCounter).Open(1, 2, "db:5432")
+	r.SetTraffic(acct.Traffic())
+	acct.Upload(1)
+	r.Close("connect failed: refused")
+
+	var e entry
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Role != "agent" || e.TunID != 1 || e.ConnID != 2 || e.Target != "db:5432" || e.Client != "127.0.0.1:40000" || e.Identity != "proxy-1" ||
+		e.Upload != 1 || e.Reason != "connect failed: refused" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	r := l.Open(Conn{Role: "proxy"})
+	r.SetClient("x")
+	r.SetTraffic(nil)
+	r.SetReason(ReasonKilled)
+	if err := r.Close(ReasonClientClosed); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range map[string]string{
+		path:        "dddddd\n",
+		path + ".1": "cccccc\n",
+		path + ".2": "bbbbbb\n",
+	} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Errorf("%s: got %q, expected %q", name, b, expected)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backup beyond maxBackups exists: %v", err)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if f, err := ParseFormat("JSON"); err != nil || f != FormatJSON {
+		t.Errorf("ParseFormat(JSON) = %q, %v", f, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("ParseFormat(xml) succeeded")
+	}
+}
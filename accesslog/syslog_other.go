@@ -0,0 +1,13 @@
+//go:build !unix
+
+package accesslog
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog is not supported on this platform
+func openSyslog(network string, addr string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to syslog, local syslog if network is empty
+func openSyslog(network string, addr string) (io.WriteCloser, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "tnet")
+}
@@ -0,0 +1,78 @@
+// Package asciicast reads and writes terminal sessions in asciicast v2 format,
+// see https://docs.asciinema.org/manual/asciicast/v2/
+package asciicast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Version is the supported asciicast version
+const Version = 2
+
+// event types
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+// Header is the first line of asciicast file
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Event is a line of asciicast file following the header
+type Event struct {
+	Time float64 // seconds since the start of recording
+	Type string
+	Data string
+}
+
+// MarshalJSON encodes event as [time, type, data]
+func (e *Event) MarshalJSON() ([]byte, error) {
+	t := strconv.FormatFloat(e.Time, 'f', 6, 64)
+	typ, err := json.Marshal(e.Type)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("[%s, %s, %s]", t, typ, data)), nil
+}
+
+// UnmarshalJSON decodes event from [time, type, data]
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var v []json.RawMessage
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if len(v) != 3 {
+		return errors.New("asciicast: invalid event")
+	}
+	if err := json.Unmarshal(v[0], &e.Time); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(v[1], &e.Type); err != nil {
+		return err
+	}
+	return json.Unmarshal(v[2], &e.Data)
+}
+
+// Size parses width and height of resize event
+func (e *Event) Size() (width int, height int, err error) {
+	if _, err := fmt.Sscanf(e.Data, "%dx%d", &width, &height); err != nil {
+		return 0, 0, fmt.Errorf("asciicast: invalid resize event %q", e.Data)
+	}
+	return width, height, nil
+}
@@ -0,0 +1,94 @@
+package asciicast
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterReader(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Header{Width: 80, Height: 24, Command: "sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := "héllo 世界\r\n"
+	// split multi-byte characters across writes
+	for _, chunk := range []string{s[:2], s[2:8], s[8:]} {
+		if err := w.WriteOutput([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteInput([]byte("exit\r")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteResize(100, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := r.Header; h.Version != Version || h.Width != 80 || h.Height != 24 || h.Command != "sh" || h.Timestamp == 0 {
+		t.Errorf("unexpected header %+v", h)
+	}
+
+	var output, input strings.Builder
+	var resized bool
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch e.Type {
+		case EventOutput:
+			output.WriteString(e.Data)
+		case EventInput:
+			input.WriteString(e.Data)
+		case EventResize:
+			width, height, err := e.Size()
+			if err != nil || width != 100 || height != 30 {
+				t.Errorf("Size() = %d, %d, %v", width, height, err)
+			}
+			resized = true
+		}
+	}
+	if output.String() != s {
+		t.Errorf("output = %q, %q expected", output.String(), s)
+	}
+	if input.String() != "exit\r" {
+		t.Errorf("input = %q", input.String())
+	}
+	if !resized {
+		t.Error("resize event missing")
+	}
+}
+
+func TestPlay(t *testing.T) {
+	cast := `{"version": 2, "width": 80, "height": 24}
+[0.5, "o", "hello "]
+[1.0, "i", "x"]
+[30.0, "o", "world"]
+`
+	r, err := NewReader(strings.NewReader(cast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := Play(context.Background(), &out, r, PlayOptions{Speed: 100, IdleTimeLimit: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello world" {
+		t.Errorf("played %q", out.String())
+	}
+}
@@ -0,0 +1,91 @@
+package asciicast
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Reader reads events of a recorded terminal session
+type Reader struct {
+	Header Header
+	dec    *json.Decoder
+}
+
+// NewReader reads header from r
+func NewReader(r io.Reader) (*Reader, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var h Header
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("asciicast: read header: %w", err)
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("asciicast: unsupported version %d", h.Version)
+	}
+	return &Reader{Header: h, dec: dec}, nil
+}
+
+// Next returns the next event, io.EOF is returned at the end of recording
+func (r *Reader) Next() (*Event, error) {
+	var e Event
+	if err := r.dec.Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// PlayOptions controls replaying of recording
+type PlayOptions struct {
+	// Speed multiplies playback speed, 1 if not positive
+	Speed float64
+
+	// IdleTimeLimit caps pauses between events if positive
+	IdleTimeLimit time.Duration
+}
+
+// Play writes output events of r to w in recorded pace until the end of recording or ctx is done
+func Play(ctx context.Context, w io.Writer, r *Reader, opts PlayOptions) error {
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	var last float64
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		delay := time.Duration((e.Time - last) / speed * float64(time.Second))
+		last = e.Time
+		if opts.IdleTimeLimit > 0 && delay > opts.IdleTimeLimit {
+			delay = opts.IdleTimeLimit
+		}
+		if delay > 0 {
+			timer.Reset(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if e.Type != EventOutput {
+			continue
+		}
+		if _, err := io.WriteString(w, e.Data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package asciicast
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Writer writes events of a terminal session, it is safe for concurrent use
+type Writer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	enc   *json.Encoder
+	start time.Time
+
+	// incomplete utf-8 sequence at the end of last data, by event type
+	pending map[string][]byte
+}
+
+// NewWriter writes header to w and returns writer of events,
+// Version and Timestamp of header are filled if they are zero
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	start := time.Now()
+	if h.Version == 0 {
+		h.Version = Version
+	}
+	if h.Timestamp == 0 {
+		h.Timestamp = start.Unix()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(&h); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:       w,
+		enc:     enc,
+		start:   start,
+		pending: make(map[string][]byte),
+	}, nil
+}
+
+// WriteOutput records data written to terminal
+func (w *Writer) WriteOutput(data []byte) error {
+	return w.writeData(EventOutput, data)
+}
+
+// WriteInput records data typed by user
+func (w *Writer) WriteInput(data []byte) error {
+	return w.writeData(EventInput, data)
+}
+
+// WriteResize records terminal resize
+func (w *Writer) WriteResize(width int, height int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writeEvent(EventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close flushes incomplete utf-8 sequences and closes underlying writer if it is an io.Closer
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	for _, typ := range []string{EventOutput, EventInput} {
+		if p := w.pending[typ]; len(p) > 0 {
+			delete(w.pending, typ)
+			if e := w.writeEvent(typ, string(p)); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	if c, ok := w.w.(io.Closer); ok {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (w *Writer) writeData(typ string, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if p := w.pending[typ]; len(p) > 0 {
+		data = append(p, data...)
+	}
+	// keep a utf-8 sequence split across writes for the next write
+	n := len(data) - incompleteSuffix(data)
+	w.pending[typ] = append([]byte(nil), data[n:]...)
+	if n == 0 {
+		return nil
+	}
+	return w.writeEvent(typ, string(data[:n]))
+}
+
+func (w *Writer) writeEvent(typ string, data string) error {
+	return w.enc.Encode(&Event{
+		Time: time.Since(w.start).Seconds(),
+		Type: typ,
+		Data: data,
+	})
+}
+
+// incompleteSuffix returns length of the incomplete utf-8 sequence at the end of b
+func incompleteSuffix(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if utf8.RuneStart(c) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return i
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// Create creates file name in dir and returns writer of events to it,
+// the file is closed when the writer is closed
+func Create(dir string, name string, h Header) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(f, h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
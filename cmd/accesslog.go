@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"github.com/tutils/tnet/accesslog"
+	"github.com/tutils/tnet/config"
+	"github.com/tutils/tnet/ratelimit"
+)
+
+// openAccessLog opens access log of t, returns nil logger if it is not set
+func openAccessLog(t *config.Tunnel) (*accesslog.Logger, error) {
+	if t.AccessLog == "" {
+		return nil, nil
+	}
+	format, err := accesslog.ParseFormat(t.AccessLogFormat)
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := ratelimit.ParseSize(t.AccessLogMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	w, err := accesslog.Open(t.AccessLog, maxSize, t.AccessLogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return accesslog.New(w, format), nil
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"log/slog"
+
+	"github.com/tutils/tnet/endpoint/admin"
+)
+
+// serveAdmin starts admin api server of role on addr, returns nil registry if addr is empty.
+// stop closes the server and waits for it to exit.
+func serveAdmin(addr string, role string) (r *admin.Registry, stop func(), err error) {
+	if addr == "" {
+		return nil, func() {}, nil
+	}
+	r = admin.NewRegistry(role)
+	ln, err := admin.Listen(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	slog.Info("admin server listen", "addr", addr)
+	return r, serveHTTP("admin", ln, r.Handler()), nil
+}
@@ -2,14 +2,11 @@ package cmd
 
 import (
 	"context"
-	"fmt"
-	"log"
-	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/tutils/tnet/accesslog"
+	"github.com/tutils/tnet/config"
 	"github.com/tutils/tnet/crypt/xor"
-	"github.com/tutils/tnet/endpoint/agent"
-	"github.com/tutils/tnet/tun"
 )
 
 // agentCmd represents the agent command
@@ -20,65 +17,18 @@ var agentCmd = &cobra.Command{
   tnet agent --tunnel-listen=ws://0.0.0.0:8080/stream --crypt-key=816559
   tnet agent --tunnel-connect=ws://proxy-server:8080/stream --crypt-key=816559`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if tunClientConnectAddress != "" && tunServerListenAddress != "" {
-			return fmt.Errorf("cannot specify both --tunnel-connect and --tunnel-listen")
-		}
-		if tunClientConnectAddress == "" && tunServerListenAddress == "" {
-			return fmt.Errorf("must specify either --tunnel-connect or --tunnel-listen")
-		}
-		var epOpt agent.Option
-		var a *agent.Agent
-		if tunServerListenAddress != "" {
-			// Normal mode: agent waits for proxy to connect
-			epOpt = agent.WithTunServer(
-				tun.NewServer(
-					tun.WithListenAddress(tunServerListenAddress),
-				),
-			)
-		} else {
-			// Reverse mode: agent actively connects to proxy
-			epOpt = agent.WithTunClient(
-				tun.NewClient(
-					tun.WithConnectAddress(tunClientConnectAddress),
-				),
-			)
-		}
-
-		a = agent.New(
-			epOpt,
-			agent.WithTunHandlerNewer(agent.NewTCPAgentTunHandler),
-			agent.WithTunCrypt(xor.NewCrypt(xorCryptSeed)),
-			agent.WithEnabledExecute(enabledExecute),
-		)
-
-		// backoff
-		var tempDelay time.Duration
-		for {
-			// Create a new context for each Serve call
-			ctx := context.Background()
-			if err := a.Serve(ctx); err != nil {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				log.Println(err)
-				time.Sleep(tempDelay)
-				continue
-			}
+		t := tunnelFlags
+		t.Role = config.RoleAgent
+		ctx := context.Background()
+		s, err := newAgent(ctx, &t)
+		if err != nil {
+			return err
 		}
+		s.run(ctx)
+		return nil
 	},
 }
 
-var (
-	enabledExecute bool
-)
-
-const defaultXorCryptSeed = 98545715754651
-
 func init() {
 	rootCmd.AddCommand(agentCmd)
 
@@ -91,10 +41,34 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	flags := agentCmd.Flags()
-	flags.BoolVarP(&enabledExecute, "enabled-execute", "e", false, "enable remote command execution (SECURITY WARNING: only use with trusted input)")
-	flags.StringVarP(&tunServerListenAddress, "tunnel-listen", "", "", "tunnel server listening address")
-	flags.StringVarP(&tunClientConnectAddress, "tunnel-connect", "", "", "tunnel client connect address (for reverse mode)")
-	flags.Int64VarP(&xorCryptSeed, "crypt-key", "k", defaultXorCryptSeed, "crypt key")
+	flags.BoolVarP(&tunnelFlags.EnabledExecute, "enabled-execute", "e", false, "enable remote command execution (SECURITY WARNING: only use with trusted input)")
+	flags.StringVarP(&tunnelFlags.TunnelListen, "tunnel-listen", "", "", "tunnel server listening address")
+	flags.StringVarP(&tunnelFlags.TunnelConnect, "tunnel-connect", "", "", "tunnel client connect address (for reverse mode)")
+	flags.Int64VarP(&tunnelFlags.CryptKey, "crypt-key", "k", xor.DefaultSeed, "crypt key")
+	addTLSFlags(flags, &tunnelFlags)
+	addDialFlags(flags, &tunnelFlags.Dial, "target addresses and tunnel connect address")
+	flags.StringSliceVarP(&tunnelFlags.Allow, "allow", "", nil, "allowed connect address rule, host[:ports] where host is a CIDR, IP or hostname glob")
+	flags.StringSliceVarP(&tunnelFlags.Deny, "deny", "", nil, "denied connect address rule, host[:ports] where host is a CIDR, IP or hostname glob")
+	flags.StringSliceVarP(&tunnelFlags.ExecuteAllow, "execute-allow", "", nil, "allowed command of remote execution, \"name glob...\" matched against args one by one, last * matches any remaining args")
+	flags.StringVarP(&tunnelFlags.ExecuteShell, "execute-shell", "", "", "run command line of remote execution by \"shell -c\"")
+	flags.StringVarP(&tunnelFlags.ExecuteUser, "execute-user", "", "", "run remote execution as user[:group]")
+	flags.StringSliceVarP(&tunnelFlags.ExecuteEnv, "execute-env", "", nil, "glob pattern of environment variable names inherited by remote execution")
+	flags.StringSliceVarP(&tunnelFlags.ExecuteSetEnv, "execute-setenv", "", nil, "KEY=VALUE environment variable added to remote execution")
+	flags.StringVarP(&tunnelFlags.ExecuteDir, "execute-dir", "", "", "working directory of remote execution")
+	flags.IntVarP(&tunnelFlags.ExecuteMaxSessions, "execute-max-sessions", "", 0, "max number of concurrent remote execution sessions")
+	flags.DurationVarP(&tunnelFlags.ExecuteMaxDuration, "execute-max-duration", "", 0, "max duration of remote execution session")
+	flags.StringSliceVarP(&tunnelFlags.FileRead, "file-read", "", nil, "path glob pattern of files allowed to be downloaded by tnet cp")
+	flags.StringSliceVarP(&tunnelFlags.FileWrite, "file-write", "", nil, "path glob pattern of files allowed to be uploaded by tnet cp")
+	flags.StringVarP(&tunnelFlags.PolicyFile, "policy-file", "", "", "file of connect address rules, one \"allow|deny rule\" per line")
+	flags.StringVarP(&tunnelFlags.RecordDir, "record-dir", "", "", "record pty and exec sessions of remote execution to asciicast files in this directory")
+	flags.BoolVarP(&tunnelFlags.RecordInput, "record-input", "", false, "record user input of pty sessions and stdin of exec sessions")
+	flags.StringVarP(&tunnelFlags.MetricsListen, "metrics-listen", "", "", "listen address of prometheus metrics http server, metrics are served at /metrics")
+	flags.DurationVarP(&tunnelFlags.StatsInterval, "stats-interval", "", 0, "log traffic of each connection and target at this interval, 0 means only when connection is closed")
+	flags.StringVarP(&tunnelFlags.AdminListen, "admin-listen", "", "", "listen address of admin api used by tnet status and tnet kill, loopback host:port or unix:path")
+	flags.StringVarP(&tunnelFlags.AccessLog, "access-log", "", "", "write one record per forwarded connection to this file, - for stdout, syslog: for local syslog or syslog:NETWORK:ADDR for remote syslog")
+	flags.StringVarP(&tunnelFlags.AccessLogFormat, "access-log-format", "", string(accesslog.FormatText), "format of access log records, text or json")
+	flags.StringVarP(&tunnelFlags.AccessLogMaxSize, "access-log-max-size", "", "100M", "rotate access log file when its size would exceed this size, 0 means never")
+	flags.IntVarP(&tunnelFlags.AccessLogMaxBackups, "access-log-max-backups", "", accesslog.DefaultMaxBackups, "number of rotated access log files kept")
 
 	agentCmd.MarkFlagsMutuallyExclusive("tunnel-connect", "tunnel-listen")
 	agentCmd.MarkFlagsOneRequired("tunnel-connect", "tunnel-listen")
@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/crypt/xor"
+	"github.com/tutils/tnet/endpoint/proxy"
+	"github.com/tutils/tnet/tun"
+)
+
+// cpCmd represents the cp command
+var cpCmd = &cobra.Command{
+	Use:   "cp [flags] src dst",
+	Short: "Copy file between local and agent",
+	Long: `Copy file between local and agent started with --file-read or --file-write.
+Remote file is host[:port]:path or ws://host:port/stream:path, an interrupted copy is resumed
+and the copied file is verified by SHA-256, For example:
+  tnet cp --crypt-key=816559 ./backup.tar.gz 123.45.67.89:8080:/data/backup.tar.gz
+  tnet cp --crypt-key=816559 ws://123.45.67.89:8080/stream:/var/log/syslog ./syslog`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := commandLogger(cpVerbose)
+
+		srcHost, srcPath := splitRemotePath(args[0])
+		dstHost, dstPath := splitRemotePath(args[1])
+		if (srcHost == "") == (dstHost == "") {
+			return errors.New("exactly one of src and dst must be remote")
+		}
+		upload := dstHost != ""
+		host := srcHost
+		if upload {
+			host = dstHost
+			if strings.HasSuffix(dstPath, "/") {
+				dstPath += filepath.Base(srcPath)
+			}
+		} else if fi, err := os.Stat(dstPath); err == nil && fi.IsDir() {
+			dstPath = filepath.Join(dstPath, path.Base(srcPath))
+		}
+
+		dialOpts, err := dialOptions(&tunnelFlags.Dial)
+		if err != nil {
+			return err
+		}
+		dialOpt, err := tunDialOption(dialOpts)
+		if err != nil {
+			return err
+		}
+
+		// backoff
+		var tempDelay time.Duration
+		for retry := 0; ; retry++ {
+			var copyErr error
+			p := proxy.New(
+				proxy.WithTunClient(
+					tun.NewClient(
+						tun.WithConnectAddress(tunnelURL(host)),
+						tun.WithClientLogger(logger),
+						dialOpt,
+					),
+				),
+				proxy.WithTunHandlerNewer(proxy.NewProxyTunHandler),
+				proxy.WithTunnelFunc(func(ctx context.Context, t *proxy.Tunnel) {
+					copyErr = copyFile(ctx, t, upload, srcPath, dstPath)
+				}),
+				proxy.WithTunCrypt(xor.NewCrypt(tunnelFlags.CryptKey)),
+				proxy.WithLogger(logger),
+			)
+			err := p.Serve(context.Background())
+			if err == nil {
+				if copyErr == nil {
+					return nil
+				}
+				err = copyErr
+				// errors of file are not fixed by reconnecting
+				if !errors.Is(err, proxy.ErrTunnelClosed) && !errors.Is(err, proxy.ErrChecksumMismatch) {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+			if retry >= cpRetries {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			if tempDelay == 0 {
+				tempDelay = 500 * time.Millisecond
+			} else {
+				tempDelay *= 2
+			}
+			if max := 10 * time.Second; tempDelay > max {
+				tempDelay = max
+			}
+			if !cpQuiet {
+				fmt.Fprintf(os.Stderr, "%v, retry in %v\n", err, tempDelay)
+			}
+			time.Sleep(tempDelay)
+		}
+	},
+}
+
+var (
+	cpRetries int
+	cpQuiet   bool
+	cpVerbose bool
+)
+
+// splitRemotePath splits host[:port]:path or ws://host:port/stream:path into host and path,
+// host is empty if s is a local path
+func splitRemotePath(s string) (string, string) {
+	if i := strings.Index(s, "://"); i >= 0 {
+		// path follows the first ':' after the url path
+		start := i + 3
+		if j := strings.Index(s[start:], "/"); j >= 0 {
+			start += j
+		}
+		if j := strings.Index(s[start:], ":"); j >= 0 {
+			return s[:start+j], s[start+j+1:]
+		}
+		return "", s
+	}
+	i := strings.Index(s, ":")
+	if i <= 0 || strings.Contains(s[:i], "/") || (len(s[:i]) == 1 && filepath.VolumeName(s) != "") {
+		return "", s
+	}
+	// host:port:path or host:path
+	rest := s[i+1:]
+	if j := strings.Index(rest, ":"); j > 0 && isPort(rest[:j]) {
+		return s[:i+1+j], rest[j+1:]
+	}
+	return s[:i], rest
+}
+
+func isPort(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// copyFile copies file through tunnel, resuming from the part already copied
+func copyFile(ctx context.Context, t *proxy.Tunnel, upload bool, srcPath string, dstPath string) error {
+	var offset, total int64
+	var err error
+	if upload {
+		fi, err := os.Stat(srcPath)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return fmt.Errorf("%s is a directory", srcPath)
+		}
+		total = fi.Size()
+		offset, err = t.UploadOffset(ctx, srcPath, dstPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		fi, err := t.StatFile(ctx, srcPath)
+		if err != nil {
+			return err
+		}
+		total = fi.Size
+		offset, err = t.DownloadOffset(ctx, srcPath, dstPath)
+		if err != nil {
+			return err
+		}
+	}
+	if offset > 0 && !cpQuiet {
+		fmt.Fprintf(os.Stderr, "resume from %s\n", counter.HumanReadable(uint64(offset)))
+	}
+
+	c := newEWMACounter()
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		if !cpQuiet {
+			printProgress(offset+c.Value(), total, c)
+			fmt.Fprintln(os.Stderr)
+		}
+	}()
+	if !cpQuiet {
+		go func() {
+			tk := time.NewTicker(500 * time.Millisecond)
+			defer tk.Stop()
+			for {
+				select {
+				case <-tk.C:
+					printProgress(offset+c.Value(), total, c)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	if upload {
+		err = t.Upload(ctx, srcPath, dstPath, offset, c)
+	} else {
+		err = t.Download(ctx, srcPath, dstPath, offset, c)
+	}
+	return err
+}
+
+func printProgress(n int64, total int64, c counter.Counter) {
+	percent := 100
+	if total > 0 {
+		percent = int(n * 100 / total)
+	}
+	fmt.Fprintf(os.Stderr, "\r%s / %s %3d%% %s/s    ",
+		counter.HumanReadable(uint64(n)), counter.HumanReadable(uint64(total)), percent,
+		counter.HumanReadable(uint64(c.IncreaceRatePerSec())))
+}
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+
+	flags := cpCmd.Flags()
+	flags.IntVarP(&cpRetries, "retries", "", 5, "max number of reconnections to resume an interrupted copy")
+	flags.BoolVarP(&cpQuiet, "quiet", "q", false, "do not print progress")
+	flags.BoolVarP(&cpVerbose, "verbose", "v", false, "print logs to stderr")
+	flags.Int64VarP(&tunnelFlags.CryptKey, "crypt-key", "k", xor.DefaultSeed, "crypt key")
+	addDialFlags(flags, &tunnelFlags.Dial, "tunnel connect address")
+}
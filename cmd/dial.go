@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+	"github.com/tutils/tnet/config"
+	"github.com/tutils/tnet/tcp"
+	"github.com/tutils/tnet/tun"
+)
+
+func addDialFlags(flags *pflag.FlagSet, d *config.Dial, usage string) {
+	flags.DurationVarP(&d.Timeout, "dial-timeout", "", 0, "timeout of dialing "+usage)
+	flags.StringVarP(&d.SourceAddr, "source-addr", "", "", "local source address of dialing "+usage)
+	flags.StringVarP(&d.BindInterface, "bind-interface", "", "", "egress network interface of dialing "+usage)
+	flags.StringVarP(&d.DNSServer, "dns-server", "", "", "DNS server address used to resolve "+usage)
+	flags.IntVarP(&d.IPVersion, "ip-version", "", 0, "IP version used to dial "+usage+", 4 or 6, 0 means both")
+	flags.DurationVarP(&d.HappyEyeballsDelay, "happy-eyeballs-delay", "", 0, "Happy Eyeballs fallback delay of dialing "+usage)
+	flags.BoolVarP(&d.NoHappyEyeballs, "no-happy-eyeballs", "", false, "disable Happy Eyeballs fallback of dialing "+usage)
+}
+
+func dialOptions(d *config.Dial) ([]tcp.ClientOption, error) {
+	var opts []tcp.ClientOption
+	if d.Timeout > 0 {
+		opts = append(opts, tcp.WithClientDialTimeout(d.Timeout))
+	}
+	if d.SourceAddr != "" {
+		opts = append(opts, tcp.WithClientLocalAddress(d.SourceAddr))
+	}
+	if d.BindInterface != "" {
+		opts = append(opts, tcp.WithClientBindInterface(d.BindInterface))
+	}
+	if d.DNSServer != "" {
+		opts = append(opts, tcp.WithClientDNSServer(d.DNSServer))
+	}
+	switch d.IPVersion {
+	case 0:
+	case 4, 6:
+		opts = append(opts, tcp.WithClientIPVersion(d.IPVersion))
+	default:
+		return nil, fmt.Errorf("invalid --ip-version %d", d.IPVersion)
+	}
+	if d.NoHappyEyeballs {
+		opts = append(opts, tcp.WithClientFallbackDelay(-1))
+	} else if d.HappyEyeballsDelay > 0 {
+		opts = append(opts, tcp.WithClientFallbackDelay(d.HappyEyeballsDelay))
+	}
+	return opts, nil
+}
+
+// tunDialOption returns tunnel client option dialing with opts
+func tunDialOption(opts []tcp.ClientOption) (tun.ClientOption, error) {
+	f, err := tcp.NewDialContextFunc(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return tun.WithDialContextFunc(f), nil
+}
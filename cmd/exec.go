@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tutils/tnet/crypt/xor"
+	"github.com/tutils/tnet/endpoint/proxy"
+	"github.com/tutils/tnet/tun"
+	"golang.org/x/term"
+)
+
+// execCmd represents the exec command
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] host -- command [args...]",
+	Short: "Execute command on agent",
+	Long: `Execute command on agent started with --enabled-execute, like ssh.
+Stdout and stderr of the command are kept apart unless --tty is given, For example:
+  tnet exec 123.45.67.89:8080 --crypt-key=816559 -- uname -a
+  tnet exec ws://123.45.67.89:8080/stream --crypt-key=816559 -- cat /etc/hosts | grep localhost`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := commandLogger(execVerbose)
+
+		dialOpts, err := dialOptions(&tunnelFlags.Dial)
+		if err != nil {
+			return err
+		}
+		dialOpt, err := tunDialOption(dialOpts)
+		if err != nil {
+			return err
+		}
+
+		p := proxy.New(
+			proxy.WithTunClient(
+				tun.NewClient(
+					tun.WithConnectAddress(tunnelURL(args[0])),
+					tun.WithClientLogger(logger),
+					dialOpt,
+				),
+			),
+			proxy.WithTunHandlerNewer(proxy.NewProxyTunHandler),
+			proxy.WithTunnelFunc(executeFunc(args[1:], false, !execTTY)),
+			proxy.WithTunCrypt(xor.NewCrypt(tunnelFlags.CryptKey)),
+			proxy.WithLogger(logger),
+		)
+		if err := p.Serve(context.Background()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(255)
+		}
+		return nil
+	},
+}
+
+var (
+	execTTY     bool
+	execVerbose bool
+)
+
+// tunnelURL completes host[:port] to websocket tunnel address
+func tunnelURL(host string) string {
+	if strings.Contains(host, "://") {
+		return host
+	}
+	if !strings.Contains(host, ":") {
+		host += ":8080"
+	}
+	return "ws://" + host + "/stream"
+}
+
+// isTerminal reports whether stdin is a terminal
+func isTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+
+	flags := execCmd.Flags()
+	flags.BoolVarP(&execTTY, "tty", "t", false, "execute command in pty")
+	flags.BoolVarP(&execVerbose, "verbose", "v", false, "print logs to stderr")
+	flags.Int64VarP(&tunnelFlags.CryptKey, "crypt-key", "k", xor.DefaultSeed, "crypt key")
+	addDialFlags(flags, &tunnelFlags.Dial, "tunnel connect address")
+}
@@ -13,10 +13,12 @@ var httpsrvCmd = &cobra.Command{
   tnet httpsrv --listen 8080`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// 调用httpsrv包中的StartServer函数，使用正确的包导入
-		return httpsrv.StartServer(listenAddress)
+		return httpsrv.StartServer(httpListenAddress)
 	},
 }
 
+var httpListenAddress string
+
 func init() {
 	rootCmd.AddCommand(httpsrvCmd)
 
@@ -29,5 +31,5 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	flags := httpsrvCmd.Flags()
-	flags.StringVarP(&listenAddress, "listen", "l", "0.0.0.0:8080", "http server listen address")
+	flags.StringVarP(&httpListenAddress, "listen", "l", "0.0.0.0:8080", "http server listen address")
 }
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevelVar is level of default logger, loggers derived from it follow its changes
+var logLevelVar slog.LevelVar
+
+// setupLogger sets default logger writing to stderr at level, in json if jsonFormat,
+// output of standard log package goes to it as well
+func setupLogger(level string, jsonFormat bool) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+		return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", level)
+	}
+	logLevelVar.Set(l)
+	opts := &slog.HandlerOptions{Level: &logLevelVar}
+	var h slog.Handler
+	if jsonFormat {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// commandLogger returns default logger if verbose, otherwise a logger dropping all records,
+// for commands whose stderr is output of remote command
+func commandLogger(verbose bool) *slog.Logger {
+	if verbose {
+		return slog.Default()
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
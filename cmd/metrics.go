@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/tutils/tnet/endpoint/common"
+	"github.com/tutils/tnet/metrics"
+)
+
+// serveMetrics starts metrics http server on addr, returns nil metrics if addr is empty.
+// stop closes the server and waits for it to exit.
+func serveMetrics(addr string) (m *common.Metrics, stop func(), err error) {
+	if addr == "" {
+		return nil, func() {}, nil
+	}
+	r := metrics.NewRegistry()
+	m = common.NewMetrics(r)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+	slog.Info("metrics server listen", "addr", ln.Addr().String())
+	return m, serveHTTP("metrics", ln, mux), nil
+}
+
+// serveHTTP serves h on ln, the returned stop closes the server and waits for it to exit,
+// so its address can be listened again once stop returns
+func serveHTTP(name string, ln net.Listener, h http.Handler) (stop func()) {
+	srv := &http.Server{Handler: h}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error(name+" server failed", "err", err)
+		}
+	}()
+	return func() {
+		srv.Close()
+		<-done
+	}
+}
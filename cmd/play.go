@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tutils/tnet/asciicast"
+	"golang.org/x/term"
+)
+
+// playCmd represents the play command
+var playCmd = &cobra.Command{
+	Use:   "play [flags] file",
+	Short: "Replay recorded session",
+	Long: `Replay pty or exec session recorded by --record-dir of agent or proxy in the terminal, For example:
+  tnet play /var/log/tnet/20240101-120000-1-1.cast
+  tnet play --speed=2 --idle-time-limit=1s /var/log/tnet/20240101-120000-1-1.cast`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r, err := asciicast.NewReader(f)
+		if err != nil {
+			return err
+		}
+		h := r.Header
+		if w, ht, err := term.GetSize(int(os.Stdout.Fd())); err == nil && (w < h.Width || ht < h.Height) {
+			fmt.Fprintf(os.Stderr, "terminal %dx%d is smaller than recording %dx%d\n", w, ht, h.Width, h.Height)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := asciicast.Play(ctx, os.Stdout, r, asciicast.PlayOptions{
+			Speed:         playSpeed,
+			IdleTimeLimit: playIdleTimeLimit,
+		}); err != nil && err != context.Canceled {
+			return err
+		}
+		return nil
+	},
+}
+
+var (
+	playSpeed         float64
+	playIdleTimeLimit time.Duration
+)
+
+func init() {
+	rootCmd.AddCommand(playCmd)
+
+	flags := playCmd.Flags()
+	flags.Float64VarP(&playSpeed, "speed", "s", 1, "playback speed multiplier")
+	flags.DurationVarP(&playIdleTimeLimit, "idle-time-limit", "i", 0, "max pause between outputs, 0 means unlimited")
+}
@@ -2,15 +2,15 @@ package cmd
 
 import (
 	"context"
-	"fmt"
-	"log"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
-	"github.com/tutils/tnet/counter/period"
+	"github.com/tutils/tnet/accesslog"
+	"github.com/tutils/tnet/config"
 	"github.com/tutils/tnet/crypt/xor"
 	"github.com/tutils/tnet/endpoint/proxy"
-	"github.com/tutils/tnet/tun"
 )
 
 // proxyCmd represents the proxy command
@@ -19,74 +19,47 @@ var proxyCmd = &cobra.Command{
 	Short: "TCP tunnel proxy",
 	Long: `Start TCP tunnel proxy, For example:
   tnet proxy --listen=0.0.0.0:56080 --connect=127.0.0.1:3128 --tunnel-connect=ws://123.45.67.89:8080/stream --crypt-key=816559
-  tnet proxy --tunnel-listen=ws://0.0.0.0:8080/stream --connect=127.0.0.1:3128 --crypt-key=816559`,
+  tnet proxy --tunnel-listen=ws://0.0.0.0:8080/stream --connect=127.0.0.1:3128 --crypt-key=816559
+  tnet proxy --tunnel-connect=ws://123.45.67.89:8080/stream --mapping=:2222=10.0.0.5:22 --mapping=:8080=10.0.0.6:80
+Mappings of --mapping-file are reloaded on SIGHUP, and can be replaced by tnet mapping through admin api.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if tunClientConnectAddress != "" && tunServerListenAddress != "" {
-			return fmt.Errorf("cannot specify both --tunnel-connect and --tunnel-listen")
+		t := tunnelFlags
+		t.Role = config.RoleProxy
+		var extra []proxy.Option
+		if len(executeArgs) > 0 {
+			extra = append(extra, proxy.WithTunnelFunc(executeFunc(executeArgs, rawPTYMode, noPTY || !isTerminal())))
 		}
-		if tunClientConnectAddress == "" && tunServerListenAddress == "" {
-			return fmt.Errorf("must specify either --tunnel-connect or --tunnel-listen")
+		// stop on signals, so that usage of quotas is saved
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		s, err := newProxy(ctx, &t, extra...)
+		if err != nil {
+			return err
 		}
-
-		var epOpt proxy.Option
-		var p *proxy.Proxy
-		if tunClientConnectAddress != "" {
-			// Normal mode: proxy actively connects to agent
-			epOpt = proxy.WithTunClient(
-				tun.NewClient(
-					tun.WithConnectAddress(tunClientConnectAddress),
-				),
-			)
-		} else {
-			// Reverse mode: proxy waits for agent to connect
-			epOpt = proxy.WithTunServer(
-				tun.NewServer(
-					tun.WithListenAddress(tunServerListenAddress),
-				),
-			)
+		if t.MappingFile != "" {
+			go reloadMappingsOnSIGHUP(s, &t)
 		}
+		s.run(ctx)
+		return nil
+	},
+}
 
-		p = proxy.New(
-			epOpt,
-			proxy.WithTunHandlerNewer(proxy.NewProxyTunHandler),
-			proxy.WithListenAddress(listenAddress),
-			proxy.WithConnectAddress(connectAddress),
-			proxy.WithConnectPTY(executeArgs),
-			proxy.WithRawPTYMode(rawPTYMode),
-			proxy.WithTunCrypt(xor.NewCrypt(xorCryptSeed)),
-			proxy.WithDownloadCounter(period.NewPeriodCounter(time.Second)),
-			proxy.WithUploadCounter(period.NewPeriodCounter(time.Second)),
-			proxy.WithDumpDir(dumpDir),
-		)
-
-		// backoff
-		var tempDelay time.Duration
-		for {
-			// Create a new context for each Serve call
-			ctx := context.Background()
-			if err := p.Serve(ctx); err != nil {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				log.Println(err)
-				time.Sleep(tempDelay)
-				continue
-			}
+// reloadMappingsOnSIGHUP reloads mapping file of t on SIGHUP
+func reloadMappingsOnSIGHUP(s *tunnelServer, t *config.Tunnel) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		s.logger.Info("reload mappings", "file", t.MappingFile)
+		if err := s.reloadMappings(t); err != nil {
+			s.logger.Error("reload mappings failed", "err", err)
 		}
-	},
+	}
 }
 
 var (
-	listenAddress  string
-	connectAddress string
-	executeArgs    []string
-	rawPTYMode     bool
-	dumpDir        string
+	executeArgs []string
+	rawPTYMode  bool
+	noPTY       bool
 )
 
 func init() {
@@ -102,20 +75,41 @@ func init() {
 	// is called directly, e.g.:
 	// proxyCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	flags := proxyCmd.Flags()
-	flags.StringVarP(&listenAddress, "listen", "l", "", "proxy listen address")
-	flags.StringVarP(&connectAddress, "connect", "c", "", "agent connect address")
+	flags.StringVarP(&tunnelFlags.Listen, "listen", "l", "", "proxy listen address")
+	flags.StringVarP(&tunnelFlags.Connect, "connect", "c", "", "agent connect address")
+	flags.StringArrayVarP(&tunnelFlags.Mappings, "mapping", "m", nil, "forwarding mapping LISTEN=CONNECT, can be repeated")
+	flags.StringVarP(&tunnelFlags.MappingFile, "mapping-file", "", "", "file of forwarding mappings, one LISTEN=CONNECT per line, reloaded on SIGHUP")
 	flags.StringSliceVarP(&executeArgs, "execute", "e", nil, "agent execute command")
 	flags.BoolVarP(&rawPTYMode, "raw-pty", "r", false, "agent execute command in raw pty mode")
-	flags.StringVarP(&tunClientConnectAddress, "tunnel-connect", "", "", "tunnel client connect address")
-	flags.StringVarP(&tunServerListenAddress, "tunnel-listen", "", "", "tunnel server listening address (for reverse mode)")
-	flags.Int64VarP(&xorCryptSeed, "crypt-key", "k", defaultXorCryptSeed, "crypt key")
-	flags.StringVarP(&dumpDir, "dump-dir", "d", "", "dump traffic to files in this directory")
+	flags.BoolVarP(&noPTY, "no-pty", "T", false, "agent execute command without pty, implied if stdin is not a terminal")
+	flags.StringVarP(&tunnelFlags.TunnelConnect, "tunnel-connect", "", "", "tunnel client connect address")
+	flags.StringVarP(&tunnelFlags.TunnelListen, "tunnel-listen", "", "", "tunnel server listening address (for reverse mode)")
+	flags.Int64VarP(&tunnelFlags.CryptKey, "crypt-key", "k", xor.DefaultSeed, "crypt key")
+	addTLSFlags(flags, &tunnelFlags)
+	flags.StringVarP(&tunnelFlags.DumpDir, "dump-dir", "d", "", "dump traffic to files in this directory")
+	flags.StringVarP(&tunnelFlags.DumpFormat, "dump-format", "", string(proxy.DumpRaw), "format of dumped traffic, raw or pcapng")
+	addDialFlags(flags, &tunnelFlags.Dial, "tunnel connect address")
+	flags.DurationVarP(&tunnelFlags.ConnectTimeout, "connect-timeout", "", proxy.DefaultConnectTimeout, "timeout of waiting for agent to connect")
+	flags.StringVarP(&tunnelFlags.RecordDir, "record-dir", "", "", "record pty sessions to asciicast files in this directory")
+	flags.BoolVarP(&tunnelFlags.RecordInput, "record-input", "", false, "record user input of pty sessions")
+	flags.StringVarP(&tunnelFlags.MetricsListen, "metrics-listen", "", "", "listen address of prometheus metrics http server, metrics are served at /metrics")
+	flags.DurationVarP(&tunnelFlags.StatsInterval, "stats-interval", "", 0, "log traffic of each connection and target at this interval, 0 means only when connection is closed")
+	flags.StringVarP(&tunnelFlags.AdminListen, "admin-listen", "", "", "listen address of admin api used by tnet status and tnet kill, loopback host:port or unix:path")
+	flags.StringVarP(&tunnelFlags.AccessLog, "access-log", "", "", "write one record per forwarded connection to this file, - for stdout, syslog: for local syslog or syslog:NETWORK:ADDR for remote syslog")
+	flags.StringVarP(&tunnelFlags.AccessLogFormat, "access-log-format", "", string(accesslog.FormatText), "format of access log records, text or json")
+	flags.StringVarP(&tunnelFlags.AccessLogMaxSize, "access-log-max-size", "", "100M", "rotate access log file when its size would exceed this size, 0 means never")
+	flags.IntVarP(&tunnelFlags.AccessLogMaxBackups, "access-log-max-backups", "", accesslog.DefaultMaxBackups, "number of rotated access log files kept")
+	flags.StringVarP(&tunnelFlags.TunnelLimit, "tunnel-limit", "", "", "rate limit of tunnel in bytes per second, RATE or UPLOAD/DOWNLOAD, e.g. 10M or 1M/10M")
+	flags.StringVarP(&tunnelFlags.MappingLimit, "mapping-limit", "", "", "rate limit shared by all forwarded connections, RATE or UPLOAD/DOWNLOAD, download is shared by connections of each tunnel")
+	flags.StringVarP(&tunnelFlags.ConnLimit, "conn-limit", "", "", "rate limit of each forwarded connection, RATE or UPLOAD/DOWNLOAD")
+	flags.StringVarP(&tunnelFlags.DailyQuota, "daily-quota", "", "", "refuse new connections when forwarded bytes of the day exceed this size, e.g. 10G")
+	flags.StringVarP(&tunnelFlags.MonthlyQuota, "monthly-quota", "", "", "refuse new connections when forwarded bytes of the month exceed this size, e.g. 500G")
+	flags.StringVarP(&tunnelFlags.QuotaFile, "quota-file", "", "", "file keeping usage of quotas across restarts, quotas are reset on restart if not set")
 
 	proxyCmd.MarkFlagsMutuallyExclusive("tunnel-connect", "tunnel-listen")
 	proxyCmd.MarkFlagsOneRequired("tunnel-connect", "tunnel-listen")
 
 	proxyCmd.MarkFlagsRequiredTogether("listen", "connect")
 
-	proxyCmd.MarkFlagsMutuallyExclusive("listen", "execute")
-	proxyCmd.MarkFlagsOneRequired("listen", "execute")
+	proxyCmd.MarkFlagsOneRequired("listen", "mapping", "mapping-file", "execute")
 }
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tutils/tnet/pcapng"
+)
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay [flags] file target",
+	Short: "Re-send recorded client stream to target",
+	Long: `Re-send client stream of connections recorded by --dump-dir of proxy to target for regression testing.
+File is a pcapng capture dumped with --dump-format=pcapng or captured by Wireshark, or a raw read.dmp,
+responses of target are compared with recorded responses if --verify is given, For example:
+  tnet replay /var/dump/1/1.pcapng 127.0.0.1:3128
+  tnet replay --verify --speed=1 /var/dump/1/1.pcapng 127.0.0.1:3128
+  tnet replay /var/dump/1/1/read.dmp 127.0.0.1:3128`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+
+		var flows []*pcapng.Flow
+		if bytes.HasPrefix(data, pcapng.Magic) {
+			if flows, err = pcapng.ReadFlows(bytes.NewReader(data)); err != nil {
+				return err
+			}
+		} else {
+			// raw dump has client stream only
+			flows = []*pcapng.Flow{{Chunks: []pcapng.Chunk{{FromClient: true, Data: data}}}}
+		}
+		if replayFlow >= 0 {
+			if replayFlow >= len(flows) {
+				return fmt.Errorf("flow %d not found, %d flows in %s", replayFlow, len(flows), args[0])
+			}
+			flows = flows[replayFlow : replayFlow+1]
+		}
+
+		failed := false
+		for i, f := range flows {
+			recorded := f.ServerData()
+			received, sent, err := replay(args[1], f)
+			name := fmt.Sprintf("flow %d", i)
+			if f.Client.IsValid() {
+				name = fmt.Sprintf("flow %d %s -> %s", i, f.Client, f.Server)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("%s: sent %d bytes, received %d bytes, recorded %d bytes\n", name, sent, len(received), len(recorded))
+			if !replayVerify {
+				continue
+			}
+			if off := diffOffset(received, recorded); off >= 0 {
+				fmt.Printf("%s: response differs at offset %d\n", name, off)
+				failed = true
+			} else {
+				fmt.Printf("%s: response matches\n", name)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
+var (
+	replayFlow    int
+	replaySpeed   float64
+	replayTimeout time.Duration
+	replayVerify  bool
+)
+
+// replay sends client stream of flow to target and returns response
+func replay(target string, f *pcapng.Flow) ([]byte, int, error) {
+	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	expected := len(f.ServerData())
+	type result struct {
+		data []byte
+		err  error
+	}
+	resCh := make(chan result, 1)
+	sendDone := make(chan struct{})
+	go func() {
+		// read until target closes, idle timeout after sending, or recorded response is received
+		var buf bytes.Buffer
+		b := make([]byte, 32<<10)
+		for {
+			select {
+			case <-sendDone:
+				conn.SetReadDeadline(time.Now().Add(replayTimeout))
+			default:
+			}
+			n, err := conn.Read(b)
+			buf.Write(b[:n])
+			if err != nil {
+				var ne net.Error
+				if err == io.EOF || (errors.As(err, &ne) && ne.Timeout()) {
+					err = nil
+				}
+				resCh <- result{buf.Bytes(), err}
+				return
+			}
+			if expected > 0 && buf.Len() >= expected && isClosed(sendDone) {
+				resCh <- result{buf.Bytes(), nil}
+				return
+			}
+		}
+	}()
+
+	sent := 0
+	var first time.Time
+	start := time.Now()
+	for _, c := range f.Chunks {
+		if !c.FromClient {
+			continue
+		}
+		if replaySpeed > 0 && !c.Timestamp.IsZero() {
+			if first.IsZero() {
+				first = c.Timestamp
+			}
+			due := start.Add(time.Duration(float64(c.Timestamp.Sub(first)) / replaySpeed))
+			time.Sleep(time.Until(due))
+		}
+		n, err := conn.Write(c.Data)
+		sent += n
+		if err != nil {
+			return nil, sent, err
+		}
+	}
+	close(sendDone)
+	// wake up reader blocked before sending finished
+	conn.SetReadDeadline(time.Now().Add(replayTimeout))
+
+	res := <-resCh
+	return res.data, sent, res.err
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// diffOffset returns offset of the first different byte of a and b, or -1 if they are equal
+func diffOffset(a []byte, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		return n
+	}
+	return -1
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	flags := replayCmd.Flags()
+	flags.IntVarP(&replayFlow, "flow", "f", -1, "index of connection in capture to replay, -1 means all connections one by one")
+	flags.Float64VarP(&replaySpeed, "speed", "s", 0, "keep recorded intervals between sends at this speed multiplier, 0 means sending at once")
+	flags.DurationVarP(&replayTimeout, "timeout", "t", 5*time.Second, "max idle time of waiting for response after sending")
+	flags.BoolVarP(&replayVerify, "verify", "", false, "compare responses with recorded responses")
+}
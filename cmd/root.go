@@ -5,18 +5,13 @@ import (
 	"os"
 	"strings"
 
-	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var (
-	cfgFile string
-
 	// Shared flags
-	xorCryptSeed            int64
-	tunServerListenAddress  string
-	tunClientConnectAddress string
+	logLevel string
+	logJSON  bool
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -27,10 +22,15 @@ var rootCmd = &cobra.Command{
 Repo: https://github.com/tutils/tnet
 Start proxy or agent to setup a TCP tunnel, For example:
   tnet proxy --listen=0.0.0.0:56080 --connect=127.0.0.1:3128 --tunnel-connect=ws://123.45.67.89:8080/stream --crypt-key=816559
-  tnet agent --tunnel-listen=ws://0.0.0.0:8080/stream --crypt-key=816559`,
+  tnet agent --tunnel-listen=ws://0.0.0.0:8080/stream --crypt-key=816559
+Or start proxies and agents described by a config file:
+  tnet run -c tnet.yaml`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupLogger(logLevel, logJSON)
+	},
 }
 
 const (
@@ -55,41 +55,14 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize( /*initConfig*/ )
-
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	//rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.tcptun.yaml)")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().BoolVar(&logJSON, "log-json", false, "write logs in json")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	//flags := rootCmd.Flags()
 }
-
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Find home directory.
-		home, err := homedir.Dir()
-		if err != nil {
-			log.Println(err)
-			os.Exit(1)
-		}
-
-		// Search config in home directory with name ".tcptun" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigName(".conf")
-	}
-
-	viper.AutomaticEnv() // read in environment variables that match
-
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		log.Println("Using config file:", viper.ConfigFileUsed())
-	}
-}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/tutils/tnet/config"
+)
+
+// runCmd represents the run command
+var runCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Start proxies and agents described by a config file",
+	Long: `Start proxies and agents described by a YAML, TOML or JSON config file in one process.
+Keys of a tunnel are the same as flags of tnet proxy and tnet agent. On SIGHUP the file is reloaded,
+added tunnels are started, removed and changed tunnels are stopped or restarted, other tunnels are untouched.
+A proxy whose forwarding mappings are the only change, or whose mapping-file is given, reloads its mappings in place.
+For example:
+  tnet run -c tnet.yaml
+  kill -HUP $(pidof tnet)`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := config.Load(runConfigFile)
+		if err != nil {
+			return err
+		}
+		if err := applyLogConfig(cmd, &c.Log); err != nil {
+			return err
+		}
+
+		r := &runner{tunnels: make(map[string]*runningTunnel)}
+		r.apply(c)
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigCh)
+		for sig := range sigCh {
+			if sig != syscall.SIGHUP {
+				slog.Info("stop all tunnels", "signal", sig.String())
+				r.stop(r.names()...)
+				return nil
+			}
+			slog.Info("reload config", "file", runConfigFile)
+			c, err := config.Load(runConfigFile)
+			if err != nil {
+				slog.Error("reload config failed, keep running", "err", err)
+				continue
+			}
+			if err := applyLogConfig(cmd, &c.Log); err != nil {
+				slog.Error("reload config failed, keep running", "err", err)
+				continue
+			}
+			r.apply(c)
+		}
+		return nil
+	},
+}
+
+var runConfigFile string
+
+// applyLogConfig sets up default logger by l, command line flags take precedence over config file
+func applyLogConfig(cmd *cobra.Command, l *config.Log) error {
+	level, jsonFormat := logLevel, logJSON
+	if l.Level != "" && !cmd.Flags().Changed("log-level") {
+		level = l.Level
+	}
+	if !cmd.Flags().Changed("log-json") {
+		jsonFormat = l.JSON
+	}
+	return setupLogger(level, jsonFormat)
+}
+
+// runner runs tunnels of config file, it is used by one goroutine
+type runner struct {
+	config  *config.Config
+	tunnels map[string]*runningTunnel
+}
+
+type runningTunnel struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	server *tunnelServer
+}
+
+// exited reports whether tunnel stopped by itself, e.g. its options are invalid
+func (t *runningTunnel) exited() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// apply stops removed and changed tunnels, then starts added and changed ones,
+// proxies with only mappings changed reload mappings in place,
+// unchanged tunnels keep running unless they have exited
+func (r *runner) apply(c *config.Config) {
+	added, removed, changed := config.Diff(r.config, c)
+	for _, t := range c.Tunnels {
+		if rt, ok := r.tunnels[t.Name]; ok && rt.exited() && !containsTunnel(changed, t.Name) {
+			changed = append(changed, t)
+		}
+	}
+
+	var restarted []config.Tunnel
+	reloaded := 0
+	for _, t := range c.Tunnels {
+		rt, ok := r.tunnels[t.Name]
+		if !ok || rt.exited() || t.Role != config.RoleProxy {
+			continue
+		}
+		if containsTunnel(changed, t.Name) {
+			if old := r.config.Tunnel(t.Name); old == nil || !old.EqualExceptMappings(&t) {
+				continue
+			}
+		} else if t.MappingFile == "" {
+			continue
+		}
+		if err := rt.server.reloadMappings(&t); err != nil {
+			slog.Error("reload mappings failed", "tunnel", t.Name, "err", err)
+		}
+		reloaded++
+	}
+	for _, t := range changed {
+		if rt, ok := r.tunnels[t.Name]; ok && !rt.exited() && t.Role == config.RoleProxy {
+			if old := r.config.Tunnel(t.Name); old != nil && old.EqualExceptMappings(&t) {
+				continue
+			}
+		}
+		restarted = append(restarted, t)
+	}
+
+	var names []string
+	for _, t := range removed {
+		names = append(names, t.Name)
+	}
+	for _, t := range restarted {
+		names = append(names, t.Name)
+	}
+	r.stop(names...)
+
+	for _, t := range restarted {
+		r.start(t)
+	}
+	for _, t := range added {
+		r.start(t)
+	}
+	r.config = c
+	slog.Info("config applied", "tunnels", len(c.Tunnels),
+		"added", len(added), "removed", len(removed), "restarted", len(restarted), "reloaded", reloaded)
+}
+
+func containsTunnel(tunnels []config.Tunnel, name string) bool {
+	for _, t := range tunnels {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *runner) start(t config.Tunnel) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rt := &runningTunnel{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	r.tunnels[t.Name] = rt
+	slog.Info("start tunnel", "tunnel", t.Name, "role", t.Role)
+	s, err := newTunnelServer(ctx, &t)
+	if err != nil {
+		slog.Error("tunnel failed", "tunnel", t.Name, "err", err)
+		cancel()
+		close(rt.done)
+		return
+	}
+	rt.server = s
+	go func() {
+		defer close(rt.done)
+		s.run(ctx)
+		slog.Info("tunnel stopped", "tunnel", t.Name)
+	}()
+}
+
+// stop stops tunnels of names and waits for them to exit
+func (r *runner) stop(names ...string) {
+	var stopping []*runningTunnel
+	for _, name := range names {
+		if rt, ok := r.tunnels[name]; ok {
+			rt.cancel()
+			stopping = append(stopping, rt)
+			delete(r.tunnels, name)
+		}
+	}
+	for _, rt := range stopping {
+		<-rt.done
+	}
+}
+
+func (r *runner) names() []string {
+	var names []string
+	for name := range r.tunnels {
+		names = append(names, name)
+	}
+	return names
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+
+	flags := runCmd.Flags()
+	flags.StringVarP(&runConfigFile, "config", "c", "tnet.yaml", "config file of tunnels, YAML, TOML or JSON by extension")
+}
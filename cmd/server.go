@@ -1,7 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
 	"github.com/spf13/cobra"
+	"github.com/tutils/tnet/config"
 	"github.com/tutils/tnet/endpoint/server"
 )
 
@@ -10,14 +17,61 @@ var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Start tnet management server",
 	Long: `Start tnet management server with web interface, For example:
-  tnet server --listen=0.0.0.0:8080`,
+  tnet server --listen=127.0.0.1:8080
+  tnet server --listen=127.0.0.1:8080 --state-file=/var/lib/tnet/server.json --instance-log-dir=/var/log/tnet
+  TNET_ADMIN_PASSWORD=secret tnet server --listen=0.0.0.0:8443 --token-file=/etc/tnet/tokens --tls-cert=cert.pem --tls-key=key.pem
+Authentication by password or api token is required unless the server listens on a loopback address.
+Passwords can also be given by TNET_ADMIN_PASSWORD and TNET_READ_ONLY_PASSWORD environment variables.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return server.StartServer(serverListenAddress)
+		adminPassword, readOnlyPassword := serverAdminPassword, serverReadOnlyPassword
+		if adminPassword == "" {
+			adminPassword = os.Getenv("TNET_ADMIN_PASSWORD")
+		}
+		if readOnlyPassword == "" {
+			readOnlyPassword = os.Getenv("TNET_READ_ONLY_PASSWORD")
+		}
+		var tokens map[string]server.Role
+		if serverTokenFile != "" {
+			var err error
+			if tokens, err = server.LoadTokens(serverTokenFile); err != nil {
+				return err
+			}
+		}
+		return server.StartServer(serverListenAddress,
+			server.WithStateFile(serverStateFile),
+			server.WithLogDir(serverLogDir),
+			server.WithPasswords(adminPassword, readOnlyPassword),
+			server.WithTokens(tokens),
+			server.WithTLS(serverTLSCert, serverTLSKey),
+			server.WithRunner(runInstance),
+			server.WithTunClientOptions(tunClientOptions),
+			server.WithStopTimeout(serverStopTimeout),
+		)
 	},
 }
 
+// runInstance runs tunnel of management server instance in process until ctx is done, its log is written to out
+func runInstance(ctx context.Context, t *config.Tunnel, out io.Writer, started func()) error {
+	logger := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: &logLevelVar}))
+	s, err := newTunnelServer(withTunnelLogger(ctx, logger), t)
+	if err != nil {
+		return err
+	}
+	started()
+	s.run(ctx)
+	return nil
+}
+
 var (
-	serverListenAddress string
+	serverListenAddress    string
+	serverStateFile        string
+	serverLogDir           string
+	serverAdminPassword    string
+	serverReadOnlyPassword string
+	serverTokenFile        string
+	serverTLSCert          string
+	serverTLSKey           string
+	serverStopTimeout      time.Duration
 )
 
 func init() {
@@ -25,5 +79,15 @@ func init() {
 
 	// Here you will define your flags and configuration settings.
 	flags := serverCmd.Flags()
-	flags.StringVarP(&serverListenAddress, "listen", "l", "0.0.0.0:8080", "server listen address")
+	flags.StringVarP(&serverListenAddress, "listen", "l", "127.0.0.1:8080", "server listen address")
+	flags.StringVarP(&serverStateFile, "state-file", "", "", "persist agents and proxies to this JSON file and restore them on startup")
+	flags.StringVarP(&serverLogDir, "instance-log-dir", "", "", "also write output of each agent and proxy to a rotated file TYPE-ID.log in this directory")
+	flags.StringVarP(&serverAdminPassword, "admin-password", "", "", "password of web interface login with admin role")
+	flags.StringVarP(&serverReadOnlyPassword, "read-only-password", "", "", "password of web interface login with read-only role")
+	flags.StringVarP(&serverTokenFile, "token-file", "", "", "file of api tokens accepted in Authorization: Bearer header, one ROLE TOKEN per line, ROLE is admin or read-only")
+	flags.StringVarP(&serverTLSCert, "tls-cert", "", "", "serve https with this certificate file")
+	flags.StringVarP(&serverTLSKey, "tls-key", "", "", "key file of --tls-cert")
+	flags.DurationVarP(&serverStopTimeout, "stop-timeout", "", server.DefaultStopTimeout, "kill child process of instance if it doesn't exit in this time after SIGTERM, abandon in-process instance as failed if it doesn't stop in this time")
+
+	serverCmd.MarkFlagsRequiredTogether("tls-cert", "tls-key")
 }
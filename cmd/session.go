@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tutils/tnet/endpoint/proxy"
+	"golang.org/x/term"
+)
+
+// executeFunc returns tunnel function executing args on agent with local stdio,
+// the process exits with exit code of the command
+func executeFunc(args []string, rawPTYMode bool, noPTY bool) proxy.TunnelFunc {
+	return func(ctx context.Context, t *proxy.Tunnel) {
+		var exitCode int
+		var err error
+		if noPTY {
+			exitCode, err = t.RunExec(ctx, &proxy.ExecSession{
+				Args:   args,
+				Stdin:  os.Stdin,
+				Stdout: os.Stdout,
+				Stderr: os.Stderr,
+			})
+		} else {
+			exitCode, err = runPTY(ctx, t, args, rawPTYMode)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(exitCode)
+	}
+}
+
+// runPTY executes args in pty on agent with local terminal
+func runPTY(ctx context.Context, t *proxy.Tunnel, args []string, rawPTYMode bool) (int, error) {
+	fd := int(os.Stdin.Fd())
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		return 1, err
+	}
+
+	if !rawPTYMode {
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			return 1, err
+		}
+		defer term.Restore(fd, oldState)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resizeCh := make(chan proxy.WindowSize, 1)
+	resized := notifyResize(ctx)
+	go func() {
+		for {
+			select {
+			case <-resized:
+				if w, h, err := term.GetSize(fd); err == nil && (w != width || h != height) {
+					width, height = w, h
+					select {
+					case resizeCh <- proxy.WindowSize{Width: w, Height: h}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, forwardedSignals...)
+	defer signal.Stop(sigCh)
+	remoteSigCh := make(chan syscall.Signal, 1)
+	go func() {
+		for {
+			select {
+			case sig := <-sigCh:
+				select {
+				case remoteSigCh <- sig.(syscall.Signal):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return t.RunPTY(ctx, &proxy.PTYSession{
+		Args:   args,
+		Raw:    rawPTYMode,
+		Size:   proxy.WindowSize{Width: width, Height: height},
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Resize: resizeCh,
+		Signal: remoteSigCh,
+	})
+}
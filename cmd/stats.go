@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/counter/ewma"
+)
+
+func newEWMACounter() counter.Counter {
+	return ewma.NewEWMACounter(ewma.DefaultWindow)
+}
+
+// newAccounting creates traffic accounting of tcp connections,
+// traffic of active connections and targets is logged to logger every interval until ctx is done if interval is positive
+func newAccounting(ctx context.Context, logger *slog.Logger, interval time.Duration) *counter.Accounting {
+	a := counter.NewAccounting(newEWMACounter)
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				for _, t := range a.Targets.Active() {
+					logger.Info("target traffic", "target", t.Labels[0], "active", t.Active(), "traffic", t)
+				}
+				for _, t := range a.Conns.Active() {
+					logger.Info("connection traffic", "tunID", t.Labels[0], "connID", t.Labels[1], "traffic", t)
+				}
+			}
+		}()
+	}
+	return a
+}
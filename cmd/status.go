@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/endpoint/admin"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status [flags] [tunID]",
+	Short: "Show tunnels and connections of running proxy or agent",
+	Long: `Show tunnels and connections of proxy or agent started with --admin-listen, For example:
+  tnet status --admin-connect=unix:/run/tnet.sock
+  tnet status --admin-connect=127.0.0.1:9200 --conns
+  tnet status --admin-connect=127.0.0.1:9200 1`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := admin.NewClient(adminConnect)
+		var tunID int64
+		if len(args) > 0 {
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid tunnel id %q", args[0])
+			}
+			tunID = id
+		}
+
+		if tunID == 0 {
+			tunnels, err := c.Tunnels()
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "TUNNEL\tROLE\tPEER\tUPTIME\tUPLOAD\tDOWNLOAD\tCONNS")
+			for _, t := range tunnels {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%v\t%s\t%s\t%d\n", t.ID, t.Role, t.Peer, uptime(t.Uptime),
+					counter.HumanReadable(uint64(t.Upload)), counter.HumanReadable(uint64(t.Download)), t.Conns)
+			}
+			tw.Flush()
+			if !statusConns {
+				return nil
+			}
+			fmt.Println()
+		}
+
+		conns, err := c.Conns(tunID)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CONN\tSOURCE\tTARGET\tUPTIME\tUPLOAD\tDOWNLOAD")
+		for _, c := range conns {
+			fmt.Fprintf(tw, "%d:%d\t%s\t%s\t%v\t%s\t%s\n", c.TunnelID, c.ID, c.Source, c.Target, uptime(c.Uptime),
+				counter.HumanReadable(uint64(c.Upload)), counter.HumanReadable(uint64(c.Download)))
+		}
+		return tw.Flush()
+	},
+}
+
+// killCmd represents the kill command
+var killCmd = &cobra.Command{
+	Use:   "kill [flags] tunID[:connID]...",
+	Short: "Close tunnels or connections of running proxy or agent",
+	Long: `Close tunnels or connections of proxy or agent started with --admin-listen,
+ids are shown by tnet status, connections and sessions of a closed tunnel are closed too,
+a dialing side reconnects after its tunnel is closed, For example:
+  tnet kill --admin-connect=unix:/run/tnet.sock 1:3
+  tnet kill --admin-connect=127.0.0.1:9200 2`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := admin.NewClient(adminConnect)
+		failed := false
+		for _, arg := range args {
+			if err := kill(c, arg); err != nil {
+				fmt.Fprintf(os.Stderr, "kill %s: %v\n", arg, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
+// mappingCmd represents the mapping command
+var mappingCmd = &cobra.Command{
+	Use:   "mapping [flags] [LISTEN=CONNECT...]",
+	Short: "Show or replace forwarding mappings of running proxy",
+	Long: `Show forwarding mappings of proxy started with --admin-listen, or replace them by the given ones.
+Listeners of removed mappings are shut down gracefully, connections of unchanged mappings are untouched, For example:
+  tnet mapping --admin-connect=unix:/run/tnet.sock
+  tnet mapping --admin-connect=127.0.0.1:9200 :2222=10.0.0.5:22 :8080=10.0.0.6:80
+  tnet mapping --admin-connect=127.0.0.1:9200 --clear`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := admin.NewClient(adminConnect)
+		var (
+			mappings []string
+			err      error
+		)
+		if len(args) == 0 && !mappingClear {
+			mappings, err = c.Mappings()
+		} else {
+			if mappingClear && len(args) > 0 {
+				return fmt.Errorf("--clear cannot be used with mappings")
+			}
+			mappings, err = c.SetMappings(args)
+		}
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "LISTEN\tCONNECT")
+		for _, m := range mappings {
+			listen, connect, _ := strings.Cut(m, "=")
+			fmt.Fprintf(tw, "%s\t%s\n", listen, connect)
+		}
+		return tw.Flush()
+	},
+}
+
+// kill closes tunnel or connection of id in form tunID[:connID]
+func kill(c *admin.Client, id string) error {
+	tun, conn, isConn := strings.Cut(id, ":")
+	tunID, err := strconv.ParseInt(tun, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid tunnel id %q", tun)
+	}
+	if !isConn {
+		return c.CloseTunnel(tunID)
+	}
+	connID, err := strconv.ParseInt(conn, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid connection id %q", conn)
+	}
+	return c.CloseConn(tunID, connID)
+}
+
+func uptime(sec float64) time.Duration {
+	return time.Duration(sec * float64(time.Second)).Round(time.Second)
+}
+
+var (
+	adminConnect string
+	statusConns  bool
+	mappingClear bool
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(killCmd)
+	rootCmd.AddCommand(mappingCmd)
+
+	for _, cmd := range []*cobra.Command{statusCmd, killCmd, mappingCmd} {
+		cmd.Flags().StringVarP(&adminConnect, "admin-connect", "a", "", "admin api address of proxy or agent, host:port or unix:path")
+		cmd.MarkFlagRequired("admin-connect")
+	}
+	statusCmd.Flags().BoolVarP(&statusConns, "conns", "c", false, "also list connections of all tunnels")
+	mappingCmd.Flags().BoolVarP(&mappingClear, "clear", "", false, "remove all mappings")
+}
@@ -0,0 +1,36 @@
+//go:build !unix
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// forwardedSignals are delivered to remote pty when received by proxy
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+// notifyResize returns a channel receiving a value when terminal may be resized,
+// terminal size is polled since there is no SIGWINCH
+func notifyResize(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case ch <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+	"github.com/tutils/tnet/config"
+	"github.com/tutils/tnet/tun"
+)
+
+func addTLSFlags(flags *pflag.FlagSet, t *config.Tunnel) {
+	flags.StringVarP(&t.TLSCert, "tls-cert", "", "", "certificate file of wss tunnel, server certificate of tunnel-listen, client certificate of tunnel-connect")
+	flags.StringVarP(&t.TLSKey, "tls-key", "", "", "private key file of tls-cert")
+	flags.StringVarP(&t.TLSCA, "tls-ca", "", "", "CA file of wss tunnel, required client certificates of tunnel-listen are verified by it, server certificate of tunnel-connect is verified by it instead of system roots")
+}
+
+// tunServerTLSOption returns tls option of tunnel server of t, clients must present certificates signed by tls-ca if it is set
+func tunServerTLSOption(t *config.Tunnel) (tun.ServerOption, error) {
+	if t.TLSCert == "" {
+		if t.TLSCA != "" {
+			return nil, fmt.Errorf("tls-ca of tunnel-listen requires tls-cert")
+		}
+		return tun.WithServerTLSConfig(nil), nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.TLSCert, t.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("load tls cert: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.TLSCA != "" {
+		pool, err := loadCertPool(t.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tun.WithServerTLSConfig(cfg), nil
+}
+
+// tunClientTLSOption returns tls option of tunnel client of t, system roots are used if tls-ca is not set
+func tunClientTLSOption(t *config.Tunnel) (tun.ClientOption, error) {
+	if t.TLSCert == "" && t.TLSCA == "" {
+		return tun.WithClientTLSConfig(nil), nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(t.TLSCert, t.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("load tls cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if t.TLSCA != "" {
+		pool, err := loadCertPool(t.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return tun.WithClientTLSConfig(cfg), nil
+}
+
+func loadCertPool(name string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("load tls ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("load tls ca: no certificate in %s", name)
+	}
+	return pool, nil
+}
@@ -0,0 +1,471 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/tutils/tnet/accesslog"
+	"github.com/tutils/tnet/config"
+	"github.com/tutils/tnet/crypt/xor"
+	"github.com/tutils/tnet/endpoint/agent"
+	"github.com/tutils/tnet/endpoint/policy"
+	"github.com/tutils/tnet/endpoint/proxy"
+	"github.com/tutils/tnet/ratelimit"
+	"github.com/tutils/tnet/tcp"
+	"github.com/tutils/tnet/tun"
+)
+
+// tunnelFlags is tunnel configured by command line flags of proxy, agent, cp and exec
+var tunnelFlags config.Tunnel
+
+// tunnelServer is proxy or agent of a tunnel configuration
+type tunnelServer struct {
+	serve     func(ctx context.Context) error
+	proxy     *proxy.Proxy // nil for agent
+	accessLog *accesslog.Logger
+	quotaFile *ratelimit.QuotaFile // nil if usage of quotas is not saved
+	logger    *slog.Logger
+	stops     []func() // stop servers of metrics and admin api
+}
+
+// interval of saving usage of quotas
+const quotaSaveInterval = time.Minute
+
+// run serves until ctx is done
+func (s *tunnelServer) run(ctx context.Context) {
+	defer s.accessLog.Close()
+	defer s.stopServers()
+	if f := s.quotaFile; f != nil {
+		onError := func(err error) { s.logger.Error("save quota file failed", "err", err) }
+		go f.Run(ctx, quotaSaveInterval, onError)
+		defer func() {
+			if err := f.Save(); err != nil {
+				onError(err)
+			}
+		}()
+	}
+	serveWithBackoff(ctx, s.logger, s.serve)
+}
+
+// stopServers stops servers of metrics and admin api and waits for them to exit
+func (s *tunnelServer) stopServers() {
+	for _, stop := range s.stops {
+		stop()
+	}
+}
+
+// newTunnelServer creates proxy or agent of t, servers of metrics and admin api are stopped when it stops running
+func newTunnelServer(ctx context.Context, t *config.Tunnel) (*tunnelServer, error) {
+	if t.Role == config.RoleProxy {
+		return newProxy(ctx, t)
+	}
+	return newAgent(ctx, t)
+}
+
+type loggerKey struct{}
+
+// withTunnelLogger returns ctx of which tunnels log to logger instead of default logger
+func withTunnelLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// tunnelLogger returns logger of ctx or default logger, with name of t
+func tunnelLogger(ctx context.Context, t *config.Tunnel) *slog.Logger {
+	logger, ok := ctx.Value(loggerKey{}).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+	if t.Name == "" {
+		return logger
+	}
+	return logger.With("tunnel", t.Name)
+}
+
+// tunClientOptions returns dial and tls options of tunnel client of t
+func tunClientOptions(t *config.Tunnel) ([]tun.ClientOption, error) {
+	dialOpts, err := dialOptions(&t.Dial)
+	if err != nil {
+		return nil, err
+	}
+	dialOpt, err := tunDialOption(dialOpts)
+	if err != nil {
+		return nil, err
+	}
+	tlsOpt, err := tunClientTLSOption(t)
+	if err != nil {
+		return nil, err
+	}
+	return []tun.ClientOption{dialOpt, tlsOpt}, nil
+}
+
+// proxyMappings returns forwarding mappings of listen and connect, mapping and mapping-file of t
+func proxyMappings(t *config.Tunnel) ([]proxy.Mapping, error) {
+	var mappings []proxy.Mapping
+	if t.Listen != "" {
+		mappings = append(mappings, proxy.Mapping{Listen: t.Listen, Connect: t.Connect})
+	}
+	for _, s := range t.Mappings {
+		m, err := proxy.ParseMapping(s)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, m)
+	}
+	if t.MappingFile != "" {
+		fileMappings, err := proxy.LoadMappingsFile(t.MappingFile)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, fileMappings...)
+	}
+	return mappings, nil
+}
+
+// reloadMappings replaces forwarding mappings of running proxy by those of t
+func (s *tunnelServer) reloadMappings(t *config.Tunnel) error {
+	mappings, err := proxyMappings(t)
+	if err != nil {
+		return err
+	}
+	return s.proxy.SetMappings(mappings...)
+}
+
+// newProxy creates proxy of t, extra options are appended to options of t
+func newProxy(ctx context.Context, t *config.Tunnel, extra ...proxy.Option) (*tunnelServer, error) {
+	format, err := proxy.ParseDumpFormat(t.DumpFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	limitOpts, quotaFile, err := limitOptions(t)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings, err := proxyMappings(t)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := tunnelLogger(ctx, t)
+	var epOpt proxy.Option
+	if t.TunnelConnect != "" {
+		clientOpts, err := tunClientOptions(t)
+		if err != nil {
+			return nil, err
+		}
+		// Normal mode: proxy actively connects to agent
+		epOpt = proxy.WithTunClient(
+			tun.NewClient(append(clientOpts,
+				tun.WithConnectAddress(t.TunnelConnect),
+				tun.WithClientLogger(logger),
+			)...),
+		)
+	} else {
+		tlsOpt, err := tunServerTLSOption(t)
+		if err != nil {
+			return nil, err
+		}
+		// Reverse mode: proxy waits for agent to connect
+		epOpt = proxy.WithTunServer(
+			tun.NewServer(
+				tun.WithListenAddress(t.TunnelListen),
+				tun.WithServerLogger(logger),
+				tlsOpt,
+			),
+		)
+	}
+
+	m, stopMetrics, err := serveMetrics(t.MetricsListen)
+	if err != nil {
+		return nil, err
+	}
+
+	ar, stopAdmin, err := serveAdmin(t.AdminListen, config.RoleProxy)
+	if err != nil {
+		stopMetrics()
+		return nil, err
+	}
+
+	al, err := openAccessLog(t)
+	if err != nil {
+		stopMetrics()
+		stopAdmin()
+		return nil, err
+	}
+
+	opts := []proxy.Option{
+		epOpt,
+		proxy.WithTunHandlerNewer(proxy.NewProxyTunHandler),
+		proxy.WithMappings(mappings...),
+		proxy.WithTunCrypt(xor.NewCrypt(t.CryptKey)),
+		proxy.WithDownloadCounter(newEWMACounter()),
+		proxy.WithUploadCounter(newEWMACounter()),
+		proxy.WithDumpDir(t.DumpDir),
+		proxy.WithDumpFormat(format),
+		proxy.WithConnectTimeout(t.ConnectTimeout),
+		proxy.WithRecordDir(t.RecordDir),
+		proxy.WithRecordInput(t.RecordInput),
+		proxy.WithMetrics(m),
+		proxy.WithAccounting(newAccounting(ctx, logger, t.StatsInterval)),
+		proxy.WithAdmin(ar),
+		proxy.WithAccessLog(al),
+		proxy.WithLogger(logger),
+	}
+	opts = append(opts, limitOpts...)
+	opts = append(opts, extra...)
+	p := proxy.New(opts...)
+	return &tunnelServer{
+		serve:     p.Serve,
+		proxy:     p,
+		accessLog: al,
+		quotaFile: quotaFile,
+		logger:    logger,
+		stops:     []func(){stopMetrics, stopAdmin},
+	}, nil
+}
+
+// newAgent creates agent of t
+func newAgent(ctx context.Context, t *config.Tunnel) (*tunnelServer, error) {
+	dialOpts, err := dialOptions(&t.Dial)
+	if err != nil {
+		return nil, err
+	}
+	dialPolicy, err := newDialPolicy(t)
+	if err != nil {
+		return nil, err
+	}
+
+	execPolicy, err := newExecPolicy(t)
+	if err != nil {
+		return nil, err
+	}
+
+	filePolicy := newFilePolicy(t)
+
+	logger := tunnelLogger(ctx, t)
+	var epOpt agent.Option
+	if t.TunnelListen != "" {
+		tlsOpt, err := tunServerTLSOption(t)
+		if err != nil {
+			return nil, err
+		}
+		// Normal mode: agent waits for proxy to connect
+		epOpt = agent.WithTunServer(
+			tun.NewServer(
+				tun.WithListenAddress(t.TunnelListen),
+				tun.WithServerLogger(logger),
+				tlsOpt,
+			),
+		)
+	} else {
+		clientOpts, err := tunClientOptions(t)
+		if err != nil {
+			return nil, err
+		}
+		// Reverse mode: agent actively connects to proxy
+		epOpt = agent.WithTunClient(
+			tun.NewClient(append(clientOpts,
+				tun.WithConnectAddress(t.TunnelConnect),
+				tun.WithClientLogger(logger),
+			)...),
+		)
+	}
+
+	m, stopMetrics, err := serveMetrics(t.MetricsListen)
+	if err != nil {
+		return nil, err
+	}
+
+	ar, stopAdmin, err := serveAdmin(t.AdminListen, config.RoleAgent)
+	if err != nil {
+		stopMetrics()
+		return nil, err
+	}
+
+	al, err := openAccessLog(t)
+	if err != nil {
+		stopMetrics()
+		stopAdmin()
+		return nil, err
+	}
+
+	a := agent.New(
+		epOpt,
+		agent.WithTunHandlerNewer(agent.NewTCPAgentTunHandler),
+		agent.WithTunCrypt(xor.NewCrypt(t.CryptKey)),
+		agent.WithEnabledExecute(t.EnabledExecute),
+		agent.WithDialOptions(dialOpts...),
+		agent.WithDialPolicy(dialPolicy),
+		agent.WithExecPolicy(execPolicy),
+		agent.WithFilePolicy(filePolicy),
+		agent.WithMetrics(m),
+		agent.WithAccounting(newAccounting(ctx, logger, t.StatsInterval)),
+		agent.WithAdmin(ar),
+		agent.WithAccessLog(al),
+		agent.WithRecordDir(t.RecordDir),
+		agent.WithRecordInput(t.RecordInput),
+		agent.WithLogger(logger),
+	)
+	return &tunnelServer{
+		serve:     a.Serve,
+		accessLog: al,
+		logger:    logger,
+		stops:     []func(){stopMetrics, stopAdmin},
+	}, nil
+}
+
+// serveWithBackoff calls serve again after it returns until ctx is done, with backoff on errors
+func serveWithBackoff(ctx context.Context, logger *slog.Logger, serve func(ctx context.Context) error) {
+	var tempDelay time.Duration
+	for {
+		err := serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			tempDelay = 0
+			continue
+		}
+		if tempDelay == 0 {
+			tempDelay = 5 * time.Millisecond
+		} else {
+			tempDelay *= 2
+		}
+		if max := 1 * time.Second; tempDelay > max {
+			tempDelay = max
+		}
+		logger.Warn("serve failed, retrying", "err", err, "delay", tempDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(tempDelay):
+		}
+	}
+}
+
+// limitOptions parses rate limits and quotas of t, usage of quotas is restored from quota file if it is set
+func limitOptions(t *config.Tunnel) ([]proxy.Option, *ratelimit.QuotaFile, error) {
+	var opts []proxy.Option
+	for _, l := range []struct {
+		flag  string
+		value string
+		opt   func(upload int64, download int64) proxy.Option
+	}{
+		{"tunnel-limit", t.TunnelLimit, proxy.WithTunnelRateLimit},
+		{"mapping-limit", t.MappingLimit, proxy.WithMappingRateLimit},
+		{"conn-limit", t.ConnLimit, proxy.WithConnRateLimit},
+	} {
+		upload, download, err := ratelimit.ParseLimit(l.value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--%s: %w", l.flag, err)
+		}
+		opts = append(opts, l.opt(upload, download))
+	}
+
+	var quotas []*ratelimit.Quota
+	for _, q := range []struct {
+		flag   string
+		value  string
+		period ratelimit.Period
+	}{
+		{"daily-quota", t.DailyQuota, ratelimit.Daily},
+		{"monthly-quota", t.MonthlyQuota, ratelimit.Monthly},
+	} {
+		if q.value == "" {
+			continue
+		}
+		limit, err := ratelimit.ParseSize(q.value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--%s: %w", q.flag, err)
+		}
+		quotas = append(quotas, ratelimit.NewQuota(limit, q.period))
+	}
+	var quotaFile *ratelimit.QuotaFile
+	if t.QuotaFile != "" && len(quotas) > 0 {
+		f, err := ratelimit.OpenQuotaFile(t.QuotaFile, quotas...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--quota-file: %w", err)
+		}
+		quotaFile = f
+	}
+	return append(opts, proxy.WithQuotas(quotas...)), quotaFile, nil
+}
+
+// newDialPolicy creates dial policy of t, returns nil if no rule is given
+func newDialPolicy(t *config.Tunnel) (*policy.DialPolicy, error) {
+	var rules []*policy.Rule
+	if t.PolicyFile != "" {
+		fileRules, err := policy.LoadRulesFile(t.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
+	}
+	for _, s := range t.Allow {
+		r, err := policy.ParseRule(policy.Allow, s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	for _, s := range t.Deny {
+		r, err := policy.ParseRule(policy.Deny, s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	p := policy.NewDialPolicy(rules...)
+	if t.DNSServer != "" {
+		p.Resolver = tcp.NewResolver(t.DNSServer)
+	}
+	return p, nil
+}
+
+// newExecPolicy creates execute policy of t, returns nil if no restriction is given
+func newExecPolicy(t *config.Tunnel) (*policy.ExecPolicy, error) {
+	p := &policy.ExecPolicy{
+		Commands:    t.ExecuteAllow,
+		Shell:       t.ExecuteShell,
+		Env:         t.ExecuteEnv,
+		SetEnv:      t.ExecuteSetEnv,
+		Dir:         t.ExecuteDir,
+		MaxSessions: t.ExecuteMaxSessions,
+		MaxDuration: t.ExecuteMaxDuration,
+	}
+	for _, kv := range t.ExecuteSetEnv {
+		if !strings.Contains(kv, "=") {
+			return nil, fmt.Errorf("invalid --execute-setenv %q, KEY=VALUE expected", kv)
+		}
+	}
+	if t.ExecuteUser != "" {
+		cred, err := policy.LookupCredential(t.ExecuteUser)
+		if err != nil {
+			return nil, err
+		}
+		p.Credential = cred
+	}
+	if p.Commands == nil && p.Shell == "" && p.Credential == nil && p.Env == nil && p.SetEnv == nil &&
+		p.Dir == "" && p.MaxSessions <= 0 && p.MaxDuration <= 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// newFilePolicy creates file transfer policy of t, returns nil if file transfer is not enabled
+func newFilePolicy(t *config.Tunnel) *policy.FilePolicy {
+	if len(t.FileRead) == 0 && len(t.FileWrite) == 0 {
+		return nil
+	}
+	return &policy.FilePolicy{
+		Read:  t.FileRead,
+		Write: t.FileWrite,
+	}
+}
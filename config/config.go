@@ -0,0 +1,346 @@
+// Package config is configuration file of tnet run, which describes named proxies and agents
+// served in one process. Keys of a tunnel are the same as command line flags of tnet proxy and tnet agent.
+// The file is YAML, TOML or JSON by its extension, for example:
+//
+//	log:
+//	  level: info
+//	tunnels:
+//	  - name: squid
+//	    role: proxy
+//	    listen: 0.0.0.0:56080
+//	    connect: 127.0.0.1:3128
+//	    tunnel-connect: ws://123.45.67.89:8080/stream
+//	    crypt-key: 816559
+//	  - name: office
+//	    role: agent
+//	    tunnel-listen: ws://0.0.0.0:8080/stream
+//	    crypt-key: 816559
+//	    allow: [10.0.0.0/8:22]
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"github.com/tutils/tnet/accesslog"
+	"github.com/tutils/tnet/crypt/xor"
+	"github.com/tutils/tnet/endpoint/policy"
+	"github.com/tutils/tnet/endpoint/proxy"
+	"github.com/tutils/tnet/ratelimit"
+)
+
+// roles of tunnel
+const (
+	RoleProxy = "proxy"
+	RoleAgent = "agent"
+)
+
+// Config is content of configuration file
+type Config struct {
+	Log     Log      `mapstructure:"log" json:"log"`
+	Tunnels []Tunnel `mapstructure:"tunnels" json:"tunnels"`
+}
+
+// Log is logging of the process
+type Log struct {
+	Level string `mapstructure:"level" json:"level,omitempty"` // debug, info, warn or error
+	JSON  bool   `mapstructure:"json" json:"json,omitempty"`
+}
+
+// Dial is options of dialing tcp connections
+type Dial struct {
+	Timeout            time.Duration `mapstructure:"dial-timeout" json:"dial-timeout,omitempty"`
+	SourceAddr         string        `mapstructure:"source-addr" json:"source-addr,omitempty"`
+	BindInterface      string        `mapstructure:"bind-interface" json:"bind-interface,omitempty"`
+	DNSServer          string        `mapstructure:"dns-server" json:"dns-server,omitempty"`
+	IPVersion          int           `mapstructure:"ip-version" json:"ip-version,omitempty"`
+	HappyEyeballsDelay time.Duration `mapstructure:"happy-eyeballs-delay" json:"happy-eyeballs-delay,omitempty"`
+	NoHappyEyeballs    bool          `mapstructure:"no-happy-eyeballs" json:"no-happy-eyeballs,omitempty"`
+}
+
+// Tunnel is a named proxy or agent, fields not applicable to its role are ignored.
+// Its JSON keys are the same as keys of configuration file, durations are encoded in nanoseconds.
+type Tunnel struct {
+	Name string `mapstructure:"name" json:"name,omitempty"`
+	Role string `mapstructure:"role" json:"role,omitempty"`
+
+	// transport
+	TunnelListen  string                   `mapstructure:"tunnel-listen" json:"tunnel-listen,omitempty"`
+	TunnelConnect string                   `mapstructure:"tunnel-connect" json:"tunnel-connect,omitempty"`
+	CryptKey      int64                    `mapstructure:"crypt-key" json:"crypt-key"`
+	TLSCert       string                   `mapstructure:"tls-cert" json:"tls-cert,omitempty"` // server certificate of tunnel-listen, client certificate of tunnel-connect
+	TLSKey        string                   `mapstructure:"tls-key" json:"tls-key,omitempty"`
+	TLSCA         string                   `mapstructure:"tls-ca" json:"tls-ca,omitempty"` // verifies client certificates of tunnel-listen, server certificate of tunnel-connect
+	Dial          `mapstructure:",squash"` // of tunnel connect address on proxy, of target addresses and tunnel connect address on agent
+
+	// proxy forwarding
+	Listen         string        `mapstructure:"listen" json:"listen,omitempty"`
+	Connect        string        `mapstructure:"connect" json:"connect,omitempty"`
+	Mappings       []string      `mapstructure:"mapping" json:"mapping,omitempty"`           // LISTEN=CONNECT
+	MappingFile    string        `mapstructure:"mapping-file" json:"mapping-file,omitempty"` // one LISTEN=CONNECT per line
+	ConnectTimeout time.Duration `mapstructure:"connect-timeout" json:"connect-timeout"`
+	DumpDir        string        `mapstructure:"dump-dir" json:"dump-dir,omitempty"`
+	DumpFormat     string        `mapstructure:"dump-format" json:"dump-format"`
+	TunnelLimit    string        `mapstructure:"tunnel-limit" json:"tunnel-limit,omitempty"`
+	MappingLimit   string        `mapstructure:"mapping-limit" json:"mapping-limit,omitempty"`
+	ConnLimit      string        `mapstructure:"conn-limit" json:"conn-limit,omitempty"`
+	DailyQuota     string        `mapstructure:"daily-quota" json:"daily-quota,omitempty"`
+	MonthlyQuota   string        `mapstructure:"monthly-quota" json:"monthly-quota,omitempty"`
+	QuotaFile      string        `mapstructure:"quota-file" json:"quota-file,omitempty"`
+
+	// agent policies
+	EnabledExecute     bool          `mapstructure:"enabled-execute" json:"enabled-execute,omitempty"`
+	Allow              []string      `mapstructure:"allow" json:"allow,omitempty"`
+	Deny               []string      `mapstructure:"deny" json:"deny,omitempty"`
+	PolicyFile         string        `mapstructure:"policy-file" json:"policy-file,omitempty"`
+	ExecuteAllow       []string      `mapstructure:"execute-allow" json:"execute-allow,omitempty"`
+	ExecuteShell       string        `mapstructure:"execute-shell" json:"execute-shell,omitempty"`
+	ExecuteUser        string        `mapstructure:"execute-user" json:"execute-user,omitempty"`
+	ExecuteEnv         []string      `mapstructure:"execute-env" json:"execute-env,omitempty"`
+	ExecuteSetEnv      []string      `mapstructure:"execute-setenv" json:"execute-setenv,omitempty"`
+	ExecuteDir         string        `mapstructure:"execute-dir" json:"execute-dir,omitempty"`
+	ExecuteMaxSessions int           `mapstructure:"execute-max-sessions" json:"execute-max-sessions,omitempty"`
+	ExecuteMaxDuration time.Duration `mapstructure:"execute-max-duration" json:"execute-max-duration,omitempty"`
+	FileRead           []string      `mapstructure:"file-read" json:"file-read,omitempty"`
+	FileWrite          []string      `mapstructure:"file-write" json:"file-write,omitempty"`
+
+	// observability
+	RecordDir           string        `mapstructure:"record-dir" json:"record-dir,omitempty"`
+	RecordInput         bool          `mapstructure:"record-input" json:"record-input,omitempty"`
+	MetricsListen       string        `mapstructure:"metrics-listen" json:"metrics-listen,omitempty"`
+	StatsInterval       time.Duration `mapstructure:"stats-interval" json:"stats-interval,omitempty"`
+	AdminListen         string        `mapstructure:"admin-listen" json:"admin-listen,omitempty"`
+	AccessLog           string        `mapstructure:"access-log" json:"access-log,omitempty"`
+	AccessLogFormat     string        `mapstructure:"access-log-format" json:"access-log-format"`
+	AccessLogMaxSize    string        `mapstructure:"access-log-max-size" json:"access-log-max-size"`
+	AccessLogMaxBackups int           `mapstructure:"access-log-max-backups" json:"access-log-max-backups"`
+}
+
+// default values of tunnel, they are also defaults of command line flags
+var defaults = map[string]any{
+	"crypt-key":              int64(xor.DefaultSeed),
+	"connect-timeout":        proxy.DefaultConnectTimeout,
+	"dump-format":            string(proxy.DumpRaw),
+	"access-log-format":      string(accesslog.FormatText),
+	"access-log-max-size":    "100M",
+	"access-log-max-backups": accesslog.DefaultMaxBackups,
+}
+
+// Default returns tunnel of role with default values
+func Default(role string) Tunnel {
+	t, _ := decodeTunnel(map[string]any{"role": role})
+	return t
+}
+
+// decodeTunnel decodes tunnel from raw values of configuration file, missing keys are set to defaults
+func decodeTunnel(raw map[string]any, opts ...viper.DecoderConfigOption) (Tunnel, error) {
+	v := viper.New()
+	for k, d := range defaults {
+		v.SetDefault(k, d)
+	}
+	var t Tunnel
+	if err := v.MergeConfigMap(raw); err != nil {
+		return t, err
+	}
+	err := v.Unmarshal(&t, opts...)
+	return t, err
+}
+
+// DecodeTunnel decodes tunnel from raw values such as a decoded JSON object, missing keys are set to defaults
+// and unknown keys are errors. Durations are strings like 3s or numbers of nanoseconds.
+func DecodeTunnel(raw map[string]any) (Tunnel, error) {
+	return decodeTunnel(raw, func(c *mapstructure.DecoderConfig) {
+		c.ErrorUnused = true
+	})
+}
+
+// Load reads configuration file at path
+func Load(path string) (*Config, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := v.UnmarshalKey("log", &c.Log); err != nil {
+		return nil, fmt.Errorf("log: %w", err)
+	}
+	var raws []map[string]any
+	if err := v.UnmarshalKey("tunnels", &raws); err != nil {
+		return nil, fmt.Errorf("tunnels: %w", err)
+	}
+	for i, raw := range raws {
+		t, err := decodeTunnel(raw)
+		if err != nil {
+			return nil, fmt.Errorf("tunnels[%d]: %w", i, err)
+		}
+		c.Tunnels = append(c.Tunnels, t)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks tunnels are named uniquely and their roles and addresses are set
+func (c *Config) Validate() error {
+	if len(c.Tunnels) == 0 {
+		return fmt.Errorf("no tunnel is configured")
+	}
+	names := make(map[string]bool)
+	for i := range c.Tunnels {
+		t := &c.Tunnels[i]
+		if t.Name == "" {
+			return fmt.Errorf("tunnels[%d]: name is required", i)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tunnel %s: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("tunnel %s: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks role, addresses and values of tunnel
+func (t *Tunnel) Validate() error {
+	if t.Role != RoleProxy && t.Role != RoleAgent {
+		return fmt.Errorf("invalid role %q, expected %s or %s", t.Role, RoleProxy, RoleAgent)
+	}
+	if (t.TunnelListen == "") == (t.TunnelConnect == "") {
+		return fmt.Errorf("either tunnel-listen or tunnel-connect must be set")
+	}
+	if t.Role == RoleProxy {
+		if (t.Listen == "") != (t.Connect == "") {
+			return fmt.Errorf("listen and connect must be set together")
+		}
+		if t.Listen == "" && len(t.Mappings) == 0 && t.MappingFile == "" {
+			return fmt.Errorf("listen and connect, mapping or mapping-file must be set")
+		}
+		for _, m := range t.Mappings {
+			if _, err := proxy.ParseMapping(m); err != nil {
+				return fmt.Errorf("mapping: %w", err)
+			}
+		}
+		if t.DumpFormat != "" {
+			if _, err := proxy.ParseDumpFormat(t.DumpFormat); err != nil {
+				return fmt.Errorf("dump-format: %w", err)
+			}
+		}
+		for _, l := range []struct{ key, value string }{
+			{"tunnel-limit", t.TunnelLimit},
+			{"mapping-limit", t.MappingLimit},
+			{"conn-limit", t.ConnLimit},
+		} {
+			if _, _, err := ratelimit.ParseLimit(l.value); err != nil {
+				return fmt.Errorf("%s: %w", l.key, err)
+			}
+		}
+		for _, q := range []struct{ key, value string }{
+			{"daily-quota", t.DailyQuota},
+			{"monthly-quota", t.MonthlyQuota},
+		} {
+			if q.value == "" {
+				continue
+			}
+			if _, err := ratelimit.ParseSize(q.value); err != nil {
+				return fmt.Errorf("%s: %w", q.key, err)
+			}
+		}
+	} else {
+		for _, rules := range []struct {
+			action policy.Action
+			values []string
+		}{
+			{policy.Allow, t.Allow},
+			{policy.Deny, t.Deny},
+		} {
+			for _, r := range rules.values {
+				if _, err := policy.ParseRule(rules.action, r); err != nil {
+					return fmt.Errorf("%s: %w", rules.action, err)
+				}
+			}
+		}
+		for _, kv := range t.ExecuteSetEnv {
+			if !strings.Contains(kv, "=") {
+				return fmt.Errorf("execute-setenv: invalid %q, KEY=VALUE expected", kv)
+			}
+		}
+		if t.ExecuteMaxSessions < 0 || t.ExecuteMaxDuration < 0 {
+			return fmt.Errorf("execute-max-sessions and execute-max-duration must not be negative")
+		}
+	}
+	if t.IPVersion != 0 && t.IPVersion != 4 && t.IPVersion != 6 {
+		return fmt.Errorf("ip-version: invalid %d, expected 4 or 6", t.IPVersion)
+	}
+	if t.AccessLogFormat != "" {
+		if _, err := accesslog.ParseFormat(t.AccessLogFormat); err != nil {
+			return fmt.Errorf("access-log-format: %w", err)
+		}
+	}
+	return nil
+}
+
+// Equal tells whether t and o are the same configuration
+func (t *Tunnel) Equal(o *Tunnel) bool {
+	return reflect.DeepEqual(t, o)
+}
+
+// EqualExceptMappings tells whether t and o are the same configuration except forwarding mappings
+// of proxy, which are listen, connect, mapping and mapping-file
+func (t *Tunnel) EqualExceptMappings(o *Tunnel) bool {
+	a, b := *t, *o
+	for _, c := range []*Tunnel{&a, &b} {
+		c.Listen, c.Connect, c.Mappings, c.MappingFile = "", "", nil, ""
+	}
+	return reflect.DeepEqual(&a, &b)
+}
+
+// Tunnel returns tunnel of name, nil if it is not found
+func (c *Config) Tunnel(name string) *Tunnel {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Tunnels {
+		if c.Tunnels[i].Name == name {
+			return &c.Tunnels[i]
+		}
+	}
+	return nil
+}
+
+// Diff compares tunnels of old and new configuration by name,
+// changed tunnels are those of the same name with different configuration
+func Diff(old *Config, new *Config) (added []Tunnel, removed []Tunnel, changed []Tunnel) {
+	oldTunnels := make(map[string]*Tunnel)
+	if old != nil {
+		for i := range old.Tunnels {
+			oldTunnels[old.Tunnels[i].Name] = &old.Tunnels[i]
+		}
+	}
+	newNames := make(map[string]bool)
+	for _, t := range new.Tunnels {
+		newNames[t.Name] = true
+		o, ok := oldTunnels[t.Name]
+		switch {
+		case !ok:
+			added = append(added, t)
+		case !o.Equal(&t):
+			changed = append(changed, t)
+		}
+	}
+	if old != nil {
+		for _, t := range old.Tunnels {
+			if !newNames[t.Name] {
+				removed = append(removed, t)
+			}
+		}
+	}
+	return added, removed, changed
+}
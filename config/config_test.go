@@ -0,0 +1,162 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tutils/tnet/crypt/xor"
+	"github.com/tutils/tnet/endpoint/proxy"
+)
+
+const testYAML = `
+log:
+  level: debug
+tunnels:
+  - name: squid
+    role: proxy
+    listen: 127.0.0.1:56080
+    connect: 127.0.0.1:3128
+    tunnel-connect: ws://127.0.0.1:8080/stream
+    crypt-key: 816559
+    dial-timeout: 3s
+    conn-limit: 1M
+    mapping: [127.0.0.1:2222=10.0.0.5:22]
+  - name: office
+    role: agent
+    tunnel-listen: ws://0.0.0.0:8080/stream
+    allow: [10.0.0.0/8:22, "*.internal"]
+`
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load(writeFile(t, "tnet.yaml", testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Log.Level != "debug" || len(c.Tunnels) != 2 {
+		t.Fatalf("unexpected config %+v", c)
+	}
+	p := c.Tunnels[0]
+	if p.Role != RoleProxy || p.CryptKey != 816559 || p.Timeout != 3*time.Second || p.ConnLimit != "1M" ||
+		len(p.Mappings) != 1 {
+		t.Errorf("unexpected proxy %+v", p)
+	}
+	if p.ConnectTimeout != proxy.DefaultConnectTimeout || p.AccessLogMaxSize != "100M" {
+		t.Errorf("defaults are not applied %+v", p)
+	}
+	a := c.Tunnels[1]
+	if a.CryptKey != xor.DefaultSeed || len(a.Allow) != 2 || a.Allow[1] != "*.internal" {
+		t.Errorf("unexpected agent %+v", a)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	c, err := Load(writeFile(t, "tnet.toml", `
+[[tunnels]]
+name = "office"
+role = "agent"
+tunnel-connect = "ws://proxy:8080/stream"
+file-read = ["/var/log/*"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := c.Tunnels[0]; a.TunnelConnect != "ws://proxy:8080/stream" || len(a.FileRead) != 1 {
+		t.Errorf("unexpected agent %+v", a)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, s := range []string{
+		"tunnels: []",
+		"tunnels: [{role: agent, tunnel-listen: ws://:8080/stream}]",
+		"tunnels: [{name: a, role: server, tunnel-listen: ws://:8080/stream}]",
+		"tunnels: [{name: a, role: agent}]",
+		"tunnels: [{name: a, role: proxy, tunnel-listen: ws://:8080/stream, listen: :1080}]",
+		"tunnels: [{name: a, role: proxy, tunnel-listen: ws://:8080/stream}]",
+		"tunnels: [{name: a, role: agent, tunnel-listen: ws://:8080/stream}, {name: a, role: agent, tunnel-listen: ws://:8081/stream}]",
+		"tunnels: [{name: a, role: proxy, tunnel-listen: ws://:8080/stream, mapping: [':2222']}]",
+		"tunnels: [{name: a, role: proxy, tunnel-listen: ws://:8080/stream, mapping: [':2222=h:22'], conn-limit: fast}]",
+		"tunnels: [{name: a, role: agent, tunnel-listen: ws://:8080/stream, allow: ['10.0.0.0/8:x']}]",
+		"tunnels: [{name: a, role: agent, tunnel-listen: ws://:8080/stream, ip-version: 5}]",
+	} {
+		if _, err := Load(writeFile(t, "tnet.yaml", s)); err == nil {
+			t.Errorf("%s is valid", s)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := &Config{Tunnels: []Tunnel{
+		{Name: "a", Role: RoleAgent, TunnelListen: "ws://:8080/stream"},
+		{Name: "b", Role: RoleAgent, TunnelListen: "ws://:8081/stream"},
+		{Name: "c", Role: RoleAgent, TunnelListen: "ws://:8082/stream"},
+	}}
+	new := &Config{Tunnels: []Tunnel{
+		{Name: "a", Role: RoleAgent, TunnelListen: "ws://:8080/stream"},
+		{Name: "b", Role: RoleAgent, TunnelListen: "ws://:8081/stream", Allow: []string{"*"}},
+		{Name: "d", Role: RoleAgent, TunnelListen: "ws://:8083/stream"},
+	}}
+	added, removed, changed := Diff(old, new)
+	if len(added) != 1 || added[0].Name != "d" {
+		t.Errorf("unexpected added %v", added)
+	}
+	if len(removed) != 1 || removed[0].Name != "c" {
+		t.Errorf("unexpected removed %v", removed)
+	}
+	if len(changed) != 1 || changed[0].Name != "b" {
+		t.Errorf("unexpected changed %v", changed)
+	}
+
+	b := new.Tunnels[1]
+	b.Listen, b.Connect, b.Mappings = ":2222", "10.0.0.5:22", []string{":8080=10.0.0.6:80"}
+	if !b.EqualExceptMappings(&new.Tunnels[1]) || b.Equal(&new.Tunnels[1]) {
+		t.Error("mappings are compared")
+	}
+	b.CryptKey = 1
+	if b.EqualExceptMappings(&new.Tunnels[1]) {
+		t.Error("crypt key is not compared")
+	}
+
+	added, _, _ = Diff(nil, new)
+	if len(added) != 3 {
+		t.Errorf("unexpected added %v", added)
+	}
+}
+
+func TestDecodeTunnel(t *testing.T) {
+	var raw map[string]any
+	json.Unmarshal([]byte(`{"role":"proxy","tunnel-connect":"ws://127.0.0.1:8080/stream","mapping":[":2222=10.0.0.5:22"],"dial-timeout":"3s"}`), &raw)
+	p, err := DecodeTunnel(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Timeout != 3*time.Second || len(p.Mappings) != 1 || p.CryptKey != xor.DefaultSeed {
+		t.Errorf("unexpected proxy %+v", p)
+	}
+
+	// encoded tunnel decodes to itself
+	data, err := json.Marshal(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw = nil
+	json.Unmarshal(data, &raw)
+	if d, err := DecodeTunnel(raw); err != nil || !d.Equal(&p) {
+		t.Errorf("round trip %s: %+v %v", data, d, err)
+	}
+
+	if _, err := DecodeTunnel(map[string]any{"role": "agent", "tunel-listen": "ws://:8080/stream"}); err == nil {
+		t.Error("unknown key is decoded")
+	}
+}
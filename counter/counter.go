@@ -1,5 +1,10 @@
 package counter
 
+import (
+	"fmt"
+	"math"
+)
+
 // Counter is a cumulative metric
 type Counter interface {
 	Value() int64
@@ -7,3 +12,18 @@ type Counter interface {
 
 	Add(bytes int64)
 }
+
+var units = []string{"B", "KB", "MB", "GB", "TB", "PB", "EB", "ZB", "YB"}
+var log1024 = math.Log(1024.0)
+
+// HumanReadable formats bytes in binary units
+func HumanReadable(bytes uint64) string {
+	base := 1024.0
+	f := float64(bytes)
+	if f < base {
+		return fmt.Sprintf("%d %s", bytes, units[0])
+	}
+	exp := int(math.Log(f) / log1024)
+	roundedSize := int64(f / math.Pow(base, float64(exp)))
+	return fmt.Sprintf("%d %s", roundedSize, units[exp])
+}
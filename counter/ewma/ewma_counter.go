@@ -0,0 +1,70 @@
+package ewma
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tutils/tnet/counter"
+)
+
+// DefaultWindow is the default time constant of rate
+const DefaultWindow = 5 * time.Second
+
+var _ counter.Counter = &ewmaCounter{}
+
+// ewmaCounter estimates rate by exponentially weighted moving average,
+// each added amount contributes to rate with weight decaying by exp(-age/window),
+// so the rate follows bursts smoothly and decays to 0 when idle
+type ewmaCounter struct {
+	value  int64
+	window float64 // seconds
+
+	mut  sync.Mutex
+	rate float64 // per second at last
+	last time.Time
+}
+
+// NewEWMACounter creates counter whose rate is averaged over window
+func NewEWMACounter(window time.Duration) counter.Counter {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &ewmaCounter{
+		window: window.Seconds(),
+		last:   time.Now(),
+	}
+}
+
+// Value implements Counter.
+func (c *ewmaCounter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// IncreaceRatePerSec implements Counter.
+func (c *ewmaCounter) IncreaceRatePerSec() int64 {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return int64(c.decay(time.Now()))
+}
+
+// Add implements Counter.
+func (c *ewmaCounter) Add(bytes int64) {
+	atomic.AddInt64(&c.value, bytes)
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	now := time.Now()
+	c.rate = c.decay(now) + float64(bytes)/c.window
+	c.last = now
+}
+
+// decay returns rate at now
+func (c *ewmaCounter) decay(now time.Time) float64 {
+	elapsed := now.Sub(c.last).Seconds()
+	if elapsed <= 0 {
+		return c.rate
+	}
+	return c.rate * math.Exp(-elapsed/c.window)
+}
@@ -0,0 +1,34 @@
+package ewma
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEWMACounter(t *testing.T) {
+	c := NewEWMACounter(time.Second).(*ewmaCounter)
+	start := time.Now()
+	c.last = start
+
+	// 1000 bytes/s for 10 seconds converges to 1000/s
+	for i := 1; i <= 100; i++ {
+		c.mut.Lock()
+		now := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		c.rate = c.decay(now) + 100/c.window
+		c.last = now
+		c.mut.Unlock()
+	}
+	if r := c.decay(c.last); r < 900 || r > 1100 {
+		t.Errorf("unexpected rate %v", r)
+	}
+
+	// decays when idle
+	if r := c.decay(c.last.Add(5 * time.Second)); r > 10 {
+		t.Errorf("rate %v does not decay", r)
+	}
+
+	c.Add(10)
+	if v := c.Value(); v != 10 {
+		t.Errorf("unexpected value %d", v)
+	}
+}
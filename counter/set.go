@@ -0,0 +1,289 @@
+package counter
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewFunc creates a counter
+type NewFunc func() Counter
+
+// Traffic is upload and download counters of a labelled connection or group of connections,
+// upload is from client to target, download is from target to client
+type Traffic struct {
+	Labels   []string
+	Upload   Counter
+	Download Counter
+	Opened   time.Time
+
+	mu     sync.Mutex
+	closed time.Time
+	refs   int
+}
+
+// Bytes returns bytes of upload and download, 0 if t is nil
+func (t *Traffic) Bytes() (upload int64, download int64) {
+	if t == nil {
+		return 0, 0
+	}
+	return t.Upload.Value(), t.Download.Value()
+}
+
+// Closed returns the time when the last connection of traffic was closed, zero if any is open
+func (t *Traffic) Closed() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// Active returns number of open connections of traffic
+func (t *Traffic) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.refs
+}
+
+// String returns summary of traffic
+func (t *Traffic) String() string {
+	s := fmt.Sprintf("upload %s (%s/s), download %s (%s/s), opened %s",
+		HumanReadable(uint64(t.Upload.Value())), HumanReadable(uint64(t.Upload.IncreaceRatePerSec())),
+		HumanReadable(uint64(t.Download.Value())), HumanReadable(uint64(t.Download.IncreaceRatePerSec())),
+		t.Opened.Format(time.RFC3339))
+	if closed := t.Closed(); !closed.IsZero() {
+		s += fmt.Sprintf(", duration %v", closed.Sub(t.Opened).Round(time.Millisecond))
+	}
+	return s
+}
+
+// LogValue implements slog.LogValuer, byte counts and rates are logged as numbers
+func (t *Traffic) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Int64("upload", t.Upload.Value()),
+		slog.Int64("uploadRate", t.Upload.IncreaceRatePerSec()),
+		slog.Int64("download", t.Download.Value()),
+		slog.Int64("downloadRate", t.Download.IncreaceRatePerSec()),
+		slog.Time("opened", t.Opened),
+	}
+	if closed := t.Closed(); !closed.IsZero() {
+		attrs = append(attrs, slog.Duration("duration", closed.Sub(t.Opened).Round(time.Millisecond)))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Set is traffic partitioned by labels, it is safe for concurrent use
+type Set struct {
+	newCounter NewFunc
+	maxClosed  int
+
+	mu     sync.Mutex
+	active map[string]*Traffic
+	closed []*Traffic // recently closed, oldest first
+}
+
+// NewSet creates set of traffic whose counters are created by newCounter,
+// at most maxClosed closed traffic are kept
+func NewSet(newCounter NewFunc, maxClosed int) *Set {
+	return &Set{
+		newCounter: newCounter,
+		maxClosed:  maxClosed,
+		active:     make(map[string]*Traffic),
+	}
+}
+
+// Open returns traffic of labels and counts an open connection of it,
+// traffic is created when its first connection is opened
+func (s *Set) Open(labels ...string) *Traffic {
+	key := strings.Join(labels, "\xff")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.active[key]
+	if !ok {
+		t = &Traffic{
+			Labels:   labels,
+			Upload:   s.newCounter(),
+			Download: s.newCounter(),
+			Opened:   time.Now(),
+		}
+		s.active[key] = t
+	}
+	t.mu.Lock()
+	t.refs++
+	t.closed = time.Time{}
+	t.mu.Unlock()
+	return t
+}
+
+// Close counts a closed connection of t, t is moved to closed traffic when all its connections are closed
+func (s *Set) Close(t *Traffic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.mu.Lock()
+	t.refs--
+	last := t.refs == 0
+	if last {
+		t.closed = time.Now()
+	}
+	t.mu.Unlock()
+	if !last {
+		return
+	}
+
+	key := strings.Join(t.Labels, "\xff")
+	if s.active[key] == t {
+		delete(s.active, key)
+	}
+	if s.maxClosed > 0 {
+		if len(s.closed) >= s.maxClosed {
+			s.closed = append(s.closed[:0], s.closed[len(s.closed)-s.maxClosed+1:]...)
+		}
+		s.closed = append(s.closed, t)
+	}
+}
+
+// Active returns traffic with open connections ordered by labels
+func (s *Set) Active() []*Traffic {
+	s.mu.Lock()
+	list := make([]*Traffic, 0, len(s.active))
+	for _, t := range s.active {
+		list = append(list, t)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return lessLabels(list[i].Labels, list[j].Labels)
+	})
+	return list
+}
+
+// Closed returns recently closed traffic, oldest first
+func (s *Set) Closed() []*Traffic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Traffic(nil), s.closed...)
+}
+
+// lessLabels compares labels, numeric labels are compared by value
+func lessLabels(a []string, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		x, err1 := strconv.ParseInt(a[i], 10, 64)
+		y, err2 := strconv.ParseInt(b[i], 10, 64)
+		if err1 == nil && err2 == nil {
+			return x < y
+		}
+		return a[i] < b[i]
+	}
+	return len(a) < len(b)
+}
+
+// Accounting is traffic of tcp connections in total, per tunnel, per connection and per forward target.
+// It is the only place bytes of connections are counted, metrics, admin api and access log read traffic of it.
+type Accounting struct {
+	Total   *Traffic // all connections, never closed
+	Tunnels *Set     // labels: tunID
+	Conns   *Set     // labels: tunID, connID
+	Targets *Set     // labels: target
+}
+
+// DefaultMaxClosed is the number of closed connections kept by accounting
+const DefaultMaxClosed = 100
+
+// NewAccounting creates accounting whose counters are created by newCounter
+func NewAccounting(newCounter NewFunc) *Accounting {
+	return &Accounting{
+		Total: &Traffic{
+			Upload:   newCounter(),
+			Download: newCounter(),
+			Opened:   time.Now(),
+		},
+		Tunnels: NewSet(newCounter, DefaultMaxClosed),
+		Conns:   NewSet(newCounter, DefaultMaxClosed),
+		Targets: NewSet(newCounter, DefaultMaxClosed),
+	}
+}
+
+// OpenTunnel returns traffic of tunnel tunID, which is kept active until CloseTunnel,
+// it returns nil if a is nil
+func (a *Accounting) OpenTunnel(tunID int64) *Traffic {
+	if a == nil {
+		return nil
+	}
+	return a.Tunnels.Open(strconv.FormatInt(tunID, 10))
+}
+
+// CloseTunnel closes traffic of tunnel returned by OpenTunnel
+func (a *Accounting) CloseTunnel(t *Traffic) {
+	if a == nil || t == nil {
+		return
+	}
+	a.Tunnels.Close(t)
+}
+
+// Conn counts traffic of a connection into total, its tunnel, connection and target traffic
+type Conn struct {
+	a      *Accounting
+	tunnel *Traffic
+	conn   *Traffic
+	target *Traffic
+}
+
+// Open counts an opened connection, it returns nil Conn if a is nil,
+// all methods of nil Conn do nothing
+func (a *Accounting) Open(tunID int64, connID int64, target string) *Conn {
+	if a == nil {
+		return nil
+	}
+	tun := strconv.FormatInt(tunID, 10)
+	return &Conn{
+		a:      a,
+		tunnel: a.Tunnels.Open(tun),
+		conn:   a.Conns.Open(tun, strconv.FormatInt(connID, 10)),
+		target: a.Targets.Open(target),
+	}
+}
+
+// Upload counts bytes from client to target
+func (c *Conn) Upload(bytes int64) {
+	if c == nil {
+		return
+	}
+	c.a.Total.Upload.Add(bytes)
+	c.tunnel.Upload.Add(bytes)
+	c.conn.Upload.Add(bytes)
+	c.target.Upload.Add(bytes)
+}
+
+// Download counts bytes from target to client
+func (c *Conn) Download(bytes int64) {
+	if c == nil {
+		return
+	}
+	c.a.Total.Download.Add(bytes)
+	c.tunnel.Download.Add(bytes)
+	c.conn.Download.Add(bytes)
+	c.target.Download.Add(bytes)
+}
+
+// Traffic returns traffic of the connection, nil if c is nil
+func (c *Conn) Traffic() *Traffic {
+	if c == nil {
+		return nil
+	}
+	return c.conn
+}
+
+// Close counts the closed connection
+func (c *Conn) Close() {
+	if c == nil {
+		return
+	}
+	c.a.Tunnels.Close(c.tunnel)
+	c.a.Conns.Close(c.conn)
+	c.a.Targets.Close(c.target)
+}
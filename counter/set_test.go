@@ -0,0 +1,106 @@
+package counter
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+type testCounter struct {
+	value int64
+}
+
+func (c *testCounter) Value() int64              { return atomic.LoadInt64(&c.value) }
+func (c *testCounter) IncreaceRatePerSec() int64 { return 0 }
+func (c *testCounter) Add(bytes int64)           { atomic.AddInt64(&c.value, bytes) }
+
+func newTestCounter() Counter {
+	return &testCounter{}
+}
+
+func TestAccounting(t *testing.T) {
+	a := NewAccounting(newTestCounter)
+	c1 := a.Open(1, 1, "127.0.0.1:80")
+	c2 := a.Open(1, 2, "127.0.0.1:80")
+	c3 := a.Open(2, 10, "127.0.0.1:22")
+	c1.Upload(100)
+	c1.Download(1000)
+	c2.Upload(10)
+	c3.Download(5)
+
+	targets := a.Targets.Active()
+	if len(targets) != 2 || targets[0].Labels[0] != "127.0.0.1:22" || targets[1].Labels[0] != "127.0.0.1:80" {
+		t.Fatalf("unexpected targets %v", targets)
+	}
+	if tr := targets[1]; tr.Upload.Value() != 110 || tr.Download.Value() != 1000 || tr.Active() != 2 {
+		t.Errorf("unexpected target traffic %v, %d active", tr, tr.Active())
+	}
+	conns := a.Conns.Active()
+	if len(conns) != 3 || conns[2].Labels[1] != "10" {
+		t.Fatalf("unexpected connections %v", conns)
+	}
+
+	c1.Close()
+	if n := len(a.Conns.Active()); n != 2 {
+		t.Errorf("got %d active connections, 2 expected", n)
+	}
+	closed := a.Conns.Closed()
+	if len(closed) != 1 || closed[0] != c1.Traffic() || closed[0].Closed().IsZero() {
+		t.Errorf("unexpected closed connections %v", closed)
+	}
+	if n := len(a.Targets.Closed()); n != 0 {
+		t.Errorf("target with open connection is closed")
+	}
+
+	c2.Close()
+	c3.Close()
+	if n := len(a.Targets.Active()); n != 0 {
+		t.Errorf("got %d active targets, 0 expected", n)
+	}
+	if n := len(a.Tunnels.Closed()); n != 2 {
+		t.Errorf("got %d closed tunnels, 2 expected", n)
+	}
+
+	if up, down := a.Total.Bytes(); up != 110 || down != 1005 {
+		t.Errorf("total traffic is %d/%d, 110/1005 expected", up, down)
+	}
+
+	var nilAccounting *Accounting
+	c := nilAccounting.Open(1, 1, "")
+	c.Upload(1)
+	c.Close()
+	if up, down := c.Traffic().Bytes(); up != 0 || down != 0 {
+		t.Errorf("nil traffic has bytes")
+	}
+}
+
+func TestAccountingTunnel(t *testing.T) {
+	a := NewAccounting(newTestCounter)
+	tun := a.OpenTunnel(1)
+	c := a.Open(1, 1, "127.0.0.1:80")
+	c.Upload(3)
+	c.Close()
+	c = a.Open(1, 2, "127.0.0.1:80")
+	c.Download(4)
+	c.Close()
+	if tun.Active() != 1 || len(a.Tunnels.Closed()) != 0 {
+		t.Fatal("tunnel is closed with its last connection")
+	}
+	if up, down := tun.Bytes(); up != 3 || down != 4 {
+		t.Errorf("tunnel traffic is %d/%d, 3/4 expected", up, down)
+	}
+	a.CloseTunnel(tun)
+	if closed := a.Tunnels.Closed(); len(closed) != 1 || closed[0] != tun {
+		t.Errorf("unexpected closed tunnels %v", closed)
+	}
+}
+
+func TestSetMaxClosed(t *testing.T) {
+	s := NewSet(newTestCounter, 2)
+	for _, l := range []string{"a", "b", "c"} {
+		s.Close(s.Open(l))
+	}
+	closed := s.Closed()
+	if len(closed) != 2 || closed[0].Labels[0] != "b" || closed[1].Labels[0] != "c" {
+		t.Errorf("unexpected closed %v", closed)
+	}
+}
@@ -29,6 +29,9 @@ func (c *xorCrypt) NewDecoder(r io.Reader, opts ...crypt.DecoderOption) io.Reade
 	}
 }
 
+// DefaultSeed is the seed used by tnet commands if --crypt-key is not given
+const DefaultSeed = 98545715754651
+
 // NewCrypt create a new Crypt
 func NewCrypt(seed int64) crypt.Crypt {
 	return &xorCrypt{
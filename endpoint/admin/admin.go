@@ -0,0 +1,306 @@
+// Package admin keeps track of live tunnels and tcp connections of proxy or agent,
+// and serves them on a local http api which can list and close them
+package admin
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tutils/tnet/counter"
+)
+
+// ErrNotFound means the tunnel or connection is not open
+var ErrNotFound = errors.New("not found")
+
+// Registry is live tunnels and their tcp connections, it is safe for concurrent use,
+// all methods of nil Registry, Tunnel and Conn do nothing
+type Registry struct {
+	role string
+
+	mu       sync.Mutex
+	tunnels  map[int64]*Tunnel
+	mappings Mappings
+}
+
+// Mappings is forwarding mappings of proxy in form LISTEN=CONNECT, which can be replaced by admin api
+type Mappings interface {
+	Mappings() []string
+	SetMappings(mappings []string) error
+}
+
+// ErrNoMappings means mappings are not set, e.g. of agent
+var ErrNoMappings = errors.New("no reloadable mappings")
+
+// SetMappings sets mappings served by admin api
+func (r *Registry) SetMappings(m Mappings) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mappings = m
+}
+
+func (r *Registry) getMappings() (Mappings, error) {
+	if r == nil {
+		return nil, ErrNoMappings
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mappings == nil {
+		return nil, ErrNoMappings
+	}
+	return r.mappings, nil
+}
+
+// NewRegistry creates registry of proxy or agent named by role
+func NewRegistry(role string) *Registry {
+	return &Registry{
+		role:    role,
+		tunnels: make(map[int64]*Tunnel),
+	}
+}
+
+// Tunnel is an entry of established tunnel
+type Tunnel struct {
+	r      *Registry
+	id     int64
+	peer   string
+	opened time.Time
+	cancel func()
+
+	traffic *counter.Traffic // traffic of connections of tunnel in accounting
+
+	mu    sync.Mutex
+	conns map[int64]*Conn
+}
+
+// NewTunnel creates entry of tunnel connected to peer, cancel is called to close it,
+// the entry is listed after Open
+func (r *Registry) NewTunnel(peer string, cancel func()) *Tunnel {
+	if r == nil {
+		return nil
+	}
+	return &Tunnel{
+		r:      r,
+		peer:   peer,
+		opened: time.Now(),
+		cancel: cancel,
+		conns:  make(map[int64]*Conn),
+	}
+}
+
+// Open lists tunnel by id synchronized with peer, bytes of tunnel are read from traffic
+func (t *Tunnel) Open(id int64, traffic *counter.Traffic) {
+	if t == nil {
+		return
+	}
+	t.id = id
+	t.traffic = traffic
+	t.r.mu.Lock()
+	t.r.tunnels[id] = t
+	t.r.mu.Unlock()
+}
+
+// Close removes tunnel from list
+func (t *Tunnel) Close() {
+	if t == nil {
+		return
+	}
+	t.r.mu.Lock()
+	if t.r.tunnels[t.id] == t {
+		delete(t.r.tunnels, t.id)
+	}
+	t.r.mu.Unlock()
+}
+
+// Conn is an entry of tcp connection forwarded through tunnel
+type Conn struct {
+	t      *Tunnel
+	id     int64
+	source string
+	target string
+	opened time.Time
+	cancel func()
+
+	traffic *counter.Traffic // traffic of connection in accounting
+}
+
+// OpenConn lists connection from source to target, bytes of connection are read from traffic,
+// cancel is called to close it
+func (t *Tunnel) OpenConn(id int64, source string, target string, traffic *counter.Traffic, cancel func()) *Conn {
+	if t == nil {
+		return nil
+	}
+	c := &Conn{
+		t:       t,
+		id:      id,
+		source:  source,
+		target:  target,
+		opened:  time.Now(),
+		cancel:  cancel,
+		traffic: traffic,
+	}
+	t.mu.Lock()
+	t.conns[id] = c
+	t.mu.Unlock()
+	return c
+}
+
+// Close removes connection from list
+func (c *Conn) Close() {
+	if c == nil {
+		return
+	}
+	c.t.mu.Lock()
+	if c.t.conns[c.id] == c {
+		delete(c.t.conns, c.id)
+	}
+	c.t.mu.Unlock()
+}
+
+// TunnelInfo is state of a tunnel
+type TunnelInfo struct {
+	ID       int64     `json:"id"`
+	Role     string    `json:"role"`
+	Peer     string    `json:"peer"`
+	Opened   time.Time `json:"opened"`
+	Uptime   float64   `json:"uptime"`   // seconds
+	Upload   int64     `json:"upload"`   // bytes from clients to targets of connections
+	Download int64     `json:"download"` // bytes from targets to clients of connections
+	Conns    int       `json:"conns"`
+}
+
+// ConnInfo is state of a tcp connection
+type ConnInfo struct {
+	TunnelID int64     `json:"tunnelId"`
+	ID       int64     `json:"id"`
+	Source   string    `json:"source"`
+	Target   string    `json:"target"`
+	Opened   time.Time `json:"opened"`
+	Uptime   float64   `json:"uptime"` // seconds
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+}
+
+// list returns tunnels ordered by id
+func (r *Registry) list() []*Tunnel {
+	r.mu.Lock()
+	list := make([]*Tunnel, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		list = append(list, t)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].id < list[j].id
+	})
+	return list
+}
+
+// Tunnels returns state of open tunnels ordered by id
+func (r *Registry) Tunnels() []TunnelInfo {
+	if r == nil {
+		return nil
+	}
+	now := time.Now()
+	infos := []TunnelInfo{}
+	for _, t := range r.list() {
+		t.mu.Lock()
+		conns := len(t.conns)
+		t.mu.Unlock()
+		upload, download := t.traffic.Bytes()
+		infos = append(infos, TunnelInfo{
+			ID:       t.id,
+			Role:     r.role,
+			Peer:     t.peer,
+			Opened:   t.opened,
+			Uptime:   now.Sub(t.opened).Seconds(),
+			Upload:   upload,
+			Download: download,
+			Conns:    conns,
+		})
+	}
+	return infos
+}
+
+// Conns returns state of open connections of tunnel tunID, or of all tunnels if tunID is 0,
+// ordered by tunnel id and connection id
+func (r *Registry) Conns(tunID int64) ([]ConnInfo, error) {
+	if r == nil {
+		return nil, ErrNotFound
+	}
+	var tunnels []*Tunnel
+	if tunID == 0 {
+		tunnels = r.list()
+	} else if t := r.tunnel(tunID); t != nil {
+		tunnels = []*Tunnel{t}
+	} else {
+		return nil, ErrNotFound
+	}
+
+	now := time.Now()
+	infos := []ConnInfo{}
+	for _, t := range tunnels {
+		start := len(infos)
+		t.mu.Lock()
+		for _, c := range t.conns {
+			upload, download := c.traffic.Bytes()
+			infos = append(infos, ConnInfo{
+				TunnelID: t.id,
+				ID:       c.id,
+				Source:   c.source,
+				Target:   c.target,
+				Opened:   c.opened,
+				Uptime:   now.Sub(c.opened).Seconds(),
+				Upload:   upload,
+				Download: download,
+			})
+		}
+		t.mu.Unlock()
+		conns := infos[start:]
+		sort.Slice(conns, func(i, j int) bool {
+			return conns[i].ID < conns[j].ID
+		})
+	}
+	return infos, nil
+}
+
+func (r *Registry) tunnel(id int64) *Tunnel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tunnels[id]
+}
+
+// CloseTunnel closes tunnel id with all its connections and sessions
+func (r *Registry) CloseTunnel(id int64) error {
+	if r == nil {
+		return ErrNotFound
+	}
+	t := r.tunnel(id)
+	if t == nil {
+		return ErrNotFound
+	}
+	t.cancel()
+	return nil
+}
+
+// CloseConn closes connection connID of tunnel tunID
+func (r *Registry) CloseConn(tunID int64, connID int64) error {
+	if r == nil {
+		return ErrNotFound
+	}
+	t := r.tunnel(tunID)
+	if t == nil {
+		return ErrNotFound
+	}
+	t.mu.Lock()
+	c := t.conns[connID]
+	t.mu.Unlock()
+	if c == nil {
+		return ErrNotFound
+	}
+	c.cancel()
+	return nil
+}
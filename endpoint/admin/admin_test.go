@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/counter/ewma"
+)
+
+func TestRegistry(t *testing.T) {
+	a := counter.NewAccounting(func() counter.Counter { return ewma.NewEWMACounter(ewma.DefaultWindow) })
+	r := NewRegistry("proxy")
+	tunClosed := false
+	tun := r.NewTunnel("1.2.3.4:5", func() { tunClosed = true })
+	if len(r.Tunnels()) != 0 {
+		t.Fatal("tunnel is listed before open")
+	}
+	tun.Open(7, a.OpenTunnel(7))
+
+	connClosed := false
+	acct1, acct2 := a.Open(7, 1, "127.0.0.1:80"), a.Open(7, 2, "127.0.0.1:80")
+	c := tun.OpenConn(2, "127.0.0.1:1000", "127.0.0.1:80", acct2.Traffic(), func() { connClosed = true })
+	tun.OpenConn(1, "127.0.0.1:1001", "127.0.0.1:80", acct1.Traffic(), func() {})
+	acct2.Upload(3)
+	acct2.Download(4)
+	acct1.Upload(2)
+
+	srv := httptest.NewServer(r.Handler())
+	defer srv.Close()
+	cli := NewClient(strings.TrimPrefix(srv.URL, "http://"))
+
+	tunnels, err := cli.Tunnels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 1 || tunnels[0].ID != 7 || tunnels[0].Role != "proxy" || tunnels[0].Peer != "1.2.3.4:5" ||
+		tunnels[0].Upload != 5 || tunnels[0].Download != 4 || tunnels[0].Conns != 2 {
+		t.Errorf("unexpected tunnels %+v", tunnels)
+	}
+
+	conns, err := cli.Conns(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 2 || conns[0].ID != 1 || conns[1].ID != 2 || conns[1].Upload != 3 || conns[1].Download != 4 {
+		t.Errorf("unexpected conns %+v", conns)
+	}
+	if _, err := cli.Conns(8); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected err %v", err)
+	}
+
+	if err := cli.CloseConn(7, 2); err != nil || !connClosed {
+		t.Errorf("conn is not closed, %v", err)
+	}
+	if err := cli.CloseConn(7, 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected err %v", err)
+	}
+	if err := cli.CloseTunnel(7); err != nil || !tunClosed {
+		t.Errorf("tunnel is not closed, %v", err)
+	}
+
+	c.Close()
+	tun.Close()
+	if tunnels, _ := cli.Tunnels(); len(tunnels) != 0 {
+		t.Errorf("tunnel is listed after close")
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var r *Registry
+	tun := r.NewTunnel("", nil)
+	tun.Open(1, nil)
+	c := tun.OpenConn(1, "", "", nil, nil)
+	c.Close()
+	tun.Close()
+	if err := r.CloseTunnel(1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected err %v", err)
+	}
+}
+
+type testMappings struct {
+	list []string
+}
+
+func (m *testMappings) Mappings() []string {
+	return m.list
+}
+
+func (m *testMappings) SetMappings(list []string) error {
+	for _, s := range list {
+		if !strings.Contains(s, "=") {
+			return errors.New("invalid mapping")
+		}
+	}
+	m.list = list
+	return nil
+}
+
+func TestMappings(t *testing.T) {
+	r := NewRegistry("proxy")
+	srv := httptest.NewServer(r.Handler())
+	defer srv.Close()
+	cli := NewClient(strings.TrimPrefix(srv.URL, "http://"))
+
+	if _, err := cli.Mappings(); err == nil {
+		t.Error("mappings are listed without being set")
+	}
+
+	m := &testMappings{list: []string{":1080=127.0.0.1:3128"}}
+	r.SetMappings(m)
+	list, err := cli.Mappings()
+	if err != nil || len(list) != 1 || list[0] != ":1080=127.0.0.1:3128" {
+		t.Errorf("unexpected mappings %v, %v", list, err)
+	}
+	list, err = cli.SetMappings([]string{":1080=127.0.0.1:3128", ":2222=10.0.0.1:22"})
+	if err != nil || len(list) != 2 || m.list[1] != ":2222=10.0.0.1:22" {
+		t.Errorf("unexpected mappings %v, %v", list, err)
+	}
+	if _, err := cli.SetMappings([]string{"invalid"}); err == nil || len(m.list) != 2 {
+		t.Errorf("invalid mapping is set, %v", err)
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	srv := httptest.NewServer(NewRegistry("agent").Handler())
+	defer srv.Close()
+
+	for _, c := range []struct {
+		header map[string]string
+		host   string
+		code   int
+	}{
+		{nil, "", http.StatusOK},
+		{nil, "localhost", http.StatusOK},
+		{map[string]string{"Origin": "https://evil.example"}, "", http.StatusForbidden},
+		{map[string]string{"Origin": srv.URL}, "", http.StatusForbidden},
+		{map[string]string{"Sec-Fetch-Site": "cross-site"}, "", http.StatusForbidden},
+		{nil, "evil.example", http.StatusForbidden}, // dns rebinding
+	} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/tunnels/close?id=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		if c.host != "" {
+			req.Host = c.host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// tunnel 1 doesn't exist
+		if code := resp.StatusCode; c.code == http.StatusOK && code != http.StatusNotFound || c.code != http.StatusOK && code != c.code {
+			t.Errorf("post with %v to %q: %s", c.header, c.host, resp.Status)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0", "[::]:0", "example.com:0"} {
+		if ln, err := Listen(addr); err == nil {
+			ln.Close()
+			t.Errorf("Listen(%s) succeeds", addr)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1:0", "localhost:0"} {
+		ln, err := Listen(addr)
+		if err != nil {
+			t.Errorf("Listen(%s): %v", addr, err)
+			continue
+		}
+		ln.Close()
+	}
+}
@@ -0,0 +1,297 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response is response of admin api
+type Response struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Handler returns http handler of admin api:
+//
+//	GET  /api/tunnels                       list tunnels
+//	GET  /api/conns?tunnel=ID               list connections of tunnel ID, or of all tunnels without tunnel
+//	POST /api/tunnels/close?id=ID           close tunnel ID
+//	POST /api/conns/close?tunnel=ID&id=CID  close connection CID of tunnel ID
+//	GET  /api/mappings                      list forwarding mappings of proxy
+//	POST /api/mappings?mapping=L=C...       replace forwarding mappings of proxy, no mapping removes all
+//
+// Api has no authentication, it is only served to local clients other than browsers, see localOnly.
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tunnels", func(w http.ResponseWriter, req *http.Request) {
+		writeResponse(w, r.Tunnels(), nil)
+	})
+	mux.HandleFunc("/api/conns", func(w http.ResponseWriter, req *http.Request) {
+		tunID, err := queryID(req, "tunnel", false)
+		if err != nil {
+			writeResponse(w, nil, err)
+			return
+		}
+		conns, err := r.Conns(tunID)
+		writeResponse(w, conns, err)
+	})
+	mux.HandleFunc("/api/tunnels/close", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := queryID(req, "id", true)
+		if err == nil {
+			err = r.CloseTunnel(id)
+		}
+		writeResponse(w, nil, err)
+	})
+	mux.HandleFunc("/api/conns/close", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tunID, err := queryID(req, "tunnel", true)
+		if err != nil {
+			writeResponse(w, nil, err)
+			return
+		}
+		id, err := queryID(req, "id", true)
+		if err == nil {
+			err = r.CloseConn(tunID, id)
+		}
+		writeResponse(w, nil, err)
+	})
+	mux.HandleFunc("/api/mappings", func(w http.ResponseWriter, req *http.Request) {
+		m, err := r.getMappings()
+		if err != nil {
+			writeResponse(w, nil, err)
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			writeResponse(w, m.Mappings(), nil)
+		case http.MethodPost:
+			if err := m.SetMappings(req.URL.Query()["mapping"]); err != nil {
+				writeResponse(w, nil, err)
+				return
+			}
+			writeResponse(w, m.Mappings(), nil)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return localOnly(mux)
+}
+
+// localOnly rejects requests of browsers, which are sent with Origin or Sec-Fetch-Site header,
+// so that pages of any site can't close tunnels or replace mappings. Host must be local,
+// otherwise pages may reach the api by dns rebinding.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Origin") != "" || req.Header.Get("Sec-Fetch-Site") != "" {
+			writeError(w, http.StatusForbidden, errors.New("requests of browsers are not allowed"))
+			return
+		}
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host != unixHost && !isLoopbackHost(strings.Trim(host, "[]")) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %s is not allowed", req.Host))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// isLoopbackHost tells whether host name or ip is local
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// queryID parses id in query parameter name, 0 if it is missing and not required
+func queryID(req *http.Request, name string, required bool) (int64, error) {
+	s := req.URL.Query().Get(name)
+	if s == "" {
+		if required {
+			return 0, fmt.Errorf("missing %s", name)
+		}
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return id, nil
+}
+
+func writeResponse(w http.ResponseWriter, data any, err error) {
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, ErrNotFound) {
+			code = http.StatusNotFound
+		}
+		writeError(w, code, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	resp := Response{Success: true}
+	if data != nil {
+		resp.Data, _ = json.Marshal(data)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(Response{Error: err.Error()})
+}
+
+const (
+	// unixPrefix is prefix of unix socket path in admin address
+	unixPrefix = "unix:"
+	// unixHost is host of requests to unix socket
+	unixHost = "unix"
+)
+
+// Listen listens on admin address, which is a unix socket path prefixed with unix:, or tcp host:port
+// of a loopback address, since anyone who can reach the api can close tunnels and replace mappings.
+// Stale unix socket file is removed.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !isLoopbackHost(strings.Trim(host, "[]")) {
+		return nil, fmt.Errorf("admin address %s is not local, use a loopback address or unix:path", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Client calls admin api of a running proxy or agent
+type Client struct {
+	hc   *http.Client
+	base string
+}
+
+// NewClient creates client of admin address accepted by Listen
+func NewClient(addr string) *Client {
+	tr := &http.Transport{}
+	base := "http://" + addr
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		base = "http://" + unixHost
+	}
+	return &Client{
+		hc:   &http.Client{Transport: tr, Timeout: 10 * time.Second},
+		base: base,
+	}
+}
+
+func (c *Client) call(method string, path string, query url.Values, data any) error {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var r Response
+	if err := json.Unmarshal(body, &r); err != nil {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if !r.Success {
+		if resp.StatusCode == http.StatusNotFound {
+			return ErrNotFound
+		}
+		return errors.New(r.Error)
+	}
+	if data != nil && len(r.Data) > 0 {
+		return json.Unmarshal(r.Data, data)
+	}
+	return nil
+}
+
+// Tunnels lists open tunnels
+func (c *Client) Tunnels() ([]TunnelInfo, error) {
+	var tunnels []TunnelInfo
+	err := c.call(http.MethodGet, "/api/tunnels", nil, &tunnels)
+	return tunnels, err
+}
+
+// Conns lists open connections of tunnel tunID, or of all tunnels if tunID is 0
+func (c *Client) Conns(tunID int64) ([]ConnInfo, error) {
+	query := url.Values{}
+	if tunID != 0 {
+		query.Set("tunnel", strconv.FormatInt(tunID, 10))
+	}
+	var conns []ConnInfo
+	err := c.call(http.MethodGet, "/api/conns", query, &conns)
+	return conns, err
+}
+
+// CloseTunnel closes tunnel id
+func (c *Client) CloseTunnel(id int64) error {
+	query := url.Values{"id": {strconv.FormatInt(id, 10)}}
+	return c.call(http.MethodPost, "/api/tunnels/close", query, nil)
+}
+
+// CloseConn closes connection connID of tunnel tunID
+func (c *Client) CloseConn(tunID int64, connID int64) error {
+	query := url.Values{
+		"tunnel": {strconv.FormatInt(tunID, 10)},
+		"id":     {strconv.FormatInt(connID, 10)},
+	}
+	return c.call(http.MethodPost, "/api/conns/close", query, nil)
+}
+
+// Mappings lists forwarding mappings of proxy
+func (c *Client) Mappings() ([]string, error) {
+	var mappings []string
+	err := c.call(http.MethodGet, "/api/mappings", nil, &mappings)
+	return mappings, err
+}
+
+// SetMappings replaces forwarding mappings of proxy, returns mappings after replacement
+func (c *Client) SetMappings(mappings []string) ([]string, error) {
+	query := url.Values{"mapping": mappings}
+	var result []string
+	err := c.call(http.MethodPost, "/api/mappings", query, &result)
+	return result, err
+}
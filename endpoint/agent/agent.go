@@ -4,10 +4,14 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"sync"
 
 	"github.com/tutils/tnet"
+	"github.com/tutils/tnet/endpoint/admin"
 	"github.com/tutils/tnet/endpoint/common"
+	"github.com/tutils/tnet/ratelimit"
+	"github.com/tutils/tnet/tcp"
 	"github.com/tutils/tnet/tun"
 )
 
@@ -19,6 +23,7 @@ type Agent struct {
 // New create a new Endpoint
 func New(opts ...Option) *Agent {
 	opt := newOptions(opts...)
+	opt.metrics.CountTraffic(opt.accounting.Total)
 	return &Agent{
 		opts: *opt,
 	}
@@ -27,15 +32,15 @@ func New(opts ...Option) *Agent {
 // Serve starts agent
 func (a *Agent) Serve(ctx context.Context) error {
 	if tunClient := a.opts.tunClient; tunClient != nil {
-		log.Println("start tun client (reverse mode)")
-		defer log.Println("tun client exit")
+		a.opts.logger.Info("start tunnel client (reverse mode)")
+		defer a.opts.logger.Info("tunnel client exit")
 		h := a.opts.tunHandlerNewer(a)
 		return tunClient.DialAndServe(ctx, h)
 	}
 
 	if tunServer := a.opts.tunServer; tunServer != nil {
-		log.Println("start tun server")
-		defer log.Println("tun server exit")
+		a.opts.logger.Info("start tunnel server")
+		defer a.opts.logger.Info("tunnel server exit")
 		h := a.opts.tunHandlerNewer(a)
 		return tunServer.ListenAndServe(ctx, h)
 	}
@@ -57,10 +62,15 @@ func NewTCPAgentTunHandler(a *Agent) tun.Handler {
 
 // ServeTun implements tun.Handler.
 func (h *agentTunHandler) ServeTun(ctx context.Context, r io.Reader, w io.Writer) {
-	log.Println("new tun connection")
-	defer log.Println("tun connection closed")
-
 	opts := &h.a.opts
+	logger := opts.logger
+	logger.Info("new tunnel connection", "peer", tun.PeerAddr(ctx))
+	defer logger.Info("tunnel connection closed", "peer", tun.PeerAddr(ctx))
+
+	// tunnel is closed by admin api when ctx is canceled
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	at := opts.admin.NewTunnel(tun.PeerAddr(ctx), cancel)
 
 	// new tun connection
 	var tunr io.Reader
@@ -80,30 +90,125 @@ func (h *agentTunHandler) ServeTun(ctx context.Context, r io.Reader, w io.Writer
 
 	// sync tunID
 	isServer := opts.tunServer != nil
-	tunID, err := common.SyncTunID(ctx, isServer, tunr, tunw)
+	tunID, err := common.SyncTunID(ctx, logger, isServer, tunr, tunw)
 	if err != nil {
 		return
 	}
-
-	// recv config: connect to
-	cmd, err := common.UnpackHeader(tunr)
-	if err != nil {
-		log.Println("unpackHeader err", err)
-		return
+	logger = logger.With("tunID", tunID)
+	opts.metrics.TunnelOpened(opts.tunServer == nil)
+	defer opts.metrics.TunnelClosed()
+	tunTraffic := opts.accounting.OpenTunnel(tunID)
+	defer opts.accounting.CloseTunnel(tunTraffic)
+	at.Open(tunID, tunTraffic)
+	defer at.Close()
+
+	t := &agentTun{
+		h:        h,
+		tunID:    tunID,
+		logger:   logger,
+		tunr:     tunr,
+		tunw:     tunw,
+		admin:    at,
+		peer:     tun.PeerAddr(ctx),
+		identity: tun.PeerIdentity(ctx),
 	}
+	defer t.close()
+
+	// serve returns when tunnel is broken, which happens after ServeTun returns if ctx is canceled
+	served := make(chan struct{})
+	go func() {
+		t.serve(ctx)
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-ctx.Done():
+	}
+}
+
+// agentTun is agent side of an established tunnel,
+// tcp connections and execute sessions are multiplexed on it
+type agentTun struct {
+	h        *agentTunHandler
+	tunID    int64
+	logger   *slog.Logger // with tunID
+	tunr     io.Reader
+	tunw     io.Writer // SyncWriter
+	admin    *admin.Tunnel
+	peer     string // remote address of tunnel
+	identity string // authenticated identity of tunnel peer
+
+	// tcp forwarding, connectAddr is set up by CmdConfig, CmdConnectTo connects to other addresses
+	connectAddr string
+	clientMu    sync.Mutex
+	clients     map[string]*tcp.Client // by connect address
+	connMap     sync.Map
+
+	// download limits set by proxy, they are only used by serve goroutine
+	connDownload   int64
+	sharedDownload *ratelimit.Limiter
+
+	sessions  sync.Map // sessionID -> *session
+	sessionWg sync.WaitGroup
+}
 
-	switch cmd {
-	case common.CmdConfig:
-		h.agentTCP(ctx, tunID, tunr, tunw)
-	case common.CmdConnectPTY:
-		if !opts.enabledExecute {
-			log.Println("CmdConnectPTY not enabled", err)
+// serve reads packets from tunnel and dispatches them until tunnel is broken
+func (t *agentTun) serve(ctx context.Context) {
+	for {
+		cmd, err := common.UnpackHeader(t.tunr)
+		if err != nil {
+			t.logger.Info("read tunnel failed", "err", err)
 			return
 		}
-		h.agentPTY(ctx, tunID, tunr, tunw)
-	default:
 
-		log.Println("invalid cmd")
-		return
+		switch cmd {
+		case common.CmdConfig:
+			err = t.handleConfig()
+		case common.CmdConnect:
+			err = t.handleConnect()
+		case common.CmdConnectTo:
+			err = t.handleConnectTo()
+		case common.CmdDownloadLimit:
+			err = t.handleDownloadLimit()
+		case common.CmdSend:
+			err = t.handleSend()
+		case common.CmdClose:
+			err = t.handleClose()
+		case common.CmdConnectPTY:
+			err = t.handleConnectPTY(ctx)
+		case common.CmdConnectExec:
+			err = t.handleConnectExec(ctx)
+		case common.CmdFileStat:
+			err = t.handleFileStat()
+		case common.CmdFileChecksum:
+			err = t.handleFileChecksum(ctx)
+		case common.CmdFileOpen:
+			err = t.handleFileOpen(ctx)
+		case common.CmdResizePTY, common.CmdIOPTY, common.CmdClosePTY, common.CmdSignalPTY,
+			common.CmdStdin, common.CmdCloseStdin, common.CmdExitExec,
+			common.CmdFileChunk, common.CmdFileAck, common.CmdFileClose:
+			err = t.handleSessionInput(cmd)
+		default:
+			t.logger.Error("invalid cmd", "cmd", cmd)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *agentTun) close() {
+	t.clientMu.Lock()
+	clients := t.clients
+	t.clients = nil
+	t.clientMu.Unlock()
+	for _, c := range clients {
+		c.Shutdown(context.Background())
 	}
+	t.sessions.Range(func(_, v any) bool {
+		v.(*session).cancel()
+		return true
+	})
+	t.sessionWg.Wait()
 }
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/tutils/tnet/asciicast"
+	"github.com/tutils/tnet/endpoint/common"
+)
+
+type executeSpec struct {
+	args        []string
+	env         []string
+	dir         string
+	sysProcAttr *syscall.SysProcAttr
+}
+
+// prepareExecute applies execute policy to args, release must be called when the execution ends
+func (t *agentTun) prepareExecute(ctx context.Context, sessionID int64, args []string) (context.Context, *executeSpec, func(), error) {
+	logger := t.logger.With("sessionID", sessionID)
+	if len(args) == 0 {
+		logger.Warn("empty execute args")
+		return ctx, nil, nil, errors.New("empty command")
+	}
+
+	spec := &executeSpec{args: args}
+	execPolicy := t.h.a.opts.execPolicy
+	if execPolicy == nil {
+		return ctx, spec, func() {}, nil
+	}
+
+	release, err := execPolicy.Acquire()
+	if err != nil {
+		logger.Warn("policy deny execute", "args", args, "err", err)
+		return ctx, nil, nil, err
+	}
+	if spec.args, err = execPolicy.Command(args); err != nil {
+		logger.Warn("policy deny execute", "args", args, "err", err)
+		release()
+		return ctx, nil, nil, err
+	}
+	if spec.sysProcAttr, err = execPolicy.SysProcAttr(); err != nil {
+		logger.Warn("policy deny execute", "args", args, "err", err)
+		release()
+		return ctx, nil, nil, err
+	}
+	logger.Info("policy allow execute", "args", spec.args)
+	spec.env = execPolicy.Environ()
+	spec.dir = execPolicy.Dir
+
+	ctx, cancel := execPolicy.Context(ctx)
+	return ctx, spec, func() {
+		cancel()
+		release()
+	}, nil
+}
+
+// time to wait for output of exec command after it exits or is killed, output held by its descendants is cut off after it
+const execWaitDelay = 5 * time.Second
+
+// terminal size in header of exec session recordings
+const (
+	execRecordWidth  = 80
+	execRecordHeight = 24
+)
+
+func (t *agentTun) writeConnectExecResult(sessionID int64, connectResult error) error {
+	if err := common.WritePacket(t.tunw, common.CmdConnectExecResult, func(w io.Writer) error {
+		return common.PackBodyConnectExecResult(w, sessionID, connectResult)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdConnectExecResult, "sessionID", sessionID, "err", err)
+		return err
+	}
+	t.logger.Debug("write packet", "cmd", common.CmdConnectExecResult, "sessionID", sessionID, "result", connectResult)
+	return nil
+}
+
+func (t *agentTun) handleConnectExec(ctx context.Context) error {
+	sessionID, executeArgs, err := common.UnpackBodyConnectExec(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdConnectExec, "err", err)
+		return err
+	}
+	logger := t.logger.With("sessionID", sessionID)
+	logger.Debug("read packet", "cmd", common.CmdConnectExec, "args", executeArgs)
+
+	if !t.h.a.opts.enabledExecute {
+		logger.Warn("exec session refused, remote execution is not enabled")
+		return t.writeConnectExecResult(sessionID, errExecuteDisabled)
+	}
+
+	ctx, s, ok := t.newSession(ctx, sessionID, common.SessionExec)
+	if !ok {
+		return t.writeConnectExecResult(sessionID, errors.New("duplicate session id"))
+	}
+	go func() {
+		defer t.removeSession(s)
+		t.agentExec(ctx, s, executeArgs)
+	}()
+	return nil
+}
+
+// execOutput returns writer sending output of exec session as packets of streamCmd,
+// output is also recorded as terminal output if rec is not nil
+func (t *agentTun) execOutput(sessionID int64, rec *asciicast.Writer, streamCmd common.Cmd) io.Writer {
+	return writerFunc(func(data []byte) error {
+		if rec != nil {
+			if err := rec.WriteOutput(data); err != nil {
+				t.logger.Error("record exec output failed", "sessionID", sessionID, "cmd", streamCmd, "err", err)
+			}
+		}
+		return common.WritePacket(t.tunw, streamCmd, func(w io.Writer) error {
+			return common.PackBodyStream(w, sessionID, data)
+		})
+	})
+}
+
+// writerFunc is io.Writer writing p by calling itself
+type writerFunc func(p []byte) error
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	if err := f(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *agentTun) agentExec(ctx context.Context, s *session, executeArgs []string) {
+	tunw, sessionID := t.tunw, s.id
+	logger := t.logger.With("sessionID", sessionID)
+
+	ctx, spec, release, err := t.prepareExecute(ctx, sessionID, executeArgs)
+	if err != nil {
+		t.writeConnectExecResult(sessionID, err)
+		return
+	}
+	defer release()
+
+	cmd := exec.CommandContext(ctx, spec.args[0], spec.args[1:]...)
+	cmd.Env = spec.env
+	cmd.Dir = spec.dir
+	cmd.SysProcAttr = spec.sysProcAttr
+	// descendants holding output of the command don't keep the session open after it is killed or exits
+	killProcessGroup(cmd)
+	cmd.WaitDelay = execWaitDelay
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.writeConnectExecResult(sessionID, err)
+		return
+	}
+
+	// stdout and stderr are recorded as terminal output, there is no terminal size of exec session
+	rec, err := t.newRecorder(sessionID, spec.args, execRecordWidth, execRecordHeight)
+	if err != nil {
+		logger.Error("create session recording failed", "err", err)
+		t.writeConnectExecResult(sessionID, err)
+		return
+	}
+	if rec != nil {
+		defer rec.Close()
+	}
+	cmd.Stdout = t.execOutput(sessionID, rec, common.CmdStdout)
+	cmd.Stderr = t.execOutput(sessionID, rec, common.CmdStderr)
+
+	err = cmd.Start()
+	if err := t.writeConnectExecResult(sessionID, err); err != nil {
+		return
+	}
+	if err != nil {
+		logger.Warn("start exec command failed", "err", err)
+		return
+	}
+
+	exitCh := make(chan struct{})
+	go func() {
+		defer close(exitCh)
+
+		// output still held by descendants after execWaitDelay is cut off with exec.ErrWaitDelay
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				logger.Warn("wait exec command failed", "err", err)
+			}
+		}
+		exitCode := cmd.ProcessState.ExitCode()
+		signal := exitSignal(cmd.ProcessState)
+		logger.Info("exec command exited", "exitCode", exitCode, "signal", signal)
+
+		if err := common.WritePacket(tunw, common.CmdExitExec, func(w io.Writer) error {
+			return common.PackBodyExitExec(w, sessionID, int64(exitCode), signal)
+		}); err != nil {
+			logger.Warn("write tunnel failed", "cmd", common.CmdExitExec, "err", err)
+			return
+		}
+	}()
+
+	for {
+		select {
+		case in := <-s.inputCh:
+			switch in.cmd {
+			case common.CmdStdin:
+				if _, err := stdin.Write(in.data); err != nil {
+					logger.Warn("write stdin failed", "err", err)
+				}
+				if rec != nil && t.h.a.opts.recordInput {
+					if err := rec.WriteInput(in.data); err != nil {
+						logger.Error("record exec input failed", "err", err)
+					}
+				}
+			case common.CmdCloseStdin:
+				stdin.Close()
+			}
+		case <-ctx.Done():
+			// session closed, the command is killed by context
+			<-exitCh
+			return
+		case <-exitCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tutils/tnet/endpoint/common"
+	"github.com/tutils/tnet/endpoint/policy"
+)
+
+func (t *agentTun) writeFileClose(sessionID int64, result error) error {
+	if err := common.WritePacket(t.tunw, common.CmdFileClose, func(w io.Writer) error {
+		return common.PackBodyFileClose(w, sessionID, result)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdFileClose, "sessionID", sessionID, "err", err)
+		return err
+	}
+	t.logger.Debug("write packet", "cmd", common.CmdFileClose, "sessionID", sessionID, "result", result)
+	return nil
+}
+
+func (t *agentTun) handleFileStat() error {
+	sessionID, path, err := common.UnpackBodyFileStat(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdFileStat, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdFileStat, "sessionID", sessionID, "path", path)
+
+	stat, result := t.statFile(path)
+	if err := common.WritePacket(t.tunw, common.CmdFileStatResult, func(w io.Writer) error {
+		return common.PackBodyFileStatResult(w, sessionID, result, stat)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdFileStatResult, "sessionID", sessionID, "err", err)
+		return err
+	}
+	return nil
+}
+
+// statFile returns nil stat if the file does not exist
+func (t *agentTun) statFile(path string) (*common.FileStat, error) {
+	filePolicy := t.h.a.opts.filePolicy
+	if filePolicy == nil {
+		return nil, policy.ErrFileTransferDisabled
+	}
+	resolved, err := filePolicy.CheckStat(path)
+	if err != nil {
+		t.logger.Warn("policy deny stat", "path", path, "err", err)
+		return nil, err
+	}
+	fi, err := os.Stat(resolved)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &common.FileStat{
+		Size:    fi.Size(),
+		Mode:    uint32(fi.Mode().Perm()),
+		IsDir:   fi.IsDir(),
+		ModTime: fi.ModTime().Unix(),
+	}, nil
+}
+
+func (t *agentTun) handleFileChecksum(ctx context.Context) error {
+	sessionID, path, length, err := common.UnpackBodyFileChecksum(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdFileChecksum, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdFileChecksum, "sessionID", sessionID, "path", path, "length", length)
+
+	// hashing large file must not block the tunnel
+	go func() {
+		sum, result := t.checksumFile(ctx, path, length)
+		if err := common.WritePacket(t.tunw, common.CmdFileChecksumResult, func(w io.Writer) error {
+			return common.PackBodyFileChecksumResult(w, sessionID, result, sum)
+		}); err != nil {
+			t.logger.Warn("write tunnel failed", "cmd", common.CmdFileChecksumResult, "sessionID", sessionID, "err", err)
+		}
+	}()
+	return nil
+}
+
+// checksumFile returns SHA-256 of the first length bytes of file, or the whole file if length is negative
+func (t *agentTun) checksumFile(ctx context.Context, path string, length int64) ([]byte, error) {
+	filePolicy := t.h.a.opts.filePolicy
+	if filePolicy == nil {
+		return nil, policy.ErrFileTransferDisabled
+	}
+	resolved, err := filePolicy.CheckStat(path)
+	if err != nil {
+		t.logger.Warn("policy deny checksum", "path", path, "err", err)
+		return nil, err
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if length >= 0 {
+		r = io.LimitReader(f, length)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, &contextReader{ctx: ctx, r: r})
+	if err != nil {
+		return nil, err
+	}
+	if length >= 0 && n < length {
+		return nil, fmt.Errorf("%s is shorter than %d bytes", path, length)
+	}
+	return h.Sum(nil), nil
+}
+
+// contextReader stops reading when ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (t *agentTun) writeFileOpenResult(sessionID int64, result error, size int64) error {
+	if err := common.WritePacket(t.tunw, common.CmdFileOpenResult, func(w io.Writer) error {
+		return common.PackBodyFileOpenResult(w, sessionID, result, size)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdFileOpenResult, "sessionID", sessionID, "err", err)
+		return err
+	}
+	t.logger.Debug("write packet", "cmd", common.CmdFileOpenResult, "sessionID", sessionID, "result", result, "size", size)
+	return nil
+}
+
+func (t *agentTun) handleFileOpen(ctx context.Context) error {
+	sessionID, path, write, offset, mode, err := common.UnpackBodyFileOpen(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdFileOpen, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdFileOpen, "sessionID", sessionID, "path", path, "write", write, "offset", offset)
+
+	f, size, err := t.openFile(path, write, offset, os.FileMode(mode).Perm())
+	if err != nil {
+		return t.writeFileOpenResult(sessionID, err, 0)
+	}
+
+	ctx, s, ok := t.newSession(ctx, sessionID, common.SessionFile)
+	if !ok {
+		f.Close()
+		return t.writeFileOpenResult(sessionID, errors.New("duplicate session id"), 0)
+	}
+	if err := t.writeFileOpenResult(sessionID, nil, size); err != nil {
+		f.Close()
+		t.removeSession(s)
+		return err
+	}
+	go func() {
+		defer t.removeSession(s)
+		if write {
+			t.agentFileWrite(ctx, s, f, offset)
+		} else {
+			t.agentFileRead(ctx, s, f, offset)
+		}
+	}()
+	return nil
+}
+
+// openFile opens file for reading from offset, or for writing at offset
+func (t *agentTun) openFile(path string, write bool, offset int64, mode os.FileMode) (*os.File, int64, error) {
+	filePolicy := t.h.a.opts.filePolicy
+	if filePolicy == nil {
+		return nil, 0, policy.ErrFileTransferDisabled
+	}
+
+	check, action := filePolicy.CheckRead, "read"
+	if write {
+		check, action = filePolicy.CheckWrite, "write"
+	}
+	resolved, err := check(path)
+	if err != nil {
+		t.logger.Warn("policy deny file", "action", action, "path", path, "err", err)
+		return nil, 0, err
+	}
+	t.logger.Info("policy allow file", "action", action, "path", resolved)
+
+	var f *os.File
+	if write {
+		f, err = os.OpenFile(resolved, os.O_WRONLY|os.O_CREATE, mode)
+	} else {
+		f, err = os.Open(resolved)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s is a directory", path)
+	}
+	if offset < 0 || offset > fi.Size() {
+		f.Close()
+		return nil, 0, fmt.Errorf("offset %d out of file size %d", offset, fi.Size())
+	}
+	if write {
+		// drop data after offset which is going to be rewritten
+		if err := f.Truncate(offset); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// agentFileWrite writes chunks sent by proxy to file and acknowledges them
+func (t *agentTun) agentFileWrite(ctx context.Context, s *session, f *os.File, offset int64) {
+	tunw, sessionID := t.tunw, s.id
+	logger := t.logger.With("sessionID", sessionID)
+	defer f.Close()
+
+	for {
+		var in sessionInput
+		select {
+		case in = <-s.inputCh:
+		case <-ctx.Done():
+			logger.Info("file write aborted", "offset", offset)
+			return
+		}
+		if in.cmd != common.CmdFileChunk {
+			continue
+		}
+
+		if in.offset != offset {
+			t.writeFileClose(sessionID, fmt.Errorf("unexpected chunk offset %d, %d expected", in.offset, offset))
+			return
+		}
+		if len(in.data) == 0 {
+			// end of file
+			result := f.Sync()
+			if err := f.Close(); result == nil {
+				result = err
+			}
+			logger.Info("file write finished", "size", offset, "result", result)
+			t.writeFileClose(sessionID, result)
+			return
+		}
+		if _, err := f.Write(in.data); err != nil {
+			t.writeFileClose(sessionID, err)
+			return
+		}
+		offset += int64(len(in.data))
+
+		if err := common.WritePacket(tunw, common.CmdFileAck, func(w io.Writer) error {
+			return common.PackBodyFileAck(w, sessionID, offset)
+		}); err != nil {
+			logger.Warn("write tunnel failed", "cmd", common.CmdFileAck, "err", err)
+			return
+		}
+	}
+}
+
+// agentFileRead sends file from offset to proxy in chunks, no more than common.FileWindowSize unacknowledged
+func (t *agentTun) agentFileRead(ctx context.Context, s *session, f *os.File, offset int64) {
+	tunw, sessionID := t.tunw, s.id
+	logger := t.logger.With("sessionID", sessionID)
+	defer f.Close()
+
+	acked := offset
+	eof := false
+	buf := make([]byte, common.FileChunkSize)
+	for {
+		// wait for acknowledgement if window is full, or all data including the end is acknowledged
+		for eof || offset-acked >= common.FileWindowSize {
+			if eof && acked >= offset {
+				logger.Info("file read finished", "size", offset)
+				return
+			}
+			select {
+			case in := <-s.inputCh:
+				if in.cmd == common.CmdFileAck && in.offset > acked {
+					acked = in.offset
+				}
+			case <-ctx.Done():
+				logger.Info("file read aborted", "offset", offset)
+				return
+			}
+		}
+
+		n, err := f.Read(buf)
+		if err != nil && err != io.EOF {
+			t.writeFileClose(sessionID, err)
+			return
+		}
+		data := buf[:n]
+		if err == io.EOF {
+			eof = true
+			data = nil
+		}
+		if err := common.WritePacket(tunw, common.CmdFileChunk, func(w io.Writer) error {
+			return common.PackBodyFileChunk(w, sessionID, offset, data)
+		}); err != nil {
+			logger.Warn("write tunnel failed", "cmd", common.CmdFileChunk, "err", err)
+			return
+		}
+		offset += int64(len(data))
+	}
+}
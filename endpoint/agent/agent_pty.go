@@ -2,40 +2,73 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"path/filepath"
+	"strings"
 
 	"github.com/aymanbagabas/go-pty"
+	"github.com/tutils/tnet/asciicast"
 	"github.com/tutils/tnet/endpoint/common"
 	"golang.org/x/term"
 )
 
-func (h *agentTunHandler) agentPTY(ctx context.Context, tunID int64, tunr io.Reader, tunw io.Writer) {
-	rawMode, executeArgs, width, height, err := common.UnpackBodyConnectPTY(tunr)
+// errExecuteDisabled means agent is not started with remote execution enabled
+var errExecuteDisabled = errors.New("remote execution is not enabled")
+
+func (t *agentTun) writeConnectPTYResult(sessionID int64, connectResult error) error {
+	if err := common.WritePacket(t.tunw, common.CmdConnectPTYResult, func(w io.Writer) error {
+		return common.PackBodyConnectPTYResult(w, sessionID, connectResult)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdConnectPTYResult, "sessionID", sessionID, "err", err)
+		return err
+	}
+	t.logger.Debug("write packet", "cmd", common.CmdConnectPTYResult, "sessionID", sessionID, "result", connectResult)
+	return nil
+}
+
+func (t *agentTun) handleConnectPTY(ctx context.Context) error {
+	sessionID, rawMode, executeArgs, width, height, err := common.UnpackBodyConnectPTY(t.tunr)
 	if err != nil {
-		log.Println("unpackBodyConnectPTY err", err)
-		return
+		t.logger.Warn("unpack body failed", "cmd", common.CmdConnectPTY, "err", err)
+		return err
 	}
-	log.Printf("Read CmdConnectPTY, args %v, size %dx%d, raw %v", executeArgs, width, height, rawMode)
+	logger := t.logger.With("sessionID", sessionID)
+	logger.Debug("read packet", "cmd", common.CmdConnectPTY, "args", executeArgs, "width", width, "height", height, "raw", rawMode)
 
-	writeConnectResult := func(err error) error {
-		if err := common.PackHeader(tunw, common.CmdConnectPTYResult); err != nil {
-			log.Println("packHeader err", err)
-			return err
-		}
-		if err := common.PackBodyConnectPTYResult(tunw, err); err != nil {
-			log.Println("packBodyConnectPTYResult err", err)
-			return err
-		}
-		log.Println("Write CmdConnectPTYResult")
-		return nil
+	if !t.h.a.opts.enabledExecute {
+		logger.Warn("pty session refused, remote execution is not enabled")
+		return t.writeConnectPTYResult(sessionID, errExecuteDisabled)
 	}
 
+	ctx, s, ok := t.newSession(ctx, sessionID, common.SessionPTY)
+	if !ok {
+		return t.writeConnectPTYResult(sessionID, errors.New("duplicate session id"))
+	}
+	go func() {
+		defer t.removeSession(s)
+		t.agentPTY(ctx, s, rawMode, executeArgs, width, height)
+	}()
+	return nil
+}
+
+func (t *agentTun) agentPTY(ctx context.Context, s *session, rawMode bool, executeArgs []string, width int16, height int16) {
+	tunw, sessionID := t.tunw, s.id
+	logger := t.logger.With("sessionID", sessionID)
+
+	ctx, spec, release, err := t.prepareExecute(ctx, sessionID, executeArgs)
+	if err != nil {
+		t.writeConnectPTYResult(sessionID, err)
+		return
+	}
+	defer release()
+
 	// connected := false
 	p, err := pty.New()
 	if err != nil {
-		log.Println("new pty err", err)
-		writeConnectResult(err)
+		logger.Warn("new pty failed", "err", err)
+		t.writeConnectPTYResult(sessionID, err)
 		return
 	}
 	defer p.Close()
@@ -45,16 +78,29 @@ func (h *agentTunHandler) agentPTY(ctx context.Context, tunID int64, tunr io.Rea
 	}
 
 	if err := p.Resize(int(width), int(height)); err != nil {
-		log.Println("resize pty err", err)
+		logger.Warn("resize pty failed", "err", err)
 	}
 
-	cmd := p.CommandContext(ctx, executeArgs[0], executeArgs[1:]...)
+	rec, err := t.newRecorder(sessionID, spec.args, width, height)
+	if err != nil {
+		logger.Error("create session recording failed", "err", err)
+		t.writeConnectPTYResult(sessionID, err)
+		return
+	}
+	if rec != nil {
+		defer rec.Close()
+	}
+
+	cmd := p.CommandContext(ctx, spec.args[0], spec.args[1:]...)
+	cmd.Env = spec.env
+	cmd.Dir = spec.dir
+	cmd.SysProcAttr = spec.sysProcAttr
 	err = cmd.Start()
-	if err := writeConnectResult(err); err != nil {
+	if err := t.writeConnectPTYResult(sessionID, err); err != nil {
 		return
 	}
 	if err != nil {
-		log.Println("start pty cmd err", err)
+		logger.Warn("start pty command failed", "err", err)
 		return
 	}
 
@@ -65,7 +111,7 @@ func (h *agentTunHandler) agentPTY(ctx context.Context, tunID int64, tunr io.Rea
 	exitCodeCh := make(chan int)
 	go func() {
 		cmd.Wait()
-		log.Printf("pty cmd exited")
+		logger.Info("pty command exited", "exitCode", cmd.ProcessState.ExitCode())
 		// 子进程退出，终止pty输出拷贝循环
 		p.Close()
 		exitCodeCh <- cmd.ProcessState.ExitCode()
@@ -76,64 +122,90 @@ func (h *agentTunHandler) agentPTY(ctx context.Context, tunID int64, tunr io.Rea
 		defer close(exitCh)
 
 		if err := common.Copy(tunw, p, func(tunw io.Writer, data []byte) error {
-			if err := common.PackHeader(tunw, common.CmdIOPTY); err != nil {
-				return err
+			if rec != nil {
+				if err := rec.WriteOutput(data); err != nil {
+					logger.Error("record pty output failed", "err", err)
+				}
 			}
-			if err := common.PackBodyIOPTY(tunw, data); err != nil {
-				return err
-			}
-			return nil
+			return common.WritePacket(tunw, common.CmdIOPTY, func(w io.Writer) error {
+				return common.PackBodyIOPTY(w, sessionID, data)
+			})
 		}); err != nil {
 			// 异常终止
-			log.Println("copy pty output err", err)
+			logger.Warn("copy pty output failed", "err", err)
 		}
-		log.Printf("copy pty output loop exited")
+		logger.Debug("copy pty output loop exited")
 
 		// pty输出拷贝循环退出，需要终止子进程
 		cmd.Process.Kill()
 		exitCode := <-exitCodeCh
-		if err := common.PackHeader(tunw, common.CmdClosePTY); err != nil {
-			log.Println("packHeader err", err)
-			return
-		}
-		if err := common.PackBodyClosePTY(tunw, int64(exitCode)); err != nil {
-			log.Println("packHeader err", err)
+		if err := common.WritePacket(tunw, common.CmdClosePTY, func(w io.Writer) error {
+			return common.PackBodyClosePTY(w, sessionID, int64(exitCode))
+		}); err != nil {
+			logger.Warn("write tunnel failed", "cmd", common.CmdClosePTY, "err", err)
 			return
 		}
+		logger.Debug("write packet", "cmd", common.CmdClosePTY, "exitCode", exitCode)
 	}()
 
 LOOP:
 	for {
-		cmd, err := common.UnpackHeader(tunr)
-		if err != nil {
-			log.Println("unpackHeader err", err)
-			break
-		}
-		switch cmd {
-		case common.CmdResizePTY:
-			width, height, err := common.UnpackBodyResizePTY(tunr)
-			if err != nil {
-				log.Println("unpackBodyResizePTY err", err)
-				break LOOP
-			}
-			log.Printf("Read CmdResizePTY, tunID %d, size %dx%d", tunID, width, height)
-			if err := p.Resize(int(width), int(height)); err != nil {
-				log.Println("resize pty err", err)
-			}
+		select {
+		case in := <-s.inputCh:
+			switch in.cmd {
+			case common.CmdResizePTY:
+				if err := p.Resize(int(in.width), int(in.height)); err != nil {
+					logger.Warn("resize pty failed", "err", err)
+				}
+				if rec != nil {
+					if err := rec.WriteResize(int(in.width), int(in.height)); err != nil {
+						logger.Error("record pty resize failed", "err", err)
+					}
+				}
 
-		case common.CmdIOPTY:
-			data, err := common.UnpackBodyIOPTY(tunr)
-			if err != nil {
-				log.Println("unpackBodyIOPTY err", err)
-				break LOOP
-			}
-			log.Printf("Read CmdIOPTY, tunID %d, %d bytes", tunID, len(data))
-			if _, err := p.Write(data); err != nil {
-				log.Println("write pty err", err)
-				break LOOP
+			case common.CmdIOPTY:
+				if _, err := p.Write(in.data); err != nil {
+					logger.Warn("write pty failed", "err", err)
+					break LOOP
+				}
+				if rec != nil && t.h.a.opts.recordInput {
+					if err := rec.WriteInput(in.data); err != nil {
+						logger.Error("record pty input failed", "err", err)
+					}
+				}
+
+			case common.CmdSignalPTY:
+				logger.Info("signal pty command", "signal", in.signal)
+				if err := signalPTY(p, cmd.Process.Pid, in.signal); err != nil {
+					logger.Warn("signal pty failed", "err", err)
+				}
 			}
+		case <-ctx.Done():
+			break LOOP
+		case <-exitCh:
+			return
 		}
 	}
 	cmd.Process.Kill()
 	<-exitCh
 }
+
+// newRecorder creates recording of pty or exec session, it returns nil if recording is disabled
+func (t *agentTun) newRecorder(sessionID int64, args []string, width int16, height int16) (*asciicast.Writer, error) {
+	dir := t.h.a.opts.recordDir
+	if dir == "" {
+		return nil, nil
+	}
+	name := common.RecordFileName(t.tunID, sessionID)
+	rec, err := asciicast.Create(dir, name, asciicast.Header{
+		Width:   int(width),
+		Height:  int(height),
+		Command: strings.Join(args, " "),
+		Title:   fmt.Sprintf("tnet agent session %d:%d", t.tunID, sessionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.logger.Info("record session", "sessionID", sessionID, "file", filepath.Join(dir, name))
+	return rec, nil
+}
@@ -3,12 +3,19 @@ package agent
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"sync"
 	"time"
 
+	"github.com/tutils/tnet/accesslog"
+	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/endpoint/admin"
 	"github.com/tutils/tnet/endpoint/common"
+	"github.com/tutils/tnet/endpoint/policy"
+	"github.com/tutils/tnet/ratelimit"
 	"github.com/tutils/tnet/tcp"
 )
 
@@ -19,40 +26,67 @@ type tcpConnData struct {
 	connID  int64
 	writeCh chan []byte
 	closeCh chan struct{}
+	access  *accesslog.Record
+
+	download []*ratelimit.Limiter // limiters of reading target, see handleDownloadLimit
 }
 
 // tcpHandler
 type tcpHandler struct {
-	tunw    io.Writer // SyncWriter
-	connMap *sync.Map
+	tunw        io.Writer    // SyncWriter
+	logger      *slog.Logger // with tunID
+	connMap     *sync.Map
+	connectAddr string
+	metrics     *common.Metrics
+	accounting  *counter.Accounting
+	admin       *admin.Tunnel
 }
 
 func (e *tcpHandler) ServeTCP(ctx context.Context, conn tcp.Conn) {
-	connr := conn.Reader()
 	tunw := e.tunw
 	connMap := e.connMap
 
 	connData := ctx.Value(tcpConnDataKey{}).(*tcpConnData)
+	connr := ratelimit.NewReader(ctx, conn.Reader(), connData.download...)
 	tunID := connData.tunID
 	connID := connData.connID
+	rec := connData.access
+	logger := e.logger.With("connID", connID)
 	connMap.Store(connID, connData)
-	log.Printf("new agent connection, connID %d:%d", tunID, connID)
-	defer log.Printf("agent connection closed, connID %d:%d", tunID, connID)
+	logger.Info("new agent connection", "target", e.connectAddr)
+	defer logger.Info("agent connection closed")
 
-	tunwbuf := &bytes.Buffer{} // TODO: use pool
-	if err := common.PackHeader(tunwbuf, common.CmdConnectResult); err != nil {
-		log.Println("packHeader err", err)
-		return
-	}
-	if err := common.PackBodyConnectResult(tunwbuf, connID, nil); err != nil {
-		log.Println("packBodyConnectResult err", err)
-		return
+	e.metrics.ConnectResult(e.connectAddr, nil)
+	e.metrics.ConnOpened(e.connectAddr)
+	defer e.metrics.ConnClosed(e.connectAddr)
+	acct := e.accounting.Open(tunID, connID, e.connectAddr)
+	defer func() {
+		if t := acct.Traffic(); t != nil {
+			acct.Close()
+			logger.Info("agent connection traffic", "traffic", t)
+		}
+	}()
+
+	var source string
+	if addr, ok := ctx.Value(tcp.LocalAddrContextKey).(net.Addr); ok {
+		source = addr.String()
 	}
-	if _, err := tunw.Write(tunwbuf.Bytes()); err != nil {
-		log.Println("write tun err", err)
+	rec.SetClient(source)
+	rec.SetTraffic(acct.Traffic())
+	ac := e.admin.OpenConn(connID, source, e.connectAddr, acct.Traffic(), func() {
+		rec.SetReason(accesslog.ReasonKilled)
+		conn.CancelContext()
+		conn.AbortPendingRead()
+	})
+	defer ac.Close()
+
+	if err := writeConnectResult(e.logger, tunw, connID, nil); err != nil {
+		rec.SetReason(accesslog.ReasonTunnelBroken)
 		return
 	}
 
+	tunwbuf := &bytes.Buffer{} // TODO: use pool
+
 	done := make(chan struct{})
 	defer func() {
 		connMap.Delete(connID)
@@ -72,33 +106,53 @@ func (e *tcpHandler) ServeTCP(ctx context.Context, conn tcp.Conn) {
 		default:
 			tunwbuf.Reset()
 			if err := common.PackHeader(tunwbuf, common.CmdClose); err != nil {
-				log.Println("packHeader err", err)
+				logger.Error("pack header failed", "cmd", common.CmdClose, "err", err)
 				break
 			}
 			if err := common.PackBodyClose(tunwbuf, connID); err != nil {
-				log.Println("packBodyClose err", err)
+				logger.Error("pack body failed", "cmd", common.CmdClose, "err", err)
 				break
 			}
 			if _, err := tunw.Write(tunwbuf.Bytes()); err != nil {
-				log.Println("write tun err", err)
+				logger.Warn("write tunnel failed", "cmd", common.CmdClose, "err", err)
 				break
 			}
+			logger.Debug("write packet", "cmd", common.CmdClose)
 		}
 	}()
 
+	writerDone := make(chan struct{})
 	go func() {
+		defer close(writerDone)
 		connw := conn.Writer()
+		write := func(data []byte) bool {
+			// counted before writing, connection may be closed as soon as target replies
+			acct.Upload(int64(len(data)))
+			if _, err := connw.Write(data); err != nil {
+				rec.SetReason("write target failed: " + err.Error())
+				logger.Warn("write connection failed", "err", err)
+				return false
+			}
+			return true
+		}
 		for {
 			select {
 			case data, ok := <-connData.writeCh:
-				if !ok {
-					return
-				}
-				if _, err := connw.Write(data); err != nil {
-					log.Println("write conn err", err)
+				if !ok || !write(data) {
 					return
 				}
 			case <-connData.closeCh:
+				// data received before CmdClose is queued already, flush it before closing
+				for flushed := false; !flushed; {
+					select {
+					case data := <-connData.writeCh:
+						if !write(data) {
+							return
+						}
+					default:
+						flushed = true
+					}
+				}
 				conn.CancelContext()
 				conn.AbortPendingRead()
 				return
@@ -115,124 +169,244 @@ func (e *tcpHandler) ServeTCP(ctx context.Context, conn tcp.Conn) {
 			// check if connection is closed
 			select {
 			case <-connData.closeCh:
-				log.Printf("read conn abort: proxy connection closed, connID %d:%d", tunID, connID)
+				rec.SetReason(accesslog.ReasonClientClosed)
+				logger.Debug("read connection aborted, proxy connection closed")
 			default:
-				log.Printf("read conn err: %v, connID %d:%d", err, tunID, connID)
+				rec.SetReason(accesslog.ReasonTargetClosed)
+				logger.Debug("read connection failed", "err", err)
 			}
 			return
 		}
 
+		acct.Download(int64(n))
+
 		select {
 		case <-connData.closeCh:
-			return // remote peer close
+			rec.SetReason(accesslog.ReasonClientClosed)
+			<-writerDone // remote peer close, wait for pending data to be flushed
+			return
 		default:
 		}
 
 		tunwbuf.Reset()
 		if err := common.PackHeader(tunwbuf, common.CmdSend); err != nil {
-			log.Println("packHeader err", err)
+			logger.Error("pack header failed", "cmd", common.CmdSend, "err", err)
 			return
 		}
 		if err := common.PackBodySend(tunwbuf, connID, buf[:n]); err != nil {
-			log.Println("packBodySend err", err)
+			logger.Error("pack body failed", "cmd", common.CmdSend, "err", err)
 			return
 		}
 		if _, err := tunw.Write(tunwbuf.Bytes()); err != nil {
-			log.Println("write tun err", err)
+			rec.SetReason(accesslog.ReasonTunnelBroken)
+			logger.Warn("write tunnel failed", "cmd", common.CmdSend, "err", err)
 			return
 		}
+		logger.Debug("write packet", "cmd", common.CmdSend, "bytes", tunwbuf.Len())
+	}
+}
+
+// writeConnectResult reports the result of connecting connID to the proxy, logger is with tunID
+func writeConnectResult(logger *slog.Logger, tunw io.Writer, connID int64, connectResult error) error {
+	logger = logger.With("connID", connID)
+	buf := &bytes.Buffer{} // TODO: use pool
+	if err := common.PackHeader(buf, common.CmdConnectResult); err != nil {
+		logger.Error("pack header failed", "cmd", common.CmdConnectResult, "err", err)
+		return err
+	}
+	if err := common.PackBodyConnectResult(buf, connID, connectResult); err != nil {
+		logger.Error("pack body failed", "cmd", common.CmdConnectResult, "err", err)
+		return err
 	}
+	if _, err := tunw.Write(buf.Bytes()); err != nil {
+		logger.Warn("write tunnel failed", "cmd", common.CmdConnectResult, "err", err)
+		return err
+	}
+	logger.Debug("write packet", "cmd", common.CmdConnectResult, "result", connectResult)
+	return nil
 }
 
-func (h *agentTunHandler) agentTCP(ctx context.Context, tunID int64, tunr io.Reader, tunw io.Writer) {
-	connectAddr, err := common.UnpackBodyConfig(tunr)
+func (t *agentTun) handleConfig() error {
+	connectAddr, err := common.UnpackBodyConfig(t.tunr)
 	if err != nil {
-		log.Println("unpackBodyConfig err", err)
-		return
+		t.logger.Warn("unpack body failed", "cmd", common.CmdConfig, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdConfig, "target", connectAddr)
+	if t.connectAddr != "" {
+		t.logger.Warn("tcp forwarding has been configured", "target", t.connectAddr)
+		return nil
 	}
-	log.Printf("Read CmdConfig, connectAddr %s", connectAddr)
+	t.connectAddr = connectAddr
+	return nil
+}
 
-	var connMap sync.Map
+// handleDownloadLimit sets download limits of tcp connections connected afterwards,
+// reading targets is limited instead of writing clients by proxy, which would block the tunnel
+func (t *agentTun) handleDownloadLimit() error {
+	connRate, sharedRate, err := common.UnpackBodyDownloadLimit(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdDownloadLimit, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdDownloadLimit, "conn", connRate, "shared", sharedRate)
+	t.connDownload = connRate
+	if t.sharedDownload.Rate() != sharedRate {
+		t.sharedDownload = ratelimit.NewLimiter(sharedRate, 0)
+	}
+	return nil
+}
+
+// tcpClient returns client connecting to connectAddr, it is created on first use
+func (t *agentTun) tcpClient(connectAddr string) *tcp.Client {
+	t.clientMu.Lock()
+	defer t.clientMu.Unlock()
+	if c, ok := t.clients[connectAddr]; ok {
+		return c
+	}
 
 	tcph := &tcpHandler{
-		tunw:    tunw,
-		connMap: &connMap,
+		tunw:        t.tunw,
+		logger:      t.logger,
+		connMap:     &t.connMap,
+		connectAddr: connectAddr,
+		metrics:     t.h.a.opts.metrics,
+		accounting:  t.h.a.opts.accounting,
+		admin:       t.admin,
 	}
 
-	c := tcp.NewClient(
+	clientOpts := []tcp.ClientOption{
 		tcp.WithConnectAddress(connectAddr),
 		tcp.WithClientHandler(tcp.NewRawTCPConnHandler(tcph)),
-		tcp.WithClientKeepAlivePeriod(time.Second*15),
+		tcp.WithClientKeepAlivePeriod(time.Second * 15),
 		tcp.WithClientKeepAliveCount(3),
-	)
-	defer c.Shutdown(context.Background())
+		tcp.WithClientLogger(t.logger),
+	}
+	clientOpts = append(clientOpts, t.h.a.opts.dialOpts...)
+	if p := t.h.a.opts.dialPolicy; p != nil {
+		// hostname may resolve to other addresses than those checked before dialing
+		clientOpts = append(clientOpts, tcp.WithClientControl(p.Control(connectAddr)))
+	}
+	c := tcp.NewClient(clientOpts...)
+	if t.clients == nil {
+		t.clients = make(map[string]*tcp.Client)
+	}
+	t.clients[connectAddr] = c
+	return c
+}
 
-	for {
-		cmd, err := common.UnpackHeader(tunr)
-		if err != nil {
-			log.Println("unpackHeader err", err)
-			return
-		}
-		switch cmd {
-		case common.CmdConnect:
-			connID, err := common.UnpackBodyConnect(tunr)
-			if err != nil {
-				log.Println("unpackBodyConnect err", err)
-				return
-			}
-			log.Printf("Read CmdConnect, connID %d:%d", tunID, connID)
-			ctx := context.Background()
-			data := &tcpConnData{
-				tunID:   tunID,
-				connID:  connID,
-				writeCh: make(chan []byte, 1<<8),
-				closeCh: make(chan struct{}),
-			}
-			ctx = context.WithValue(ctx, tcpConnDataKey{}, data)
-			go func() {
-				buf := &bytes.Buffer{} // TODO: use pool
-				if err := c.DialAndServe(ctx); err != nil {
-					buf.Reset()
-					if err := common.PackHeader(buf, common.CmdConnectResult); err != nil {
-						log.Println("packHeader err", err)
-						return
-					}
-					if err := common.PackBodyConnectResult(buf, connID, err); err != nil {
-						log.Println("packBodyConnectResult err", err)
-						return
-					}
-					if _, err := tunw.Write(buf.Bytes()); err != nil {
-						log.Println("write tun err", err)
-						return
-					}
-				}
-			}()
-		case common.CmdSend:
-			connID, data, err := common.UnpackBodySend(tunr)
-			if err != nil {
-				log.Println("unpackBodySend err", err)
-				return
-			}
-			log.Printf("Read CmdSend, connID %d:%d, %d bytes", tunID, connID, len(data))
-			v, ok := connMap.Load(connID)
-			if !ok {
-				log.Printf("connID %d:%d not found", tunID, connID)
-				break // ignore
+func (t *agentTun) handleConnect() error {
+	connID, err := common.UnpackBodyConnect(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdConnect, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdConnect, "connID", connID)
+	if t.connectAddr == "" {
+		t.logger.Warn("tcp forwarding not configured", "connID", connID)
+		return writeConnectResult(t.logger, t.tunw, connID, &common.ConnectError{Code: common.ConnectErrUnknown, Msg: "no connect address configured"})
+	}
+	t.connect(connID, t.connectAddr)
+	return nil
+}
+
+func (t *agentTun) handleConnectTo() error {
+	connID, connectAddr, err := common.UnpackBodyConnectTo(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdConnectTo, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdConnectTo, "connID", connID, "target", connectAddr)
+	t.connect(connID, connectAddr)
+	return nil
+}
+
+// connect connects connID to connectAddr in background, result is written to tunnel
+func (t *agentTun) connect(connID int64, connectAddr string) {
+	tunID, tunw := t.tunID, t.tunw
+	logger := t.logger.With("connID", connID)
+	c := t.tcpClient(connectAddr)
+
+	ctx := context.Background()
+	rec := t.h.a.opts.accessLog.Open(accesslog.Conn{
+		Role:     "agent",
+		TunID:    tunID,
+		ConnID:   connID,
+		Target:   connectAddr,
+		Peer:     t.peer,
+		Identity: t.identity,
+	})
+	data := &tcpConnData{
+		tunID:   tunID,
+		connID:  connID,
+		writeCh: make(chan []byte, 1<<8),
+		closeCh: make(chan struct{}),
+		access:  rec,
+
+		download: []*ratelimit.Limiter{ratelimit.NewLimiter(t.connDownload, 0), t.sharedDownload},
+	}
+	ctx = context.WithValue(ctx, tcpConnDataKey{}, data)
+	go func() {
+		defer func() {
+			if err := rec.Close(accesslog.ReasonTargetClosed); err != nil {
+				logger.Error("write access log failed", "err", err)
 			}
-			v.(*tcpConnData).writeCh <- data
-		case common.CmdClose:
-			connID, err := common.UnpackBodyClose(tunr)
-			if err != nil {
-				log.Println("unpackBodyClose err", err)
+		}()
+		if p := t.h.a.opts.dialPolicy; p != nil {
+			if err := p.Check(ctx, connectAddr); err != nil {
+				rec.SetReason("policy denied: " + err.Error())
+				logger.Warn("policy deny connect", "target", connectAddr, "err", err)
+				ce := &common.ConnectError{Code: common.ConnectErrDenied, Msg: err.Error()}
+				t.h.a.opts.metrics.ConnectResult(connectAddr, ce)
+				writeConnectResult(t.logger, tunw, connID, ce)
 				return
 			}
-			log.Printf("Read CmdClose, connID %d:%d,", tunID, connID)
-			v, ok := connMap.Load(connID)
-			if !ok {
-				log.Printf("connID %d:%d not found", tunID, connID)
-				break // ignore
+			logger.Info("policy allow connect", "target", connectAddr)
+		}
+		if err := c.DialAndServe(ctx); err != nil {
+			ce := common.NewConnectError(err)
+			if de := (*policy.DeniedError)(nil); errors.As(err, &de) {
+				ce = &common.ConnectError{Code: common.ConnectErrDenied, Msg: de.Error()}
+				rec.SetReason("policy denied: " + de.Error())
+				logger.Warn("policy deny connect", "target", connectAddr, "err", de)
+			} else {
+				rec.SetReason("connect failed: " + ce.Error())
+				logger.Warn("connect failed", "target", connectAddr, "err", ce)
 			}
-			close(v.(*tcpConnData).closeCh)
+			t.h.a.opts.metrics.ConnectResult(connectAddr, ce)
+			writeConnectResult(t.logger, tunw, connID, ce)
 		}
+	}()
+}
+
+func (t *agentTun) handleSend() error {
+	connID, data, err := common.UnpackBodySend(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdSend, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdSend, "connID", connID, "bytes", len(data))
+	v, ok := t.connMap.Load(connID)
+	if !ok {
+		t.logger.Debug("connection not found", "cmd", common.CmdSend, "connID", connID)
+		return nil // ignore
+	}
+	v.(*tcpConnData).writeCh <- data
+	return nil
+}
+
+func (t *agentTun) handleClose() error {
+	connID, err := common.UnpackBodyClose(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdClose, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdClose, "connID", connID)
+	v, ok := t.connMap.Load(connID)
+	if !ok {
+		t.logger.Debug("connection not found", "cmd", common.CmdClose, "connID", connID)
+		return nil // ignore
 	}
+	close(v.(*tcpConnData).closeCh)
+	return nil
 }
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+)
+
+// exitSignal returns the signal terminating the process, 0 if it exited normally
+func exitSignal(state *os.ProcessState) int32 {
+	return 0
+}
+
+// killProcessGroup does nothing, only the command is killed when context of cmd is done
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// exitSignal returns the signal terminating the process, 0 if it exited normally
+func exitSignal(state *os.ProcessState) int32 {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return int32(ws.Signal())
+	}
+	return 0
+}
+
+// killProcessGroup starts cmd in a new process group, the whole group is killed when context of cmd is done
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -1,7 +1,16 @@
 package agent
 
 import (
+	"log/slog"
+
+	"github.com/tutils/tnet/accesslog"
+	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/counter/ewma"
 	"github.com/tutils/tnet/crypt"
+	"github.com/tutils/tnet/endpoint/admin"
+	"github.com/tutils/tnet/endpoint/common"
+	"github.com/tutils/tnet/endpoint/policy"
+	"github.com/tutils/tnet/tcp"
 	"github.com/tutils/tnet/tun"
 )
 
@@ -12,6 +21,17 @@ type Options struct {
 	tunHandlerNewer AgentTunHandlerNewer
 	tunCrypt        crypt.Crypt
 	enabledExecute  bool
+	dialOpts        []tcp.ClientOption
+	dialPolicy      *policy.DialPolicy
+	execPolicy      *policy.ExecPolicy
+	recordDir       string
+	recordInput     bool
+	filePolicy      *policy.FilePolicy
+	metrics         *common.Metrics
+	accounting      *counter.Accounting
+	admin           *admin.Registry
+	logger          *slog.Logger
+	accessLog       *accesslog.Logger
 }
 
 // Option is option setter for agent
@@ -22,6 +42,14 @@ func newOptions(opts ...Option) *Options {
 	for _, o := range opts {
 		o(opt)
 	}
+	if opt.accounting == nil {
+		opt.accounting = counter.NewAccounting(func() counter.Counter {
+			return ewma.NewEWMACounter(ewma.DefaultWindow)
+		})
+	}
+	if opt.logger == nil {
+		opt.logger = slog.Default()
+	}
 	return opt
 }
 
@@ -61,3 +89,81 @@ func WithEnabledExecute(enabled bool) Option {
 		opts.enabledExecute = enabled
 	}
 }
+
+// WithDialOptions sets options of dialing connect address opt
+func WithDialOptions(dialOpts ...tcp.ClientOption) Option {
+	return func(opts *Options) {
+		opts.dialOpts = dialOpts
+	}
+}
+
+// WithDialPolicy sets policy checked before dialing connect address opt
+func WithDialPolicy(p *policy.DialPolicy) Option {
+	return func(opts *Options) {
+		opts.dialPolicy = p
+	}
+}
+
+// WithExecPolicy sets policy of remote execution opt
+func WithExecPolicy(p *policy.ExecPolicy) Option {
+	return func(opts *Options) {
+		opts.execPolicy = p
+	}
+}
+
+// WithRecordDir sets directory of pty and exec session recordings opt, sessions are not recorded if empty
+func WithRecordDir(dir string) Option {
+	return func(opts *Options) {
+		opts.recordDir = dir
+	}
+}
+
+// WithRecordInput sets recording user input of pty and exec sessions opt
+func WithRecordInput(recordInput bool) Option {
+	return func(opts *Options) {
+		opts.recordInput = recordInput
+	}
+}
+
+// WithFilePolicy sets paths accessible by file transfer opt, file transfer is disabled if nil
+func WithFilePolicy(p *policy.FilePolicy) Option {
+	return func(opts *Options) {
+		opts.filePolicy = p
+	}
+}
+
+// WithMetrics sets metrics opt, metrics are not collected if nil
+func WithMetrics(m *common.Metrics) Option {
+	return func(opts *Options) {
+		opts.metrics = m
+	}
+}
+
+// WithAccounting sets traffic accounting of tcp connections opt, which metrics, admin api and access log read,
+// accounting with EWMA counters by default
+func WithAccounting(a *counter.Accounting) Option {
+	return func(opts *Options) {
+		opts.accounting = a
+	}
+}
+
+// WithAdmin sets registry of live tunnels and connections served by admin api opt, nothing is registered if nil
+func WithAdmin(r *admin.Registry) Option {
+	return func(opts *Options) {
+		opts.admin = r
+	}
+}
+
+// WithAccessLog sets access log of forwarded connections opt, nothing is logged if nil
+func WithAccessLog(l *accesslog.Logger) Option {
+	return func(opts *Options) {
+		opts.accessLog = l
+	}
+}
+
+// WithLogger sets logger opt, slog.Default() by default
+func WithLogger(logger *slog.Logger) Option {
+	return func(opts *Options) {
+		opts.logger = logger
+	}
+}
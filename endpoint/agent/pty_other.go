@@ -0,0 +1,23 @@
+//go:build !unix
+
+package agent
+
+import (
+	"errors"
+	"os"
+
+	"github.com/aymanbagabas/go-pty"
+	"github.com/tutils/tnet/endpoint/common"
+)
+
+// signalPTY kills the command started in pty, other signals are not supported
+func signalPTY(p pty.Pty, pid int, signal int32) error {
+	if signal != common.SignalKILL && signal != common.SignalTERM {
+		return errors.New("signal is not supported")
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Kill()
+}
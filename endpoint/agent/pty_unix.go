@@ -0,0 +1,29 @@
+//go:build unix
+
+package agent
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/aymanbagabas/go-pty"
+	"github.com/tutils/tnet/endpoint/common"
+	"golang.org/x/sys/unix"
+)
+
+// signalPTY sends signal to the foreground process group of pty,
+// or the process group of the command started in pty if it is unknown
+func signalPTY(p pty.Pty, pid int, signal int32) error {
+	switch signal {
+	case common.SignalHUP, common.SignalINT, common.SignalQUIT, common.SignalKILL, common.SignalTERM:
+	default:
+		return fmt.Errorf("unsupported signal %d", signal)
+	}
+
+	pgid, err := unix.IoctlGetInt(int(p.Fd()), unix.TIOCGPGRP)
+	if err != nil || pgid <= 0 {
+		// command is started in a new session by pty
+		pgid = pid
+	}
+	return syscall.Kill(-pgid, syscall.Signal(signal))
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/tutils/tnet/endpoint/common"
+)
+
+// sessionInput is a packet sent by proxy to an execute session
+type sessionInput struct {
+	cmd    common.Cmd
+	data   []byte
+	width  int16
+	height int16
+	signal int32
+	offset int64
+}
+
+// session is an execute session multiplexed on tunnel
+type session struct {
+	id      int64
+	kind    string
+	inputCh chan sessionInput // input is written by goroutine of session, the session is closed if it is full
+	done    <-chan struct{}
+	cancel  context.CancelFunc
+}
+
+// newSession registers a new session of kind, the returned context is canceled when the session is closed
+func (t *agentTun) newSession(ctx context.Context, sessionID int64, kind string) (context.Context, *session, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &session{
+		id:      sessionID,
+		kind:    kind,
+		inputCh: make(chan sessionInput, 1<<8),
+		done:    ctx.Done(),
+		cancel:  cancel,
+	}
+	if _, loaded := t.sessions.LoadOrStore(sessionID, s); loaded {
+		cancel()
+		return nil, nil, false
+	}
+	t.sessionWg.Add(1)
+	t.h.a.opts.metrics.SessionOpened(kind)
+	return ctx, s, true
+}
+
+func (t *agentTun) removeSession(s *session) {
+	s.cancel()
+	t.sessions.Delete(s.id)
+	t.h.a.opts.metrics.SessionClosed(s.kind)
+	t.sessionWg.Done()
+}
+
+func (t *agentTun) handleSessionInput(cmd common.Cmd) error {
+	var sessionID int64
+	var in sessionInput
+	var err error
+	in.cmd = cmd
+	switch cmd {
+	case common.CmdResizePTY:
+		sessionID, in.width, in.height, err = common.UnpackBodyResizePTY(t.tunr)
+	case common.CmdIOPTY:
+		sessionID, in.data, err = common.UnpackBodyIOPTY(t.tunr)
+	case common.CmdClosePTY:
+		sessionID, _, err = common.UnpackBodyClosePTY(t.tunr)
+	case common.CmdSignalPTY:
+		sessionID, in.signal, err = common.UnpackBodySignalPTY(t.tunr)
+	case common.CmdStdin:
+		sessionID, in.data, err = common.UnpackBodyStream(t.tunr)
+	case common.CmdCloseStdin:
+		sessionID, err = common.UnpackBodyCloseStdin(t.tunr)
+	case common.CmdExitExec:
+		sessionID, _, _, err = common.UnpackBodyExitExec(t.tunr)
+	case common.CmdFileChunk:
+		sessionID, in.offset, in.data, err = common.UnpackBodyFileChunk(t.tunr)
+	case common.CmdFileAck:
+		sessionID, in.offset, err = common.UnpackBodyFileAck(t.tunr)
+	case common.CmdFileClose:
+		sessionID, _, err = common.UnpackBodyFileClose(t.tunr)
+	}
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", cmd, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", cmd, "sessionID", sessionID, "bytes", len(in.data))
+
+	v, ok := t.sessions.Load(sessionID)
+	if !ok {
+		t.logger.Debug("session not found", "cmd", cmd, "sessionID", sessionID)
+		return nil // ignore
+	}
+	s := v.(*session)
+	if cmd == common.CmdClosePTY || cmd == common.CmdExitExec || cmd == common.CmdFileClose {
+		// proxy terminates the session
+		s.cancel()
+		return nil
+	}
+	// tunnel reader never waits for a session, a session not consuming its input is closed
+	select {
+	case s.inputCh <- in:
+	case <-s.done:
+	default:
+		t.logger.Warn("session input buffer is full, close session", "cmd", cmd, "sessionID", sessionID)
+		s.cancel()
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ConnectErrCode is error code of connect result
+type ConnectErrCode int8
+
+// connect error code values
+const (
+	ConnectOK ConnectErrCode = iota
+	ConnectErrUnknown
+	ConnectErrRefused
+	ConnectErrTimeout
+	ConnectErrDNS
+	ConnectErrUnreachable
+	ConnectErrDenied
+)
+
+var connectErrCodeName = map[ConnectErrCode]string{
+	ConnectOK:             "ok",
+	ConnectErrUnknown:     "unknown",
+	ConnectErrRefused:     "connection refused",
+	ConnectErrTimeout:     "timeout",
+	ConnectErrDNS:         "dns failure",
+	ConnectErrUnreachable: "host unreachable",
+	ConnectErrDenied:      "denied by policy",
+}
+
+func (c ConnectErrCode) String() string {
+	if name, ok := connectErrCodeName[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code(%d)", int8(c))
+}
+
+var connectErrCodeReason = map[ConnectErrCode]string{
+	ConnectOK:             "success",
+	ConnectErrUnknown:     "unknown",
+	ConnectErrRefused:     "refused",
+	ConnectErrTimeout:     "timeout",
+	ConnectErrDNS:         "dns",
+	ConnectErrUnreachable: "unreachable",
+	ConnectErrDenied:      "denied",
+}
+
+// Reason returns short name of code used as metric label
+func (c ConnectErrCode) Reason() string {
+	if reason, ok := connectErrCodeReason[c]; ok {
+		return reason
+	}
+	return "unknown"
+}
+
+// ConnectError is connect failure reported by remote peer
+type ConnectError struct {
+	Code ConnectErrCode
+	Msg  string
+}
+
+func (e *ConnectError) Error() string {
+	if e.Msg == "" {
+		return e.Code.String()
+	}
+	return e.Code.String() + ": " + e.Msg
+}
+
+// NewConnectError classifies err into a ConnectError
+func NewConnectError(err error) *ConnectError {
+	if err == nil {
+		return nil
+	}
+	var ce *ConnectError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	return &ConnectError{Code: classifyConnectError(err), Msg: err.Error()}
+}
+
+func classifyConnectError(err error) ConnectErrCode {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return ConnectErrTimeout
+		}
+		return ConnectErrDNS
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ConnectErrTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ConnectErrTimeout
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectErrRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ConnectErrUnreachable
+	}
+	return ConnectErrUnknown
+}
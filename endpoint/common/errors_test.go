@@ -0,0 +1,67 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func dialError(err error) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+}
+
+func TestNewConnectError(t *testing.T) {
+	denied := &ConnectError{Code: ConnectErrDenied, Msg: "policy denied"}
+	cases := []struct {
+		err  error
+		code ConnectErrCode
+	}{
+		{dialError(syscall.ECONNREFUSED), ConnectErrRefused},
+		{dialError(syscall.EHOSTUNREACH), ConnectErrUnreachable},
+		{dialError(syscall.ENETUNREACH), ConnectErrUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}}, ConnectErrDNS},
+		{&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, ConnectErrTimeout},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, ConnectErrTimeout},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), ConnectErrTimeout},
+		{fmt.Errorf("connect: %w", denied), ConnectErrDenied},
+		{errors.New("boom"), ConnectErrUnknown},
+	}
+	for _, c := range cases {
+		ce := NewConnectError(c.err)
+		if ce == nil || ce.Code != c.code {
+			t.Errorf("NewConnectError(%v) = %v, want code %v", c.err, ce, c.code)
+		}
+	}
+	if ce := NewConnectError(nil); ce != nil {
+		t.Errorf("NewConnectError(nil) = %v, want nil", ce)
+	}
+	if ce := NewConnectError(denied); ce != denied {
+		t.Errorf("ConnectError is not kept: %v", ce)
+	}
+}
+
+func TestNewConnectErrorRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, err = net.Dial("tcp", addr)
+	if err == nil {
+		t.Skip("closed port accepted connection")
+	}
+	if ce := NewConnectError(err); ce.Code != ConnectErrRefused || ce.Code.Reason() != "refused" {
+		t.Errorf("dial of closed port is classified as %v", ce.Code)
+	}
+}
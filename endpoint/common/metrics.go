@@ -0,0 +1,121 @@
+package common
+
+import (
+	"sync/atomic"
+
+	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/metrics"
+)
+
+// session kinds of metrics
+const (
+	SessionPTY  = "pty"
+	SessionExec = "exec"
+	SessionFile = "file"
+)
+
+// Metrics is metrics of tunnels, connections and sessions shared by proxy and agent,
+// all methods do nothing on nil Metrics
+type Metrics struct {
+	tunnelsActive    *metrics.Gauge
+	tunnelsTotal     *metrics.Counter
+	tunnelReconnects *metrics.Counter
+	bytes            *metrics.CounterVec
+	connsActive      *metrics.GaugeVec
+	connsTotal       *metrics.CounterVec
+	connects         *metrics.CounterVec
+	sessionsActive   *metrics.GaugeVec
+	sessionsTotal    *metrics.CounterVec
+
+	opened atomic.Int64
+}
+
+// NewMetrics registers metrics to r
+func NewMetrics(r *metrics.Registry) *Metrics {
+	return &Metrics{
+		tunnelsActive:    r.NewGaugeVec("tnet_tunnels_active", "Number of established tunnels.").With(),
+		tunnelsTotal:     r.NewCounterVec("tnet_tunnels_total", "Number of tunnels established.").With(),
+		tunnelReconnects: r.NewCounterVec("tnet_tunnel_reconnects_total", "Number of tunnels re-established by dialing side after the first one.").With(),
+		bytes:            r.NewCounterVec("tnet_connection_bytes_total", "Bytes of forwarded tcp connections, upload is from client to target.", "direction"),
+		connsActive:      r.NewGaugeVec("tnet_connections_active", "Number of forwarded tcp connections.", "mapping"),
+		connsTotal:       r.NewCounterVec("tnet_connections_total", "Number of tcp connections forwarded.", "mapping"),
+		connects:         r.NewCounterVec("tnet_connects_total", "Results of connecting forwarded tcp connections.", "mapping", "result"),
+		sessionsActive:   r.NewGaugeVec("tnet_sessions_active", "Number of running pty, exec and file sessions.", "kind"),
+		sessionsTotal:    r.NewCounterVec("tnet_sessions_total", "Number of pty, exec and file sessions started.", "kind"),
+	}
+}
+
+// TunnelOpened counts an established tunnel, dialer tells whether this side dialed it
+func (m *Metrics) TunnelOpened(dialer bool) {
+	if m == nil {
+		return
+	}
+	if m.opened.Add(1) > 1 && dialer {
+		m.tunnelReconnects.Inc()
+	}
+	m.tunnelsTotal.Inc()
+	m.tunnelsActive.Inc()
+}
+
+// TunnelClosed counts a closed tunnel
+func (m *Metrics) TunnelClosed() {
+	if m == nil {
+		return
+	}
+	m.tunnelsActive.Dec()
+}
+
+// CountTraffic exports bytes of t, which is total traffic of connections counted by accounting
+func (m *Metrics) CountTraffic(t *counter.Traffic) {
+	if m == nil || t == nil {
+		return
+	}
+	m.bytes.Func(func() float64 { return float64(t.Upload.Value()) }, "upload")
+	m.bytes.Func(func() float64 { return float64(t.Download.Value()) }, "download")
+}
+
+// ConnectResult counts result of connecting forwarded connection of mapping
+func (m *Metrics) ConnectResult(mapping string, result error) {
+	if m == nil {
+		return
+	}
+	reason := "success"
+	if ce := NewConnectError(result); ce != nil {
+		reason = ce.Code.Reason()
+	}
+	m.connects.With(mapping, reason).Inc()
+}
+
+// ConnOpened counts a forwarded connection of mapping
+func (m *Metrics) ConnOpened(mapping string) {
+	if m == nil {
+		return
+	}
+	m.connsTotal.With(mapping).Inc()
+	m.connsActive.With(mapping).Inc()
+}
+
+// ConnClosed counts a closed forwarded connection of mapping
+func (m *Metrics) ConnClosed(mapping string) {
+	if m == nil {
+		return
+	}
+	m.connsActive.With(mapping).Dec()
+}
+
+// SessionOpened counts a session of kind
+func (m *Metrics) SessionOpened(kind string) {
+	if m == nil {
+		return
+	}
+	m.sessionsTotal.With(kind).Inc()
+	m.sessionsActive.With(kind).Inc()
+}
+
+// SessionClosed counts a closed session of kind
+func (m *Metrics) SessionClosed(kind string) {
+	if m == nil {
+		return
+	}
+	m.sessionsActive.With(kind).Dec()
+}
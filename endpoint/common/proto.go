@@ -1,9 +1,13 @@
 package common
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"math"
 )
 
 // Cmd is command code of tunnel packet
@@ -23,6 +27,83 @@ const (
 	CmdResizePTY
 	CmdIOPTY
 	CmdClosePTY
+
+	CmdConnectExec
+	CmdConnectExecResult
+	CmdStdin
+	CmdStdout
+	CmdStderr
+	CmdCloseStdin
+	CmdExitExec
+
+	CmdSignalPTY
+
+	CmdFileStat
+	CmdFileStatResult
+	CmdFileChecksum
+	CmdFileChecksumResult
+	CmdFileOpen
+	CmdFileOpenResult
+	CmdFileChunk
+	CmdFileAck
+	CmdFileClose
+
+	CmdConnectTo
+	CmdDownloadLimit
+)
+
+var cmdNames = map[Cmd]string{
+	CmdConfig:             "CmdConfig",
+	CmdTunID:              "CmdTunID",
+	CmdConnect:            "CmdConnect",
+	CmdConnectResult:      "CmdConnectResult",
+	CmdSend:               "CmdSend",
+	CmdClose:              "CmdClose",
+	CmdConnectPTY:         "CmdConnectPTY",
+	CmdConnectPTYResult:   "CmdConnectPTYResult",
+	CmdResizePTY:          "CmdResizePTY",
+	CmdIOPTY:              "CmdIOPTY",
+	CmdClosePTY:           "CmdClosePTY",
+	CmdConnectExec:        "CmdConnectExec",
+	CmdConnectExecResult:  "CmdConnectExecResult",
+	CmdStdin:              "CmdStdin",
+	CmdStdout:             "CmdStdout",
+	CmdStderr:             "CmdStderr",
+	CmdCloseStdin:         "CmdCloseStdin",
+	CmdExitExec:           "CmdExitExec",
+	CmdSignalPTY:          "CmdSignalPTY",
+	CmdFileStat:           "CmdFileStat",
+	CmdFileStatResult:     "CmdFileStatResult",
+	CmdFileChecksum:       "CmdFileChecksum",
+	CmdFileChecksumResult: "CmdFileChecksumResult",
+	CmdFileOpen:           "CmdFileOpen",
+	CmdFileOpenResult:     "CmdFileOpenResult",
+	CmdFileChunk:          "CmdFileChunk",
+	CmdFileAck:            "CmdFileAck",
+	CmdFileClose:          "CmdFileClose",
+	CmdConnectTo:          "CmdConnectTo",
+	CmdDownloadLimit:      "CmdDownloadLimit",
+}
+
+func (c Cmd) String() string {
+	if name, ok := cmdNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Cmd(%d)", int8(c))
+}
+
+// LogValue implements slog.LogValuer, cmd is logged by name in all formats
+func (c Cmd) LogValue() slog.Value {
+	return slog.StringValue(c.String())
+}
+
+// signal values of CmdSignalPTY, they are the same on all platforms
+const (
+	SignalHUP  int32 = 1
+	SignalINT  int32 = 2
+	SignalQUIT int32 = 3
+	SignalKILL int32 = 9
+	SignalTERM int32 = 15
 )
 
 func PackHeader(w io.Writer, cmd Cmd) error {
@@ -34,6 +115,22 @@ func UnpackHeader(r io.Reader) (cmd Cmd, err error) {
 	return cmd, err
 }
 
+// WritePacket packs a packet into buffer and writes it to tunw in a single Write call,
+// so that packets written by concurrent goroutines are not interleaved
+func WritePacket(tunw io.Writer, cmd Cmd, packBody func(w io.Writer) error) error {
+	buf := &bytes.Buffer{} // TODO: use pool
+	if err := PackHeader(buf, cmd); err != nil {
+		return err
+	}
+	if packBody != nil {
+		if err := packBody(buf); err != nil {
+			return err
+		}
+	}
+	_, err := tunw.Write(buf.Bytes())
+	return err
+}
+
 func PackBodyConfig(w io.Writer, connectAddr string) error {
 	if err := binary.Write(w, binary.BigEndian, int16(len(connectAddr))); err != nil {
 		return err
@@ -75,39 +172,87 @@ func UnpackBodyConnect(r io.Reader) (connID int64, err error) {
 	return connID, err
 }
 
+// PackBodyConnectTo packs CmdConnectTo, which connects connID to connectAddr instead of the one of CmdConfig
+func PackBodyConnectTo(w io.Writer, connID int64, connectAddr string) error {
+	if err := binary.Write(w, binary.BigEndian, connID); err != nil {
+		return err
+	}
+	return packString(w, connectAddr)
+}
+
+func UnpackBodyConnectTo(r io.Reader) (connID int64, connectAddr string, err error) {
+	if err = binary.Read(r, binary.BigEndian, &connID); err != nil {
+		return 0, "", err
+	}
+	if connectAddr, err = unpackString(r); err != nil {
+		return 0, "", err
+	}
+	return connID, connectAddr, nil
+}
+
+// PackBodyDownloadLimit packs CmdDownloadLimit, which asks agent to limit reading from targets of tcp connections
+// to connRate bytes per second for each connection and sharedRate for all connections of the tunnel, 0 means no limit.
+// Limits are enforced by agent so that a slow connection doesn't block the tunnel.
+func PackBodyDownloadLimit(w io.Writer, connRate int64, sharedRate int64) error {
+	if err := binary.Write(w, binary.BigEndian, connRate); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, sharedRate)
+}
+
+func UnpackBodyDownloadLimit(r io.Reader) (connRate int64, sharedRate int64, err error) {
+	if err = binary.Read(r, binary.BigEndian, &connRate); err != nil {
+		return 0, 0, err
+	}
+	err = binary.Read(r, binary.BigEndian, &sharedRate)
+	return connRate, sharedRate, err
+}
+
 func PackBodyConnectResult(w io.Writer, connID int64, connectResult error) error {
 	if err := binary.Write(w, binary.BigEndian, connID); err != nil {
 		return err
 	}
-	if connectResult != nil {
-		if err := binary.Write(w, binary.BigEndian, int16(len(connectResult.Error()))); err != nil {
-			return err
-		}
-		if err := binary.Write(w, binary.BigEndian, []byte(connectResult.Error())); err != nil {
-			return err
-		}
-	} else {
-		if err := binary.Write(w, binary.BigEndian, int16(0)); err != nil {
-			return err
-		}
+	code, msg := ConnectOK, ""
+	if ce := NewConnectError(connectResult); ce != nil {
+		code, msg = ce.Code, ce.Msg
+	}
+	if len(msg) > math.MaxInt16 {
+		msg = msg[:math.MaxInt16]
+	}
+	if err := binary.Write(w, binary.BigEndian, code); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, int16(len(msg))); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, []byte(msg)); err != nil {
+		return err
 	}
 	return nil
 }
 
+// UnpackBodyConnectResult returns connectResult as *ConnectError if connecting failed
 func UnpackBodyConnectResult(r io.Reader) (connID int64, connectResult error, err error) {
 	if err := binary.Read(r, binary.BigEndian, &connID); err != nil {
 		return 0, connectResult, err
 	}
+	var code ConnectErrCode
+	if err := binary.Read(r, binary.BigEndian, &code); err != nil {
+		return connID, connectResult, err
+	}
 	var n int16
 	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
 		return connID, connectResult, err
 	}
-	if n > 0 {
-		b := make([]byte, n)
-		if err := binary.Read(r, binary.BigEndian, b); err != nil {
-			return connID, connectResult, err
-		}
-		connectResult = errors.New(string(b))
+	if n < 0 {
+		return connID, connectResult, fmt.Errorf("invalid length %d of connect result message", n)
+	}
+	b := make([]byte, n)
+	if err := binary.Read(r, binary.BigEndian, b); err != nil {
+		return connID, connectResult, err
+	}
+	if code != ConnectOK {
+		connectResult = &ConnectError{Code: code, Msg: string(b)}
 	}
 	return connID, connectResult, nil
 }
@@ -149,14 +294,7 @@ func UnpackBodyClose(r io.Reader) (connID int64, err error) {
 	return connID, err
 }
 
-func PackBodyConnectPTY(w io.Writer, rawMode bool, args []string, width int16, height int16) error {
-	var mode uint8
-	if rawMode {
-		mode = 1
-	}
-	if err := binary.Write(w, binary.BigEndian, mode); err != nil {
-		return err
-	}
+func packArgs(w io.Writer, args []string) error {
 	n := int16(len(args))
 	if err := binary.Write(w, binary.BigEndian, n); err != nil {
 		return err
@@ -169,57 +307,44 @@ func PackBodyConnectPTY(w io.Writer, rawMode bool, args []string, width int16, h
 			return err
 		}
 	}
-	if err := PackBodyResizePTY(w, width, height); err != nil {
-		return err
-	}
 	return nil
 }
 
-func UnpackBodyConnectPTY(r io.Reader) (rawMode bool, args []string, width int16, height int16, err error) {
-	var mode uint8
-	if err := binary.Read(r, binary.BigEndian, &mode); err != nil {
-		return false, nil, 0, 0, err
-	}
-	if mode == 1 {
-		rawMode = true
-	}
-
+func unpackArgs(r io.Reader) (args []string, err error) {
 	var n int16
 	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
-		return false, nil, 0, 0, err
+		return nil, err
 	}
 
 	for i := int16(0); i < n; i++ {
 		var argLen int16
 		if err := binary.Read(r, binary.BigEndian, &argLen); err != nil {
-			return false, nil, 0, 0, err
+			return nil, err
 		}
 		b := make([]byte, argLen)
 		if _, err := io.ReadAtLeast(r, b, int(argLen)); err != nil {
-			return false, nil, 0, 0, err
+			return nil, err
 		}
 		args = append(args, string(b))
 	}
+	return args, nil
+}
 
-	if width, height, err = UnpackBodyResizePTY(r); err != nil {
-		return false, nil, 0, 0, err
-	}
+func packSessionID(w io.Writer, sessionID int64) error {
+	return binary.Write(w, binary.BigEndian, sessionID)
+}
 
-	return rawMode, args, width, height, nil
+func unpackSessionID(r io.Reader) (sessionID int64, err error) {
+	err = binary.Read(r, binary.BigEndian, &sessionID)
+	return sessionID, err
 }
 
-func PackBodyConnectPTYResult(w io.Writer, connectResult error) error {
-	// if err := binary.Write(w, binary.BigEndian, int16(len(output))); err != nil {
-	// 	return err
-	// }
-	// if _, err := w.Write([]byte(output)); err != nil {
-	// 	return err
-	// }
-	if connectResult != nil {
-		if err := binary.Write(w, binary.BigEndian, int16(len(connectResult.Error()))); err != nil {
+func packResult(w io.Writer, result error) error {
+	if result != nil {
+		if err := binary.Write(w, binary.BigEndian, int16(len(result.Error()))); err != nil {
 			return err
 		}
-		if _, err := w.Write([]byte(connectResult.Error())); err != nil {
+		if _, err := w.Write([]byte(result.Error())); err != nil {
 			return err
 		}
 	} else {
@@ -230,7 +355,7 @@ func PackBodyConnectPTYResult(w io.Writer, connectResult error) error {
 	return nil
 }
 
-func UnpackBodyConnectPTYResult(r io.Reader) (connectResult error, err error) {
+func unpackResult(r io.Reader) (result error, err error) {
 	var n int16
 	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
 		return nil, err
@@ -240,12 +365,42 @@ func UnpackBodyConnectPTYResult(r io.Reader) (connectResult error, err error) {
 		if err := binary.Read(r, binary.BigEndian, b); err != nil {
 			return nil, err
 		}
-		connectResult = errors.New(string(b))
+		result = errors.New(string(b))
+	}
+	return result, nil
+}
+
+func packData(w io.Writer, data []byte) error {
+	n := int32(len(data))
+	if err := binary.Write(w, binary.BigEndian, n); err != nil {
+		return err
+	}
+	nw, err := w.Write(data)
+	if err != nil {
+		return err
+	}
+	if nw < 0 || nw > len(data) {
+		return errors.New("invalid write result")
 	}
-	return connectResult, nil
+	if nw < len(data) {
+		return io.ErrShortWrite
+	}
+	return nil
 }
 
-func PackBodyResizePTY(w io.Writer, width int16, height int16) error {
+func unpackData(r io.Reader) (data []byte, err error) {
+	var n int32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	data = make([]byte, n)
+	if _, err := io.ReadAtLeast(r, data, int(n)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func packSize(w io.Writer, width int16, height int16) error {
 	if err := binary.Write(w, binary.BigEndian, width); err != nil {
 		return err
 	}
@@ -255,7 +410,7 @@ func PackBodyResizePTY(w io.Writer, width int16, height int16) error {
 	return nil
 }
 
-func UnpackBodyResizePTY(r io.Reader) (width int16, height int16, err error) {
+func unpackSize(r io.Reader) (width int16, height int16, err error) {
 	if err := binary.Read(r, binary.BigEndian, &width); err != nil {
 		return 0, 0, err
 	}
@@ -265,41 +420,202 @@ func UnpackBodyResizePTY(r io.Reader) (width int16, height int16, err error) {
 	return width, height, nil
 }
 
-func PackBodyIOPTY(w io.Writer, data []byte) error {
-	n := int32(len(data))
-	if err := binary.Write(w, binary.BigEndian, n); err != nil {
+// PTY and exec commands carry a session ID allocated by proxy,
+// so that many sessions and tcp connections can share one tunnel.
+
+func PackBodyConnectPTY(w io.Writer, sessionID int64, rawMode bool, args []string, width int16, height int16) error {
+	if err := packSessionID(w, sessionID); err != nil {
 		return err
 	}
-	nw, err := w.Write(data)
-	if err != nil {
+	var mode uint8
+	if rawMode {
+		mode = 1
+	}
+	if err := binary.Write(w, binary.BigEndian, mode); err != nil {
 		return err
 	}
-	if nw < 0 || nw > len(data) {
-		return errors.New("invalid write result")
+	if err := packArgs(w, args); err != nil {
+		return err
 	}
-	if nw < len(data) {
-		return io.ErrShortWrite
+	if err := packSize(w, width, height); err != nil {
+		return err
 	}
 	return nil
 }
 
-func UnpackBodyIOPTY(r io.Reader) (data []byte, err error) {
-	var n int32
-	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
-		return nil, err
+func UnpackBodyConnectPTY(r io.Reader) (sessionID int64, rawMode bool, args []string, width int16, height int16, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, false, nil, 0, 0, err
 	}
-	data = make([]byte, n)
-	if _, err := io.ReadAtLeast(r, data, int(n)); err != nil {
-		return nil, err
+	var mode uint8
+	if err := binary.Read(r, binary.BigEndian, &mode); err != nil {
+		return 0, false, nil, 0, 0, err
 	}
-	return data, nil
+	if mode == 1 {
+		rawMode = true
+	}
+
+	if args, err = unpackArgs(r); err != nil {
+		return 0, false, nil, 0, 0, err
+	}
+
+	if width, height, err = unpackSize(r); err != nil {
+		return 0, false, nil, 0, 0, err
+	}
+
+	return sessionID, rawMode, args, width, height, nil
+}
+
+func PackBodyConnectPTYResult(w io.Writer, sessionID int64, connectResult error) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	return packResult(w, connectResult)
+}
+
+func UnpackBodyConnectPTYResult(r io.Reader) (sessionID int64, connectResult error, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, nil, err
+	}
+	if connectResult, err = unpackResult(r); err != nil {
+		return 0, nil, err
+	}
+	return sessionID, connectResult, nil
+}
+
+func PackBodyResizePTY(w io.Writer, sessionID int64, width int16, height int16) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	return packSize(w, width, height)
+}
+
+func UnpackBodyResizePTY(r io.Reader) (sessionID int64, width int16, height int16, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, 0, 0, err
+	}
+	if width, height, err = unpackSize(r); err != nil {
+		return 0, 0, 0, err
+	}
+	return sessionID, width, height, nil
 }
 
-func PackBodyClosePTY(w io.Writer, exitCode int64) error {
+func PackBodyIOPTY(w io.Writer, sessionID int64, data []byte) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	return packData(w, data)
+}
+
+func UnpackBodyIOPTY(r io.Reader) (sessionID int64, data []byte, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, nil, err
+	}
+	if data, err = unpackData(r); err != nil {
+		return 0, nil, err
+	}
+	return sessionID, data, nil
+}
+
+// PackBodyClosePTY packs exit code of pty session sent by agent,
+// proxy sends it to terminate the session
+func PackBodyClosePTY(w io.Writer, sessionID int64, exitCode int64) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
 	return binary.Write(w, binary.BigEndian, exitCode)
 }
 
-func UnpackBodyClosePTY(r io.Reader) (exitCode int64, err error) {
+func UnpackBodyClosePTY(r io.Reader) (sessionID int64, exitCode int64, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, 0, err
+	}
 	err = binary.Read(r, binary.BigEndian, &exitCode)
-	return exitCode, err
+	return sessionID, exitCode, err
+}
+
+func PackBodyConnectExec(w io.Writer, sessionID int64, args []string) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	return packArgs(w, args)
+}
+
+func UnpackBodyConnectExec(r io.Reader) (sessionID int64, args []string, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, nil, err
+	}
+	if args, err = unpackArgs(r); err != nil {
+		return 0, nil, err
+	}
+	return sessionID, args, nil
+}
+
+func PackBodyConnectExecResult(w io.Writer, sessionID int64, connectResult error) error {
+	return PackBodyConnectPTYResult(w, sessionID, connectResult)
+}
+
+func UnpackBodyConnectExecResult(r io.Reader) (sessionID int64, connectResult error, err error) {
+	return UnpackBodyConnectPTYResult(r)
+}
+
+// PackBodyStream packs body of CmdStdin, CmdStdout and CmdStderr
+func PackBodyStream(w io.Writer, sessionID int64, data []byte) error {
+	return PackBodyIOPTY(w, sessionID, data)
+}
+
+// UnpackBodyStream unpacks body of CmdStdin, CmdStdout and CmdStderr
+func UnpackBodyStream(r io.Reader) (sessionID int64, data []byte, err error) {
+	return UnpackBodyIOPTY(r)
+}
+
+func PackBodyCloseStdin(w io.Writer, sessionID int64) error {
+	return packSessionID(w, sessionID)
+}
+
+func UnpackBodyCloseStdin(r io.Reader) (sessionID int64, err error) {
+	return unpackSessionID(r)
+}
+
+// PackBodyExitExec packs exit code and terminating signal, signal is 0 if the process exited normally.
+// proxy sends it to terminate the session
+func PackBodyExitExec(w io.Writer, sessionID int64, exitCode int64, signal int32) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, exitCode); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, signal)
+}
+
+func UnpackBodyExitExec(r io.Reader) (sessionID int64, exitCode int64, signal int32, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, 0, 0, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &exitCode); err != nil {
+		return 0, 0, 0, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &signal); err != nil {
+		return 0, 0, 0, err
+	}
+	return sessionID, exitCode, signal, nil
+}
+
+// PackBodySignalPTY packs signal delivered to the foreground process group of pty
+func PackBodySignalPTY(w io.Writer, sessionID int64, signal int32) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, signal)
+}
+
+func UnpackBodySignalPTY(r io.Reader) (sessionID int64, signal int32, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &signal); err != nil {
+		return 0, 0, err
+	}
+	return sessionID, signal, nil
 }
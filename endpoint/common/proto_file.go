@@ -0,0 +1,252 @@
+package common
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// FileChunkSize is the max data size of CmdFileChunk
+const FileChunkSize = 32 << 10
+
+// FileWindowSize is the max size of unacknowledged CmdFileChunk data in flight
+const FileWindowSize = 1 << 20
+
+func packString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.BigEndian, int16(len(s))); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+func unpackString(r io.Reader) (s string, err error) {
+	var n int16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func PackBodyFileStat(w io.Writer, sessionID int64, path string) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	return packString(w, path)
+}
+
+func UnpackBodyFileStat(r io.Reader) (sessionID int64, path string, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, "", err
+	}
+	if path, err = unpackString(r); err != nil {
+		return 0, "", err
+	}
+	return sessionID, path, nil
+}
+
+// FileStat is file information of CmdFileStatResult, Size is -1 if the file does not exist
+type FileStat struct {
+	Size    int64
+	Mode    uint32 // permission bits
+	IsDir   bool
+	ModTime int64 // unix seconds
+}
+
+func PackBodyFileStatResult(w io.Writer, sessionID int64, result error, stat *FileStat) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	if err := packResult(w, result); err != nil {
+		return err
+	}
+	if stat == nil {
+		stat = &FileStat{Size: -1}
+	}
+	return binary.Write(w, binary.BigEndian, stat)
+}
+
+func UnpackBodyFileStatResult(r io.Reader) (sessionID int64, result error, stat *FileStat, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, nil, nil, err
+	}
+	if result, err = unpackResult(r); err != nil {
+		return 0, nil, nil, err
+	}
+	stat = &FileStat{}
+	if err := binary.Read(r, binary.BigEndian, stat); err != nil {
+		return 0, nil, nil, err
+	}
+	return sessionID, result, stat, nil
+}
+
+// PackBodyFileChecksum packs request of SHA-256 of the first length bytes of file, -1 means the whole file
+func PackBodyFileChecksum(w io.Writer, sessionID int64, path string, length int64) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	if err := packString(w, path); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, length)
+}
+
+func UnpackBodyFileChecksum(r io.Reader) (sessionID int64, path string, length int64, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, "", 0, err
+	}
+	if path, err = unpackString(r); err != nil {
+		return 0, "", 0, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, "", 0, err
+	}
+	return sessionID, path, length, nil
+}
+
+func PackBodyFileChecksumResult(w io.Writer, sessionID int64, result error, sum []byte) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	if err := packResult(w, result); err != nil {
+		return err
+	}
+	return packData(w, sum)
+}
+
+func UnpackBodyFileChecksumResult(r io.Reader) (sessionID int64, result error, sum []byte, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, nil, nil, err
+	}
+	if result, err = unpackResult(r); err != nil {
+		return 0, nil, nil, err
+	}
+	if sum, err = unpackData(r); err != nil {
+		return 0, nil, nil, err
+	}
+	return sessionID, result, sum, nil
+}
+
+// PackBodyFileOpen packs request of opening file for reading from offset,
+// or for writing at offset where the file is truncated to offset
+func PackBodyFileOpen(w io.Writer, sessionID int64, path string, write bool, offset int64, mode uint32) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	if err := packString(w, path); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, write); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, offset); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, mode)
+}
+
+func UnpackBodyFileOpen(r io.Reader) (sessionID int64, path string, write bool, offset int64, mode uint32, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, "", false, 0, 0, err
+	}
+	if path, err = unpackString(r); err != nil {
+		return 0, "", false, 0, 0, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &write); err != nil {
+		return 0, "", false, 0, 0, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &offset); err != nil {
+		return 0, "", false, 0, 0, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &mode); err != nil {
+		return 0, "", false, 0, 0, err
+	}
+	return sessionID, path, write, offset, mode, nil
+}
+
+// PackBodyFileOpenResult packs open result and file size
+func PackBodyFileOpenResult(w io.Writer, sessionID int64, result error, size int64) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	if err := packResult(w, result); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, size)
+}
+
+func UnpackBodyFileOpenResult(r io.Reader) (sessionID int64, result error, size int64, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, nil, 0, err
+	}
+	if result, err = unpackResult(r); err != nil {
+		return 0, nil, 0, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return 0, nil, 0, err
+	}
+	return sessionID, result, size, nil
+}
+
+// PackBodyFileChunk packs file data at offset, empty data means the end of file
+func PackBodyFileChunk(w io.Writer, sessionID int64, offset int64, data []byte) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, offset); err != nil {
+		return err
+	}
+	return packData(w, data)
+}
+
+func UnpackBodyFileChunk(r io.Reader) (sessionID int64, offset int64, data []byte, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, 0, nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &offset); err != nil {
+		return 0, 0, nil, err
+	}
+	if data, err = unpackData(r); err != nil {
+		return 0, 0, nil, err
+	}
+	return sessionID, offset, data, nil
+}
+
+// PackBodyFileAck packs the offset up to which file data has been received
+func PackBodyFileAck(w io.Writer, sessionID int64, offset int64) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, offset)
+}
+
+func UnpackBodyFileAck(r io.Reader) (sessionID int64, offset int64, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &offset); err != nil {
+		return 0, 0, err
+	}
+	return sessionID, offset, nil
+}
+
+// PackBodyFileClose packs close of file transfer by either side, result is nil if the transfer succeeded
+func PackBodyFileClose(w io.Writer, sessionID int64, result error) error {
+	if err := packSessionID(w, sessionID); err != nil {
+		return err
+	}
+	return packResult(w, result)
+}
+
+func UnpackBodyFileClose(r io.Reader) (sessionID int64, result error, err error) {
+	if sessionID, err = unpackSessionID(r); err != nil {
+		return 0, nil, err
+	}
+	if result, err = unpackResult(r); err != nil {
+		return 0, nil, err
+	}
+	return sessionID, result, nil
+}
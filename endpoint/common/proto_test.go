@@ -0,0 +1,74 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestConnectResultRoundTrip(t *testing.T) {
+	cases := []struct {
+		result error
+		code   ConnectErrCode
+		msg    string
+	}{
+		{nil, ConnectOK, ""},
+		{&ConnectError{Code: ConnectErrDenied, Msg: "policy denied"}, ConnectErrDenied, "policy denied"},
+		{errors.New("boom"), ConnectErrUnknown, "boom"},
+		{&ConnectError{Code: ConnectErrTimeout}, ConnectErrTimeout, ""},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := PackBodyConnectResult(&buf, 42, c.result); err != nil {
+			t.Fatal(err)
+		}
+		connID, result, err := UnpackBodyConnectResult(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connID != 42 {
+			t.Errorf("connID = %d, want 42", connID)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%d bytes are left after unpacking %v", buf.Len(), c.result)
+		}
+		if c.code == ConnectOK {
+			if result != nil {
+				t.Errorf("result = %v, want nil", result)
+			}
+			continue
+		}
+		var ce *ConnectError
+		if !errors.As(result, &ce) || ce.Code != c.code || ce.Msg != c.msg {
+			t.Errorf("result of %v = %#v, want code %v msg %q", c.result, result, c.code, c.msg)
+		}
+	}
+}
+
+func TestConnectResultLongMessage(t *testing.T) {
+	var buf bytes.Buffer
+	msg := strings.Repeat("x", 1<<16)
+	if err := PackBodyConnectResult(&buf, 1, errors.New(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_, result, err := UnpackBodyConnectResult(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ce *ConnectError
+	if !errors.As(result, &ce) || !strings.HasPrefix(msg, ce.Msg) || len(ce.Msg) == 0 {
+		t.Errorf("long message is not truncated: %d bytes", len(ce.Msg))
+	}
+}
+
+func TestUnpackConnectResultShort(t *testing.T) {
+	var buf bytes.Buffer
+	PackBodyConnectResult(&buf, 1, errors.New("boom"))
+	b := buf.Bytes()
+	for n := 0; n < len(b); n++ {
+		if _, _, err := UnpackBodyConnectResult(bytes.NewReader(b[:n])); err == nil {
+			t.Errorf("truncated body of %d bytes is accepted", n)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+// RecordFileName returns name of recording file of a session
+func RecordFileName(tunID int64, sessionID int64) string {
+	return fmt.Sprintf("%s-%d-%d.cast", time.Now().Format("20060102-150405"), tunID, sessionID)
+}
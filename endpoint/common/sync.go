@@ -5,47 +5,47 @@ import (
 	"context"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 
 	"github.com/tutils/tnet/tun"
 )
 
-func SyncTunID(ctx context.Context, isServer bool, tunr io.Reader, tunw io.Writer) (int64, error) {
+func SyncTunID(ctx context.Context, logger *slog.Logger, isServer bool, tunr io.Reader, tunw io.Writer) (int64, error) {
 	if isServer {
 		// send tunID
 		tunID := ctx.Value(tun.ConnIDContextKey{}).(int64)
 		buf := &bytes.Buffer{} // TODO: use pool
 		if err := PackHeader(buf, CmdTunID); err != nil {
-			log.Println("packHeader err", err)
+			logger.Error("pack header failed", "cmd", CmdTunID, "err", err)
 			return 0, err
 		}
 		if err := PackBodyTunID(buf, tunID); err != nil {
-			log.Println("packBodyTunID err", err)
+			logger.Error("pack body failed", "cmd", CmdTunID, "err", err)
 			return 0, err
 		}
 		if _, err := tunw.Write(buf.Bytes()); err != nil {
-			log.Println("write tun err", err)
+			logger.Warn("write tunnel failed", "cmd", CmdTunID, "err", err)
 			return 0, err
 		}
-		log.Printf("Write CmdTunID, TunID %d", tunID)
+		logger.Debug("write packet", "cmd", CmdTunID, "tunID", tunID)
 		return tunID, nil
 	}
 
 	// recv tunID
 	cmd, err := UnpackHeader(tunr)
 	if err != nil {
-		log.Println("unpackHeader err", err)
+		logger.Warn("unpack header failed", "err", err)
 		return 0, err
 	}
 	if cmd != CmdTunID {
-		log.Println("invalid cmd")
+		logger.Error("invalid cmd", "cmd", cmd)
 		return 0, errors.New("wrong command, CmdTunID expected")
 	}
 	tunID, err := UnpackBodyTunID(tunr)
 	if err != nil {
-		log.Println("unpackBodyTunID err", err)
+		logger.Warn("unpack body failed", "cmd", cmd, "err", err)
 		return 0, err
 	}
-	log.Printf("Read CmdTunID, TunID %d", tunID)
+	logger.Debug("read packet", "cmd", cmd, "tunID", tunID)
 	return tunID, nil
 }
@@ -0,0 +1,328 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Action is action of rule
+type Action int
+
+// action values
+const (
+	Allow Action = iota
+	Deny
+)
+
+func (a Action) String() string {
+	if a == Deny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// ParseAction parses "allow" or "deny"
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	}
+	return Allow, fmt.Errorf("invalid action %q", s)
+}
+
+// Rule matches destination address by CIDR or hostname glob and port range
+type Rule struct {
+	Action Action
+
+	raw     string
+	ipNet   *net.IPNet
+	host    string // hostname glob if ipNet is nil
+	minPort int
+	maxPort int
+}
+
+func (r *Rule) String() string {
+	return r.Action.String() + " " + r.raw
+}
+
+// ParseRule parses rule of format host[:ports].
+// host is a CIDR, an IP or a hostname glob such as *.example.com,
+// IPv6 host must be enclosed in brackets if ports is given.
+// ports is a port, a port range such as 8000-9000 or *, and defaults to *.
+func ParseRule(action Action, s string) (*Rule, error) {
+	r := &Rule{Action: action, raw: s, minPort: 0, maxPort: 65535}
+	host, ports := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid rule %q", s)
+		}
+		host = s[1:end]
+		if rest := s[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return nil, fmt.Errorf("invalid rule %q", s)
+			}
+			ports = rest[1:]
+		}
+	} else if strings.Count(s, ":") == 1 {
+		i := strings.LastIndex(s, ":")
+		host, ports = s[:i], s[i+1:]
+	}
+	if host == "" {
+		return nil, fmt.Errorf("invalid rule %q: empty host", s)
+	}
+
+	if ports != "" && ports != "*" {
+		lo, hi, found := strings.Cut(ports, "-")
+		min, err := strconv.Atoi(lo)
+		if err != nil || min < 0 || min > 65535 {
+			return nil, fmt.Errorf("invalid rule %q: bad port %q", s, lo)
+		}
+		max := min
+		if found {
+			if max, err = strconv.Atoi(hi); err != nil || max < min || max > 65535 {
+				return nil, fmt.Errorf("invalid rule %q: bad port %q", s, hi)
+			}
+		}
+		r.minPort, r.maxPort = min, max
+	}
+
+	if _, ipNet, err := net.ParseCIDR(host); err == nil {
+		r.ipNet = ipNet
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", s, err)
+		}
+		r.host = normalizeHost(host)
+	}
+	return r, nil
+}
+
+func (r *Rule) matchPort(port int) bool {
+	return port >= r.minPort && port <= r.maxPort
+}
+
+func (r *Rule) matchHost(host string) bool {
+	if r.ipNet != nil {
+		return false
+	}
+	ok, _ := path.Match(r.host, normalizeHost(host))
+	return ok
+}
+
+// normalizeHost lowers hostname and removes trailing dot of fully qualified name,
+// db.internal. and DB.Internal are the same host as db.internal
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (r *Rule) matchIP(ip net.IP) bool {
+	return r.ipNet != nil && r.ipNet.Contains(ip)
+}
+
+// DeniedError is returned if destination is rejected by dial policy
+type DeniedError struct {
+	Addr   string
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("%s denied: %s", e.Addr, e.Reason)
+}
+
+// DialPolicy decides whether a destination address may be dialed.
+// Deny rules take precedence over allow rules, and once any allow rule
+// is configured, destinations matching no allow rule are denied.
+type DialPolicy struct {
+	rules []*Rule
+
+	// Resolver resolves hostnames for CIDR rules, net.DefaultResolver is used if nil
+	Resolver *net.Resolver
+}
+
+// NewDialPolicy creates a new dial policy
+func NewDialPolicy(rules ...*Rule) *DialPolicy {
+	return &DialPolicy{rules: rules}
+}
+
+// Rules returns rules of policy
+func (p *DialPolicy) Rules() []*Rule {
+	return p.rules
+}
+
+// Check returns *DeniedError if addr is not allowed.
+// Hostname of addr is resolved to check CIDR rules, it may resolve to other addresses when it is dialed,
+// so CheckDialed must also be called with the address actually dialed.
+func (p *DialPolicy) Check(ctx context.Context, addr string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	var ips []net.IP
+	isIP := false
+	if ip := net.ParseIP(host); ip != nil {
+		ips, isIP = []net.IP{ip}, true
+	} else if p.hasCIDRRule(port) {
+		resolver := p.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return &DeniedError{Addr: addr, Reason: err.Error()}
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	return p.check(addr, host, port, isIP, ips)
+}
+
+// CheckDialed returns *DeniedError if dialed, the ip address dialed for addr, is not allowed.
+// It is called by net.Dialer.ControlContext, see Control.
+func (p *DialPolicy) CheckDialed(addr string, dialed string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ipStr, _, err := net.SplitHostPort(dialed)
+	if err != nil {
+		ipStr = dialed
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return &DeniedError{Addr: addr, Reason: "invalid dialed address " + dialed}
+	}
+	return p.check(addr, host, port, net.ParseIP(host) != nil, []net.IP{ip})
+}
+
+// Control returns function of net.Dialer.ControlContext checking addresses dialed for addr
+func (p *DialPolicy) Control(addr string) func(ctx context.Context, network, address string, c syscall.RawConn) error {
+	return func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		return p.CheckDialed(addr, address)
+	}
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, &DeniedError{Addr: addr, Reason: err.Error()}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, &DeniedError{Addr: addr, Reason: "invalid port " + portStr}
+	}
+	return host, port, nil
+}
+
+// check checks host of addr, which is an ip if isIP, and its ips against rules
+func (p *DialPolicy) check(addr string, host string, port int, isIP bool, ips []net.IP) error {
+	hasAllow := false
+	allowedHost := false
+	allowedIPs := make([]bool, len(ips))
+	for _, r := range p.rules {
+		if !r.matchPort(port) {
+			if r.Action == Allow {
+				hasAllow = true
+			}
+			continue
+		}
+		switch r.Action {
+		case Deny:
+			if !isIP && r.matchHost(host) {
+				return &DeniedError{Addr: addr, Reason: "matched rule " + r.String()}
+			}
+			for _, ip := range ips {
+				if r.matchIP(ip) {
+					return &DeniedError{Addr: addr, Reason: fmt.Sprintf("%s matched rule %s", ip, r)}
+				}
+			}
+		case Allow:
+			hasAllow = true
+			if !isIP && r.matchHost(host) {
+				allowedHost = true
+			}
+			for i, ip := range ips {
+				if r.matchIP(ip) {
+					allowedIPs[i] = true
+				}
+			}
+		}
+	}
+
+	if !hasAllow || allowedHost {
+		return nil
+	}
+	if len(ips) == 0 {
+		return &DeniedError{Addr: addr, Reason: "no allow rule matched"}
+	}
+	for i, ok := range allowedIPs {
+		if !ok {
+			return &DeniedError{Addr: addr, Reason: fmt.Sprintf("%s matched no allow rule", ips[i])}
+		}
+	}
+	return nil
+}
+
+func (p *DialPolicy) hasCIDRRule(port int) bool {
+	for _, r := range p.rules {
+		if r.ipNet != nil && r.matchPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRulesFile loads rules from file, one "allow|deny rule" per line,
+// blank lines and lines starting with # are ignored
+func LoadRulesFile(name string) ([]*Rule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []*Rule
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"allow|deny rule\"", name, lineno)
+		}
+		action, err := ParseAction(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineno, err)
+		}
+		r, err := ParseRule(action, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineno, err)
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
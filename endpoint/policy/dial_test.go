@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func mustRule(t *testing.T, action Action, s string) *Rule {
+	r, err := ParseRule(action, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestDialPolicyCheck(t *testing.T) {
+	p := NewDialPolicy(
+		mustRule(t, Allow, "10.0.0.0/8:22-80"),
+		mustRule(t, Allow, "*.example.com:443"),
+		mustRule(t, Deny, "10.0.0.1:22"),
+		mustRule(t, Deny, "[2001:db8::/32]:22"),
+	)
+	cases := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.1.2.3:22", true},
+		{"10.1.2.3:80", true},
+		{"10.1.2.3:81", false},
+		{"10.0.0.1:22", false},
+		{"192.168.0.1:22", false},
+		{"www.example.com:443", true},
+		{"www.example.com:8080", false},
+		{"[2001:db8::1]:22", false},
+	}
+	for _, c := range cases {
+		err := p.Check(context.Background(), c.addr)
+		if (err == nil) != c.allowed {
+			t.Errorf("Check(%s) = %v, allowed %v expected", c.addr, err, c.allowed)
+		}
+	}
+}
+
+func TestDialPolicyDenyOnly(t *testing.T) {
+	p := NewDialPolicy(mustRule(t, Deny, "*.internal"))
+	if err := p.Check(context.Background(), "db.internal:5432"); err == nil {
+		t.Error("db.internal expected to be denied")
+	}
+	if err := p.Check(context.Background(), "127.0.0.1:5432"); err != nil {
+		t.Errorf("127.0.0.1 expected to be allowed, got %v", err)
+	}
+}
+
+func TestDialPolicyTrailingDot(t *testing.T) {
+	p := NewDialPolicy(mustRule(t, Deny, "*.internal"), mustRule(t, Deny, "Secret.Example.com."))
+	for _, addr := range []string{"db.internal.:5432", "DB.Internal:5432", "secret.example.com:443", "secret.example.com.:443"} {
+		if err := p.Check(context.Background(), addr); err == nil {
+			t.Errorf("%s expected to be denied", addr)
+		}
+	}
+
+	p = NewDialPolicy(mustRule(t, Allow, "*.example.com"))
+	if err := p.Check(context.Background(), "www.example.com.:443"); err != nil {
+		t.Errorf("www.example.com. expected to be allowed, got %v", err)
+	}
+}
+
+func TestDialPolicyCheckDialed(t *testing.T) {
+	p := NewDialPolicy(
+		mustRule(t, Allow, "0.0.0.0/0"),
+		mustRule(t, Deny, "10.0.0.0/8"),
+		mustRule(t, Deny, "127.0.0.0/8"),
+	)
+	cases := []struct {
+		addr, dialed string
+		allowed      bool
+	}{
+		{"www.example.com:80", "93.184.216.34:80", true},
+		{"rebind.example.com:80", "10.0.0.5:80", false}, // resolved to public address when checked
+		{"rebind.example.com:80", "127.0.0.1:80", false},
+		{"93.184.216.34:80", "93.184.216.34:80", true},
+		{"www.example.com:80", "bad", false},
+	}
+	for _, c := range cases {
+		err := p.CheckDialed(c.addr, c.dialed)
+		if (err == nil) != c.allowed {
+			t.Errorf("CheckDialed(%s, %s) = %v, allowed %v expected", c.addr, c.dialed, err, c.allowed)
+		}
+	}
+
+	// hostnames allowed by name may resolve to any address
+	p = NewDialPolicy(mustRule(t, Allow, "*.example.com"), mustRule(t, Allow, "192.168.0.0/16"))
+	if err := p.CheckDialed("www.example.com:80", "10.0.0.5:80"); err != nil {
+		t.Errorf("www.example.com expected to be allowed, got %v", err)
+	}
+	if err := p.CheckDialed("www.example.org:80", "10.0.0.5:80"); err == nil {
+		t.Error("www.example.org expected to be denied")
+	}
+}
+
+func TestDialPolicyControl(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+
+	// no rule matches the name, the address it resolves to is denied
+	p := NewDialPolicy(mustRule(t, Deny, "127.0.0.0/8"), mustRule(t, Deny, "::1"))
+	d := &net.Dialer{ControlContext: p.Control(addr)}
+	conn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial expected to be denied")
+	}
+	var de *DeniedError
+	if !errors.As(err, &de) {
+		t.Errorf("DeniedError expected, got %v", err)
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	for _, s := range []string{"", "host:70000", "host:80-10", "[::1", "a[:80"} {
+		if _, err := ParseRule(Allow, s); err == nil {
+			t.Errorf("ParseRule(%q) expected error", s)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTooManySessions means the max number of execute sessions is reached
+var ErrTooManySessions = errors.New("too many execute sessions")
+
+// ExecPolicy restricts commands executed by agent and the way they are run
+type ExecPolicy struct {
+	// Commands are patterns of space separated words matched against args one by one,
+	// the first word must equal the command name and the others are glob patterns of single args,
+	// where * matches any sequence of characters and ? matches any single character.
+	// A last word of * matches any remaining args. Any command is allowed if empty.
+	Commands []string
+
+	// Shell runs the command line of shell quoted args by "Shell -c cmdline" if set
+	Shell string
+
+	// Credential runs the command as the given user if set
+	Credential *Credential
+
+	// Env is glob patterns of variable names inherited from agent environment,
+	// all variables are inherited if nil
+	Env []string
+
+	// SetEnv is KEY=VALUE variables added to the environment
+	SetEnv []string
+
+	// Dir is the working directory of the command
+	Dir string
+
+	// MaxSessions limits the number of concurrent sessions if positive
+	MaxSessions int
+
+	// MaxDuration kills the command after running for the duration if positive
+	MaxDuration time.Duration
+
+	mu       sync.Mutex
+	sessions int
+}
+
+// Credential is user and group identity of command
+type Credential struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+}
+
+// LookupCredential parses "user[:group]" where user and group are names or numeric ids
+func LookupCredential(s string) (*Credential, error) {
+	userName, groupName, hasGroup := strings.Cut(s, ":")
+	cred := &Credential{}
+
+	u, err := user.LookupId(userName)
+	if err != nil {
+		if u, err = user.Lookup(userName); err != nil {
+			return nil, err
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: unsupported uid %q", userName, u.Uid)
+	}
+	cred.Uid = uint32(uid)
+	gidStr := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroupId(groupName)
+		if err != nil {
+			if g, err = user.LookupGroup(groupName); err != nil {
+				return nil, err
+			}
+		}
+		gidStr = g.Gid
+	} else if gids, err := u.GroupIds(); err == nil {
+		for _, id := range gids {
+			if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(gid))
+			}
+		}
+	}
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: unsupported gid %q", userName, gidStr)
+	}
+	cred.Gid = uint32(gid)
+	return cred, nil
+}
+
+// Command checks args against Commands and returns the command to run
+func (p *ExecPolicy) Command(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	if len(p.Commands) > 0 {
+		allowed := false
+		for _, pattern := range p.Commands {
+			if matchArgs(strings.Fields(pattern), args) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("command %q is not allowed", args)
+		}
+	}
+	if p.Shell != "" {
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		return []string{p.Shell, "-c", strings.Join(quoted, " ")}, nil
+	}
+	return args, nil
+}
+
+// matchArgs reports whether args match pattern words, see ExecPolicy.Commands
+func matchArgs(words []string, args []string) bool {
+	if len(words) == 0 || words[0] != args[0] {
+		return false
+	}
+	words, args = words[1:], args[1:]
+	for i, word := range words {
+		if word == "*" && i == len(words)-1 {
+			return true
+		}
+		if i >= len(args) || !globMatch(word, args[i]) {
+			return false
+		}
+	}
+	return len(words) == len(args)
+}
+
+// shellQuote quotes s as a single word of posix shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Environ returns the environment of command, nil means inheriting agent environment
+func (p *ExecPolicy) Environ() []string {
+	if p.Env == nil && len(p.SetEnv) == 0 {
+		return nil
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if p.Env == nil {
+			env = append(env, kv)
+			continue
+		}
+		for _, pattern := range p.Env {
+			if globMatch(pattern, name) {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	env = append(env, p.SetEnv...)
+	if env == nil {
+		env = []string{}
+	}
+	return env
+}
+
+// Acquire reserves a session, release must be called when the session ends
+func (p *ExecPolicy) Acquire() (release func(), err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.MaxSessions > 0 && p.sessions >= p.MaxSessions {
+		return nil, ErrTooManySessions
+	}
+	p.sessions++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			p.sessions--
+			p.mu.Unlock()
+		})
+	}, nil
+}
+
+// Context returns ctx limited by MaxDuration
+func (p *ExecPolicy) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.MaxDuration > 0 {
+		return context.WithTimeout(ctx, p.MaxDuration)
+	}
+	return context.WithCancel(ctx)
+}
+
+// globMatch reports whether s matches pattern, * matches any sequence and ? any single character.
+// On mismatch it backtracks to the last * only, which takes linear space and O(len(pattern)*len(s)) time.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0 // index of last * in pattern and index of s it is retried at
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+			continue
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+			continue
+		case star >= 0:
+			// let the last * match one more character
+			next++
+			p, i = star+1, next
+			continue
+		}
+		return false
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package policy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// SysProcAttr returns attributes running command as Credential
+func (p *ExecPolicy) SysProcAttr() (*syscall.SysProcAttr, error) {
+	if p.Credential != nil {
+		return nil, errors.New("running command as another user is not supported")
+	}
+	return nil, nil
+}
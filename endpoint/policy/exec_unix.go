@@ -0,0 +1,20 @@
+//go:build unix
+
+package policy
+
+import "syscall"
+
+// SysProcAttr returns attributes running command as Credential
+func (p *ExecPolicy) SysProcAttr() (*syscall.SysProcAttr, error) {
+	cred := p.Credential
+	if cred == nil {
+		return nil, nil
+	}
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    cred.Uid,
+			Gid:    cred.Gid,
+			Groups: cred.Groups,
+		},
+	}, nil
+}
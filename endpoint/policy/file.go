@@ -0,0 +1,74 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrFileTransferDisabled means agent is not started with file transfer enabled
+var ErrFileTransferDisabled = errors.New("file transfer is not enabled")
+
+// FilePolicy restricts paths accessible by file transfer.
+// Patterns are globs matched against absolute paths with symlinks resolved,
+// * matches any sequence of characters including "/", so /data/* allows everything under /data.
+type FilePolicy struct {
+	// Read is glob patterns of paths which can be read
+	Read []string
+
+	// Write is glob patterns of paths which can be written
+	Write []string
+}
+
+// Resolve returns absolute path of file with symlinks resolved,
+// symlinks of the parent directory are resolved if the file does not exist
+func Resolve(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+// CheckRead checks if path can be read and returns its resolved path
+func (p *FilePolicy) CheckRead(path string) (string, error) {
+	return p.check(path, p.Read)
+}
+
+// CheckWrite checks if path can be written and returns its resolved path
+func (p *FilePolicy) CheckWrite(path string) (string, error) {
+	return p.check(path, p.Write)
+}
+
+// CheckStat checks if information of path can be read, which is allowed by either Read or Write,
+// and returns its resolved path
+func (p *FilePolicy) CheckStat(path string) (string, error) {
+	resolved, err := p.check(path, p.Read)
+	if err != nil {
+		return p.check(path, p.Write)
+	}
+	return resolved, nil
+}
+
+func (p *FilePolicy) check(path string, patterns []string) (string, error) {
+	resolved, err := Resolve(path)
+	if err != nil {
+		return "", err
+	}
+	for _, pattern := range patterns {
+		if globMatch(filepath.ToSlash(pattern), filepath.ToSlash(resolved)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("path %q is not allowed", path)
+}
@@ -0,0 +1,52 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilePolicy(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := filepath.Join(dir, "pub")
+	secret := filepath.Join(dir, "secret")
+	for _, d := range []string{pub, secret} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// symlink escaping the allowed directory
+	if err := os.Symlink(secret, filepath.Join(pub, "link")); err != nil {
+		t.Skip("symlink not supported:", err)
+	}
+
+	p := &FilePolicy{
+		Read:  []string{pub + "/*"},
+		Write: []string{pub + "/upload/*"},
+	}
+	if err := os.Mkdir(filepath.Join(pub, "upload"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.CheckRead(filepath.Join(pub, "a.txt")); err != nil {
+		t.Errorf("read pub/a.txt: %v", err)
+	}
+	if _, err := p.CheckRead(filepath.Join(pub, "link", "key")); err == nil {
+		t.Error("read through symlink out of pub expected to be denied")
+	}
+	if _, err := p.CheckRead(filepath.Join(pub, "..", "secret", "key")); err == nil {
+		t.Error("read secret/key expected to be denied")
+	}
+	if _, err := p.CheckWrite(filepath.Join(pub, "a.txt")); err == nil {
+		t.Error("write pub/a.txt expected to be denied")
+	}
+	if _, err := p.CheckWrite(filepath.Join(pub, "upload", "new.bin")); err != nil {
+		t.Errorf("write pub/upload/new.bin: %v", err)
+	}
+	if _, err := (&FilePolicy{Write: p.Write}).CheckStat(filepath.Join(pub, "upload", "new.bin")); err != nil {
+		t.Errorf("stat pub/upload/new.bin: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tutils/tnet/pcapng"
+)
+
+// DumpFormat is file format of dumped traffic
+type DumpFormat string
+
+// dump formats
+const (
+	// DumpRaw dumps data read from and written to each proxy connection to read.dmp and write.dmp
+	DumpRaw DumpFormat = "raw"
+	// DumpPcapng dumps each proxy connection to a pcapng file with synthesized TCP/IP headers
+	DumpPcapng DumpFormat = "pcapng"
+)
+
+// ParseDumpFormat parses dump format name
+func ParseDumpFormat(s string) (DumpFormat, error) {
+	switch f := DumpFormat(s); f {
+	case DumpRaw, DumpPcapng:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown dump format %q", s)
+}
+
+// connDump dumps traffic of a proxy connection
+type connDump interface {
+	// Read dumps data read from client
+	Read(data []byte) error
+	// Write dumps data written to client
+	Write(data []byte) error
+	// Close finishes dump, clientClosed tells which side closed the connection first
+	Close(clientClosed bool) error
+}
+
+// newConnDump creates dump files of connection in dir/tunID
+func newConnDump(dir string, format DumpFormat, tunID int64, connData *tcpConnData, connectAddr string) (connDump, error) {
+	dumpPath := filepath.Join(dir, fmt.Sprint(tunID))
+	if format == DumpPcapng {
+		if err := os.MkdirAll(dumpPath, 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(filepath.Join(dumpPath, fmt.Sprintf("%d.pcapng", connData.connID)))
+		if err != nil {
+			return nil, err
+		}
+		comment := fmt.Sprintf("tnet proxy connection %d:%d, connect %s", tunID, connData.connID, connectAddr)
+		w, err := pcapng.NewWriter(f, comment)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		d := &pcapngDump{
+			f: f,
+			s: pcapng.NewStream(w, addrPort(connData.clientAddr), addrPort(connData.serverAddr)),
+		}
+		if err := d.s.Open(time.Now()); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return d, nil
+	}
+
+	dumpPath = filepath.Join(dumpPath, fmt.Sprint(connData.connID))
+	if err := os.MkdirAll(dumpPath, 0755); err != nil {
+		return nil, err
+	}
+	d := &rawDump{}
+	var err error
+	if d.write, err = os.Create(filepath.Join(dumpPath, "write.dmp")); err != nil {
+		return nil, err
+	}
+	if d.read, err = os.Create(filepath.Join(dumpPath, "read.dmp")); err != nil {
+		d.write.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// addrPort converts TCP address, unknown address is converted to 0.0.0.0:0
+func addrPort(addr net.Addr) netip.AddrPort {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.AddrPort()
+	}
+	return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+}
+
+type rawDump struct {
+	write io.WriteCloser
+	read  io.WriteCloser
+}
+
+func (d *rawDump) Read(data []byte) error {
+	_, err := d.read.Write(data)
+	return err
+}
+
+func (d *rawDump) Write(data []byte) error {
+	_, err := d.write.Write(data)
+	return err
+}
+
+func (d *rawDump) Close(clientClosed bool) error {
+	err := d.write.Close()
+	if err2 := d.read.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+type pcapngDump struct {
+	mu sync.Mutex
+	f  *os.File
+	s  *pcapng.Stream
+}
+
+func (d *pcapngDump) Read(data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.s.Write(time.Now(), true, data)
+}
+
+func (d *pcapngDump) Write(data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.s.Write(time.Now(), false, data)
+}
+
+func (d *pcapngDump) Close(clientClosed bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	err := d.s.Close(now, clientClosed)
+	if err2 := d.s.Close(now, !clientClosed); err == nil {
+		err = err2
+	}
+	if err2 := d.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tutils/tnet/endpoint/common"
+	"github.com/tutils/tnet/tcp"
+)
+
+// Mapping forwards connections accepted on Listen to Connect reached by agent
+type Mapping struct {
+	Listen  string
+	Connect string
+}
+
+// ParseMapping parses mapping in form LISTEN=CONNECT
+func ParseMapping(s string) (Mapping, error) {
+	listen, connect, ok := strings.Cut(s, "=")
+	if !ok || listen == "" || connect == "" {
+		return Mapping{}, fmt.Errorf("invalid mapping %q, LISTEN=CONNECT expected", s)
+	}
+	return Mapping{Listen: listen, Connect: connect}, nil
+}
+
+// String formats mapping in form LISTEN=CONNECT
+func (m Mapping) String() string {
+	return m.Listen + "=" + m.Connect
+}
+
+// LoadMappingsFile loads mappings from file, one LISTEN=CONNECT per line,
+// blank lines and lines starting with # are ignored
+func LoadMappingsFile(name string) ([]Mapping, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mappings []Mapping
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m, err := ParseMapping(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineno, err)
+		}
+		mappings = append(mappings, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// checkMappings checks addresses are set and listen addresses are unique
+func checkMappings(mappings []Mapping) error {
+	listens := make(map[string]bool)
+	for _, m := range mappings {
+		if m.Listen == "" || m.Connect == "" {
+			return fmt.Errorf("invalid mapping %q, LISTEN=CONNECT expected", m.String())
+		}
+		if listens[m.Listen] {
+			return fmt.Errorf("duplicate listen address %s", m.Listen)
+		}
+		listens[m.Listen] = true
+	}
+	return nil
+}
+
+// Mappings returns current forwarding mappings
+func (p *Proxy) Mappings() []Mapping {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Mapping(nil), p.mappings...)
+}
+
+// SetMappings replaces forwarding mappings, listeners of established tunnels are updated in place:
+// added listen addresses are listened, removed ones are shut down by tcp.Server.Shutdown,
+// and new connections of a kept listen address go to its new connect address.
+// Connections of unchanged mappings are untouched.
+// Mappings are replaced even if some of them fail to listen, the errors are returned.
+func (p *Proxy) SetMappings(mappings ...Mapping) error {
+	if err := checkMappings(mappings); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mappings = append([]Mapping(nil), mappings...)
+	var errs []error
+	for t := range p.tunnels {
+		if err := t.applyMappings(mappings); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %d: %w", t.tunID, err))
+		}
+	}
+	p.opts.logger.Info("proxy mappings set", "mappings", len(mappings))
+	return errors.Join(errs...)
+}
+
+// addTunnel registers t to be updated by SetMappings and listens on current mappings
+func (p *Proxy) addTunnel(t *Tunnel) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tunnels == nil {
+		p.tunnels = make(map[*Tunnel]struct{})
+	}
+	p.tunnels[t] = struct{}{}
+	return t.applyMappings(p.mappings)
+}
+
+func (p *Proxy) removeTunnel(t *Tunnel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.tunnels, t)
+}
+
+// adminMappings exposes mappings of proxy to admin api
+type adminMappings struct {
+	p *Proxy
+}
+
+func (m adminMappings) Mappings() []string {
+	var list []string
+	for _, mapping := range m.p.Mappings() {
+		list = append(list, mapping.String())
+	}
+	return list
+}
+
+func (m adminMappings) SetMappings(list []string) error {
+	var mappings []Mapping
+	for _, s := range list {
+		mapping, err := ParseMapping(s)
+		if err != nil {
+			return err
+		}
+		mappings = append(mappings, mapping)
+	}
+	return m.p.SetMappings(mappings...)
+}
+
+// mappingListener is tcp server of a listen address on a tunnel
+type mappingListener struct {
+	s *tcp.Server
+	h *tcpHandler
+}
+
+// applyMappings listens on added listen addresses, shuts down removed ones and changes connect address of kept ones
+func (t *Tunnel) applyMappings(mappings []Mapping) error {
+	t.mappingMu.Lock()
+	defer t.mappingMu.Unlock()
+	if t.listenersClosed {
+		return nil
+	}
+	if t.listeners == nil {
+		t.listeners = make(map[string]*mappingListener)
+	}
+
+	var errs []error
+	kept := make(map[string]bool)
+	for _, m := range mappings {
+		kept[m.Listen] = true
+		if l, ok := t.listeners[m.Listen]; ok {
+			if old := l.h.setConnectAddr(m.Connect); old != m.Connect {
+				t.logger.Info("proxy mapping changed", "addr", m.Listen, "target", m.Connect, "oldTarget", old)
+			}
+			continue
+		}
+		l, err := t.listen(m)
+		if err != nil {
+			t.logger.Warn("proxy listen failed", "addr", m.Listen, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		t.listeners[m.Listen] = l
+	}
+	for addr, l := range t.listeners {
+		if kept[addr] {
+			continue
+		}
+		delete(t.listeners, addr)
+		t.logger.Info("proxy unlisten", "addr", addr)
+		go l.s.Shutdown(context.Background())
+	}
+	return errors.Join(errs...)
+}
+
+// closeListeners shuts down listeners of all mappings and waits for them
+func (t *Tunnel) closeListeners() {
+	t.mappingMu.Lock()
+	listeners := t.listeners
+	t.listeners = nil
+	t.listenersClosed = true
+	t.mappingMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.s.Shutdown(context.Background())
+		}()
+	}
+	wg.Wait()
+}
+
+// listen starts tcp server forwarding connections accepted on listen address of m through tunnel
+func (t *Tunnel) listen(m Mapping) (*mappingListener, error) {
+	ln, err := net.Listen("tcp", m.Listen)
+	if err != nil {
+		return nil, err
+	}
+	opts := &t.h.p.opts
+	tcph := &tcpHandler{
+		tunw:       t.tunw,
+		tunID:      t.tunID,
+		logger:     t.logger,
+		connMap:    &t.connMap,
+		dumpDir:    opts.dumpDir,
+		dumpFormat: opts.dumpFormat,
+		metrics:    opts.metrics,
+		accounting: opts.accounting,
+		admin:      t.admin,
+		accessLog:  opts.accessLog,
+		peer:       t.peer,
+		identity:   t.identity,
+
+		connUpload:    opts.connLimit.upload,
+		mappingUpload: t.h.p.mappingUpload,
+		quotas:        opts.quotas,
+
+		listenAddr:     m.Listen,
+		connectAddr:    m.Connect,
+		configAddr:     t.configAddr,
+		connectTimeout: opts.connectTimeout,
+	}
+
+	s := tcp.NewServer(
+		tcp.WithListenAddress(m.Listen),
+		tcp.WithServerHandler(tcp.NewRawTCPConnHandler(tcph)),
+		tcp.WithServerConnContextFunc(func(ctx context.Context, c net.Conn) context.Context {
+			data := &tcpConnData{
+				connID:       t.lastConnID.Add(1),
+				connectResCh: make(chan error, 1),
+				writeCh:      make(chan []byte, 1<<8),
+				closeCh:      make(chan struct{}),
+				clientAddr:   c.RemoteAddr(),
+				serverAddr:   c.LocalAddr(),
+			}
+			return context.WithValue(ctx, tcpConnDataKey{}, data)
+		}),
+		tcp.WithServerKeepAlivePeriod(time.Second*15),
+		tcp.WithServerKeepAliveCount(3),
+		tcp.WithServerLogger(t.logger),
+	)
+	go func() {
+		if err := s.Serve(ln); err != nil && err != tcp.ErrServerClosed {
+			t.logger.Warn("proxy serve failed", "addr", m.Listen, "err", err)
+		}
+	}()
+	t.logger.Info("proxy listen", "addr", m.Listen, "target", m.Connect)
+	return &mappingListener{s: s, h: tcph}, nil
+}
+
+// writeConnect asks agent to connect connID to connectAddr, by CmdConnect if it is the one of CmdConfig
+// so that agents without CmdConnectTo work with a single mapping
+func (h *tcpHandler) writeConnect(connID int64, connectAddr string) (common.Cmd, error) {
+	if connectAddr == h.configAddr {
+		return common.CmdConnect, common.WritePacket(h.tunw, common.CmdConnect, func(w io.Writer) error {
+			return common.PackBodyConnect(w, connID)
+		})
+	}
+	return common.CmdConnectTo, common.WritePacket(h.tunw, common.CmdConnectTo, func(w io.Writer) error {
+		return common.PackBodyConnectTo(w, connID, connectAddr)
+	})
+}
+
+// getConnectAddr returns connect address of new connections
+func (h *tcpHandler) getConnectAddr() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.connectAddr
+}
+
+// setConnectAddr changes connect address of new connections, returns the old one
+func (h *tcpHandler) setConnectAddr(addr string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	old := h.connectAddr
+	h.connectAddr = addr
+	return old
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMapping(t *testing.T) {
+	m, err := ParseMapping("0.0.0.0:2222=10.0.0.5:22")
+	if err != nil || m.Listen != "0.0.0.0:2222" || m.Connect != "10.0.0.5:22" {
+		t.Errorf("unexpected mapping %v, %v", m, err)
+	}
+	if m.String() != "0.0.0.0:2222=10.0.0.5:22" {
+		t.Errorf("unexpected string %s", m)
+	}
+	for _, s := range []string{"", ":2222", "=10.0.0.5:22", ":2222="} {
+		if _, err := ParseMapping(s); err == nil {
+			t.Errorf("%q is valid", s)
+		}
+	}
+}
+
+func TestLoadMappingsFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "mappings")
+	content := "# ssh\n:2222=10.0.0.5:22\n\n  :8080=10.0.0.6:80  \n"
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := LoadMappingsFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 2 || mappings[1].Listen != ":8080" || mappings[1].Connect != "10.0.0.6:80" {
+		t.Errorf("unexpected mappings %v", mappings)
+	}
+
+	if err := os.WriteFile(name, []byte(":2222\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadMappingsFile(name); err == nil {
+		t.Error("invalid file is loaded")
+	}
+}
+
+func TestCheckMappings(t *testing.T) {
+	if err := checkMappings([]Mapping{{":1", "a:1"}, {":2", "a:1"}}); err != nil {
+		t.Error(err)
+	}
+	if err := checkMappings([]Mapping{{":1", "a:1"}, {":1", "a:2"}}); err == nil {
+		t.Error("duplicate listen address is valid")
+	}
+}
@@ -1,8 +1,17 @@
 package proxy
 
 import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/tutils/tnet/accesslog"
 	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/counter/ewma"
 	"github.com/tutils/tnet/crypt"
+	"github.com/tutils/tnet/endpoint/admin"
+	"github.com/tutils/tnet/endpoint/common"
+	"github.com/tutils/tnet/ratelimit"
 	"github.com/tutils/tnet/tun"
 )
 
@@ -14,23 +23,64 @@ type Options struct {
 	tunCrypt        crypt.Crypt
 	listenAddr      string
 	connectAddr     string
-	executeArgs     []string
-	rawPTYMode      bool
+	mappings        []Mapping
+	tunnelFunc      TunnelFunc
 	downloadCounter counter.Counter
 	uploadCounter   counter.Counter
 	dumpDir         string
+	dumpFormat      DumpFormat
+	connectTimeout  time.Duration
+	recordDir       string
+	recordInput     bool
+	metrics         *common.Metrics
+	accounting      *counter.Accounting
+	tunnelLimit     rateLimit
+	mappingLimit    rateLimit
+	connLimit       rateLimit
+	quotas          []*ratelimit.Quota
+	admin           *admin.Registry
+	logger          *slog.Logger
+	accessLog       *accesslog.Logger
+}
+
+// rateLimit is upload and download limits in bytes per second, 0 means no limit
+type rateLimit struct {
+	upload   int64
+	download int64
+}
+
+func (l rateLimit) limiters() (upload *ratelimit.Limiter, download *ratelimit.Limiter) {
+	return ratelimit.NewLimiter(l.upload, 0), ratelimit.NewLimiter(l.download, 0)
 }
 
 // Option is option setter for proxy
 type Option func(opts *Options)
 
 // default proxy options
+var (
+	DefaultConnectTimeout = 30 * time.Second
+)
+
 func newOptions(opts ...Option) *Options {
 	opt := &Options{}
 	for _, o := range opts {
 		o(opt)
 	}
 
+	if opt.dumpFormat == "" {
+		opt.dumpFormat = DumpRaw
+	}
+	if opt.connectTimeout <= 0 {
+		opt.connectTimeout = DefaultConnectTimeout
+	}
+	if opt.accounting == nil {
+		opt.accounting = counter.NewAccounting(func() counter.Counter {
+			return ewma.NewEWMACounter(ewma.DefaultWindow)
+		})
+	}
+	if opt.logger == nil {
+		opt.logger = slog.Default()
+	}
 	return opt
 }
 
@@ -78,17 +128,20 @@ func WithConnectAddress(addr string) Option {
 	}
 }
 
-// WithConnectPTY sets remote agent connect pty opt
-func WithConnectPTY(args []string) Option {
+// WithMappings adds forwarding mappings opt besides the one of WithListenAddress and WithConnectAddress
+func WithMappings(mappings ...Mapping) Option {
 	return func(opts *Options) {
-		opts.executeArgs = args
+		opts.mappings = append(opts.mappings, mappings...)
 	}
 }
 
-// WithRawPTYMode sets raw pty mode opt
-func WithRawPTYMode(rawPTYMode bool) Option {
+// TunnelFunc is called with each established tunnel, the tunnel is closed when it returns
+type TunnelFunc func(ctx context.Context, t *Tunnel)
+
+// WithTunnelFunc sets function running sessions on established tunnel opt
+func WithTunnelFunc(fn TunnelFunc) Option {
 	return func(opts *Options) {
-		opts.rawPTYMode = rawPTYMode
+		opts.tunnelFunc = fn
 	}
 }
 
@@ -112,3 +165,99 @@ func WithDumpDir(dir string) Option {
 		opts.dumpDir = dir
 	}
 }
+
+// WithDumpFormat sets file format of dumped traffic opt, DumpRaw by default
+func WithDumpFormat(format DumpFormat) Option {
+	return func(opts *Options) {
+		opts.dumpFormat = format
+	}
+}
+
+// WithConnectTimeout sets timeout of waiting for agent connect result opt
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.connectTimeout = timeout
+	}
+}
+
+// WithRecordDir sets directory of pty session recordings opt, sessions are not recorded if empty
+func WithRecordDir(dir string) Option {
+	return func(opts *Options) {
+		opts.recordDir = dir
+	}
+}
+
+// WithRecordInput sets recording user input of pty sessions opt
+func WithRecordInput(recordInput bool) Option {
+	return func(opts *Options) {
+		opts.recordInput = recordInput
+	}
+}
+
+// WithMetrics sets metrics opt, metrics are not collected if nil
+func WithMetrics(m *common.Metrics) Option {
+	return func(opts *Options) {
+		opts.metrics = m
+	}
+}
+
+// WithAccounting sets traffic accounting of tcp connections opt, which metrics, admin api and access log read,
+// accounting with EWMA counters by default
+func WithAccounting(a *counter.Accounting) Option {
+	return func(opts *Options) {
+		opts.accounting = a
+	}
+}
+
+// WithTunnelRateLimit sets upload and download limits in bytes per second shared by all tunnels opt,
+// they limit everything on tunnels including tcp connections and sessions, 0 means no limit
+func WithTunnelRateLimit(upload int64, download int64) Option {
+	return func(opts *Options) {
+		opts.tunnelLimit = rateLimit{upload: upload, download: download}
+	}
+}
+
+// WithMappingRateLimit sets upload and download limits in bytes per second shared by all forwarded tcp connections opt,
+// 0 means no limit. Download is limited by agent and shared by connections of each tunnel, it requires agent support of CmdDownloadLimit
+func WithMappingRateLimit(upload int64, download int64) Option {
+	return func(opts *Options) {
+		opts.mappingLimit = rateLimit{upload: upload, download: download}
+	}
+}
+
+// WithConnRateLimit sets upload and download limits in bytes per second of each forwarded tcp connection opt,
+// 0 means no limit. Download is limited by agent, it requires agent support of CmdDownloadLimit
+func WithConnRateLimit(upload int64, download int64) Option {
+	return func(opts *Options) {
+		opts.connLimit = rateLimit{upload: upload, download: download}
+	}
+}
+
+// WithQuotas sets quotas of bytes transferred by forwarded tcp connections opt,
+// new connections are refused when any of them is exceeded, nil quotas are ignored
+func WithQuotas(quotas ...*ratelimit.Quota) Option {
+	return func(opts *Options) {
+		opts.quotas = quotas
+	}
+}
+
+// WithAdmin sets registry of live tunnels and connections served by admin api opt, nothing is registered if nil
+func WithAdmin(r *admin.Registry) Option {
+	return func(opts *Options) {
+		opts.admin = r
+	}
+}
+
+// WithAccessLog sets access log of forwarded connections opt, nothing is logged if nil
+func WithAccessLog(l *accesslog.Logger) Option {
+	return func(opts *Options) {
+		opts.accessLog = l
+	}
+}
+
+// WithLogger sets logger opt, slog.Default() by default
+func WithLogger(logger *slog.Logger) Option {
+	return func(opts *Options) {
+		opts.logger = logger
+	}
+}
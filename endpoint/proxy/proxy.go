@@ -2,41 +2,63 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"os"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 
 	"github.com/tutils/tnet"
+	"github.com/tutils/tnet/endpoint/admin"
 	"github.com/tutils/tnet/endpoint/common"
+	"github.com/tutils/tnet/ratelimit"
 	"github.com/tutils/tnet/tun"
 )
 
 // Proxy for proxying remote tcp server to local address
 type Proxy struct {
 	opts Options
+
+	// limiters shared by all tunnels
+	tunUpload     *ratelimit.Limiter
+	tunDownload   *ratelimit.Limiter
+	mappingUpload *ratelimit.Limiter // download of mappings is limited by agent of each tunnel
+
+	mu       sync.Mutex
+	mappings []Mapping
+	tunnels  map[*Tunnel]struct{} // tunnels forwarding mappings
 }
 
 // New create a new proxy
 func New(opts ...Option) *Proxy {
 	opt := newOptions(opts...)
-	return &Proxy{
+	p := &Proxy{
 		opts: *opt,
 	}
+	opt.metrics.CountTraffic(opt.accounting.Total)
+	p.tunUpload, p.tunDownload = opt.tunnelLimit.limiters()
+	p.mappingUpload = ratelimit.NewLimiter(opt.mappingLimit.upload, 0)
+	if opt.listenAddr != "" {
+		p.mappings = append(p.mappings, Mapping{Listen: opt.listenAddr, Connect: opt.connectAddr})
+	}
+	p.mappings = append(p.mappings, opt.mappings...)
+	opt.admin.SetMappings(adminMappings{p})
+	return p
 }
 
 // Serve starts proxy
 func (p *Proxy) Serve(ctx context.Context) error {
 	if tunServer := p.opts.tunServer; tunServer != nil {
-		log.Println("start tun server (reverse mode)")
-		defer log.Println("tun server exit")
+		p.opts.logger.Info("start tunnel server (reverse mode)")
+		defer p.opts.logger.Info("tunnel server exit")
 		h := p.opts.tunHandlerNewer(p)
 		return tunServer.ListenAndServe(ctx, h)
 	}
 
 	if tunClient := p.opts.tunClient; tunClient != nil {
-		log.Println("start tun client")
-		defer log.Println("tun client exit")
+		p.opts.logger.Info("start tunnel client")
+		defer p.opts.logger.Info("tunnel client exit")
 		h := p.opts.tunHandlerNewer(p)
 		return tunClient.DialAndServe(ctx, h)
 	}
@@ -58,10 +80,18 @@ func NewProxyTunHandler(p *Proxy) tun.Handler {
 
 // ServeTun implements tun.Handler.
 func (h *proxyTunHandler) ServeTun(ctx context.Context, r io.Reader, w io.Writer) {
-	log.Println("new tun connection")
-	defer log.Println("tun connection closed")
-
 	opts := &h.p.opts
+	logger := opts.logger
+	logger.Info("new tunnel connection", "peer", tun.PeerAddr(ctx))
+	defer logger.Info("tunnel connection closed", "peer", tun.PeerAddr(ctx))
+
+	// tunnel is closed by admin api when ctx is canceled
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	at := opts.admin.NewTunnel(tun.PeerAddr(ctx), cancel)
+	// limited below crypt and sync writer, so that packets are not interleaved when split into chunks
+	r = ratelimit.NewReader(ctx, r, h.p.tunDownload)
+	w = ratelimit.NewWriter(ctx, w, h.p.tunUpload)
 	// tcp tunnel has been setup
 	var tunr io.Reader
 	if crypt := opts.tunCrypt; crypt != nil {
@@ -86,16 +116,120 @@ func (h *proxyTunHandler) ServeTun(ctx context.Context, r io.Reader, w io.Writer
 
 	// sync tunID
 	isServer := opts.tunServer != nil
-	tunID, err := common.SyncTunID(ctx, isServer, tunr, tunw)
+	tunID, err := common.SyncTunID(ctx, logger, isServer, tunr, tunw)
 	if err != nil {
 		return
 	}
+	logger = logger.With("tunID", tunID)
+	opts.metrics.TunnelOpened(opts.tunServer == nil)
+	defer opts.metrics.TunnelClosed()
+	tunTraffic := opts.accounting.OpenTunnel(tunID)
+	defer opts.accounting.CloseTunnel(tunTraffic)
+	at.Open(tunID, tunTraffic)
+	defer at.Close()
 
-	if len(opts.listenAddr) > 0 {
-		h.proxyTCP(ctx, tunID, tunr, tunw)
-	} else if len(opts.executeArgs) > 0 {
-		os.Exit(h.proxyPTY(ctx, tunID, tunr, tunw))
-	} else {
-		log.Println("invalid options")
+	t := &Tunnel{
+		h:        h,
+		tunID:    tunID,
+		logger:   logger,
+		tunr:     tunr,
+		tunw:     tunw,
+		admin:    at,
+		peer:     tun.PeerAddr(ctx),
+		identity: tun.PeerIdentity(ctx),
+		done:     make(chan struct{}),
+	}
+	go t.serve()
+
+	// without tunnel function, tunnel forwards mappings which may be set later by SetMappings
+	tcpErrCh := make(chan error, 1)
+	if opts.tunnelFunc == nil || len(h.p.Mappings()) > 0 {
+		go func() {
+			tcpErrCh <- t.proxyTCP(ctx)
+		}()
+	}
+
+	if fn := opts.tunnelFunc; fn != nil {
+		// tunnel is closed when fn returns
+		fn(ctx, t)
+		return
+	}
+
+	select {
+	case <-t.done:
+	case <-tcpErrCh:
+	case <-ctx.Done():
+	}
+}
+
+// Tunnel is proxy side of an established tunnel,
+// tcp connections and execute sessions are multiplexed on it.
+// It is passed to the function set by WithTunnelFunc.
+type Tunnel struct {
+	h        *proxyTunHandler
+	tunID    int64
+	logger   *slog.Logger // with tunID
+	tunr     io.Reader
+	tunw     io.Writer // SyncWriter
+	admin    *admin.Tunnel
+	peer     string // remote address of tunnel
+	identity string // authenticated identity of tunnel peer
+
+	// tcp forwarding
+	configAddr      string // connect address sent by CmdConfig
+	lastConnID      atomic.Int64
+	connMap         sync.Map
+	mappingMu       sync.Mutex
+	listeners       map[string]*mappingListener // by listen address
+	listenersClosed bool
+
+	sessions      sync.Map // sessionID -> *session
+	lastSessionID int64
+
+	done chan struct{} // closed when tunnel is broken
+}
+
+// ErrTunnelClosed means the tunnel is broken before session ends
+var ErrTunnelClosed = errors.New("tunnel closed")
+
+// ID returns tunnel id synchronized with agent
+func (t *Tunnel) ID() int64 {
+	return t.tunID
+}
+
+// Done returns a channel that is closed when tunnel is broken
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// serve reads packets from tunnel and dispatches them until tunnel is broken
+func (t *Tunnel) serve() {
+	defer close(t.done)
+	for {
+		cmd, err := common.UnpackHeader(t.tunr)
+		if err != nil {
+			t.logger.Info("read tunnel failed", "err", err)
+			return
+		}
+
+		switch cmd {
+		case common.CmdConnectResult:
+			err = t.handleConnectResult()
+		case common.CmdSend:
+			err = t.handleSend()
+		case common.CmdClose:
+			err = t.handleClose()
+		case common.CmdConnectPTYResult, common.CmdIOPTY, common.CmdClosePTY,
+			common.CmdConnectExecResult, common.CmdStdout, common.CmdStderr, common.CmdExitExec,
+			common.CmdFileStatResult, common.CmdFileChecksumResult, common.CmdFileOpenResult,
+			common.CmdFileChunk, common.CmdFileAck, common.CmdFileClose:
+			err = t.handleSessionEvent(cmd)
+		default:
+			t.logger.Error("invalid cmd", "cmd", cmd)
+			return
+		}
+		if err != nil {
+			return
+		}
 	}
 }
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"io"
+
+	"github.com/tutils/tnet/endpoint/common"
+)
+
+// ExecSession is a command executed on agent without pty, stdout and stderr are kept apart
+type ExecSession struct {
+	Args []string
+
+	// Stdin is copied to the command until EOF, which is propagated to the command.
+	// Stdin of the command is closed at once if it is nil.
+	Stdin io.Reader
+
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// RunExec executes command on agent and waits for it to exit,
+// the command is killed when ctx is done.
+// It returns exit code of the command, 128+n if it is killed by signal n like shells,
+// or error if the session ends abnormally.
+func (t *Tunnel) RunExec(ctx context.Context, es *ExecSession) (int, error) {
+	tunw := t.tunw
+
+	s := t.newSession(common.SessionExec)
+	defer t.removeSession(s)
+	sessionID := s.id
+	logger := t.logger.With("sessionID", sessionID)
+
+	// send config: execute command
+	if err := common.WritePacket(tunw, common.CmdConnectExec, func(w io.Writer) error {
+		return common.PackBodyConnectExec(w, sessionID, es.Args)
+	}); err != nil {
+		logger.Warn("write tunnel failed", "cmd", common.CmdConnectExec, "err", err)
+		return 1, err
+	}
+	logger.Debug("write packet", "cmd", common.CmdConnectExec, "args", es.Args)
+
+	connected := false
+	defer func() {
+		if connected {
+			// kill the command if it is still running
+			t.writeExitExec(sessionID)
+		}
+	}()
+
+	for {
+		var ev sessionEvent
+		select {
+		case ev = <-s.eventCh:
+		case <-t.done:
+			return 1, ErrTunnelClosed
+		case <-ctx.Done():
+			return 1, ctx.Err()
+		}
+
+		switch ev.cmd {
+		case common.CmdConnectExecResult:
+			logger.Debug("read packet", "cmd", ev.cmd, "result", ev.result)
+			if ev.result != nil {
+				return 1, ev.result
+			}
+			connected = true
+
+			go func() {
+				if es.Stdin != nil {
+					err := common.Copy(tunw, es.Stdin, func(tunw io.Writer, data []byte) error {
+						select {
+						case <-s.done:
+							return errSessionClosed
+						default:
+						}
+						return common.WritePacket(tunw, common.CmdStdin, func(w io.Writer) error {
+							return common.PackBodyStream(w, sessionID, data)
+						})
+					})
+					if err != nil {
+						if err != errSessionClosed {
+							logger.Warn("copy stdin failed", "err", err)
+						}
+						return
+					}
+				}
+				// propagate stdin EOF
+				if err := common.WritePacket(tunw, common.CmdCloseStdin, func(w io.Writer) error {
+					return common.PackBodyCloseStdin(w, sessionID)
+				}); err != nil {
+					logger.Warn("write tunnel failed", "cmd", common.CmdCloseStdin, "err", err)
+					return
+				}
+				logger.Debug("write packet", "cmd", common.CmdCloseStdin)
+			}()
+
+		case common.CmdStdout, common.CmdStderr:
+			out := es.Stdout
+			if ev.cmd == common.CmdStderr {
+				out = es.Stderr
+			}
+			if _, err := out.Write(ev.data); err != nil {
+				logger.Warn("write output failed", "err", err)
+				return 1, err
+			}
+
+		case common.CmdExitExec:
+			logger.Debug("read packet", "cmd", ev.cmd, "exitCode", ev.exitCode, "signal", ev.signal)
+			connected = false
+			if ev.signal != 0 {
+				// same as shells
+				return 128 + int(ev.signal), nil
+			}
+			return int(ev.exitCode), nil
+		}
+	}
+}
+
+func (t *Tunnel) writeExitExec(sessionID int64) error {
+	if err := common.WritePacket(t.tunw, common.CmdExitExec, func(w io.Writer) error {
+		return common.PackBodyExitExec(w, sessionID, 0, 0)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdExitExec, "sessionID", sessionID, "err", err)
+		return err
+	}
+	t.logger.Debug("write packet", "cmd", common.CmdExitExec, "sessionID", sessionID)
+	return nil
+}
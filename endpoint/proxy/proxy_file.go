@@ -0,0 +1,413 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/endpoint/common"
+)
+
+// ErrChecksumMismatch means SHA-256 of transferred file differs from the source
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// FileInfo is information of file on agent
+type FileInfo struct {
+	Size    int64
+	Mode    os.FileMode
+	IsDir   bool
+	ModTime time.Time
+}
+
+// waitEvent waits for the next event of session
+func (t *Tunnel) waitEvent(ctx context.Context, s *session) (sessionEvent, error) {
+	select {
+	case ev := <-s.eventCh:
+		return ev, nil
+	case <-t.done:
+		return sessionEvent{}, ErrTunnelClosed
+	case <-ctx.Done():
+		return sessionEvent{}, ctx.Err()
+	}
+}
+
+// tunnelError wraps error of writing tunnel, which means the tunnel is broken
+func tunnelError(err error) error {
+	return fmt.Errorf("%w: %v", ErrTunnelClosed, err)
+}
+
+// StatFile returns information of file on agent, error wrapping os.ErrNotExist is returned if it does not exist
+func (t *Tunnel) StatFile(ctx context.Context, path string) (*FileInfo, error) {
+	s := t.newSession("")
+	defer t.removeSession(s)
+
+	if err := common.WritePacket(t.tunw, common.CmdFileStat, func(w io.Writer) error {
+		return common.PackBodyFileStat(w, s.id, path)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdFileStat, "sessionID", s.id, "err", err)
+		return nil, tunnelError(err)
+	}
+	ev, err := t.waitEvent(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if ev.result != nil {
+		return nil, ev.result
+	}
+	if ev.stat.Size < 0 {
+		return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+	return &FileInfo{
+		Size:    ev.stat.Size,
+		Mode:    os.FileMode(ev.stat.Mode),
+		IsDir:   ev.stat.IsDir,
+		ModTime: time.Unix(ev.stat.ModTime, 0),
+	}, nil
+}
+
+// ChecksumFile returns SHA-256 of the first length bytes of file on agent, or the whole file if length is negative
+func (t *Tunnel) ChecksumFile(ctx context.Context, path string, length int64) ([]byte, error) {
+	s := t.newSession("")
+	defer t.removeSession(s)
+
+	if err := common.WritePacket(t.tunw, common.CmdFileChecksum, func(w io.Writer) error {
+		return common.PackBodyFileChecksum(w, s.id, path, length)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdFileChecksum, "sessionID", s.id, "err", err)
+		return nil, tunnelError(err)
+	}
+	ev, err := t.waitEvent(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if ev.result != nil {
+		return nil, ev.result
+	}
+	return ev.sum, nil
+}
+
+// openFile opens file on agent and returns its size
+func (t *Tunnel) openFile(ctx context.Context, s *session, path string, write bool, offset int64, mode os.FileMode) (int64, error) {
+	if err := common.WritePacket(t.tunw, common.CmdFileOpen, func(w io.Writer) error {
+		return common.PackBodyFileOpen(w, s.id, path, write, offset, uint32(mode.Perm()))
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdFileOpen, "sessionID", s.id, "err", err)
+		return 0, tunnelError(err)
+	}
+	t.logger.Debug("write packet", "cmd", common.CmdFileOpen, "sessionID", s.id, "path", path, "write", write, "offset", offset)
+
+	ev, err := t.waitEvent(ctx, s)
+	if err != nil {
+		return 0, err
+	}
+	t.logger.Debug("read packet", "cmd", ev.cmd, "sessionID", s.id, "result", ev.result, "size", ev.size)
+	return ev.size, ev.result
+}
+
+func (t *Tunnel) writeFileClose(sessionID int64, result error) error {
+	if err := common.WritePacket(t.tunw, common.CmdFileClose, func(w io.Writer) error {
+		return common.PackBodyFileClose(w, sessionID, result)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdFileClose, "sessionID", sessionID, "err", err)
+		return tunnelError(err)
+	}
+	t.logger.Debug("write packet", "cmd", common.CmdFileClose, "sessionID", sessionID, "result", result)
+	return nil
+}
+
+// WriteFile writes r to file on agent at offset, the file is created with mode if it does not exist
+// and truncated to offset before writing. c counts bytes written if it is not nil.
+func (t *Tunnel) WriteFile(ctx context.Context, path string, r io.Reader, offset int64, mode os.FileMode, c counter.Counter) error {
+	s := t.newSession(common.SessionFile)
+	defer t.removeSession(s)
+	sessionID := s.id
+
+	if _, err := t.openFile(ctx, s, path, true, offset, mode); err != nil {
+		return err
+	}
+
+	acked := offset
+	eof := false
+	buf := make([]byte, common.FileChunkSize)
+	for !eof {
+		// wait for acknowledgement if window is full
+		for offset-acked >= common.FileWindowSize {
+			ev, err := t.waitEvent(ctx, s)
+			if err != nil {
+				t.writeFileClose(sessionID, err)
+				return err
+			}
+			switch ev.cmd {
+			case common.CmdFileAck:
+				if c != nil {
+					c.Add(ev.offset - acked)
+				}
+				acked = ev.offset
+			case common.CmdFileClose:
+				return ev.result
+			}
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			t.writeFileClose(sessionID, err)
+			return err
+		}
+		if err := common.WritePacket(t.tunw, common.CmdFileChunk, func(w io.Writer) error {
+			return common.PackBodyFileChunk(w, sessionID, offset, buf[:n])
+		}); err != nil {
+			t.logger.Warn("write tunnel failed", "cmd", common.CmdFileChunk, "sessionID", sessionID, "err", err)
+			return tunnelError(err)
+		}
+		offset += int64(n)
+		if eof && n > 0 {
+			// empty chunk marks the end of file
+			if err := common.WritePacket(t.tunw, common.CmdFileChunk, func(w io.Writer) error {
+				return common.PackBodyFileChunk(w, sessionID, offset, nil)
+			}); err != nil {
+				t.logger.Warn("write tunnel failed", "cmd", common.CmdFileChunk, "sessionID", sessionID, "err", err)
+				return tunnelError(err)
+			}
+		}
+	}
+
+	// agent closes file after all chunks are written
+	for {
+		ev, err := t.waitEvent(ctx, s)
+		if err != nil {
+			return err
+		}
+		switch ev.cmd {
+		case common.CmdFileAck:
+			if c != nil {
+				c.Add(ev.offset - acked)
+			}
+			acked = ev.offset
+		case common.CmdFileClose:
+			t.logger.Debug("read packet", "cmd", ev.cmd, "sessionID", sessionID, "result", ev.result)
+			return ev.result
+		}
+	}
+}
+
+// ReadFile reads file on agent from offset to w, c counts bytes read if it is not nil
+func (t *Tunnel) ReadFile(ctx context.Context, path string, offset int64, w io.Writer, c counter.Counter) error {
+	s := t.newSession(common.SessionFile)
+	defer t.removeSession(s)
+	sessionID := s.id
+
+	if _, err := t.openFile(ctx, s, path, false, offset, 0); err != nil {
+		return err
+	}
+
+	for {
+		ev, err := t.waitEvent(ctx, s)
+		if err != nil {
+			t.writeFileClose(sessionID, err)
+			return err
+		}
+		switch ev.cmd {
+		case common.CmdFileChunk:
+			if ev.offset != offset {
+				err := fmt.Errorf("unexpected chunk offset %d, %d expected", ev.offset, offset)
+				t.writeFileClose(sessionID, err)
+				return err
+			}
+			if _, err := w.Write(ev.data); err != nil {
+				t.writeFileClose(sessionID, err)
+				return err
+			}
+			offset += int64(len(ev.data))
+			if c != nil {
+				c.Add(int64(len(ev.data)))
+			}
+			if err := common.WritePacket(t.tunw, common.CmdFileAck, func(w io.Writer) error {
+				return common.PackBodyFileAck(w, sessionID, offset)
+			}); err != nil {
+				t.logger.Warn("write tunnel failed", "cmd", common.CmdFileAck, "sessionID", sessionID, "err", err)
+				return tunnelError(err)
+			}
+			if len(ev.data) == 0 {
+				// end of file
+				return nil
+			}
+		case common.CmdFileClose:
+			t.logger.Debug("read packet", "cmd", ev.cmd, "sessionID", sessionID, "result", ev.result)
+			if ev.result == nil {
+				return io.ErrUnexpectedEOF
+			}
+			return ev.result
+		}
+	}
+}
+
+// localChecksum returns SHA-256 of the first length bytes of local file, or the whole file if length is negative
+func localChecksum(path string, length int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if length >= 0 {
+		r = io.LimitReader(f, length)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	if length >= 0 && n < length {
+		return nil, fmt.Errorf("%s is shorter than %d bytes", path, length)
+	}
+	return h.Sum(nil), nil
+}
+
+// resumeOffset returns size of dst if it is a prefix of src, otherwise 0
+func resumeOffset(dstSize int64, srcSize int64, dstSum func(int64) ([]byte, error), srcSum func(int64) ([]byte, error)) (int64, error) {
+	if dstSize <= 0 || dstSize > srcSize {
+		return 0, nil
+	}
+	dst, err := dstSum(dstSize)
+	if err != nil {
+		return 0, err
+	}
+	src, err := srcSum(dstSize)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(dst, src) {
+		return 0, nil
+	}
+	return dstSize, nil
+}
+
+// UploadOffset returns offset from which uploading localPath to remotePath resumes,
+// it is the size of remote file if the file is a prefix of local file, otherwise 0
+func (t *Tunnel) UploadOffset(ctx context.Context, localPath string, remotePath string) (int64, error) {
+	lfi, err := os.Stat(localPath)
+	if err != nil {
+		return 0, err
+	}
+	rfi, err := t.StatFile(ctx, remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return resumeOffset(rfi.Size, lfi.Size(), func(n int64) ([]byte, error) {
+		return t.ChecksumFile(ctx, remotePath, n)
+	}, func(n int64) ([]byte, error) {
+		return localChecksum(localPath, n)
+	})
+}
+
+// Upload copies localPath to remotePath from offset and verifies SHA-256 of the whole file,
+// c counts bytes uploaded if it is not nil
+func (t *Tunnel) Upload(ctx context.Context, localPath string, remotePath string, offset int64, c counter.Counter) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := t.WriteFile(ctx, remotePath, f, offset, fi.Mode(), c); err != nil {
+		return err
+	}
+
+	local, err := localChecksum(localPath, -1)
+	if err != nil {
+		return err
+	}
+	remote, err := t.ChecksumFile(ctx, remotePath, -1)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(local, remote) {
+		return ErrChecksumMismatch
+	}
+	t.logger.Info("upload verified", "local", localPath, "remote", remotePath, "sha256", fmt.Sprintf("%x", local))
+	return nil
+}
+
+// DownloadOffset returns offset from which downloading remotePath to localPath resumes,
+// it is the size of local file if the file is a prefix of remote file, otherwise 0
+func (t *Tunnel) DownloadOffset(ctx context.Context, remotePath string, localPath string) (int64, error) {
+	rfi, err := t.StatFile(ctx, remotePath)
+	if err != nil {
+		return 0, err
+	}
+	lfi, err := os.Stat(localPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return resumeOffset(lfi.Size(), rfi.Size, func(n int64) ([]byte, error) {
+		return localChecksum(localPath, n)
+	}, func(n int64) ([]byte, error) {
+		return t.ChecksumFile(ctx, remotePath, n)
+	})
+}
+
+// Download copies remotePath to localPath from offset and verifies SHA-256 of the whole file,
+// c counts bytes downloaded if it is not nil
+func (t *Tunnel) Download(ctx context.Context, remotePath string, localPath string, offset int64, c counter.Counter) error {
+	mode := os.FileMode(0644)
+	if rfi, err := t.StatFile(ctx, remotePath); err != nil {
+		return err
+	} else if rfi.IsDir {
+		return fmt.Errorf("%s is a directory", remotePath)
+	} else {
+		mode = rfi.Mode
+	}
+
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := t.ReadFile(ctx, remotePath, offset, f, c); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	local, err := localChecksum(localPath, -1)
+	if err != nil {
+		return err
+	}
+	remote, err := t.ChecksumFile(ctx, remotePath, -1)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(local, remote) {
+		return ErrChecksumMismatch
+	}
+	t.logger.Info("download verified", "remote", remotePath, "local", localPath, "sha256", fmt.Sprintf("%x", local))
+	return nil
+}
@@ -1,135 +1,206 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
+	"fmt"
 	"io"
-	"log"
-	"os"
-	"time"
+	"path/filepath"
+	"strings"
+	"syscall"
 
+	"github.com/tutils/tnet/asciicast"
 	"github.com/tutils/tnet/endpoint/common"
-	"golang.org/x/term"
 )
 
-func (h *proxyTunHandler) proxyPTY(ctx context.Context, tunID int64, tunr io.Reader, tunw io.Writer) int {
-	opts := &h.p.opts
+// WindowSize is terminal size in characters
+type WindowSize struct {
+	Width  int
+	Height int
+}
+
+// PTYSession is a command executed in pty on agent
+type PTYSession struct {
+	Args []string
+
+	// Raw makes pty on agent raw, local terminal is left to caller in any mode
+	Raw bool
+
+	// Size is the initial size of pty
+	Size WindowSize
+
+	// Stdin is copied to pty until EOF, it may be nil
+	Stdin io.Reader
+
+	// Stdout receives pty output
+	Stdout io.Writer
+
+	// Resize delivers terminal size changes, it may be nil
+	Resize <-chan WindowSize
+
+	// Signal delivers signals to the foreground process group of pty, it may be nil.
+	// SIGHUP, SIGINT, SIGQUIT, SIGKILL and SIGTERM are supported.
+	Signal <-chan syscall.Signal
+}
+
+// RunPTY executes command in pty on agent and waits for it to exit,
+// the command is terminated when ctx is done.
+// It returns exit code of the command, or error if the session ends abnormally.
+func (t *Tunnel) RunPTY(ctx context.Context, ps *PTYSession) (int, error) {
+	tunw := t.tunw
+
+	s := t.newSession(common.SessionPTY)
+	defer t.removeSession(s)
+	sessionID := s.id
+	logger := t.logger.With("sessionID", sessionID)
 
-	width, height, err := term.GetSize(int(os.Stdin.Fd()))
+	rec, err := t.newRecorder(sessionID, ps)
 	if err != nil {
-		log.Println("GetSize err", err)
-		return 1
+		logger.Error("create session recording failed", "err", err)
+		return 1, err
 	}
-
-	// send config: connect to pty
-	buf := &bytes.Buffer{} // TODO: use pool
-	if err := common.PackHeader(buf, common.CmdConnectPTY); err != nil {
-		log.Println("packHeader err", err)
-		return 1
+	if rec != nil {
+		defer rec.Close()
 	}
 
-	if err := common.PackBodyConnectPTY(buf, opts.rawPTYMode, opts.executeArgs, int16(width), int16(height)); err != nil {
-		log.Println("packBodyConnectPTY err", err)
-		return 1
-	}
-	if _, err := tunw.Write(buf.Bytes()); err != nil {
-		log.Println("write tun err", err)
-		return 1
+	// send config: connect to pty
+	if err := common.WritePacket(tunw, common.CmdConnectPTY, func(w io.Writer) error {
+		return common.PackBodyConnectPTY(w, sessionID, ps.Raw, ps.Args, int16(ps.Size.Width), int16(ps.Size.Height))
+	}); err != nil {
+		logger.Warn("write tunnel failed", "cmd", common.CmdConnectPTY, "err", err)
+		return 1, err
 	}
-	log.Printf("Write CmdConnectPTY, pty[%dx%d] %v", width, height, opts.executeArgs)
+	logger.Debug("write packet", "cmd", common.CmdConnectPTY, "width", ps.Size.Width, "height", ps.Size.Height, "args", ps.Args)
 
-	fd := int(os.Stdin.Fd())
-	var oldState *term.State
+	connected := false
+	defer func() {
+		if connected {
+			// terminate the command if it is still running
+			t.writeClosePTY(sessionID)
+		}
+	}()
 
 	// tun_reader -> conn_writer
 	for {
-		// select {
-		// case <-errCh:
-		// 	return
-		// default:
-		// }
-
-		cmd, err := common.UnpackHeader(tunr)
-		if err != nil {
-			log.Println("unpackHeader err", err)
-			return 1
-		}
-		switch cmd {
-		case common.CmdConnectPTYResult:
-			connectResult, err := common.UnpackBodyConnectPTYResult(tunr)
-			if err != nil {
-				log.Println("unpackBodyConnectPTYResult err", err)
-				return 1
+		var ev sessionEvent
+		select {
+		case ev = <-s.eventCh:
+		case size := <-ps.Resize:
+			if err := common.WritePacket(tunw, common.CmdResizePTY, func(w io.Writer) error {
+				return common.PackBodyResizePTY(w, sessionID, int16(size.Width), int16(size.Height))
+			}); err != nil {
+				logger.Warn("write tunnel failed", "cmd", common.CmdResizePTY, "err", err)
+				return 1, err
 			}
-			log.Printf("Read CmdConnectPTYResult, tunID %d, %v", tunID, connectResult)
-
-			if !opts.rawPTYMode {
-				oldState, err = term.MakeRaw(fd)
-				if err != nil {
-					log.Println("term err", err)
-					return 1
+			logger.Debug("write packet", "cmd", common.CmdResizePTY, "width", size.Width, "height", size.Height)
+			if rec != nil {
+				if err := rec.WriteResize(size.Width, size.Height); err != nil {
+					logger.Error("record pty resize failed", "err", err)
 				}
-				defer term.Restore(fd, oldState)
 			}
+			continue
+		case sig := <-ps.Signal:
+			if !connected {
+				continue
+			}
+			if err := common.WritePacket(tunw, common.CmdSignalPTY, func(w io.Writer) error {
+				return common.PackBodySignalPTY(w, sessionID, int32(sig))
+			}); err != nil {
+				logger.Warn("write tunnel failed", "cmd", common.CmdSignalPTY, "err", err)
+				return 1, err
+			}
+			logger.Debug("write packet", "cmd", common.CmdSignalPTY, "signal", int(sig))
+			continue
+		case <-t.done:
+			return 1, ErrTunnelClosed
+		case <-ctx.Done():
+			return 1, ctx.Err()
+		}
+
+		switch ev.cmd {
+		case common.CmdConnectPTYResult:
+			logger.Debug("read packet", "cmd", ev.cmd, "result", ev.result)
+			if ev.result != nil {
+				return 1, ev.result
+			}
+			connected = true
 
-			go func() {
-				ticker := time.NewTicker(time.Second)
-				defer ticker.Stop()
-				err := common.Copy(tunw, os.Stdin, func(tunw io.Writer, data []byte) error {
-					select {
-					case <-ticker.C:
-						if w, h, err := term.GetSize(fd); err == nil && (w != width || h != height) {
-							if err := common.PackHeader(tunw, common.CmdResizePTY); err != nil {
-								return err
-							}
-							if err := common.PackBodyResizePTY(tunw, int16(w), int16(h)); err != nil {
-								return err
+			if ps.Stdin != nil {
+				go func() {
+					err := common.Copy(tunw, ps.Stdin, func(tunw io.Writer, data []byte) error {
+						select {
+						case <-s.done:
+							return errSessionClosed
+						default:
+						}
+						if rec != nil && t.h.p.opts.recordInput {
+							if err := rec.WriteInput(data); err != nil {
+								logger.Error("record pty input failed", "err", err)
 							}
-							width, height = w, h
 						}
-					default:
+						return common.WritePacket(tunw, common.CmdIOPTY, func(w io.Writer) error {
+							return common.PackBodyIOPTY(w, sessionID, data)
+						})
+					})
+					if err != nil && err != errSessionClosed {
+						// 异常终止
+						logger.Warn("copy pty input failed", "err", err)
 					}
-
-					if err := common.PackHeader(tunw, common.CmdIOPTY); err != nil {
-						return err
-					}
-					if err := common.PackBodyIOPTY(tunw, data); err != nil {
-						return err
-					}
-					return nil
-				})
-				if err != nil {
-					// 异常终止
-					log.Println("copy pty output err", err)
-				}
-			}()
+				}()
+			}
 
 		case common.CmdIOPTY:
-			data, err := common.UnpackBodyIOPTY(tunr)
-			if err != nil {
-				log.Println("unpackBodyPTYIO err", err)
-				return 1
-			}
-			if opts.rawPTYMode {
-				if cr, ok := tunr.(*counterReader); ok {
-					log.Printf("Read CmdIOPTY, tunID %d, %d bytes, download %s/s", tunID, len(data), humanReadable(uint64(cr.c.IncreaceRatePerSec())))
+			if ps.Raw {
+				if cr, ok := t.tunr.(*counterReader); ok {
+					logger.Debug("read packet", "cmd", ev.cmd, "bytes", len(ev.data), "downloadRate", cr.c.IncreaceRatePerSec())
 				} else {
-					log.Printf("Read CmdIOPTY, tunID %d, %d bytes", tunID, len(data))
+					logger.Debug("read packet", "cmd", ev.cmd, "bytes", len(ev.data))
 				}
 			}
-			if _, err := os.Stdout.Write(data); err != nil {
-				log.Println("Write stdout err", err)
-				return 1
+			if rec != nil {
+				if err := rec.WriteOutput(ev.data); err != nil {
+					logger.Error("record pty output failed", "err", err)
+				}
+			}
+			if _, err := ps.Stdout.Write(ev.data); err != nil {
+				logger.Warn("write pty output failed", "err", err)
+				return 1, err
 			}
 
 		case common.CmdClosePTY:
-			exitCode, err := common.UnpackBodyClosePTY(tunr)
-			if err != nil {
-				log.Println("UnpackBodyClosePTY err", err)
-				return 1
-			}
-			log.Printf("Read CmdClosePTY, tunID %d, exitCode %d", tunID, exitCode)
-			return int(exitCode)
+			logger.Debug("read packet", "cmd", ev.cmd, "exitCode", ev.exitCode)
+			connected = false
+			return int(ev.exitCode), nil
 		}
 	}
 }
+
+func (t *Tunnel) writeClosePTY(sessionID int64) error {
+	if err := common.WritePacket(t.tunw, common.CmdClosePTY, func(w io.Writer) error {
+		return common.PackBodyClosePTY(w, sessionID, 0)
+	}); err != nil {
+		t.logger.Warn("write tunnel failed", "cmd", common.CmdClosePTY, "sessionID", sessionID, "err", err)
+		return err
+	}
+	t.logger.Debug("write packet", "cmd", common.CmdClosePTY, "sessionID", sessionID)
+	return nil
+}
+
+// newRecorder creates recording of pty session, it returns nil if recording is disabled
+func (t *Tunnel) newRecorder(sessionID int64, ps *PTYSession) (*asciicast.Writer, error) {
+	dir := t.h.p.opts.recordDir
+	if dir == "" {
+		return nil, nil
+	}
+	name := common.RecordFileName(t.tunID, sessionID)
+	rec, err := asciicast.Create(dir, name, asciicast.Header{
+		Width:   ps.Size.Width,
+		Height:  ps.Size.Height,
+		Command: strings.Join(ps.Args, " "),
+		Title:   fmt.Sprintf("tnet proxy session %d:%d", t.tunID, sessionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.logger.Info("record pty session", "sessionID", sessionID, "file", filepath.Join(dir, name))
+	return rec, nil
+}
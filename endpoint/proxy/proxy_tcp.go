@@ -3,15 +3,17 @@ package proxy
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"os"
 	"sync"
 	"time"
 
+	"github.com/tutils/tnet/accesslog"
+	"github.com/tutils/tnet/counter"
+	"github.com/tutils/tnet/endpoint/admin"
 	"github.com/tutils/tnet/endpoint/common"
+	"github.com/tutils/tnet/ratelimit"
 	"github.com/tutils/tnet/tcp"
 )
 
@@ -22,79 +24,137 @@ type tcpConnData struct {
 	connectResCh chan error
 	writeCh      chan []byte
 	closeCh      chan struct{}
-	writeDump    io.WriteCloser
-	readDump     io.WriteCloser
+	clientAddr   net.Addr
+	serverAddr   net.Addr
+	dump         connDump
 }
 
 // tcpHandler
 type tcpHandler struct {
-	tunw    io.Writer // SyncWriter
-	tunID   int64
-	connMap *sync.Map
-	dumpDir string
+	tunw       io.Writer // SyncWriter
+	tunID      int64
+	logger     *slog.Logger // with tunID
+	connMap    *sync.Map
+	dumpDir    string
+	dumpFormat DumpFormat
+	metrics    *common.Metrics
+	accounting *counter.Accounting
+	admin      *admin.Tunnel
+	accessLog  *accesslog.Logger
+	peer       string
+	identity   string
+
+	connUpload    int64 // download limits are enforced by agent, see CmdDownloadLimit
+	mappingUpload *ratelimit.Limiter
+	quotas        []*ratelimit.Quota
+
+	listenAddr     string
+	configAddr     string // connect address sent by CmdConfig
+	connectTimeout time.Duration
+
+	mu          sync.Mutex
+	connectAddr string // changed by reloading mappings
 }
 
 // ServeTCP called from multiple goroutines
 func (h *tcpHandler) ServeTCP(ctx context.Context, conn tcp.Conn) {
 	// new proxy connection
-	connr := conn.Reader()
+	connr := ratelimit.NewReader(ctx, conn.Reader(), ratelimit.NewLimiter(h.connUpload, 0), h.mappingUpload)
 	tunw := h.tunw
 	connMap := h.connMap
+	connectAddr := h.getConnectAddr()
+	mapping := h.listenAddr + "->" + connectAddr
 
 	// conn_reader -> tun_writer
 	connData := ctx.Value(tcpConnDataKey{}).(*tcpConnData)
 	connID := connData.connID
+	logger := h.logger.With("connID", connID)
+	rec := h.accessLog.Open(accesslog.Conn{
+		Role:     "proxy",
+		TunID:    h.tunID,
+		ConnID:   connID,
+		Client:   connData.clientAddr.String(),
+		Target:   connectAddr,
+		Peer:     h.peer,
+		Identity: h.identity,
+	})
+	defer func() {
+		if err := rec.Close(accesslog.ReasonClientClosed); err != nil {
+			logger.Error("write access log failed", "err", err)
+		}
+	}()
+	if q := ratelimit.Exceeded(h.quotas...); q != nil {
+		rec.SetReason(accesslog.ReasonQuotaExceeded)
+		logger.Warn("proxy connection refused", "quota", q.String())
+		h.metrics.ConnectResult(mapping, &common.ConnectError{Code: common.ConnectErrDenied, Msg: "quota exceeded"})
+		return
+	}
 	connMap.Store(connID, connData)
-	log.Printf("new proxy connection, connID %d:%d", h.tunID, connID)
-	defer log.Printf("proxy connection closed, connID %d:%d", h.tunID, connID)
+	logger.Info("new proxy connection", "client", connData.clientAddr.String())
+	defer logger.Info("proxy connection closed")
 
 	// create dump files if dumpDir is set
+	clientClosed := false
 	if h.dumpDir != "" {
-		dumpPath := fmt.Sprintf("%s/%d/%d", h.dumpDir, h.tunID, connID)
-		if err := os.MkdirAll(dumpPath, 0755); err != nil {
-			log.Printf("create dump dir err: %v", err)
-			return
-		}
-		if writeDump, err := os.Create(fmt.Sprintf("%s/write.dmp", dumpPath)); err != nil {
-			log.Printf("create write dump file err: %v", err)
-			return
-		} else {
-			connData.writeDump = writeDump
-		}
-		if readDump, err := os.Create(fmt.Sprintf("%s/read.dmp", dumpPath)); err != nil {
-			log.Printf("create read dump file err: %v", err)
+		dump, err := newConnDump(h.dumpDir, h.dumpFormat, h.tunID, connData, connectAddr)
+		if err != nil {
+			rec.SetReason("create dump file failed: " + err.Error())
+			logger.Error("create dump file failed", "err", err)
 			return
-		} else {
-			connData.readDump = readDump
 		}
+		connData.dump = dump
 		defer func() {
-			if connData.writeDump != nil {
-				connData.writeDump.Close()
-			}
-			if connData.readDump != nil {
-				connData.readDump.Close()
+			if err := dump.Close(clientClosed); err != nil {
+				logger.Error("close dump file failed", "err", err)
 			}
 		}()
 	}
 
-	tunwbuf := &bytes.Buffer{} // TODO: use pool
-	if err := common.PackHeader(tunwbuf, common.CmdConnect); err != nil {
-		log.Println("packHeader err", err)
+	if cmd, err := h.writeConnect(connID, connectAddr); err != nil {
+		rec.SetReason(accesslog.ReasonTunnelBroken)
+		logger.Warn("write tunnel failed", "cmd", cmd, "err", err)
 		return
+	} else {
+		logger.Debug("write packet", "cmd", cmd, "target", connectAddr)
 	}
-	if err := common.PackBodyConnect(tunwbuf, connID); err != nil {
-		log.Println("packBodyConnect err", err)
-		return
+
+	tunwbuf := &bytes.Buffer{} // TODO: use pool
+
+	timer := time.NewTimer(h.connectTimeout)
+	var connectResult error
+	select {
+	case connectResult = <-connData.connectResCh:
+	case <-timer.C:
+		connectResult = &common.ConnectError{Code: common.ConnectErrTimeout, Msg: "no connect result from agent"}
+	case <-ctx.Done():
+		connectResult = ctx.Err()
 	}
-	if _, err := tunw.Write(tunwbuf.Bytes()); err != nil {
-		log.Println("write tun err", err)
+	timer.Stop()
+	h.metrics.ConnectResult(mapping, connectResult)
+	if connectResult != nil {
+		connMap.Delete(connID)
+		rec.SetReason("connect failed: " + connectResult.Error())
+		logger.Warn("connect failed", "target", connectAddr, "err", connectResult)
 		return
 	}
-	log.Printf("Write CmdConnect, connID %d:%d", h.tunID, connID)
 
-	if err := <-connData.connectResCh; err != nil {
-		return
-	}
+	h.metrics.ConnOpened(mapping)
+	defer h.metrics.ConnClosed(mapping)
+	acct := h.accounting.Open(h.tunID, connID, connectAddr)
+	defer func() {
+		if t := acct.Traffic(); t != nil {
+			acct.Close()
+			logger.Info("proxy connection traffic", "traffic", t)
+		}
+	}()
+
+	rec.SetTraffic(acct.Traffic())
+	ac := h.admin.OpenConn(connID, connData.clientAddr.String(), connectAddr, acct.Traffic(), func() {
+		rec.SetReason(accesslog.ReasonKilled)
+		conn.CancelContext()
+		conn.AbortPendingRead()
+	})
+	defer ac.Close()
 
 	done := make(chan struct{})
 	defer func() {
@@ -113,41 +173,48 @@ func (h *tcpHandler) ServeTCP(ctx context.Context, conn tcp.Conn) {
 		select {
 		case <-connData.closeCh:
 		default:
-			tunwbuf.Reset()
-			if err := common.PackHeader(tunwbuf, common.CmdClose); err != nil {
-				log.Println("packHeader err", err)
-				break
-			}
-			if err := common.PackBodyClose(tunwbuf, connID); err != nil {
-				log.Println("packBodyClose err", err)
-				break
-			}
-			if _, err := tunw.Write(tunwbuf.Bytes()); err != nil {
-				log.Println("write tun err", err)
-				break
-			}
-			log.Printf("Write CmdClose, connID %d:%d", h.tunID, connID)
+			writeClose(h.logger, tunw, connID)
 		}
 	}()
 
+	writerDone := make(chan struct{})
 	go func() {
+		defer close(writerDone)
 		connw := conn.Writer()
+		write := func(data []byte) bool {
+			// counted before writing, connection may be closed as soon as client replies
+			acct.Download(int64(len(data)))
+			h.countQuotas(len(data))
+			if _, err := connw.Write(data); err != nil {
+				rec.SetReason("write client failed: " + err.Error())
+				logger.Warn("write connection failed", "err", err)
+				return false
+			}
+			if connData.dump != nil {
+				if err := connData.dump.Write(data); err != nil {
+					logger.Error("write dump file failed", "err", err)
+				}
+			}
+			return true
+		}
 		for {
 			select {
 			case data, ok := <-connData.writeCh:
-				if !ok {
-					return
-				}
-				if _, err := connw.Write(data); err != nil {
-					log.Println("write conn err", err)
+				if !ok || !write(data) {
 					return
 				}
-				if connData.writeDump != nil {
-					if _, err := connData.writeDump.Write(data); err != nil {
-						log.Printf("write dump file err: %v", err)
+			case <-connData.closeCh:
+				// data received before CmdClose is queued already, flush it before closing
+				for flushed := false; !flushed; {
+					select {
+					case data := <-connData.writeCh:
+						if !write(data) {
+							return
+						}
+					default:
+						flushed = true
 					}
 				}
-			case <-connData.closeCh:
 				conn.CancelContext()
 				conn.AbortPendingRead()
 				return
@@ -164,160 +231,175 @@ func (h *tcpHandler) ServeTCP(ctx context.Context, conn tcp.Conn) {
 			// check if connection is closed
 			select {
 			case <-connData.closeCh:
-				log.Printf("read conn abort: agent connection closed, connID %d:%d", h.tunID, connID)
+				rec.SetReason(accesslog.ReasonTargetClosed)
+				logger.Debug("read connection aborted, agent connection closed")
 			default:
-				log.Printf("read conn err: %v, connID %d:%d", err, h.tunID, connID)
+				clientClosed = true
+				logger.Debug("read connection failed", "err", err)
 			}
 			return
 		}
 
-		if connData.readDump != nil {
-			if _, err := connData.readDump.Write(buf[:n]); err != nil {
-				log.Printf("write dump file err: %v", err)
+		acct.Upload(int64(n))
+		h.countQuotas(n)
+		if connData.dump != nil {
+			if err := connData.dump.Read(buf[:n]); err != nil {
+				logger.Error("write dump file failed", "err", err)
 			}
 		}
 
 		select {
 		case <-connData.closeCh:
-			return // remote peer close
+			rec.SetReason(accesslog.ReasonTargetClosed)
+			<-writerDone // remote peer close, wait for pending data to be flushed
+			return
 		default:
 		}
 
 		tunwbuf.Reset()
 		if err := common.PackHeader(tunwbuf, common.CmdSend); err != nil {
-			log.Println("packHeader err", err)
+			logger.Error("pack header failed", "cmd", common.CmdSend, "err", err)
 			return
 		}
 		if err := common.PackBodySend(tunwbuf, connID, buf[:n]); err != nil {
-			log.Println("packBodySend err", err)
+			logger.Error("pack body failed", "cmd", common.CmdSend, "err", err)
 			return
 		}
 		if _, err := tunw.Write(tunwbuf.Bytes()); err != nil {
-			log.Println("write tun err", err)
+			rec.SetReason(accesslog.ReasonTunnelBroken)
+			logger.Warn("write tunnel failed", "cmd", common.CmdSend, "err", err)
 			return
 		}
 		if cw, ok := tunw.(*counterWriter); ok {
-			log.Printf("Write CmdSend, connID %d:%d, %d bytes, upload %s/s", h.tunID, connID, tunwbuf.Len(), humanReadable(uint64(cw.c.IncreaceRatePerSec())))
+			logger.Debug("write packet", "cmd", common.CmdSend, "bytes", tunwbuf.Len(), "uploadRate", cw.c.IncreaceRatePerSec())
 		} else {
-			log.Printf("Write CmdSend, connID %d:%d, %d bytes", h.tunID, connID, tunwbuf.Len())
+			logger.Debug("write packet", "cmd", common.CmdSend, "bytes", tunwbuf.Len())
 		}
 	}
 }
 
-func (h *proxyTunHandler) proxyTCP(ctx context.Context, tunID int64, tunr io.Reader, tunw io.Writer) {
-	opts := &h.p.opts
+// countQuotas counts n bytes transferred by a connection into quotas
+func (h *tcpHandler) countQuotas(n int) {
+	for _, q := range h.quotas {
+		q.Add(int64(n))
+	}
+}
 
-	// send config: connect to
+// writeClose tells agent to close connID, logger is with tunID
+func writeClose(logger *slog.Logger, tunw io.Writer, connID int64) error {
+	logger = logger.With("connID", connID)
 	buf := &bytes.Buffer{} // TODO: use pool
-	if err := common.PackHeader(buf, common.CmdConfig); err != nil {
-		log.Println("packHeader err", err)
-		return
+	if err := common.PackHeader(buf, common.CmdClose); err != nil {
+		logger.Error("pack header failed", "cmd", common.CmdClose, "err", err)
+		return err
 	}
-	if err := common.PackBodyConfig(buf, opts.connectAddr); err != nil {
-		log.Println("packBodyConfig err", err)
-		return
+	if err := common.PackBodyClose(buf, connID); err != nil {
+		logger.Error("pack body failed", "cmd", common.CmdClose, "err", err)
+		return err
 	}
 	if _, err := tunw.Write(buf.Bytes()); err != nil {
-		log.Println("write tun err", err)
-		return
+		logger.Warn("write tunnel failed", "cmd", common.CmdClose, "err", err)
+		return err
 	}
-	log.Printf("Write CmdConfig, connectAddr %s", opts.connectAddr)
+	logger.Debug("write packet", "cmd", common.CmdClose)
+	return nil
+}
 
-	var connMap sync.Map
+// proxyTCP listens on listen addresses of mappings and forwards accepted connections through tunnel,
+// listeners follow mappings set by Proxy.SetMappings until tunnel is closed
+func (t *Tunnel) proxyTCP(ctx context.Context) error {
+	p := t.h.p
 
-	tcph := &tcpHandler{
-		tunw:    tunw,
-		tunID:   tunID,
-		connMap: &connMap,
-		dumpDir: opts.dumpDir,
+	// send config: connect to, connect address of the first mapping is used by CmdConnect
+	if mappings := p.Mappings(); len(mappings) > 0 {
+		t.configAddr = mappings[0].Connect
+		if err := common.WritePacket(t.tunw, common.CmdConfig, func(w io.Writer) error {
+			return common.PackBodyConfig(w, t.configAddr)
+		}); err != nil {
+			t.logger.Warn("write tunnel failed", "cmd", common.CmdConfig, "err", err)
+			return err
+		}
+		t.logger.Debug("write packet", "cmd", common.CmdConfig, "target", t.configAddr)
 	}
 
-	var connID int64
-
-	s := tcp.NewServer(
-		tcp.WithListenAddress(opts.listenAddr),
-		tcp.WithServerHandler(tcp.NewRawTCPConnHandler(tcph)),
-		tcp.WithServerConnContextFunc(func(ctx context.Context, c net.Conn) context.Context {
-			connID++
-			data := &tcpConnData{
-				connID:       connID,
-				connectResCh: make(chan error, 1),
-				writeCh:      make(chan []byte, 1<<8),
-				closeCh:      make(chan struct{}),
-			}
-			return context.WithValue(ctx, tcpConnDataKey{}, data)
-		}),
-		tcp.WithServerKeepAlivePeriod(time.Second*15),
-		tcp.WithServerKeepAliveCount(3),
-	)
-
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- s.ListenAndServe()
-	}()
-	defer s.Shutdown(context.Background())
+	// writing to a slow client must not block reading tunnel, download of connections is limited by agent
+	if conn, mapping := p.opts.connLimit.download, p.opts.mappingLimit.download; conn > 0 || mapping > 0 {
+		if err := common.WritePacket(t.tunw, common.CmdDownloadLimit, func(w io.Writer) error {
+			return common.PackBodyDownloadLimit(w, conn, mapping)
+		}); err != nil {
+			t.logger.Warn("write tunnel failed", "cmd", common.CmdDownloadLimit, "err", err)
+			return err
+		}
+		t.logger.Debug("write packet", "cmd", common.CmdDownloadLimit, "conn", conn, "shared", mapping)
+	}
 
-	log.Printf("tcp server listen on %s", opts.listenAddr)
+	err := p.addTunnel(t)
+	defer t.closeListeners()
+	defer p.removeTunnel(t)
+	if err != nil {
+		return err
+	}
 
-	// tun_reader -> conn_writer
-	for {
-		select {
-		case <-errCh:
-			return
-		default:
-		}
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-		cmd, err := common.UnpackHeader(tunr)
-		if err != nil {
-			log.Println("unpackHeader err", err)
-			return
+func (t *Tunnel) handleConnectResult() error {
+	connID, connectResult, err := common.UnpackBodyConnectResult(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdConnectResult, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdConnectResult, "connID", connID, "result", connectResult)
+	v, ok := t.connMap.Load(connID)
+	if !ok {
+		t.logger.Debug("connection not found", "cmd", common.CmdConnectResult, "connID", connID)
+		if connectResult == nil {
+			// connected after the proxy connection gave up, let agent close it
+			writeClose(t.logger, t.tunw, connID)
 		}
-		switch cmd {
-		case common.CmdConnectResult:
-			connID, connectResult, err := common.UnpackBodyConnectResult(tunr)
-			if err != nil {
-				log.Println("unpackBodyConnectResult err", err)
-				return
-			}
-			log.Printf("Read CmdConnectResult, connID %d:%d, %v", tunID, connID, connectResult)
-			v, ok := connMap.Load(connID)
-			if !ok {
-				log.Printf("connID %d:%d not found", tunID, connID)
-				break // ignore
-			}
-			v.(*tcpConnData).connectResCh <- connectResult
+		return nil // ignore
+	}
+	v.(*tcpConnData).connectResCh <- connectResult
+	return nil
+}
 
-		case common.CmdSend:
-			connID, data, err := common.UnpackBodySend(tunr)
-			if err != nil {
-				log.Println("unpackBodySend err", err)
-				return
-			}
-			if cr, ok := tunr.(*counterReader); ok {
-				log.Printf("Read CmdSend, connID %d:%d, %d bytes, download %s/s", tunID, connID, len(data), humanReadable(uint64(cr.c.IncreaceRatePerSec())))
-			} else {
-				log.Printf("Read CmdSend, connID %d:%d, %d bytes", tunID, connID, len(data))
-			}
-			v, ok := connMap.Load(connID)
-			if !ok {
-				log.Printf("connID %d:%d not found", tunID, connID)
-				break // ignore
-			}
-			v.(*tcpConnData).writeCh <- data
+func (t *Tunnel) handleSend() error {
+	connID, data, err := common.UnpackBodySend(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdSend, "err", err)
+		return err
+	}
+	if cr, ok := t.tunr.(*counterReader); ok {
+		t.logger.Debug("read packet", "cmd", common.CmdSend, "connID", connID, "bytes", len(data), "downloadRate", cr.c.IncreaceRatePerSec())
+	} else {
+		t.logger.Debug("read packet", "cmd", common.CmdSend, "connID", connID, "bytes", len(data))
+	}
+	v, ok := t.connMap.Load(connID)
+	if !ok {
+		t.logger.Debug("connection not found", "cmd", common.CmdSend, "connID", connID)
+		return nil // ignore
+	}
+	v.(*tcpConnData).writeCh <- data
+	return nil
+}
 
-		case common.CmdClose:
-			connID, err := common.UnpackBodyClose(tunr)
-			if err != nil {
-				log.Println("unpackBodyClose err", err)
-				return
-			}
-			log.Printf("Read CmdClose, connID %d:%d", tunID, connID)
-			v, ok := connMap.Load(connID)
-			if !ok {
-				log.Printf("connID %d:%d not found", tunID, connID)
-				break // ignore
-			}
-			close(v.(*tcpConnData).closeCh)
-		}
+func (t *Tunnel) handleClose() error {
+	connID, err := common.UnpackBodyClose(t.tunr)
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", common.CmdClose, "err", err)
+		return err
+	}
+	t.logger.Debug("read packet", "cmd", common.CmdClose, "connID", connID)
+	v, ok := t.connMap.Load(connID)
+	if !ok {
+		t.logger.Debug("connection not found", "cmd", common.CmdClose, "connID", connID)
+		return nil // ignore
 	}
+	close(v.(*tcpConnData).closeCh)
+	return nil
 }
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/tutils/tnet/endpoint/common"
+)
+
+// errSessionClosed stops copying input of a finished session
+var errSessionClosed = errors.New("session closed")
+
+// sessionEvent is a packet sent by agent to an execute session
+type sessionEvent struct {
+	cmd      common.Cmd
+	data     []byte
+	result   error
+	exitCode int64
+	signal   int32
+	offset   int64
+	size     int64
+	stat     *common.FileStat
+	sum      []byte
+}
+
+// session is an execute session multiplexed on tunnel
+type session struct {
+	id      int64
+	kind    string
+	eventCh chan sessionEvent
+	done    chan struct{}
+}
+
+// newSession registers a new session of kind, requests which are not sessions of metrics have empty kind
+func (t *Tunnel) newSession(kind string) *session {
+	s := &session{
+		id:      atomic.AddInt64(&t.lastSessionID, 1),
+		kind:    kind,
+		eventCh: make(chan sessionEvent, 1<<8),
+		done:    make(chan struct{}),
+	}
+	t.sessions.Store(s.id, s)
+	if kind != "" {
+		t.h.p.opts.metrics.SessionOpened(kind)
+	}
+	return s
+}
+
+func (t *Tunnel) removeSession(s *session) {
+	t.sessions.Delete(s.id)
+	if s.kind != "" {
+		t.h.p.opts.metrics.SessionClosed(s.kind)
+	}
+	close(s.done)
+}
+
+func (t *Tunnel) handleSessionEvent(cmd common.Cmd) error {
+	var sessionID int64
+	var ev sessionEvent
+	var err error
+	ev.cmd = cmd
+	switch cmd {
+	case common.CmdConnectPTYResult:
+		sessionID, ev.result, err = common.UnpackBodyConnectPTYResult(t.tunr)
+	case common.CmdIOPTY:
+		sessionID, ev.data, err = common.UnpackBodyIOPTY(t.tunr)
+	case common.CmdClosePTY:
+		sessionID, ev.exitCode, err = common.UnpackBodyClosePTY(t.tunr)
+	case common.CmdConnectExecResult:
+		sessionID, ev.result, err = common.UnpackBodyConnectExecResult(t.tunr)
+	case common.CmdStdout, common.CmdStderr:
+		sessionID, ev.data, err = common.UnpackBodyStream(t.tunr)
+	case common.CmdExitExec:
+		sessionID, ev.exitCode, ev.signal, err = common.UnpackBodyExitExec(t.tunr)
+	case common.CmdFileStatResult:
+		sessionID, ev.result, ev.stat, err = common.UnpackBodyFileStatResult(t.tunr)
+	case common.CmdFileChecksumResult:
+		sessionID, ev.result, ev.sum, err = common.UnpackBodyFileChecksumResult(t.tunr)
+	case common.CmdFileOpenResult:
+		sessionID, ev.result, ev.size, err = common.UnpackBodyFileOpenResult(t.tunr)
+	case common.CmdFileChunk:
+		sessionID, ev.offset, ev.data, err = common.UnpackBodyFileChunk(t.tunr)
+	case common.CmdFileAck:
+		sessionID, ev.offset, err = common.UnpackBodyFileAck(t.tunr)
+	case common.CmdFileClose:
+		sessionID, ev.result, err = common.UnpackBodyFileClose(t.tunr)
+	}
+	if err != nil {
+		t.logger.Warn("unpack body failed", "cmd", cmd, "err", err)
+		return err
+	}
+
+	v, ok := t.sessions.Load(sessionID)
+	if !ok {
+		t.logger.Debug("session not found", "cmd", cmd, "sessionID", sessionID)
+		return nil // ignore
+	}
+	s := v.(*session)
+	select {
+	case s.eventCh <- ev:
+	case <-s.done:
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is permission of a logged in user or api token
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"     // view and manage instances, open terminals
+	RoleReadOnly Role = "read-only" // view instances and their logs
+)
+
+// ParseRole parses role
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleAdmin, RoleReadOnly:
+		return r, nil
+	}
+	return "", fmt.Errorf("invalid role %q, expected %s or %s", s, RoleAdmin, RoleReadOnly)
+}
+
+const (
+	sessionCookie = "tnet_session"
+	csrfHeader    = "X-CSRF-Token"
+	sessionTTL    = 12 * time.Hour
+	// delay of failed login, slows down guessing passwords
+	loginFailureDelay = time.Second
+)
+
+// LoadTokens loads api tokens from file, one ROLE TOKEN per line,
+// blank lines and lines starting with # are ignored
+func LoadTokens(name string) (map[string]Role, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]Role)
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: ROLE TOKEN expected", name, lineno)
+		}
+		role, err := ParseRole(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineno, err)
+		}
+		tokens[fields[1]] = role
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// session is login session of web interface
+type session struct {
+	role    Role
+	csrf    string // token required in X-CSRF-Token header of requests changing state
+	expires time.Time
+}
+
+// authenticator authenticates requests by session cookie or bearer token and authorizes them by role
+type authenticator struct {
+	passwords map[Role]string
+	tokens    map[string]Role
+	secure    bool // set Secure attribute of session cookie
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newAuthenticator(opt *Options) *authenticator {
+	a := &authenticator{
+		passwords: make(map[Role]string),
+		tokens:    opt.tokens,
+		secure:    opt.tlsCert != "",
+		sessions:  make(map[string]*session),
+	}
+	if opt.adminPassword != "" {
+		a.passwords[RoleAdmin] = opt.adminPassword
+	}
+	if opt.readOnlyPassword != "" {
+		a.passwords[RoleReadOnly] = opt.readOnlyPassword
+	}
+	return a
+}
+
+// enabled tells whether any password or token is configured
+func (a *authenticator) enabled() bool {
+	return len(a.passwords) > 0 || len(a.tokens) > 0
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// login returns role of password
+func (a *authenticator) login(password string) (Role, bool) {
+	for _, role := range []Role{RoleAdmin, RoleReadOnly} {
+		p, ok := a.passwords[role]
+		if ok && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+// session returns unexpired session of request, nil if it is not found
+func (a *authenticator) session(r *http.Request) (string, *session) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.sessions[c.Value]
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(s.expires) {
+		delete(a.sessions, c.Value)
+		return "", nil
+	}
+	return c.Value, s
+}
+
+// newSession creates session of role, expired sessions are removed
+func (a *authenticator) newSession(role Role) (string, *session) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for id, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, id)
+		}
+	}
+	id := randomToken()
+	s := &session{role: role, csrf: randomToken(), expires: now.Add(sessionTTL)}
+	a.sessions[id] = s
+	return id, s
+}
+
+func (a *authenticator) deleteSession(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, id)
+}
+
+// bearerRole returns role of bearer token in Authorization header
+func (a *authenticator) bearerRole(r *http.Request) (Role, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for t, role := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+// requiresAdmin tells whether request changes state or opens a shell
+func requiresAdmin(r *http.Request) bool {
+	return r.Method != http.MethodGet && r.Method != http.MethodHead || r.URL.Path == "/api/terminal"
+}
+
+// roleKey is context key of role of authorized api request
+type roleKey struct{}
+
+// requestRole returns role of authorized api request, it is admin if authentication is disabled
+func requestRole(r *http.Request) Role {
+	if role, ok := r.Context().Value(roleKey{}).(Role); ok {
+		return role
+	}
+	return RoleAdmin
+}
+
+// checkOrigin rejects cross-site requests changing state, browsers send them without credentials
+// even if authentication is disabled. Host must be a loopback name if authentication is disabled,
+// otherwise pages of other sites may read and change instances by dns rebinding.
+func (a *authenticator) checkOrigin(r *http.Request) error {
+	if !a.enabled() {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !isLoopbackHost(strings.Trim(host, "[]")) {
+			return fmt.Errorf("host %s is not allowed", r.Host)
+		}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return nil
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site == "cross-site" || site == "same-site" {
+		return fmt.Errorf("%s request is not allowed", site)
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return fmt.Errorf("origin %s is not allowed", origin)
+		}
+	}
+	return nil
+}
+
+// sessionInfo is response of session api
+type sessionInfo struct {
+	Auth      bool   `json:"auth"` // whether authentication is enabled
+	Role      Role   `json:"role"`
+	CSRFToken string `json:"csrfToken,omitempty"`
+}
+
+// handler requires authentication of api requests, static files are public:
+//
+//	POST /api/login   {"password": "..."} sets session cookie, returns role and csrf token
+//	POST /api/logout  removes session
+//	GET  /api/session role and csrf token of current session
+//
+// Api requests are authenticated by session cookie or Authorization: Bearer TOKEN,
+// requests of session other than GET must have X-CSRF-Token header. Read-only role may only GET.
+// Cross-site api requests are rejected whether authentication is enabled or not, see checkOrigin.
+func (a *authenticator) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			if err := a.checkOrigin(r); err != nil {
+				log.Printf("Rejected request %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+				writeAPIError(w, http.StatusForbidden, "Cross-site request is not allowed")
+				return
+			}
+		}
+		switch r.URL.Path {
+		case "/api/login":
+			a.handleLogin(w, r)
+			return
+		case "/api/logout":
+			if id, _ := a.session(r); id != "" {
+				a.deleteSession(id)
+			}
+			a.setCookie(w, "", -1)
+			writeJSON(w, http.StatusOK, APIResponse{Success: true})
+			return
+		case "/api/session":
+			if !a.enabled() {
+				writeJSON(w, http.StatusOK, APIResponse{Success: true, Data: sessionInfo{Role: RoleAdmin}})
+				return
+			}
+			if _, s := a.session(r); s != nil {
+				writeJSON(w, http.StatusOK, APIResponse{Success: true, Data: sessionInfo{Auth: true, Role: s.role, CSRFToken: s.csrf}})
+				return
+			}
+			writeAPIError(w, http.StatusUnauthorized, "Login required")
+			return
+		}
+		if !a.enabled() || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		role, ok := a.bearerRole(r)
+		if !ok {
+			_, s := a.session(r)
+			if s == nil {
+				writeAPIError(w, http.StatusUnauthorized, "Login required")
+				return
+			}
+			// GET needs no csrf token, websocket of terminal is protected by same origin check
+			if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+				subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(s.csrf)) != 1 {
+				writeAPIError(w, http.StatusForbidden, "Invalid CSRF token")
+				return
+			}
+			role = s.role
+		}
+		if role != RoleAdmin && requiresAdmin(r) {
+			writeAPIError(w, http.StatusForbidden, "Permission denied, admin role required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, role)))
+	})
+}
+
+func (a *authenticator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	role, ok := a.login(req.Password)
+	if !ok {
+		log.Printf("Failed login from %s", r.RemoteAddr)
+		time.Sleep(loginFailureDelay)
+		writeAPIError(w, http.StatusUnauthorized, "Invalid password")
+		return
+	}
+	id, s := a.newSession(role)
+	a.setCookie(w, id, int(sessionTTL/time.Second))
+	log.Printf("Login as %s from %s", role, r.RemoteAddr)
+	writeJSON(w, http.StatusOK, APIResponse{Success: true, Data: sessionInfo{Auth: true, Role: role, CSRFToken: s.csrf}})
+}
+
+// setCookie sets session cookie, maxAge < 0 removes it
+func (a *authenticator) setCookie(w http.ResponseWriter, id string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// isLoopback tells whether listen address only accepts local connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return isLoopbackHost(host)
+}
+
+// isLoopbackHost tells whether host name or ip is local
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, code int, resp APIResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tutils/tnet/config"
+)
+
+func newTestAuthServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/agents", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, APIResponse{Success: true})
+	})
+	mux.HandleFunc("/api/agents/start", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, APIResponse{Success: true})
+	})
+	a := newAuthenticator(newOptions(
+		WithPasswords("admin-secret", "viewer-secret"),
+		WithTokens(map[string]Role{"rotoken": RoleReadOnly}),
+	))
+	s := httptest.NewServer(a.handler(mux))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func doRequest(t *testing.T, method string, url string, body string, header map[string]string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAuthToken(t *testing.T) {
+	s := newTestAuthServer(t)
+	if resp := doRequest(t, http.MethodGet, s.URL+"/api/agents", "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request: %s", resp.Status)
+	}
+	bearer := map[string]string{"Authorization": "Bearer rotoken"}
+	if resp := doRequest(t, http.MethodGet, s.URL+"/api/agents", "", bearer); resp.StatusCode != http.StatusOK {
+		t.Errorf("read-only get: %s", resp.Status)
+	}
+	if resp := doRequest(t, http.MethodPost, s.URL+"/api/agents/start", "{}", bearer); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("read-only post: %s", resp.Status)
+	}
+	if resp := doRequest(t, http.MethodGet, s.URL+"/static/index.html", "", nil); resp.StatusCode == http.StatusUnauthorized {
+		t.Error("static files require login")
+	}
+}
+
+func TestAuthSession(t *testing.T) {
+	s := newTestAuthServer(t)
+	if resp := doRequest(t, http.MethodPost, s.URL+"/api/login", `{"password":"wrong"}`, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password: %s", resp.Status)
+	}
+
+	resp := doRequest(t, http.MethodPost, s.URL+"/api/login", `{"password":"admin-secret"}`, nil)
+	var r struct {
+		Data sessionInfo `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	cookies := resp.Cookies()
+	if r.Data.Role != RoleAdmin || r.Data.CSRFToken == "" || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("unexpected login %+v %v", r.Data, cookies)
+	}
+	cookie := map[string]string{"Cookie": sessionCookie + "=" + cookies[0].Value}
+
+	if resp := doRequest(t, http.MethodGet, s.URL+"/api/agents", "", cookie); resp.StatusCode != http.StatusOK {
+		t.Errorf("session get: %s", resp.Status)
+	}
+	if resp := doRequest(t, http.MethodPost, s.URL+"/api/agents/start", "{}", cookie); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("post without csrf token: %s", resp.Status)
+	}
+	cookie[csrfHeader] = r.Data.CSRFToken
+	if resp := doRequest(t, http.MethodPost, s.URL+"/api/agents/start", "{}", cookie); resp.StatusCode != http.StatusOK {
+		t.Errorf("post with csrf token: %s", resp.Status)
+	}
+
+	doRequest(t, http.MethodPost, s.URL+"/api/logout", "", cookie)
+	if resp := doRequest(t, http.MethodGet, s.URL+"/api/agents", "", cookie); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("get after logout: %s", resp.Status)
+	}
+}
+
+func TestAuthDisabledCrossSite(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/agents/start", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, APIResponse{Success: true})
+	})
+	s := httptest.NewServer(newAuthenticator(newOptions()).handler(mux))
+	t.Cleanup(s.Close)
+
+	for _, c := range []struct {
+		header map[string]string
+		code   int
+	}{
+		{nil, http.StatusOK},
+		{map[string]string{"Origin": s.URL, "Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+		{map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{map[string]string{"Host": "evil.example"}, http.StatusForbidden}, // dns rebinding
+	} {
+		req, err := http.NewRequest(http.MethodPost, s.URL+"/api/agents/start", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		if host := c.header["Host"]; host != "" {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("post with %v: %s", c.header, resp.Status)
+		}
+	}
+}
+
+func TestViewInstances(t *testing.T) {
+	spec := config.Default(config.RoleAgent)
+	spec.CryptKey = 12345
+	instances := []*ServiceInstance{{ID: "a", Type: "agent", InstanceConfig: InstanceConfig{Spec: spec}}}
+	for _, c := range []struct {
+		role   Role
+		secret bool
+	}{
+		{RoleAdmin, true},
+		{RoleReadOnly, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/agents", nil)
+		r = r.WithContext(context.WithValue(r.Context(), roleKey{}, c.role))
+		b, err := json.Marshal(viewInstances(r, instances))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret := strings.Contains(string(b), `"crypt-key":12345`); secret != c.secret || !strings.Contains(string(b), `"id":"a"`) {
+			t.Errorf("%s: unexpected instances %s", c.role, b)
+		}
+	}
+}
+
+func TestLoadTokens(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "tokens")
+	os.WriteFile(name, []byte("# tokens\nadmin abc\nread-only def\n"), 0o600)
+	tokens, err := LoadTokens(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens["abc"] != RoleAdmin || tokens["def"] != RoleReadOnly {
+		t.Errorf("unexpected tokens %v", tokens)
+	}
+	os.WriteFile(name, []byte("root abc\n"), 0o600)
+	if _, err := LoadTokens(name); err == nil {
+		t.Error("invalid role is loaded")
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"localhost:8080": true,
+		"[::1]:8080":     true,
+		"0.0.0.0:8080":   false,
+		":8080":          false,
+		"10.0.0.1:8080":  false,
+	} {
+		if isLoopback(addr) != expected {
+			t.Errorf("isLoopback(%s) != %v", addr, expected)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tutils/tnet/accesslog"
+)
+
+const (
+	// number of output lines kept for each instance
+	logBufferLines = 1000
+	// longer output lines are split
+	maxLogLineSize = 16 << 10
+	// lines sent by logs api if tail is not given
+	defaultLogTail = 200
+	// lines buffered for a follower, a follower is dropped if it falls behind
+	logFollowerBuffer = 256
+)
+
+// logBuffer keeps last lines of output of an instance, copies them to out and an optional file,
+// and sends new lines to followers. It is safe for concurrent use.
+type logBuffer struct {
+	prefix string    // prefix of lines written to out
+	out    io.Writer // server output
+
+	mu        sync.Mutex
+	lines     []string // ring of last lines
+	next      int      // index of next line in ring when it is full
+	partial   []byte   // incomplete last line
+	file      io.WriteCloser
+	followers map[chan string]struct{}
+}
+
+// newLogBuffer creates log buffer of instance, its output is also written to a rotated file in dir if dir is set
+func newLogBuffer(instance *ServiceInstance, out io.Writer, dir string) (*logBuffer, error) {
+	b := &logBuffer{
+		prefix:    fmt.Sprintf("%s %s: ", instance.Type, instance.ID),
+		out:       out,
+		followers: make(map[chan string]struct{}),
+	}
+	if dir != "" {
+		name := filepath.Join(dir, instance.Type+"-"+instance.ID+".log")
+		f, err := accesslog.OpenFile(name, accesslog.DefaultMaxSize, accesslog.DefaultMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		b.file = f
+	}
+	return b, nil
+}
+
+// Write implements io.Writer, output is split into lines
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		i := 0
+		for i < len(p) && p[i] != '\n' {
+			i++
+		}
+		b.partial = append(b.partial, p[:i]...)
+		if i < len(p) || len(b.partial) >= maxLogLineSize {
+			b.addLine(string(b.partial))
+			b.partial = b.partial[:0]
+		}
+		if i < len(p) {
+			i++ // skip '\n'
+		}
+		p = p[i:]
+	}
+	return n, nil
+}
+
+// addLine keeps line and copies it to out, file and followers, b.mu must be held
+func (b *logBuffer) addLine(line string) {
+	if len(b.lines) < logBufferLines {
+		b.lines = append(b.lines, line)
+	} else {
+		b.lines[b.next] = line
+		b.next = (b.next + 1) % logBufferLines
+	}
+	if b.out != nil {
+		io.WriteString(b.out, b.prefix+line+"\n")
+	}
+	if b.file != nil {
+		io.WriteString(b.file, line+"\n")
+	}
+	for ch := range b.followers {
+		select {
+		case ch <- line:
+		default:
+			delete(b.followers, ch)
+			close(ch)
+		}
+	}
+}
+
+// tail returns last n lines, b.mu must be held
+func (b *logBuffer) tail(n int) []string {
+	lines := make([]string, 0, len(b.lines))
+	lines = append(lines, b.lines[b.next:]...)
+	lines = append(lines, b.lines[:b.next]...)
+	if n >= 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// Tail returns last n lines, all kept lines if n is negative
+func (b *logBuffer) Tail(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tail(n)
+}
+
+// Follow returns last n lines and a channel of lines written after them,
+// the channel is closed if the follower falls behind or the buffer is closed
+func (b *logBuffer) Follow(n int) ([]string, chan string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan string, logFollowerBuffer)
+	if b.followers == nil {
+		close(ch)
+	} else {
+		b.followers[ch] = struct{}{}
+	}
+	return b.tail(n), ch
+}
+
+// Unfollow stops sending lines to ch returned by Follow
+func (b *logBuffer) Unfollow(ch chan string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.followers[ch]; ok {
+		delete(b.followers, ch)
+		close(ch)
+	}
+}
+
+// Close closes log file and followers
+func (b *logBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.followers {
+		close(ch)
+	}
+	b.followers = nil
+	if b.file != nil {
+		return b.file.Close()
+	}
+	return nil
+}
+
+// logs returns log buffer of instance id of type typ
+func (sm *ServiceManager) logs(typ string, id string) (*logBuffer, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	instance, exists := sm.instances(typ)[id]
+	if !exists {
+		return nil, fmt.Errorf("%s with ID %s not found", typ, id)
+	}
+	return instance.logs, nil
+}
+
+// handleLogs returns handler of logs api of instances of type typ:
+//
+//	GET /api/agents/logs?id=ID&tail=N           last N lines of output as json
+//	GET /api/agents/logs?id=ID&tail=N&follow=1  last N lines then new lines as server-sent events
+func handleLogs(typ string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		tail := defaultLogTail
+		if s := query.Get("tail"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid tail %q", s))
+				return
+			}
+			tail = n
+		}
+		logs, err := serviceManager.logs(typ, query.Get("id"))
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		follow, _ := strconv.ParseBool(query.Get("follow"))
+		if !follow {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: true,
+				Data:    logs.Tail(tail),
+			})
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeAPIError(w, http.StatusInternalServerError, "Streaming unsupported")
+			return
+		}
+		lines, ch := logs.Follow(tail)
+		defer logs.Unfollow(ch)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		for _, line := range lines {
+			writeEvent(w, line)
+		}
+		flusher.Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case line, ok := <-ch:
+				if !ok {
+					return
+				}
+				writeEvent(w, line)
+				for n := len(ch); n > 0; n-- {
+					writeEvent(w, <-ch)
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// writeEvent writes line as a server-sent event
+func writeEvent(w io.Writer, line string) {
+	io.WriteString(w, "data: "+strings.ReplaceAll(line, "\r", "")+"\n\n")
+}
+
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, APIResponse{Success: false, Error: msg})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogBuffer(t *testing.T) {
+	dir := t.TempDir()
+	var out strings.Builder
+	b, err := newLogBuffer(&ServiceInstance{ID: "a1", Type: "agent"}, &out, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(b, "first\nsec")
+	fmt.Fprint(b, "ond\n")
+	if lines := b.Tail(-1); len(lines) != 2 || lines[1] != "second" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+	if out.String() != "agent a1: first\nagent a1: second\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	lines, ch := b.Follow(1)
+	if len(lines) != 1 || lines[0] != "second" {
+		t.Errorf("unexpected tail %q", lines)
+	}
+	for i := 0; i < logBufferLines; i++ {
+		fmt.Fprintf(b, "line %d\n", i)
+	}
+	if line := <-ch; line != "line 0" {
+		t.Errorf("unexpected followed line %q", line)
+	}
+	if lines := b.Tail(-1); len(lines) != logBufferLines || lines[0] != "line 0" || lines[logBufferLines-1] != "line 999" {
+		t.Errorf("unexpected ring %q ... %q", lines[0], lines[len(lines)-1])
+	}
+	// follower fell behind and is dropped
+	for range ch {
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "agent-a1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "first\nsecond\nline 0\n") {
+		t.Errorf("unexpected file %q", data[:32])
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import "time"
+
+// DefaultStopTimeout is default time to wait for a child process to exit after SIGTERM before it is killed
+const DefaultStopTimeout = 10 * time.Second
+
+// Options is the options of management server
+type Options struct {
+	stateFile        string
+	logDir           string
+	adminPassword    string
+	readOnlyPassword string
+	tokens           map[string]Role
+	tlsCert          string
+	tlsKey           string
+	runner           Runner
+	tunClientOptions TunClientOptions
+	stopTimeout      time.Duration
+}
+
+// Option is option setter for management server
+type Option func(opts *Options)
+
+func newOptions(opts ...Option) *Options {
+	opt := &Options{}
+	for _, o := range opts {
+		o(opt)
+	}
+	return opt
+}
+
+// WithStateFile persists agents and proxies to JSON file name, they are restored on startup
+func WithStateFile(name string) Option {
+	return func(opts *Options) {
+		opts.stateFile = name
+	}
+}
+
+// WithLogDir writes output of each agent and proxy to a rotated file TYPE-ID.log in directory dir
+func WithLogDir(dir string) Option {
+	return func(opts *Options) {
+		opts.logDir = dir
+	}
+}
+
+// WithPasswords sets passwords of web interface login as admin and read-only roles, empty password disables the role
+func WithPasswords(admin string, readOnly string) Option {
+	return func(opts *Options) {
+		opts.adminPassword = admin
+		opts.readOnlyPassword = readOnly
+	}
+}
+
+// WithTokens sets api tokens accepted in Authorization: Bearer TOKEN header and their roles
+func WithTokens(tokens map[string]Role) Option {
+	return func(opts *Options) {
+		opts.tokens = tokens
+	}
+}
+
+// WithTLS serves https with certificate and key files
+func WithTLS(certFile string, keyFile string) Option {
+	return func(opts *Options) {
+		opts.tlsCert = certFile
+		opts.tlsKey = keyFile
+	}
+}
+
+// WithRunner runs instances of in-process mode by r, only process mode is available without it
+func WithRunner(r Runner) Option {
+	return func(opts *Options) {
+		opts.runner = r
+	}
+}
+
+// WithStopTimeout sets time to wait for a child process to exit after SIGTERM before it is killed,
+// instances of in-process mode are stopped by cancellation and abandoned as failed if they don't exit in it
+func WithStopTimeout(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.stopTimeout = d
+	}
+}
+
+// WithTunClientOptions builds tunnel clients of web terminals with options returned by f for specs of agents,
+// e.g. dial and tls options, they only connect by address and crypt key without it
+func WithTunClientOptions(f TunClientOptions) Option {
+	return func(opts *Options) {
+		opts.tunClientOptions = f
+	}
+}
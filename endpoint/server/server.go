@@ -4,20 +4,24 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-// 嵌入静态文件
+// 嵌入静态文件, xterm.js of web terminal is vendored in static/vendor/xterm by vendor_xterm.sh
 //
+//go:generate sh vendor_xterm.sh
 //go:embed static/*
 var staticFiles embed.FS
 
@@ -30,34 +34,68 @@ type APIResponse struct {
 
 // ServiceManager manages agents and proxies
 type ServiceManager struct {
-	mu      sync.Mutex
-	agents  map[string]*ServiceInstance
-	proxies map[string]*ServiceInstance
+	mu        sync.Mutex
+	agents    map[string]*ServiceInstance
+	proxies   map[string]*ServiceInstance
+	stateFile string // instances are persisted to this file if it is set
+	logDir    string // output of instances is also written to files in this directory if it is set
+	runner    Runner // runs instances of in-process mode, nil if the mode is not available
+	// options of tunnel clients of web terminals, nil if they only connect by address and crypt key
+	tunClientOptions TunClientOptions
+	// child process is killed if it doesn't exit in this time after SIGTERM
+	stopTimeout time.Duration
+	wg          sync.WaitGroup
 }
 
 // ServiceInstance represents a running agent or proxy
 type ServiceInstance struct {
-	ID      string             `json:"id"`
-	Type    string             `json:"type"` // "agent" or "proxy"
-	Args    []string           `json:"args"`
-	Ctx     context.Context    `json:"-"` // Ignore in JSON
-	Cancel  context.CancelFunc `json:"-"` // Ignore in JSON
-	Status  string             `json:"status"`
-	ErrChan chan error         `json:"-"` // Ignore in JSON
+	ID   string `json:"id"`
+	Type string `json:"type"` // "agent" or "proxy"
+	InstanceConfig
+	Desired   string             `json:"desired"` // DesiredRunning or DesiredStopped
+	Ctx       context.Context    `json:"-"`       // Ignore in JSON
+	Cancel    context.CancelFunc `json:"-"`       // Ignore in JSON
+	Status    State              `json:"status"`  // actual state
+	Restarts  int                `json:"restarts"`
+	LastError string             `json:"lastError,omitempty"`
+	ExitCode  *int               `json:"exitCode,omitempty"`  // of last exited child process, -1 if it is killed by signal
+	StartedAt *time.Time         `json:"startedAt,omitempty"` // time of last start
+	StoppedAt *time.Time         `json:"stoppedAt,omitempty"` // time of last exit
+	logs      *logBuffer
+	done      chan struct{} // closed when last run exits
 }
 
 // NewServiceManager creates a new service manager
 func NewServiceManager() *ServiceManager {
 	return &ServiceManager{
-		agents:  make(map[string]*ServiceInstance),
-		proxies: make(map[string]*ServiceInstance),
+		agents:      make(map[string]*ServiceInstance),
+		proxies:     make(map[string]*ServiceInstance),
+		stopTimeout: DefaultStopTimeout,
 	}
 }
 
 var serviceManager = NewServiceManager()
 
 // StartServer starts the tnet management server
-func StartServer(listenAddress string) error {
+func StartServer(listenAddress string, opts ...Option) error {
+	opt := newOptions(opts...)
+	serviceManager.runner = opt.runner
+	serviceManager.tunClientOptions = opt.tunClientOptions
+	if opt.stopTimeout > 0 {
+		serviceManager.stopTimeout = opt.stopTimeout
+	}
+	if opt.logDir != "" {
+		if err := os.MkdirAll(opt.logDir, 0o755); err != nil {
+			return err
+		}
+		serviceManager.logDir = opt.logDir
+	}
+	if opt.stateFile != "" {
+		if err := serviceManager.Load(opt.stateFile); err != nil {
+			return err
+		}
+	}
+
 	// 设置路由
 	http.HandleFunc("/", serveStaticFile)
 	http.HandleFunc("/api/agents", handleAgents)
@@ -70,10 +108,45 @@ func StartServer(listenAddress string) error {
 	http.HandleFunc("/api/proxies/restart", handleRestartProxy)
 	http.HandleFunc("/api/agents/delete", handleDeleteAgent)
 	http.HandleFunc("/api/proxies/delete", handleDeleteProxy)
+	http.HandleFunc("/api/agents/update", handleUpdate("agent"))
+	http.HandleFunc("/api/proxies/update", handleUpdate("proxy"))
+	http.HandleFunc("/api/agents/logs", handleLogs("agent"))
+	http.HandleFunc("/api/proxies/logs", handleLogs("proxy"))
+	http.HandleFunc("/api/terminal", handleTerminal)
 
 	// 启动服务器
-	log.Printf("Starting tnet management server on %s", listenAddress)
-	return http.ListenAndServe(listenAddress, nil)
+	// 未配置认证时只允许监听本机地址，否则任何人都可以启动agent执行命令
+	auth := newAuthenticator(opt)
+	if !auth.enabled() && !isLoopback(listenAddress) {
+		return fmt.Errorf("authentication is required to listen on %s, set a password or api tokens", listenAddress)
+	}
+	if (opt.tlsCert == "") != (opt.tlsKey == "") {
+		return fmt.Errorf("tls certificate and key must be set together")
+	}
+
+	// 收到退出信号时停止所有实例，期望状态保持不变，下次启动时恢复
+	srv := &http.Server{Addr: listenAddress, Handler: auth.handler(http.DefaultServeMux)}
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		log.Printf("Received %v, stopping all instances", sig)
+		serviceManager.Shutdown()
+		srv.Close()
+	}()
+
+	var err error
+	if opt.tlsCert != "" {
+		log.Printf("Starting tnet management server on https://%s", listenAddress)
+		err = srv.ListenAndServeTLS(opt.tlsCert, opt.tlsKey)
+	} else {
+		log.Printf("Starting tnet management server on %s", listenAddress)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
 // serveStaticFile 提供静态文件服务
@@ -118,7 +191,7 @@ func handleAgents(w http.ResponseWriter, r *http.Request) {
 	agents := serviceManager.GetAgents()
 
 	// Return response, ensure we return an array
-	json.NewEncoder(w).Encode(agents)
+	json.NewEncoder(w).Encode(viewInstances(r, agents))
 }
 
 func handleProxies(w http.ResponseWriter, r *http.Request) {
@@ -128,7 +201,36 @@ func handleProxies(w http.ResponseWriter, r *http.Request) {
 	proxies := serviceManager.GetProxies()
 
 	// Return response, ensure we return an array
-	json.NewEncoder(w).Encode(proxies)
+	json.NewEncoder(w).Encode(viewInstances(r, proxies))
+}
+
+// secretKeys are keys of spec hidden from users other than admin,
+// crypt key allows connecting to agents and executing commands
+var secretKeys = []string{"crypt-key"}
+
+// viewInstances returns instances visible to role of request, secrets in spec are removed for roles other than admin
+func viewInstances(r *http.Request, instances []*ServiceInstance) any {
+	if requestRole(r) == RoleAdmin {
+		return instances
+	}
+	views := make([]map[string]any, 0, len(instances))
+	for _, instance := range instances {
+		var view map[string]any
+		b, err := json.Marshal(instance)
+		if err == nil {
+			err = json.Unmarshal(b, &view)
+		}
+		if err != nil {
+			continue
+		}
+		if spec, ok := view["spec"].(map[string]any); ok {
+			for _, k := range secretKeys {
+				delete(spec, k)
+			}
+		}
+		views = append(views, view)
+	}
+	return views
 }
 
 func handleStartAgent(w http.ResponseWriter, r *http.Request) {
@@ -140,20 +242,14 @@ func handleStartAgent(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Parse request body
-	var req struct {
-		Args []string `json:"args"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Invalid request: %v", err),
-		})
+	cfg, err := parseInstanceRequest("agent", r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
 		return
 	}
 
 	// Start agent with auto-generated ID
-	instance, err := serviceManager.StartAgent(req.Args)
+	instance, err := serviceManager.StartAgent(cfg)
 	if err != nil {
 		json.NewEncoder(w).Encode(APIResponse{
 			Success: false,
@@ -178,20 +274,14 @@ func handleStartProxy(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Parse request body
-	var req struct {
-		Args []string `json:"args"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Invalid request: %v", err),
-		})
+	cfg, err := parseInstanceRequest("proxy", r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
 		return
 	}
 
 	// Start proxy with auto-generated ID
-	instance, err := serviceManager.StartProxy(req.Args)
+	instance, err := serviceManager.StartProxy(cfg)
 	if err != nil {
 		json.NewEncoder(w).Encode(APIResponse{
 			Success: false,
@@ -405,262 +495,377 @@ func handleDeleteProxy(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// StartAgent starts a new agent instance
-func (sm *ServiceManager) StartAgent(args []string) (*ServiceInstance, error) {
+// instances returns instances of type typ, nil if typ is invalid, sm.mu must be held
+func (sm *ServiceManager) instances(typ string) map[string]*ServiceInstance {
+	switch typ {
+	case "agent":
+		return sm.agents
+	case "proxy":
+		return sm.proxies
+	}
+	return nil
+}
+
+// handleUpdate returns handler of update api of instances of type typ, it replaces definition of an instance
+// by request body of start api and restarts the instance if it is desired running:
+//
+//	POST /api/agents/update?id=ID  {"spec": {...}, "restart": "on-failure", "mode": "in-process"}
+func handleUpdate(typ string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cfg, err := parseInstanceRequest(typ, r.Body)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+		instance, err := serviceManager.updateInstance(typ, r.URL.Query().Get("id"), cfg)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Failed to update %s: %v", typ, err))
+			return
+		}
+		writeJSON(w, http.StatusOK, APIResponse{Success: true, Data: instance})
+	}
+}
+
+// startInstance creates and starts a new instance of type typ
+func (sm *ServiceManager) startInstance(typ string, cfg InstanceConfig) (*ServiceInstance, error) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
 	// Generate unique ID
 	id := uuid.New().String()[:8] // Use first 8 chars of UUID for brevity
-
-	// Create context for the agent
-	ctx, cancel := context.WithCancel(context.Background())
+	if err := sm.checkConfig(typ, id, &cfg); err != nil {
+		return nil, err
+	}
 
 	// Create service instance
 	instance := &ServiceInstance{
-		ID:      id,
-		Type:    "agent",
-		Args:    args,
-		Ctx:     ctx,
-		Cancel:  cancel,
-		Status:  "starting",
-		ErrChan: make(chan error, 1),
+		ID:             id,
+		Type:           typ,
+		InstanceConfig: cfg,
+		Desired:        DesiredRunning,
+	}
+	logs, err := newLogBuffer(instance, os.Stderr, sm.logDir)
+	if err != nil {
+		return nil, err
 	}
+	instance.logs = logs
 
 	// Add to manager
-	sm.agents[id] = instance
+	sm.instances(typ)[id] = instance
+	sm.run(instance)
+	sm.save()
+	c := *instance
+	return &c, nil
+}
 
-	// Start agent in a goroutine
-	go sm.runInstance(instance)
+// updateInstance replaces definition of an existing instance and restarts it if it is desired running
+func (sm *ServiceManager) updateInstance(typ string, id string, cfg InstanceConfig) (*ServiceInstance, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	instance, exists := sm.instances(typ)[id]
+	if !exists {
+		return nil, fmt.Errorf("%s with ID %s not found", typ, id)
+	}
+	if err := sm.checkConfig(typ, id, &cfg); err != nil {
+		return nil, err
+	}
 
-	// Update status to running
-	instance.Status = "running"
-	return instance, nil
+	instance.InstanceConfig = cfg
+	if instance.Desired == DesiredRunning {
+		sm.cancel(instance)
+		instance.Restarts = 0
+		sm.run(instance)
+	}
+	sm.save()
+	c := *instance
+	return &c, nil
 }
 
-// RestartAgent restarts an existing agent instance
-func (sm *ServiceManager) RestartAgent(id string) error {
+// restartInstance restarts an existing instance
+func (sm *ServiceManager) restartInstance(typ string, id string) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	// Check if agent exists
-	instance, exists := sm.agents[id]
+	// Check if instance exists
+	instance, exists := sm.instances(typ)[id]
 	if !exists {
-		return fmt.Errorf("agent with ID %s not found", id)
+		return fmt.Errorf("%s with ID %s not found", typ, id)
 	}
 
-	// Stop the existing instance
-	instance.Cancel()
+	// Stop the existing instance, it is started again after it exits
+	sm.cancel(instance)
 
-	// Create new context for the agent
-	ctx, cancel := context.WithCancel(context.Background())
+	instance.Desired = DesiredRunning
+	instance.Restarts = 0
+	sm.run(instance)
+	sm.save()
+	return nil
+}
 
-	// Update instance with new context and status
+// run starts instance in a new goroutine after its previous run exits, sm.mu must be held
+// and the previous run must be cancelled
+func (sm *ServiceManager) run(instance *ServiceInstance) {
+	ctx, cancel := context.WithCancel(context.Background())
 	instance.Ctx = ctx
 	instance.Cancel = cancel
-	instance.Status = "restarting"
-
-	// Start agent in a new goroutine
-	go sm.runInstance(instance)
-
-	// Update status to running
-	instance.Status = "running"
-	return nil
+	instance.Status = StatePending
+	instance.LastError = ""
+	cfg := instance.InstanceConfig
+	prev := instance.done
+	done := make(chan struct{})
+	instance.done = done
+	sm.wg.Add(1)
+	go func() {
+		defer sm.wg.Done()
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		sm.runInstance(ctx, instance, &cfg)
+	}()
 }
 
-// runInstance runs an instance in a goroutine
-func (sm *ServiceManager) runInstance(instance *ServiceInstance) {
-	// Determine the command to run
-	cmdName := "agent"
-	if instance.Type == "proxy" {
-		cmdName = "proxy"
+// Shutdown stops all instances and waits for them to exit, their desired states are kept
+func (sm *ServiceManager) Shutdown() {
+	sm.mu.Lock()
+	for _, m := range []map[string]*ServiceInstance{sm.agents, sm.proxies} {
+		for _, instance := range m {
+			sm.cancel(instance)
+		}
 	}
+	sm.mu.Unlock()
+	sm.wg.Wait()
+}
 
-	// Execute command
-	cmd := exec.CommandContext(instance.Ctx, os.Args[0], append([]string{cmdName}, instance.Args...)...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err := cmd.Run()
-	instance.ErrChan <- err
+// cancel cancels run of instance, it is stopping until the run exits, sm.mu must be held
+func (sm *ServiceManager) cancel(instance *ServiceInstance) {
+	if instance.Cancel == nil {
+		return
+	}
+	instance.Cancel()
+	select {
+	case <-instance.done:
+	default:
+		instance.Status = StateStopping
+	}
+}
 
-	// Update status
+// update calls fn with sm.mu held unless run ctx of instance is replaced, it tells whether fn is called
+func (sm *ServiceManager) update(ctx context.Context, instance *ServiceInstance, fn func()) bool {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
-	if err != nil {
-		instance.Status = fmt.Sprintf("error: %v", err)
-	} else {
-		instance.Status = "stopped"
+	if instance.Ctx != ctx {
+		return false
 	}
+	fn()
+	return true
 }
 
-// StopAgent stops a running agent instance
-func (sm *ServiceManager) StopAgent(id string) error {
+// runInstance runs instance of cfg until ctx is done, an exited instance is started again by its restart policy
+// with exponential backoff. Its state goes from pending to starting, running when it is started, then stopping
+// and stopped when ctx is done, or stopped or failed when it exits by itself.
+func (sm *ServiceManager) runInstance(ctx context.Context, instance *ServiceInstance, cfg *InstanceConfig) {
+	var delay time.Duration
+	for {
+		if ctx.Err() != nil || !sm.update(ctx, instance, func() { instance.Status = StateStarting }) {
+			sm.update(ctx, instance, func() { instance.Status = StateStopped })
+			return
+		}
+		startedAt := time.Now()
+		started := func() {
+			sm.update(ctx, instance, func() {
+				if ctx.Err() == nil {
+					instance.Status = StateRunning
+				}
+				instance.StartedAt = &startedAt
+				instance.StoppedAt = nil
+				instance.ExitCode = nil
+			})
+		}
+		var err error
+		var exitCode *int
+		if cfg.Mode == ModeProcess {
+			exitCode, err = runProcess(ctx, &cfg.Spec, instance.logs, sm.stopTimeout, started)
+		} else {
+			err = runInProcess(ctx, sm.runner, &cfg.Spec, instance.logs, sm.stopTimeout, started)
+		}
+
+		// Update state, unless instance is restarted by api
+		sm.mu.Lock()
+		if instance.Ctx != ctx {
+			sm.mu.Unlock()
+			return
+		}
+		stoppedAt := time.Now()
+		instance.StoppedAt = &stoppedAt
+		instance.ExitCode = exitCode
+		if ctx.Err() != nil {
+			instance.Status = StateStopped
+			if errors.Is(err, errStopTimeout) {
+				// abandoned run may still hold listeners of instance
+				instance.Status = StateFailed
+				instance.LastError = err.Error()
+				log.Printf("%s %s %v", instance.Type, instance.ID, err)
+			}
+			sm.mu.Unlock()
+			return
+		}
+		if err != nil {
+			instance.LastError = err.Error()
+		}
+		if !instance.Restart.shouldRestart(err) {
+			if err != nil {
+				instance.Status = StateFailed
+			} else {
+				instance.Status = StateStopped
+			}
+			sm.mu.Unlock()
+			return
+		}
+		if time.Since(startedAt) >= restartResetAfter {
+			delay = 0
+		}
+		delay = nextRestartDelay(delay)
+		instance.Status = StatePending
+		sm.mu.Unlock()
+
+		log.Printf("%s %s exited (%v), restarting in %v", instance.Type, instance.ID, err, delay)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+			sm.update(ctx, instance, func() { instance.Restarts++ })
+		}
+	}
+}
+
+// stopInstance stops a running instance and waits for it to exit
+func (sm *ServiceManager) stopInstance(typ string, id string) error {
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
 
-	// Check if agent exists
-	instance, exists := sm.agents[id]
+	// Check if instance exists
+	instance, exists := sm.instances(typ)[id]
 	if !exists {
-		return fmt.Errorf("agent with ID %s not found", id)
+		sm.mu.Unlock()
+		return fmt.Errorf("%s with ID %s not found", typ, id)
 	}
 
-	// Cancel the context to stop the agent
-	instance.Cancel()
-	instance.Status = "stopping"
+	// Cancel the context to stop the instance
+	sm.cancel(instance)
+	instance.Desired = DesiredStopped
+	sm.save()
+	done := instance.done
+	sm.mu.Unlock()
 
+	if done != nil {
+		<-done
+	}
 	return nil
 }
 
-// DeleteAgent deletes an agent instance
-func (sm *ServiceManager) DeleteAgent(id string) error {
+// deleteInstance stops and deletes an instance, it waits for the instance to exit
+func (sm *ServiceManager) deleteInstance(typ string, id string) error {
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
 
-	// Check if agent exists
-	instance, exists := sm.agents[id]
+	// Check if instance exists
+	m := sm.instances(typ)
+	instance, exists := m[id]
 	if !exists {
-		return fmt.Errorf("agent with ID %s not found", id)
+		sm.mu.Unlock()
+		return fmt.Errorf("%s with ID %s not found", typ, id)
 	}
 
-	// Stop the agent if it's running
-	if instance.Status == "running" || instance.Status == "starting" {
-		instance.Cancel()
-	}
+	// Stop the instance if it's running
+	sm.cancel(instance)
 
 	// Remove from manager
-	delete(sm.agents, id)
+	delete(m, id)
+	sm.save()
+	done := instance.done
+	sm.mu.Unlock()
 
+	if done != nil {
+		<-done
+	}
+	instance.logs.Close()
 	return nil
 }
 
-// GetAgents returns all agent instances
-func (sm *ServiceManager) GetAgents() []*ServiceInstance {
+// getInstances returns all instances of type typ
+func (sm *ServiceManager) getInstances(typ string) []*ServiceInstance {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
 	// Return a slice to avoid race conditions
-	agents := make([]*ServiceInstance, 0, len(sm.agents))
-	for _, instance := range sm.agents {
-		agents = append(agents, instance)
+	m := sm.instances(typ)
+	instances := make([]*ServiceInstance, 0, len(m))
+	for _, instance := range m {
+		c := *instance
+		instances = append(instances, &c)
 	}
+	return instances
+}
 
-	return agents
+// StartAgent starts a new agent instance
+func (sm *ServiceManager) StartAgent(cfg InstanceConfig) (*ServiceInstance, error) {
+	return sm.startInstance("agent", cfg)
 }
 
-// StartProxy starts a new proxy instance
-func (sm *ServiceManager) StartProxy(args []string) (*ServiceInstance, error) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+// UpdateAgent replaces definition of an existing agent instance
+func (sm *ServiceManager) UpdateAgent(id string, cfg InstanceConfig) (*ServiceInstance, error) {
+	return sm.updateInstance("agent", id, cfg)
+}
 
-	// Generate unique ID
-	id := uuid.New().String()[:8] // Use first 8 chars of UUID for brevity
+// RestartAgent restarts an existing agent instance
+func (sm *ServiceManager) RestartAgent(id string) error {
+	return sm.restartInstance("agent", id)
+}
 
-	// Create context for the proxy
-	ctx, cancel := context.WithCancel(context.Background())
+// StopAgent stops a running agent instance
+func (sm *ServiceManager) StopAgent(id string) error {
+	return sm.stopInstance("agent", id)
+}
 
-	// Create service instance
-	instance := &ServiceInstance{
-		ID:      id,
-		Type:    "proxy",
-		Args:    args,
-		Ctx:     ctx,
-		Cancel:  cancel,
-		Status:  "starting",
-		ErrChan: make(chan error, 1),
-	}
+// DeleteAgent deletes an agent instance
+func (sm *ServiceManager) DeleteAgent(id string) error {
+	return sm.deleteInstance("agent", id)
+}
 
-	// Add to manager
-	sm.proxies[id] = instance
+// GetAgents returns all agent instances
+func (sm *ServiceManager) GetAgents() []*ServiceInstance {
+	return sm.getInstances("agent")
+}
 
-	// Start proxy in a goroutine
-	go sm.runInstance(instance)
+// StartProxy starts a new proxy instance
+func (sm *ServiceManager) StartProxy(cfg InstanceConfig) (*ServiceInstance, error) {
+	return sm.startInstance("proxy", cfg)
+}
 
-	// Update status to running
-	instance.Status = "running"
-	return instance, nil
+// UpdateProxy replaces definition of an existing proxy instance
+func (sm *ServiceManager) UpdateProxy(id string, cfg InstanceConfig) (*ServiceInstance, error) {
+	return sm.updateInstance("proxy", id, cfg)
 }
 
 // RestartProxy restarts an existing proxy instance
 func (sm *ServiceManager) RestartProxy(id string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Check if proxy exists
-	instance, exists := sm.proxies[id]
-	if !exists {
-		return fmt.Errorf("proxy with ID %s not found", id)
-	}
-
-	// Stop the existing instance
-	instance.Cancel()
-
-	// Create new context for the proxy
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// Update instance with new context and status
-	instance.Ctx = ctx
-	instance.Cancel = cancel
-	instance.Status = "restarting"
-
-	// Start proxy in a new goroutine
-	go sm.runInstance(instance)
-
-	// Update status to running
-	instance.Status = "running"
-	return nil
+	return sm.restartInstance("proxy", id)
 }
 
 // StopProxy stops a running proxy instance
 func (sm *ServiceManager) StopProxy(id string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Check if proxy exists
-	instance, exists := sm.proxies[id]
-	if !exists {
-		return fmt.Errorf("proxy with ID %s not found", id)
-	}
-
-	// Cancel the context to stop the proxy
-	instance.Cancel()
-	instance.Status = "stopping"
-
-	return nil
+	return sm.stopInstance("proxy", id)
 }
 
 // DeleteProxy deletes a proxy instance
 func (sm *ServiceManager) DeleteProxy(id string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Check if proxy exists
-	instance, exists := sm.proxies[id]
-	if !exists {
-		return fmt.Errorf("proxy with ID %s not found", id)
-	}
-
-	// Stop the proxy if it's running
-	if instance.Status == "running" || instance.Status == "starting" {
-		instance.Cancel()
-	}
-
-	// Remove from manager
-	delete(sm.proxies, id)
-
-	return nil
+	return sm.deleteInstance("proxy", id)
 }
 
 // GetProxies returns all proxy instances
 func (sm *ServiceManager) GetProxies() []*ServiceInstance {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Return a slice to avoid race conditions
-	proxies := make([]*ServiceInstance, 0, len(sm.proxies))
-	for _, instance := range sm.proxies {
-		proxies = append(proxies, instance)
-	}
-
-	return proxies
+	return sm.getInstances("proxy")
 }
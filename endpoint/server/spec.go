@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/tutils/tnet/config"
+)
+
+// Mode tells where an instance runs
+type Mode string
+
+const (
+	ModeInProcess Mode = "in-process" // run by runner of management server in its process
+	ModeProcess   Mode = "process"    // run in a child process of tnet run
+)
+
+// ParseMode parses run mode, empty string is in-process
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case "":
+		return ModeInProcess, nil
+	case ModeInProcess, ModeProcess:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid mode %q, expected %s or %s", s, ModeInProcess, ModeProcess)
+}
+
+// Runner runs tunnel t until ctx is done and writes its log to out, it calls started once the tunnel serves.
+// It returns an error if the tunnel can't be started.
+type Runner func(ctx context.Context, t *config.Tunnel, out io.Writer, started func()) error
+
+// InstanceConfig is definition of an agent or proxy instance
+type InstanceConfig struct {
+	Spec    config.Tunnel `json:"spec"` // role of spec is type of instance, name defaults to instance ID
+	Restart RestartPolicy `json:"restart"`
+	Mode    Mode          `json:"mode"`
+}
+
+// instanceRequest is request body of start and update apis, keys of spec are those of tnet run config file:
+//
+//	{"spec": {"tunnel-listen": "ws://0.0.0.0:8080/stream", "allow": ["10.0.0.0/8:22"]}, "restart": "on-failure", "mode": "in-process"}
+type instanceRequest struct {
+	Spec    map[string]any `json:"spec"`
+	Restart string         `json:"restart"`
+	Mode    string         `json:"mode"`
+}
+
+// parseInstanceRequest decodes and validates request body of instance of type typ
+func parseInstanceRequest(typ string, body io.Reader) (InstanceConfig, error) {
+	var cfg InstanceConfig
+	var req instanceRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return cfg, err
+	}
+	if req.Spec == nil {
+		return cfg, fmt.Errorf("spec is required")
+	}
+	if role, ok := req.Spec["role"]; ok && role != typ {
+		return cfg, fmt.Errorf("spec: role %v of %s", role, typ)
+	}
+	req.Spec["role"] = typ
+	spec, err := config.DecodeTunnel(req.Spec)
+	if err != nil {
+		return cfg, fmt.Errorf("spec: %v", err)
+	}
+	if err := spec.Validate(); err != nil {
+		return cfg, fmt.Errorf("spec: %v", err)
+	}
+	cfg.Spec = spec
+	if cfg.Restart, err = ParseRestartPolicy(req.Restart); err != nil {
+		return cfg, err
+	}
+	if cfg.Mode, err = ParseMode(req.Mode); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// checkConfig validates cfg of instance id of type typ and sets its defaults
+func (sm *ServiceManager) checkConfig(typ string, id string, cfg *InstanceConfig) error {
+	if cfg.Spec.Role != typ {
+		return fmt.Errorf("spec: role %q of %s", cfg.Spec.Role, typ)
+	}
+	if err := cfg.Spec.Validate(); err != nil {
+		return fmt.Errorf("spec: %v", err)
+	}
+	if cfg.Spec.Name == "" {
+		cfg.Spec.Name = id
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = ModeInProcess
+	}
+	if cfg.Mode == ModeInProcess && sm.runner == nil {
+		return fmt.Errorf("%s mode is not available, use %s mode", ModeInProcess, ModeProcess)
+	}
+	return nil
+}
+
+// runProcess runs t in a child process of tnet run with a temporary config file until ctx is done,
+// it calls started once the process is started. The process is sent SIGTERM when ctx is done,
+// and killed if it doesn't exit in stopTimeout. Exit code is nil if the process isn't started.
+func runProcess(ctx context.Context, t *config.Tunnel, out io.Writer, stopTimeout time.Duration, started func()) (*int, error) {
+	f, err := os.CreateTemp("", "tnet-"+t.Role+"-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	// config file has crypt key, it is only readable by owner
+	err = json.NewEncoder(f).Encode(&config.Config{Tunnels: []config.Tunnel{*t}})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, os.Args[0], "run", "--config", f.Name())
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return runCommand(cmd, stopTimeout, started)
+}
+
+// runCommand runs cmd of context with graceful stop, see runProcess
+func runCommand(cmd *exec.Cmd, stopTimeout time.Duration, started func()) (*int, error) {
+	cmd.Cancel = func() error {
+		// signals other than kill are not supported on windows
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = stopTimeout
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	started()
+	err := cmd.Wait()
+	code := cmd.ProcessState.ExitCode()
+	return &code, err
+}
+
+// errStopTimeout is returned by runInProcess when the run is abandoned
+var errStopTimeout = errors.New("not stopped in stop timeout, abandoned")
+
+// runInProcess runs t by runner until ctx is done. The run is abandoned if it doesn't return in stopTimeout
+// after ctx is done, e.g. the tunnel ignores ctx, its goroutines are left running.
+func runInProcess(ctx context.Context, runner Runner, t *config.Tunnel, out io.Writer, stopTimeout time.Duration, started func()) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- runner(ctx, t, out, started)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	timer := time.NewTimer(stopTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w after %v", errStopTimeout, stopTimeout)
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tutils/tnet/config"
+)
+
+func TestParseInstanceRequest(t *testing.T) {
+	cfg, err := parseInstanceRequest("proxy", strings.NewReader(
+		`{"spec":{"tunnel-connect":"ws://127.0.0.1:8080/stream","mapping":[":2222=10.0.0.5:22"]},"restart":"always"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Spec.Role != config.RoleProxy || len(cfg.Spec.Mappings) != 1 || cfg.Restart != RestartAlways || cfg.Mode != ModeInProcess {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	for _, body := range []string{
+		`{"args":["--tunnel-listen=:8080"]}`,
+		`{"spec":{"role":"agent","tunnel-connect":"ws://127.0.0.1:8080/stream","listen":":1080","connect":"h:80"}}`,
+		`{"spec":{"tunnel-connect":"ws://127.0.0.1:8080/stream"}}`,
+		`{"spec":{"tunnel-connect":"ws://127.0.0.1:8080/stream","mapping":[":2222"]}}`,
+		`{"spec":{"tunnel-connect":"ws://127.0.0.1:8080/stream","listen":":1080","connect":"h:80","lsiten":":1081"}}`,
+		`{"spec":{"tunnel-connect":"ws://127.0.0.1:8080/stream","listen":":1080","connect":"h:80"},"mode":"thread"}`,
+	} {
+		if _, err := parseInstanceRequest("proxy", strings.NewReader(body)); err == nil {
+			t.Errorf("%s is valid", body)
+		}
+	}
+}
+
+func TestInProcessInstance(t *testing.T) {
+	running := make(chan string)
+	exited := make(chan struct{}, 2)
+	var active atomic.Int32
+	sm := NewServiceManager()
+	sm.runner = func(ctx context.Context, tun *config.Tunnel, out io.Writer, started func()) error {
+		if active.Add(1) != 1 {
+			t.Error("runs of instance overlap")
+		}
+		started()
+		running <- tun.TunnelListen
+		<-ctx.Done()
+		active.Add(-1)
+		exited <- struct{}{}
+		return nil
+	}
+	if _, err := sm.StartAgent(InstanceConfig{Spec: config.Default(config.RoleProxy)}); err == nil {
+		t.Error("agent of proxy spec is started")
+	}
+
+	spec := config.Default(config.RoleAgent)
+	spec.TunnelListen = "ws://:8080/stream"
+	instance, err := sm.StartAgent(InstanceConfig{Spec: spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listen := <-running; listen != spec.TunnelListen || instance.Spec.Name != instance.ID {
+		t.Fatalf("unexpected instance %+v", instance)
+	}
+	if a := sm.GetAgents()[0]; a.Status != StateRunning || a.StartedAt == nil {
+		t.Errorf("unexpected state %s", a.Status)
+	}
+
+	// old run exits before new run starts
+	spec.TunnelListen = "ws://:8081/stream"
+	if _, err := sm.UpdateAgent(instance.ID, InstanceConfig{Spec: spec}); err != nil {
+		t.Fatal(err)
+	}
+	if listen := <-running; listen != spec.TunnelListen {
+		t.Errorf("instance is not restarted by update, %s", listen)
+	}
+	<-exited
+
+	if err := sm.StopAgent(instance.ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	default:
+		t.Fatal("stop returns before runner exits")
+	}
+	if a := sm.GetAgents()[0]; a.Status != StateStopped || a.StoppedAt == nil || a.Desired != DesiredStopped {
+		t.Errorf("unexpected state %s", a.Status)
+	}
+}
+
+func TestFailedInstance(t *testing.T) {
+	sm := NewServiceManager()
+	sm.runner = func(ctx context.Context, tun *config.Tunnel, out io.Writer, started func()) error {
+		return errors.New("address already in use")
+	}
+	spec := config.Default(config.RoleAgent)
+	spec.TunnelListen = "ws://:8080/stream"
+	if _, err := sm.StartAgent(InstanceConfig{Spec: spec, Restart: RestartNever}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for a := sm.GetAgents()[0]; a.Status != StateFailed; a = sm.GetAgents()[0] {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected state %s", a.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a := sm.GetAgents()[0]; a.LastError != "address already in use" || a.StartedAt != nil {
+		t.Errorf("unexpected instance %+v", a)
+	}
+}
+
+func TestStuckInstance(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	sm := NewServiceManager()
+	sm.stopTimeout = 100 * time.Millisecond
+	sm.runner = func(ctx context.Context, tun *config.Tunnel, out io.Writer, started func()) error {
+		started()
+		<-release // ignores ctx
+		return nil
+	}
+	spec := config.Default(config.RoleAgent)
+	spec.TunnelListen = "ws://:8080/stream"
+	instance, err := sm.StartAgent(InstanceConfig{Spec: spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := sm.GetAgents()[0]; a.Status != StateRunning; a = sm.GetAgents()[0] {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- sm.StopAgent(instance.ID)
+	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop blocks on runner ignoring ctx")
+	}
+	if a := sm.GetAgents()[0]; a.Status != StateFailed || !strings.Contains(a.LastError, "abandoned") {
+		t.Errorf("unexpected instance %+v", a)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh is not found")
+	}
+	for _, c := range []struct {
+		script string
+		killed bool
+	}{
+		{"exec sleep 10", false},
+		{"trap '' TERM; while :; do sleep 0.1; done", true}, // ignores SIGTERM
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cmd := exec.CommandContext(ctx, sh, "-c", c.script)
+		started := make(chan struct{})
+		result := make(chan *int)
+		go func() {
+			code, _ := runCommand(cmd, 200*time.Millisecond, func() { close(started) })
+			result <- code
+		}()
+		<-started
+		time.Sleep(100 * time.Millisecond)
+		begin := time.Now()
+		cancel()
+		code := <-result
+		elapsed := time.Since(begin)
+		if code == nil || *code != -1 {
+			t.Errorf("%s: unexpected exit code %v", c.script, code)
+		}
+		if killed := elapsed >= 200*time.Millisecond; killed != c.killed || elapsed > 5*time.Second {
+			t.Errorf("%s: stopped in %v", c.script, elapsed)
+		}
+		if status := cmd.ProcessState.Sys().(syscall.WaitStatus); c.killed && status.Signal() != syscall.SIGKILL ||
+			!c.killed && status.Signal() != syscall.SIGTERM {
+			t.Errorf("%s: unexpected status %v", c.script, cmd.ProcessState)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RestartPolicy tells whether an instance is started again after it exits by itself
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = "never"      // leave exited instance stopped
+	RestartOnFailure RestartPolicy = "on-failure" // restart instance exited with error
+	RestartAlways    RestartPolicy = "always"     // restart instance however it exits
+)
+
+// ParseRestartPolicy parses restart policy, empty string is never
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	switch p := RestartPolicy(s); p {
+	case "":
+		return RestartNever, nil
+	case RestartNever, RestartOnFailure, RestartAlways:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid restart policy %q, expected %s, %s or %s", s, RestartNever, RestartOnFailure, RestartAlways)
+}
+
+// shouldRestart tells whether instance exited with err is restarted
+func (p RestartPolicy) shouldRestart(err error) bool {
+	switch p {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+	// restart delay is reset if instance has run this long
+	restartResetAfter = time.Minute
+)
+
+// nextRestartDelay doubles restart delay from minRestartDelay up to maxRestartDelay
+func nextRestartDelay(delay time.Duration) time.Duration {
+	if delay < minRestartDelay {
+		return minRestartDelay
+	}
+	if delay *= 2; delay > maxRestartDelay {
+		return maxRestartDelay
+	}
+	return delay
+}
+
+// desired states of instance
+const (
+	DesiredRunning = "running"
+	DesiredStopped = "stopped"
+)
+
+// State is actual state of instance
+type State string
+
+const (
+	StatePending  State = "pending"  // waiting for previous run to exit or for restart delay
+	StateStarting State = "starting" // being started
+	StateRunning  State = "running"  // started and serving
+	StateStopping State = "stopping" // asked to stop, waiting for it to exit
+	StateStopped  State = "stopped"  // stopped by api or exited successfully
+	StateFailed   State = "failed"   // exited with error and not restarted
+)
+
+// instanceRecord is definition of instance persisted in state file
+type instanceRecord struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	InstanceConfig
+	Desired string   `json:"desired"`
+	Args    []string `json:"args,omitempty"` // command line arguments of instance saved by older versions
+}
+
+// stateFile is content of state file
+type stateFile struct {
+	Instances []instanceRecord `json:"instances"`
+}
+
+// save writes definitions of instances to state file, sm.mu must be held
+func (sm *ServiceManager) save() {
+	if sm.stateFile == "" {
+		return
+	}
+	var state stateFile
+	for _, m := range []map[string]*ServiceInstance{sm.agents, sm.proxies} {
+		for _, instance := range m {
+			state.Instances = append(state.Instances, instanceRecord{
+				ID:             instance.ID,
+				Type:           instance.Type,
+				InstanceConfig: instance.InstanceConfig,
+				Desired:        instance.Desired,
+			})
+		}
+	}
+	sort.Slice(state.Instances, func(i, j int) bool {
+		return state.Instances[i].ID < state.Instances[j].ID
+	})
+	if err := writeStateFile(sm.stateFile, &state); err != nil {
+		log.Printf("Failed to save state file %s: %v", sm.stateFile, err)
+	}
+}
+
+// writeStateFile replaces state file atomically by renaming a temporary file
+func writeStateFile(name string, state *stateFile) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Load restores instances from state file and starts those desired running,
+// later changes of instances are saved to the file. A missing file is created on first change.
+func (sm *ServiceManager) Load(name string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.stateFile = name
+
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid state file %s: %v", name, err)
+	}
+	restored := 0
+	for _, r := range state.Instances {
+		m := sm.instances(r.Type)
+		if m == nil || r.ID == "" {
+			return fmt.Errorf("invalid instance %q of type %q in state file %s", r.ID, r.Type, name)
+		}
+		if r.Spec.Role == "" && len(r.Args) > 0 {
+			// refuse to start rather than dropping it from the file on next save
+			return fmt.Errorf("%s %s in state file %s is saved as command line arguments %q by an older version, "+
+				"replace them by its spec, or remove the instance from the file", r.Type, r.ID, name, r.Args)
+		}
+		restart, err := ParseRestartPolicy(string(r.Restart))
+		if err != nil {
+			return fmt.Errorf("instance %s: %v", r.ID, err)
+		}
+		r.Restart = restart
+		if err := sm.checkConfig(r.Type, r.ID, &r.InstanceConfig); err != nil {
+			return fmt.Errorf("instance %s: %v", r.ID, err)
+		}
+		instance := &ServiceInstance{
+			ID:             r.ID,
+			Type:           r.Type,
+			InstanceConfig: r.InstanceConfig,
+			Desired:        r.Desired,
+			Status:         StateStopped,
+		}
+		if instance.logs, err = newLogBuffer(instance, os.Stderr, sm.logDir); err != nil {
+			return err
+		}
+		m[r.ID] = instance
+		restored++
+		if instance.Desired == DesiredRunning {
+			sm.run(instance)
+		}
+	}
+	log.Printf("Restored %d instances from %s", restored, name)
+	return nil
+}
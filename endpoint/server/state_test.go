@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tutils/tnet/config"
+)
+
+func TestRestartPolicy(t *testing.T) {
+	if p, err := ParseRestartPolicy(""); err != nil || p != RestartNever {
+		t.Errorf("unexpected default policy %q %v", p, err)
+	}
+	if _, err := ParseRestartPolicy("sometimes"); err == nil {
+		t.Error("invalid policy is parsed")
+	}
+	failure := errors.New("exit status 1")
+	for _, c := range []struct {
+		policy   RestartPolicy
+		err      error
+		expected bool
+	}{
+		{RestartNever, failure, false},
+		{RestartOnFailure, failure, true},
+		{RestartOnFailure, nil, false},
+		{RestartAlways, nil, true},
+	} {
+		if c.policy.shouldRestart(c.err) != c.expected {
+			t.Errorf("%s restarts after %v: %v expected", c.policy, c.err, c.expected)
+		}
+	}
+}
+
+func TestNextRestartDelay(t *testing.T) {
+	var delay time.Duration
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if delay = nextRestartDelay(delay); delay != expected {
+			t.Fatalf("delay %v, %v expected", delay, expected)
+		}
+	}
+	if delay := nextRestartDelay(50 * time.Second); delay != maxRestartDelay {
+		t.Errorf("delay %v exceeds max", delay)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "server.json")
+	sm := NewServiceManager()
+	if err := sm.Load(name); err != nil {
+		t.Fatal(err)
+	}
+	sm.mu.Lock()
+	agent := config.Default(config.RoleAgent)
+	agent.TunnelListen = "ws://:8080/stream"
+	sm.agents["a1"] = &ServiceInstance{ID: "a1", Type: "agent", Desired: DesiredStopped,
+		InstanceConfig: InstanceConfig{Spec: agent, Restart: RestartAlways, Mode: ModeProcess}}
+	proxy := config.Default(config.RoleProxy)
+	proxy.TunnelConnect, proxy.Mappings = "ws://127.0.0.1:8080/stream", []string{":2222=10.0.0.5:22"}
+	sm.proxies["p1"] = &ServiceInstance{ID: "p1", Type: "proxy", Desired: DesiredStopped,
+		InstanceConfig: InstanceConfig{Spec: proxy, Restart: RestartOnFailure, Mode: ModeProcess}}
+	sm.save()
+	sm.mu.Unlock()
+
+	restored := NewServiceManager()
+	if err := restored.Load(name); err != nil {
+		t.Fatal(err)
+	}
+	agents, proxies := restored.GetAgents(), restored.GetProxies()
+	if len(agents) != 1 || len(proxies) != 1 {
+		t.Fatalf("unexpected instances %v %v", agents, proxies)
+	}
+	if a := agents[0]; a.ID != "a1" || a.Restart != RestartAlways || a.Spec.TunnelListen != "ws://:8080/stream" ||
+		a.Spec.Name != "a1" || a.Status != "stopped" {
+		t.Errorf("unexpected agent %+v", a)
+	}
+	if p := proxies[0]; p.Restart != RestartOnFailure || p.Desired != DesiredStopped || len(p.Spec.Mappings) != 1 ||
+		p.Spec.CryptKey != proxy.CryptKey {
+		t.Errorf("unexpected proxy %+v", p)
+	}
+}
+
+func TestStateFileArgs(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "server.json")
+	data := `{"instances":[{"id":"a1","type":"agent","desired":"running","args":["--tunnel-listen=ws://:8080/stream"]}]}`
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewServiceManager().Load(name); err == nil || !strings.Contains(err.Error(), "a1") {
+		t.Errorf("instance saved as command line arguments is loaded, err %v", err)
+	}
+	if b, err := os.ReadFile(name); err != nil || string(b) != data {
+		t.Errorf("state file is changed: %s %v", b, err)
+	}
+}
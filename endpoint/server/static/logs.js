@@ -0,0 +1,40 @@
+// Live output of agent or proxy followed by /api/agents/logs or /api/proxies/logs
+(function () {
+    const params = new URLSearchParams(window.location.search);
+    const type = params.get('type') === 'proxy' ? 'proxy' : 'agent';
+    const id = params.get('id');
+    const maxLines = 5000;
+
+    const title = document.getElementById('logs-title');
+    const status = document.getElementById('logs-status');
+    const logs = document.getElementById('logs');
+    const autoscroll = document.getElementById('logs-autoscroll');
+    title.textContent = (type === 'proxy' ? 'Proxy ' : 'Agent ') + id;
+    document.title = 'TNet Logs - ' + id;
+
+    function setStatus(text) {
+        status.textContent = text;
+        status.className = 'status-badge status-' + text;
+    }
+
+    const endpoint = type === 'proxy' ? '/api/proxies/logs' : '/api/agents/logs';
+    const query = new URLSearchParams({ id: id, tail: 1000, follow: 1 });
+    const source = new EventSource(endpoint + '?' + query.toString());
+    source.onopen = () => {
+        // Tail is sent again after reconnecting
+        logs.textContent = '';
+        setStatus('running');
+    };
+    source.onmessage = (event) => {
+        logs.appendChild(document.createTextNode(event.data + '\n'));
+        while (logs.childNodes.length > maxLines) {
+            logs.removeChild(logs.firstChild);
+        }
+        if (autoscroll.checked) {
+            logs.scrollTop = logs.scrollHeight;
+        }
+    };
+    source.onerror = () => {
+        setStatus(source.readyState === EventSource.CLOSED ? 'stopped' : 'connecting');
+    };
+})();
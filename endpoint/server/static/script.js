@@ -11,6 +11,83 @@ const closeBtns = document.querySelectorAll('.close');
 const agentsList = document.getElementById('agents-list');
 const proxiesList = document.getElementById('proxies-list');
 
+// Session, csrfToken is sent with requests changing state when authentication is enabled
+let csrfToken = '';
+const loginModal = document.getElementById('login-modal');
+
+const originalFetch = window.fetch;
+window.fetch = (url, options = {}) => {
+    if (csrfToken && options.method && options.method !== 'GET') {
+        options.headers = Object.assign({}, options.headers, { 'X-CSRF-Token': csrfToken });
+    }
+    return originalFetch(url, options).then(response => {
+        if (response.status === 401 && url !== '/api/login') {
+            openModal(loginModal);
+        }
+        return response;
+    });
+};
+
+// Apply session info returned by /api/session or /api/login
+function applySession(info) {
+    csrfToken = info.csrfToken || '';
+    document.body.classList.toggle('read-only', info.role !== 'admin');
+    document.getElementById('session-bar').classList.toggle('hidden', !info.auth);
+    document.getElementById('session-role').textContent = 'Logged in as ' + info.role;
+}
+
+function checkSession() {
+    return fetch('/api/session')
+        .then(response => response.json())
+        .then(data => {
+            if (data.success) {
+                applySession(data.data);
+                closeModal(loginModal);
+                refreshAgents();
+                refreshProxies();
+            }
+        })
+        .catch(error => {
+            console.error('Error checking session:', error);
+        });
+}
+
+function login(password) {
+    const loginError = document.getElementById('login-error');
+    loginError.textContent = '';
+    fetch('/api/login', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ password: password })
+    })
+        .then(response => response.json())
+        .then(data => {
+            if (data.success) {
+                document.getElementById('login-form').reset();
+                checkSession();
+            } else {
+                loginError.textContent = data.error;
+            }
+        })
+        .catch(error => {
+            console.error('Error logging in:', error);
+            loginError.textContent = 'Failed to login';
+        });
+}
+
+function logout() {
+    fetch('/api/logout', { method: 'POST' })
+        .finally(() => {
+            csrfToken = '';
+            agentsList.innerHTML = '';
+            proxiesList.innerHTML = '';
+            document.getElementById('session-bar').classList.add('hidden');
+            openModal(loginModal);
+        });
+}
+
 // Tab Switching
 function switchTab(tabName) {
     // Remove active class from all tabs
@@ -34,7 +111,7 @@ function closeModal(modal) {
 // Refresh Functions
 function refreshAgents() {
     fetch('/api/agents')
-        .then(response => response.json())
+        .then(response => response.ok ? response.json() : [])
         .then(data => {
             renderServiceList(agentsList, data, 'agent');
             // Update agent count badge
@@ -47,7 +124,7 @@ function refreshAgents() {
 
 function refreshProxies() {
     fetch('/api/proxies')
-        .then(response => response.json())
+        .then(response => response.ok ? response.json() : [])
         .then(data => {
             renderServiceList(proxiesList, data, 'proxy');
             // Update proxy count badge
@@ -58,24 +135,33 @@ function refreshProxies() {
         });
 }
 
-// Helper function to mask crypt key values for display
-function maskCryptKeyArgs(args) {
-    return args.map(arg => {
-        if (arg.startsWith('--crypt-key=')) {
-            return '--crypt-key=**********';
-        }
-        return arg;
-    });
+// Services of last refresh by type and ID, for editing and copying their specs
+const services = { agent: {}, proxy: {} };
+
+// Escape text shown in html
+function escapeHTML(text) {
+    return String(text).replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' })[c]);
 }
 
-// Copy full command with real crypt-key
-function copyCommand(event) {
-    const button = event.target;
-    const serviceType = button.dataset.serviceType;
-    const realArgs = JSON.parse(button.dataset.args);
+// Short description of service spec, crypt key is not shown
+function specSummary(service) {
+    const spec = service.spec || {};
+    const parts = [];
+    if (spec.name && spec.name !== service.id) parts.push(spec.name);
+    if (spec['tunnel-listen']) parts.push('tunnel listen ' + spec['tunnel-listen']);
+    if (spec['tunnel-connect']) parts.push('tunnel connect ' + spec['tunnel-connect']);
+    if (spec.listen) parts.push(spec.listen + ' → ' + spec.connect);
+    (spec.mapping || []).forEach(m => parts.push(m.replace('=', ' → ')));
+    if (spec['mapping-file']) parts.push('mappings of ' + spec['mapping-file']);
+    if (spec['enabled-execute']) parts.push('execute enabled');
+    if (service.mode === 'process') parts.push('child process');
+    return parts.join(', ');
+}
 
-    // Build full command: tnet agent [args] or tnet proxy [args]
-    const command = `tnet ${serviceType} ${realArgs.join(' ')}`;
+// Copy spec of service as JSON with real crypt-key
+function copySpec(event, serviceType, id) {
+    const button = event.target;
+    const spec = services[serviceType][id].spec;
 
     // Store original state
     const originalText = button.textContent;
@@ -83,7 +169,7 @@ function copyCommand(event) {
     const originalColor = button.style.color;
 
     // Copy to clipboard
-    navigator.clipboard.writeText(command)
+    navigator.clipboard.writeText(JSON.stringify(spec, null, 2))
         .then(() => {
             // Subtle feedback: change button text and color temporarily
             button.textContent = 'Copied!';
@@ -98,40 +184,86 @@ function copyCommand(event) {
             }, 1500);
         })
         .catch(err => {
-            console.error('Failed to copy command:', err);
+            console.error('Failed to copy spec:', err);
             // Keep alert for errors since they need user attention
-            alert('Failed to copy command');
+            alert('Failed to copy spec');
         });
 }
 
+// States changing soon, services in them are refreshed every second
+const transientStates = ['pending', 'starting', 'stopping'];
+const transientRefresh = { agent: null, proxy: null };
+
+// Time of start or exit and exit code of service
+function statusDetail(service) {
+    const time = t => new Date(t).toLocaleString();
+    if ((service.status === 'running' || service.status === 'starting') && service.startedAt) {
+        return 'since ' + time(service.startedAt);
+    }
+    if (service.stoppedAt) {
+        const code = service.exitCode !== undefined ? `exit code ${service.exitCode}, ` : '';
+        return code + 'at ' + time(service.stoppedAt);
+    }
+    return '';
+}
+
 // Render Service List
 function renderServiceList(container, data, serviceType) {
+    clearTimeout(transientRefresh[serviceType]);
+    if (data && data.some(service => transientStates.includes(service.status))) {
+        transientRefresh[serviceType] = setTimeout(serviceType === 'agent' ? refreshAgents : refreshProxies, 1000);
+    }
+
     if (!data || data.length === 0) {
         container.innerHTML = '<tr><td colspan="5" class="empty-state">No ' + serviceType + 's found</td></tr>';
         return;
     }
 
+    services[serviceType] = {};
     container.innerHTML = data.map(service => {
-        // Mask crypt-key values in the args display
-        const maskedArgs = maskCryptKeyArgs(service.args);
+        services[serviceType][service.id] = service;
         return `
             <tr>
                 <td>${service.id}</td>
-                <td><span class="status-badge status-${service.status.toLowerCase()}">${service.status}</span></td>
-                <td>${maskedArgs.join(' ')}</td>
                 <td>
-                    ${service.status === 'running' ?
-                `<button class="action-btn stop-btn" onclick="stopService('${serviceType}', '${service.id}')">Stop</button>` :
-                `<button class="action-btn start-btn" onclick="startService('${serviceType}', '${service.id}')">Start</button>`
+                    <span class="status-badge status-${service.status}" title="${escapeHTML(service.lastError || '')}">${service.status}</span>
+                    <small class="status-detail">${statusDetail(service)}</small>
+                </td>
+                <td>${service.restart}${service.restarts ? ` (${service.restarts} restarts)` : ''}</td>
+                <td>${escapeHTML(specSummary(service))}</td>
+                <td>
+                    ${service.desired === 'running' ?
+                `<button class="action-btn stop-btn admin-only" onclick="stopService('${serviceType}', '${service.id}')">Stop</button>` :
+                `<button class="action-btn start-btn admin-only" onclick="startService('${serviceType}', '${service.id}')">Start</button>`
+            }
+                    ${serviceType === 'agent' && service.status === 'running' && hasTunnelListen(service.spec) ?
+                `<button class="action-btn terminal-btn admin-only" onclick="openTerminal('${service.id}')">Terminal</button>` : ''
             }
-                    <button class="action-btn copy-command-btn" data-service-type="${serviceType}" data-args='${JSON.stringify(service.args).replace(/'/g, '&apos;')}' onclick="copyCommand(event)">Copy</button>
-                    <button class="action-btn delete-btn" onclick="deleteService('${serviceType}', '${service.id}')">Delete</button>
+                    <button class="action-btn logs-btn" onclick="openLogs('${serviceType}', '${service.id}')">Logs</button>
+                    <button class="action-btn edit-btn admin-only" onclick="editService('${serviceType}', '${service.id}')">Edit</button>
+                    <button class="action-btn copy-command-btn" title="Copy spec as JSON" onclick="copySpec(event, '${serviceType}', '${service.id}')">Copy</button>
+                    <button class="action-btn delete-btn admin-only" onclick="deleteService('${serviceType}', '${service.id}')">Delete</button>
                 </td>
             </tr>
         `;
     }).join('');
 }
 
+// Whether agent accepts tunnel connections, web terminal connects to it by tunnel
+function hasTunnelListen(spec) {
+    return !!(spec && spec['tunnel-listen']);
+}
+
+// Open web terminal of agent in a new window
+function openTerminal(id) {
+    window.open('/static/terminal.html?id=' + encodeURIComponent(id), '_blank');
+}
+
+// Open live output of agent or proxy in a new window
+function openLogs(serviceType, id) {
+    window.open('/static/logs.html?type=' + encodeURIComponent(serviceType) + '&id=' + encodeURIComponent(id), '_blank');
+}
+
 // Service Actions
 function startService(serviceType, id) {
     if (serviceType === 'agent') {
@@ -162,28 +294,6 @@ function deleteService(serviceType, id) {
 }
 
 // Agent Functions
-function startAgent(args) {
-    fetch('/api/agents/start', {
-        method: 'POST',
-        headers: {
-            'Content-Type': 'application/json',
-        },
-        body: JSON.stringify({ args: args })
-    })
-        .then(response => response.json())
-        .then(data => {
-            if (data.success) {
-                refreshAgents();
-            } else {
-                alert('Failed to start agent: ' + data.error);
-            }
-        })
-        .catch(error => {
-            console.error('Error starting agent:', error);
-            alert('Failed to start agent');
-        });
-}
-
 function restartAgent(id) {
     fetch(`/api/agents/restart?id=${id}`, {
         method: 'POST',
@@ -242,28 +352,6 @@ function deleteAgent(id) {
 }
 
 // Proxy Functions
-function startProxy(args) {
-    fetch('/api/proxies/start', {
-        method: 'POST',
-        headers: {
-            'Content-Type': 'application/json',
-        },
-        body: JSON.stringify({ args: args })
-    })
-        .then(response => response.json())
-        .then(data => {
-            if (data.success) {
-                refreshProxies();
-            } else {
-                alert('Failed to start proxy: ' + data.error);
-            }
-        })
-        .catch(error => {
-            console.error('Error starting proxy:', error);
-            alert('Failed to start proxy');
-        });
-}
-
 function restartProxy(id) {
     fetch(`/api/proxies/restart?id=${id}`, {
         method: 'POST',
@@ -321,7 +409,106 @@ function deleteProxy(id) {
         });
 }
 
-// Crypt Key Functions
+// Add and Edit Form Functions
+// Lines of textarea, blank lines are skipped
+function textLines(value) {
+    return (value || '').split('\n').map(line => line.trim()).filter(line => line);
+}
+
+// Show fields of input mode, form or json, in add form of service type
+function showInputMode(serviceType, mode) {
+    document.getElementById(`${serviceType}-form-fields`).classList.toggle('hidden', mode !== 'form');
+    document.getElementById(`${serviceType}-json-fields`).classList.toggle('hidden', mode !== 'json');
+}
+
+// Reset add form of service type for a new service
+function resetServiceForm(serviceType) {
+    const form = document.getElementById(`add-${serviceType}-form`);
+    const name = serviceType === 'agent' ? 'Agent' : 'Proxy';
+    form.reset();
+    form.querySelector(`input[name="${serviceType}-tunnel-mode"]:checked`).dispatchEvent(new Event('change'));
+    showInputMode(serviceType, 'form');
+    document.getElementById(`${serviceType}-edit-id`).value = '';
+    document.getElementById(`${serviceType}-modal-title`).textContent = `Add New ${name}`;
+    form.querySelector('.submit-btn').textContent = `Add ${name}`;
+}
+
+// Open add form of service type to edit spec of an existing service as JSON
+function editService(serviceType, id) {
+    const service = services[serviceType][id];
+    const form = document.getElementById(`add-${serviceType}-form`);
+    resetServiceForm(serviceType);
+    form.querySelector(`input[name="${serviceType}-input-mode"][value="json"]`).checked = true;
+    showInputMode(serviceType, 'json');
+    const spec = Object.assign({}, service.spec);
+    delete spec.role;
+    document.getElementById(`${serviceType}-spec-json`).value = JSON.stringify(spec, null, 2);
+    document.getElementById(`${serviceType}-restart`).value = service.restart;
+    document.getElementById(`${serviceType}-mode`).value = service.mode;
+    document.getElementById(`${serviceType}-edit-id`).value = id;
+    document.getElementById(`${serviceType}-modal-title`).textContent = `Edit ${serviceType} ${id}`;
+    form.querySelector('.submit-btn').textContent = 'Save';
+    openModal(document.getElementById(`add-${serviceType}-modal`));
+}
+
+// Spec of add form in JSON spec mode, null if JSON is invalid
+function jsonSpec(formData) {
+    try {
+        return JSON.parse(formData.get('spec-json') || '{}');
+    } catch (err) {
+        alert('Invalid JSON spec: ' + err.message);
+        return null;
+    }
+}
+
+// Save spec of add form by start api, or by update api if an existing service is edited
+function saveService(serviceType, form, spec) {
+    const formData = new FormData(form);
+    const editId = formData.get('edit-id');
+    const api = serviceType === 'agent' ? 'agents' : 'proxies';
+    const url = editId ? `/api/${api}/update?id=${encodeURIComponent(editId)}` : `/api/${api}/start`;
+    const refresh = serviceType === 'agent' ? refreshAgents : refreshProxies;
+
+    // Show saving state
+    const submitBtn = form.querySelector('.submit-btn');
+    const originalText = submitBtn.textContent;
+    submitBtn.textContent = editId ? 'Saving...' : 'Creating...';
+    submitBtn.disabled = true;
+
+    fetch(url, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+            spec: spec,
+            restart: formData.get('restart'),
+            mode: formData.get('mode')
+        })
+    })
+        .then(response => response.json())
+        .then(data => {
+            if (data.success) {
+                closeModal(document.getElementById(`add-${serviceType}-modal`));
+                resetServiceForm(serviceType);
+                // Wait 2 seconds before refreshing to show starting state
+                setTimeout(refresh, 2000);
+            } else {
+                alert(`Failed to save ${serviceType}: ` + data.error);
+            }
+        })
+        .catch(error => {
+            console.error(`Error saving ${serviceType}:`, error);
+            alert(`Failed to save ${serviceType}`);
+        })
+        .finally(() => {
+            // Restore submit button
+            submitBtn.textContent = originalText;
+            submitBtn.disabled = false;
+        });
+}
+
+// Crypt Key Functions// Crypt Key Functions
 function toggleCryptKeyVisibility(serviceType) {
     const input = document.getElementById(`${serviceType}-crypt-key`);
     const container = input.parentElement;
@@ -392,10 +579,12 @@ window.addEventListener('DOMContentLoaded', () => {
 
     // Add buttons
     addAgentBtn.addEventListener('click', () => {
+        resetServiceForm('agent');
         openModal(addAgentModal);
     });
 
     addProxyBtn.addEventListener('click', () => {
+        resetServiceForm('proxy');
         openModal(addProxyModal);
     });
 
@@ -406,9 +595,16 @@ window.addEventListener('DOMContentLoaded', () => {
         });
     });
 
-    // Close modal when clicking outside
+    // Login and logout
+    document.getElementById('login-form').addEventListener('submit', (e) => {
+        e.preventDefault();
+        login(document.getElementById('login-password').value);
+    });
+    document.getElementById('logout-btn').addEventListener('click', logout);
+
+    // Close modal when clicking outside, login can't be skipped
     window.addEventListener('click', (event) => {
-        if (event.target.classList.contains('modal')) {
+        if (event.target.classList.contains('modal') && event.target !== loginModal) {
             closeModal(event.target);
         }
     });
@@ -422,41 +618,6 @@ window.addEventListener('DOMContentLoaded', () => {
         return parent;
     }
 
-    // Helper function to parse command line arguments
-    function parseCommandArgs(cmdLine) {
-        // Basic argument parsing that handles spaces in quotes
-        const args = [];
-        let currentArg = '';
-        let inQuotes = false;
-        let escaped = false;
-
-        for (let i = 0; i < cmdLine.length; i++) {
-            const char = cmdLine[i];
-
-            if (escaped) {
-                currentArg += char;
-                escaped = false;
-            } else if (char === '\\') {
-                escaped = true;
-            } else if (char === '"') {
-                inQuotes = !inQuotes;
-            } else if (char === ' ' && !inQuotes) {
-                if (currentArg) {
-                    args.push(currentArg);
-                    currentArg = '';
-                }
-            } else {
-                currentArg += char;
-            }
-        }
-
-        if (currentArg) {
-            args.push(currentArg);
-        }
-
-        return args;
-    }
-
     // Agent form: tunnel mode radio buttons
     const agentTunnelListenRadio = document.querySelector('input[name="agent-tunnel-mode"][value="listen"]');
     const agentTunnelConnectRadio = document.querySelector('input[name="agent-tunnel-mode"][value="connect"]');
@@ -507,250 +668,80 @@ window.addEventListener('DOMContentLoaded', () => {
         proxyTunnelConnectGroup.classList.remove('hidden');
     });
 
-    // Proxy form: mode radio buttons
-    const proxyModeRadio = document.querySelector('input[name="proxy-mode"][value="proxy"]');
-    const proxyExecuteRadio = document.querySelector('input[name="proxy-mode"][value="execute"]');
-    const proxyListenGroup = getFormGroup(document.getElementById('proxy-listen'));
-    const proxyConnectGroup = getFormGroup(document.getElementById('proxy-connect'));
-    const proxyExecuteGroup = getFormGroup(document.getElementById('proxy-execute'));
-    const proxyRawPtyGroup = getFormGroup(document.getElementById('proxy-raw-pty'));
-
-    proxyModeRadio.addEventListener('change', () => {
-        proxyListenGroup.classList.remove('hidden');
-        proxyConnectGroup.classList.remove('hidden');
-        proxyExecuteGroup.classList.add('hidden');
-        proxyRawPtyGroup.classList.add('hidden');
-    });
-
-    proxyExecuteRadio.addEventListener('change', () => {
-        proxyListenGroup.classList.add('hidden');
-        proxyConnectGroup.classList.add('hidden');
-        proxyExecuteGroup.classList.remove('hidden');
-        proxyRawPtyGroup.classList.remove('hidden');
-    });
-
-    // Agent form: input mode toggle
-    const agentFormModeRadio = document.querySelector('input[name="agent-input-mode"][value="form"]');
-    const agentDirectModeRadio = document.querySelector('input[name="agent-input-mode"][value="direct"]');
-    const agentFormFields = document.getElementById('agent-form-fields');
-    const agentDirectFields = document.getElementById('agent-direct-fields');
-
-    agentFormModeRadio.addEventListener('change', () => {
-        agentFormFields.classList.remove('hidden');
-        agentDirectFields.classList.add('hidden');
-    });
-
-    agentDirectModeRadio.addEventListener('change', () => {
-        agentFormFields.classList.add('hidden');
-        agentDirectFields.classList.remove('hidden');
-    });
-
-    // Proxy form: input mode toggle
-    const proxyFormModeRadio = document.querySelector('input[name="proxy-input-mode"][value="form"]');
-    const proxyDirectModeRadio = document.querySelector('input[name="proxy-input-mode"][value="direct"]');
-    const proxyFormFields = document.getElementById('proxy-form-fields');
-    const proxyDirectFields = document.getElementById('proxy-direct-fields');
-
-    proxyFormModeRadio.addEventListener('change', () => {
-        proxyFormFields.classList.remove('hidden');
-        proxyDirectFields.classList.add('hidden');
-    });
-
-    proxyDirectModeRadio.addEventListener('change', () => {
-        proxyFormFields.classList.add('hidden');
-        proxyDirectFields.classList.remove('hidden');
+    // Input mode toggles
+    ['agent', 'proxy'].forEach(serviceType => {
+        document.querySelectorAll(`input[name="${serviceType}-input-mode"]`).forEach(radio => {
+            radio.addEventListener('change', () => showInputMode(serviceType, radio.value));
+        });
     });
 
     // Form submissions
     addAgentForm.addEventListener('submit', (e) => {
         e.preventDefault();
         const formData = new FormData(e.target);
-        let args = [];
-
-        // Check input mode
-        const inputMode = formData.get('agent-input-mode');
-
-        if (inputMode === 'direct') {
-            // Direct command mode - only use direct command parameters
-            const directCommand = formData.get('direct-command');
-            if (directCommand) {
-                args = parseCommandArgs(directCommand);
-                // Remove command name if present (agent/proxy), as server will add it automatically
-                if (args.length > 0 && (args[0] === 'agent' || args[0] === 'proxy')) {
-                    args = args.slice(1);
-                }
-            }
+        let spec = {};
+
+        if (formData.get('agent-input-mode') === 'json') {
+            spec = jsonSpec(formData);
+            if (!spec) return;
         } else {
-            // Form mode
+            if (formData.get('name')) spec.name = formData.get('name');
+
             // Tunnel mode
-            const tunnelMode = formData.get('agent-tunnel-mode');
-            if (tunnelMode === 'listen') {
-                const tunnelListen = formData.get('tunnel-listen');
-                if (tunnelListen) args.push('--tunnel-listen=' + tunnelListen);
+            if (formData.get('agent-tunnel-mode') === 'listen') {
+                spec['tunnel-listen'] = formData.get('tunnel-listen');
             } else {
-                const tunnelConnect = formData.get('tunnel-connect');
-                if (tunnelConnect) args.push('--tunnel-connect=' + tunnelConnect);
+                spec['tunnel-connect'] = formData.get('tunnel-connect');
             }
 
-            // Crypt key
             const cryptKey = formData.get('crypt-key');
-            if (cryptKey) args.push('--crypt-key=' + cryptKey);
+            if (cryptKey) spec['crypt-key'] = Number(cryptKey);
 
-            // Enabled execute
-            if (formData.has('enabled-execute')) {
-                args.push('--enabled-execute');
-            }
-        }
+            const allow = textLines(formData.get('allow'));
+            if (allow.length > 0) spec.allow = allow;
 
-        // Show creating state
-        const submitBtn = addAgentForm.querySelector('.submit-btn');
-        const originalText = submitBtn.textContent;
-        submitBtn.textContent = 'Creating...';
-        submitBtn.disabled = true;
-
-        fetch('/api/agents/start', {
-            method: 'POST',
-            headers: {
-                'Content-Type': 'application/json',
-            },
-            body: JSON.stringify({
-                args: args
-            })
-        })
-            .then(response => response.json())
-            .then(data => {
-                if (data.success) {
-                    closeModal(addAgentModal);
-                    // Reset form and ensure correct UI state
-                    addAgentForm.reset();
-                    // Explicitly show form fields and hide direct command fields
-                    const agentFormFields = document.getElementById('agent-form-fields');
-                    const agentDirectFields = document.getElementById('agent-direct-fields');
-                    agentFormFields.classList.remove('hidden');
-                    agentDirectFields.classList.add('hidden');
-                    // Wait 2 seconds before refreshing to show creating state
-                    setTimeout(() => {
-                        refreshAgents();
-                    }, 2000);
-                } else {
-                    alert('Failed to add agent: ' + data.error);
-                }
-            })
-            .catch(error => {
-                console.error('Error adding agent:', error);
-                alert('Failed to add agent');
-            })
-            .finally(() => {
-                // Restore submit button
-                submitBtn.textContent = originalText;
-                submitBtn.disabled = false;
-            });
+            spec['enabled-execute'] = formData.has('enabled-execute');
+        }
+        saveService('agent', addAgentForm, spec);
     });
 
     addProxyForm.addEventListener('submit', (e) => {
         e.preventDefault();
         const formData = new FormData(e.target);
-        let args = [];
-
-        // Check input mode
-        const inputMode = formData.get('proxy-input-mode');
-
-        if (inputMode === 'direct') {
-            // Direct command mode - only use direct command parameters
-            const directCommand = formData.get('direct-command');
-            if (directCommand) {
-                args = parseCommandArgs(directCommand);
-                // Remove command name if present (agent/proxy), as server will add it automatically
-                if (args.length > 0 && (args[0] === 'agent' || args[0] === 'proxy')) {
-                    args = args.slice(1);
-                }
-            }
+        let spec = {};
+
+        if (formData.get('proxy-input-mode') === 'json') {
+            spec = jsonSpec(formData);
+            if (!spec) return;
         } else {
-            // Form mode
+            if (formData.get('name')) spec.name = formData.get('name');
+
             // Tunnel mode
-            const tunnelMode = formData.get('proxy-tunnel-mode');
-            if (tunnelMode === 'listen') {
-                const tunnelListen = formData.get('tunnel-listen');
-                if (tunnelListen) args.push('--tunnel-listen=' + tunnelListen);
+            if (formData.get('proxy-tunnel-mode') === 'listen') {
+                spec['tunnel-listen'] = formData.get('tunnel-listen');
             } else {
-                const tunnelConnect = formData.get('tunnel-connect');
-                if (tunnelConnect) args.push('--tunnel-connect=' + tunnelConnect);
+                spec['tunnel-connect'] = formData.get('tunnel-connect');
             }
 
-            // Mode
-            const mode = formData.get('proxy-mode');
-            if (mode === 'proxy') {
-                const listen = formData.get('listen');
-                if (listen) args.push('--listen=' + listen);
-
-                const connect = formData.get('connect');
-                if (connect) args.push('--connect=' + connect);
-            } else {
-                const execute = formData.get('execute');
-                if (execute) args.push('--execute=' + execute);
-
-                if (formData.has('raw-pty')) {
-                    args.push('--raw-pty');
-                }
+            // Forwarding
+            if (formData.get('listen') || formData.get('connect')) {
+                spec.listen = formData.get('listen');
+                spec.connect = formData.get('connect');
             }
+            const mappings = textLines(formData.get('mapping'));
+            if (mappings.length > 0) spec.mapping = mappings;
 
-            // Crypt key
             const cryptKey = formData.get('crypt-key');
-            if (cryptKey) args.push('--crypt-key=' + cryptKey);
+            if (cryptKey) spec['crypt-key'] = Number(cryptKey);
 
-            // Dump dir
             const dumpDir = formData.get('dump-dir');
-            if (dumpDir) args.push('--dump-dir=' + dumpDir);
+            if (dumpDir) spec['dump-dir'] = dumpDir;
         }
-
-        // Show creating state
-        const submitBtn = addProxyForm.querySelector('.submit-btn');
-        const originalText = submitBtn.textContent;
-        submitBtn.textContent = 'Creating...';
-        submitBtn.disabled = true;
-
-        fetch('/api/proxies/start', {
-            method: 'POST',
-            headers: {
-                'Content-Type': 'application/json',
-            },
-            body: JSON.stringify({
-                args: args
-            })
-        })
-            .then(response => response.json())
-            .then(data => {
-                if (data.success) {
-                    closeModal(addProxyModal);
-                    // Reset form and ensure correct UI state
-                    addProxyForm.reset();
-                    // Explicitly show form fields and hide direct command fields
-                    const proxyFormFields = document.getElementById('proxy-form-fields');
-                    const proxyDirectFields = document.getElementById('proxy-direct-fields');
-                    proxyFormFields.classList.remove('hidden');
-                    proxyDirectFields.classList.add('hidden');
-                    // Wait 2 seconds before refreshing to show creating state
-                    setTimeout(() => {
-                        refreshProxies();
-                    }, 2000);
-                } else {
-                    alert('Failed to add proxy: ' + data.error);
-                }
-            })
-            .catch(error => {
-                console.error('Error adding proxy:', error);
-                alert('Failed to add proxy');
-            })
-            .finally(() => {
-                // Restore submit button
-                submitBtn.textContent = originalText;
-                submitBtn.disabled = false;
-            });
+        saveService('proxy', addProxyForm, spec);
     });
 
-    // Initial refresh
-    refreshAgents();
-    refreshProxies();
+    // Initial refresh after session is checked
+    checkSession();
 
     // Single polling mechanism: refresh active tab every 10 seconds
     // This reduces API calls while keeping the interface responsive
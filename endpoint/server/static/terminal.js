@@ -0,0 +1,78 @@
+// Web terminal bridged to a pty session on agent by /api/terminal
+(function () {
+    const params = new URLSearchParams(window.location.search);
+    const agentId = params.get('id');
+    const command = params.get('cmd') || '';
+
+    const title = document.getElementById('terminal-title');
+    const status = document.getElementById('terminal-status');
+    title.textContent = 'Agent ' + agentId + (command ? ' - ' + command : '');
+    document.title = 'TNet Terminal - ' + agentId;
+
+    function setStatus(text) {
+        status.textContent = text;
+        status.className = 'status-badge status-' + text.split(':')[0];
+    }
+
+    if (typeof Terminal === 'undefined' || typeof FitAddon === 'undefined') {
+        setStatus('error: xterm.js is not vendored, run go generate ./endpoint/server');
+        return;
+    }
+
+    const term = new Terminal({ cursorBlink: true, scrollback: 5000 });
+    const fitAddon = new FitAddon.FitAddon();
+    term.loadAddon(fitAddon);
+    term.open(document.getElementById('terminal'));
+    fitAddon.fit();
+    term.focus();
+
+    const scheme = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+    const query = new URLSearchParams({ id: agentId, cols: term.cols, rows: term.rows });
+    if (command) {
+        query.set('cmd', command);
+    }
+    const ws = new WebSocket(scheme + '//' + window.location.host + '/api/terminal?' + query.toString());
+    ws.binaryType = 'arraybuffer';
+
+    const encoder = new TextEncoder();
+    let finished = false;
+
+    ws.onopen = () => setStatus('running');
+
+    ws.onmessage = (event) => {
+        if (event.data instanceof ArrayBuffer) {
+            term.write(new Uint8Array(event.data));
+            return;
+        }
+        const msg = JSON.parse(event.data);
+        finished = true;
+        if (msg.type === 'exit') {
+            setStatus('stopped');
+            term.write('\r\n[process exited with code ' + msg.code + ']\r\n');
+        } else if (msg.type === 'error') {
+            setStatus('error');
+            term.write('\r\n[error: ' + msg.error + ']\r\n');
+        }
+    };
+
+    ws.onclose = () => {
+        if (!finished) {
+            setStatus('error');
+            term.write('\r\n[connection closed]\r\n');
+        }
+    };
+
+    term.onData((data) => {
+        if (ws.readyState === WebSocket.OPEN) {
+            ws.send(encoder.encode(data));
+        }
+    });
+
+    term.onResize(({ cols, rows }) => {
+        if (ws.readyState === WebSocket.OPEN) {
+            ws.send(JSON.stringify({ type: 'resize', cols: cols, rows: rows }));
+        }
+    });
+
+    window.addEventListener('resize', () => fitAddon.fit());
+})();
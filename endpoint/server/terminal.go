@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/tutils/tnet/config"
+	"github.com/tutils/tnet/crypt/xor"
+	"github.com/tutils/tnet/endpoint/proxy"
+	"github.com/tutils/tnet/tun"
+)
+
+// default command of web terminal
+var defaultTerminalCommand = []string{"sh"}
+
+var terminalUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4 << 10,
+	WriteBufferSize: 4 << 10,
+	CheckOrigin:     sameOrigin,
+}
+
+// sameOrigin rejects cross-site websocket connections, a shell must not be opened by other sites
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// terminalMessage is a control message between terminal page and server,
+// terminal input and output are sent as binary messages
+type terminalMessage struct {
+	Type  string `json:"type"` // "resize" from page, "exit" or "error" to page
+	Cols  int    `json:"cols,omitempty"`
+	Rows  int    `json:"rows,omitempty"`
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// terminalConn is websocket connection of terminal page
+type terminalConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// Write sends terminal output
+func (c *terminalConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *terminalConn) writeMessage(msg *terminalMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteJSON(msg)
+}
+
+func (c *terminalConn) writeClose() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// TunClientOptions returns options of tunnel client connecting to tunnel of t
+type TunClientOptions func(t *config.Tunnel) ([]tun.ClientOption, error)
+
+// agentTunnel returns tunnel address and crypt key of an agent listening for tunnel
+func agentTunnel(spec *config.Tunnel) (string, int64, error) {
+	if spec.TunnelListen == "" {
+		return "", 0, errors.New("agent is not listening for tunnel")
+	}
+
+	u, err := url.Parse(spec.TunnelListen)
+	if err != nil {
+		return "", 0, err
+	}
+	// connect to wildcard address by loopback
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return "", 0, err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		u.Host = net.JoinHostPort("127.0.0.1", port)
+	}
+	return u.String(), spec.CryptKey, nil
+}
+
+// handleTerminal bridges websocket of terminal page to a pty session on agent
+func handleTerminal(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	serviceManager.mu.Lock()
+	instance, exists := serviceManager.agents[id]
+	var spec config.Tunnel
+	if exists {
+		spec = instance.Spec
+	}
+	tunClientOptions := serviceManager.tunClientOptions
+	serviceManager.mu.Unlock()
+	if !exists {
+		http.Error(w, fmt.Sprintf("agent with ID %s not found", id), http.StatusNotFound)
+		return
+	}
+
+	addr, key, err := agentTunnel(&spec)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open terminal: %v", err), http.StatusBadRequest)
+		return
+	}
+	var clientOpts []tun.ClientOption
+	if tunClientOptions != nil {
+		if clientOpts, err = tunClientOptions(&spec); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to open terminal: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	command := strings.Fields(query.Get("cmd"))
+	if len(command) == 0 {
+		command = defaultTerminalCommand
+	}
+	cols, _ := strconv.Atoi(query.Get("cols"))
+	rows, _ := strconv.Atoi(query.Get("rows"))
+
+	conn, err := terminalUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgrade terminal err", err)
+		return
+	}
+	defer conn.Close()
+	tc := &terminalConn{conn: conn}
+	log.Printf("terminal of agent %s opened, %s %v", id, addr, command)
+	defer log.Printf("terminal of agent %s closed", id)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// page -> pty
+	stdinr, stdinw := io.Pipe()
+	defer stdinr.Close()
+	resizeCh := make(chan proxy.WindowSize, 1)
+	go func() {
+		defer cancel()
+		defer stdinw.Close()
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if typ == websocket.BinaryMessage {
+				if _, err := stdinw.Write(data); err != nil {
+					return
+				}
+				continue
+			}
+			var msg terminalMessage
+			if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "resize" {
+				continue
+			}
+			select {
+			case resizeCh <- proxy.WindowSize{Width: msg.Cols, Height: msg.Rows}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	exitCode, sessionErr := 0, error(nil)
+	opened := false
+	p := proxy.New(
+		proxy.WithTunClient(
+			tun.NewClient(append(clientOpts,
+				tun.WithConnectAddress(addr),
+			)...),
+		),
+		proxy.WithTunHandlerNewer(proxy.NewProxyTunHandler),
+		proxy.WithTunCrypt(xor.NewCrypt(key)),
+		proxy.WithTunnelFunc(func(ctx context.Context, t *proxy.Tunnel) {
+			opened = true
+			exitCode, sessionErr = t.RunPTY(ctx, &proxy.PTYSession{
+				Args:   command,
+				Size:   proxy.WindowSize{Width: cols, Height: rows},
+				Stdin:  stdinr,
+				Stdout: tc,
+				Resize: resizeCh,
+			})
+		}),
+	)
+	if err := p.Serve(ctx); err != nil {
+		sessionErr = err
+	} else if !opened && sessionErr == nil {
+		sessionErr = errors.New("tunnel closed")
+	}
+
+	msg := &terminalMessage{Type: "exit", Code: exitCode}
+	if sessionErr != nil && ctx.Err() == nil {
+		msg = &terminalMessage{Type: "error", Error: sessionErr.Error()}
+	}
+	tc.writeMessage(msg)
+	tc.writeClose()
+}
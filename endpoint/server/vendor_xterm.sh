@@ -0,0 +1,22 @@
+#!/bin/sh
+# vendor_xterm.sh downloads xterm.js and its fit addon from npm registry into static/vendor/xterm,
+# they are embedded and served by the management server so that web terminal works offline.
+# Run by go generate ./endpoint/server, commit the downloaded files.
+set -eu
+
+XTERM_VERSION=5.5.0
+ADDON_FIT_VERSION=0.10.0
+REGISTRY=${NPM_REGISTRY:-https://registry.npmjs.org}
+
+dir=$(cd "$(dirname "$0")" && pwd)/static/vendor/xterm
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+curl -fsSL "$REGISTRY/@xterm/xterm/-/xterm-$XTERM_VERSION.tgz" | tar -xz -C "$tmp" package/lib/xterm.js package/css/xterm.css package/LICENSE
+mkdir -p "$tmp/fit"
+curl -fsSL "$REGISTRY/@xterm/addon-fit/-/addon-fit-$ADDON_FIT_VERSION.tgz" | tar -xz -C "$tmp/fit" package/lib/addon-fit.js
+
+mkdir -p "$dir"
+cp "$tmp/package/lib/xterm.js" "$tmp/package/css/xterm.css" "$tmp/fit/package/lib/addon-fit.js" "$dir/"
+cp "$tmp/package/LICENSE" "$dir/LICENSE"
+echo "xterm $XTERM_VERSION, addon-fit $ADDON_FIT_VERSION" > "$dir/VERSION"
@@ -0,0 +1,291 @@
+// Package metrics provides counters and gauges exported in Prometheus text exposition format,
+// see https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is content type of text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metric types
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+// Registry is a set of metric families, it is safe for concurrent use
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is metrics of the same name with different label values
+type family struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*value // joined label values -> value
+}
+
+type value struct {
+	labels []string
+	bits   uint64                         // float64 bits
+	fn     atomic.Pointer[func() float64] // reads value instead of bits if set
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	if fn := v.fn.Load(); fn != nil {
+		return (*fn)()
+	}
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// register adds a family, it panics if the name is registered with different type or labels
+func (r *Registry) register(name string, help string, typ string, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s registered with different type or labels", name))
+		}
+		return f
+	}
+	f := &family{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: make(map[string]*value),
+	}
+	r.families[name] = f
+	return f
+}
+
+// with returns value of label values, it panics if the number of label values is wrong
+func (f *family) with(labelValues []string) *value {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.values[key]
+	if !ok {
+		v = &value{labels: append([]string(nil), labelValues...)}
+		f.values[key] = v
+	}
+	return v
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	f *family
+}
+
+// NewCounterVec registers a counter family, names should end with _total
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, typeCounter, labels)}
+}
+
+// With returns counter of label values in the order of labels
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{v: c.f.with(labelValues)}
+}
+
+// Func makes counter of label values read its value from f, which is counted elsewhere and never decreases,
+// e.g. bytes counted by traffic accounting
+func (c *CounterVec) Func(f func() float64, labelValues ...string) {
+	c.f.with(labelValues).fn.Store(&f)
+}
+
+// Counter is a value which only goes up
+type Counter struct {
+	v *value
+}
+
+// Inc increases counter by 1
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add increases counter by delta, negative delta is ignored
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.v.add(delta)
+	}
+}
+
+// Value returns current value
+func (c *Counter) Value() float64 {
+	return c.v.get()
+}
+
+// GaugeVec is a family of gauges partitioned by labels
+type GaugeVec struct {
+	f *family
+}
+
+// NewGaugeVec registers a gauge family
+func (r *Registry) NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, typeGauge, labels)}
+}
+
+// With returns gauge of label values in the order of labels
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{v: g.f.with(labelValues)}
+}
+
+// Gauge is a value which can go up and down
+type Gauge struct {
+	v *value
+}
+
+// Inc increases gauge by 1
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+// Dec decreases gauge by 1
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+// Add adds delta to gauge
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+// Set sets gauge to f
+func (g *Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+// Value returns current value
+func (g *Gauge) Value() float64 {
+	return g.v.get()
+}
+
+// WriteText writes all metrics in text exposition format, families and label values are sorted
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	var b strings.Builder
+	for _, f := range families {
+		f.mu.Lock()
+		values := make([]*value, 0, len(f.values))
+		for _, v := range f.values {
+			values = append(values, v)
+		}
+		f.mu.Unlock()
+		if len(values) == 0 {
+			continue
+		}
+		sort.Slice(values, func(i, j int) bool {
+			a, b := values[i].labels, values[j].labels
+			for k := range a {
+				if a[k] != b[k] {
+					return a[k] < b[k]
+				}
+			}
+			return false
+		})
+
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+		for _, v := range values {
+			b.WriteString(f.name)
+			if len(f.labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range f.labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", l, escapeLabelValue(v.labels[i]))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(formatValue(v.get()))
+			b.WriteByte('\n')
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Handler returns http handler serving metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteText(w)
+	})
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func formatValue(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	// byte counts are printed without exponent
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
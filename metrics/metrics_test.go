@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	conns := r.NewGaugeVec("tnet_connections_active", "Active connections.", "mapping")
+	connects := r.NewCounterVec("tnet_connects_total", "Connect results.", "mapping", "result")
+	bytes := r.NewCounterVec("tnet_bytes_total", "Bytes\\transferred\nby tunnel.", "direction")
+	r.NewCounterVec("tnet_unused_total", "No value.")
+	sessions := r.NewCounterVec("tnet_sessions_total", "Sessions.")
+	sessions.Func(func() float64 { return 3 })
+
+	conns.With(`a:1->"b":2`).Inc()
+	conns.With(`a:1->"b":2`).Inc()
+	conns.With("c:3").Inc()
+	conns.With("c:3").Dec()
+	connects.With("c:3", "timeout").Inc()
+	connects.With("a:1", "success").Add(2)
+	connects.With("a:1", "success").Add(-1) // ignored
+	bytes.With("in").Add(1 << 20)
+	bytes.With("out").Add(1.5)
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP tnet_bytes_total Bytes\\transferred\nby tunnel.
+# TYPE tnet_bytes_total counter
+tnet_bytes_total{direction="in"} 1048576
+tnet_bytes_total{direction="out"} 1.5
+# HELP tnet_connections_active Active connections.
+# TYPE tnet_connections_active gauge
+tnet_connections_active{mapping="a:1->\"b\":2"} 2
+tnet_connections_active{mapping="c:3"} 0
+# HELP tnet_connects_total Connect results.
+# TYPE tnet_connects_total counter
+tnet_connects_total{mapping="a:1",result="success"} 2
+tnet_connects_total{mapping="c:3",result="timeout"} 1
+# HELP tnet_sessions_total Sessions.
+# TYPE tnet_sessions_total counter
+tnet_sessions_total 3
+`
+	if got := b.String(); got != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeVec("tnet_tunnels_active", "Active tunnels.").With().Set(3)
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "\ntnet_tunnels_active 3\n") {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestRegisterConflict(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("tnet_x_total", "x", "a")
+	if c := r.NewCounterVec("tnet_x_total", "x", "a"); c == nil {
+		t.Fatal("same family is not returned")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("conflicting registration does not panic")
+		}
+	}()
+	r.NewGaugeVec("tnet_x_total", "x", "a")
+}
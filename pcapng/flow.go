@@ -0,0 +1,119 @@
+package pcapng
+
+import (
+	"io"
+	"net/netip"
+	"time"
+)
+
+// Chunk is payload of a TCP segment in a flow
+type Chunk struct {
+	Timestamp  time.Time
+	FromClient bool
+	Data       []byte
+}
+
+// Flow is payload of a TCP connection in both directions in capture order
+type Flow struct {
+	Client netip.AddrPort
+	Server netip.AddrPort
+	Chunks []Chunk
+
+	isn     uint32    // initial sequence number of client
+	next    [2]uint32 // next expected sequence number of client and server
+	started [2]bool
+}
+
+// ClientData returns all data sent by client
+func (f *Flow) ClientData() []byte {
+	return f.data(true)
+}
+
+// ServerData returns all data sent by server
+func (f *Flow) ServerData() []byte {
+	return f.data(false)
+}
+
+func (f *Flow) data(fromClient bool) []byte {
+	var b []byte
+	for _, c := range f.Chunks {
+		if c.FromClient == fromClient {
+			b = append(b, c.Data...)
+		}
+	}
+	return b
+}
+
+// add appends payload of segment, retransmitted data is dropped
+func (f *Flow) add(s *Segment, fromClient bool) {
+	d := dir(fromClient)
+	seq := s.Seq
+	if s.Flags&FlagSYN != 0 {
+		seq++
+		f.next[d], f.started[d] = seq, true
+	}
+	if len(s.Payload) == 0 {
+		return
+	}
+	if !f.started[d] {
+		// handshake is not captured
+		f.next[d], f.started[d] = seq, true
+	}
+
+	payload := s.Payload
+	if diff := int32(f.next[d] - seq); diff > 0 {
+		if int(diff) >= len(payload) {
+			return
+		}
+		payload = payload[diff:]
+	}
+	f.next[d] = seq + uint32(len(s.Payload))
+	f.Chunks = append(f.Chunks, Chunk{Timestamp: s.Timestamp, FromClient: fromClient, Data: payload})
+}
+
+type flowKey struct {
+	a, b netip.AddrPort
+}
+
+func newFlowKey(a netip.AddrPort, b netip.AddrPort) flowKey {
+	if a.Compare(b) > 0 {
+		a, b = b, a
+	}
+	return flowKey{a, b}
+}
+
+// ReadFlows reads TCP flows from pcapng file in the order they start,
+// the client of a flow is the sender of SYN, or of the first segment if handshake is not captured
+func ReadFlows(r io.Reader) ([]*Flow, error) {
+	pr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var flows []*Flow
+	active := make(map[flowKey]*Flow)
+	for {
+		p, err := pr.Next()
+		if err == io.EOF {
+			return flows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		s, ok := ParseSegment(p)
+		if !ok {
+			continue
+		}
+
+		key := newFlowKey(s.Src, s.Dst)
+		f := active[key]
+		// a new connection reusing the address pair
+		newConn := s.Flags&(FlagSYN|FlagACK) == FlagSYN && (f == nil || f.isn != s.Seq)
+		if f == nil || newConn {
+			f = &Flow{Client: s.Src, Server: s.Dst, isn: s.Seq}
+			active[key] = f
+			flows = append(flows, f)
+		}
+		f.add(s, s.Src == f.Client)
+	}
+}
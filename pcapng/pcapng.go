@@ -0,0 +1,46 @@
+// Package pcapng reads and writes packet captures in pcapng format,
+// see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+package pcapng
+
+import (
+	"errors"
+	"time"
+)
+
+// block types
+const (
+	blockSectionHeader    = 0x0A0D0D0A
+	blockInterface        = 0x00000001
+	blockSimplePacket     = 0x00000003
+	blockEnhancedPacket   = 0x00000006
+	byteOrderMagic        = 0x1A2B3C4D
+	byteOrderMagicSwapped = 0x4D3C2B1A
+)
+
+// option codes
+const (
+	optEndOfOpt     = 0
+	optComment      = 1
+	optShbUserAppl  = 4
+	optIfTSResol    = 9
+	tsResolNanosecs = 9
+)
+
+// link types
+const (
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101 // IPv4 or IPv6 packet without link layer header
+)
+
+// Magic is the first 4 bytes of pcapng file
+var Magic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+// ErrFormat means the data is not valid pcapng
+var ErrFormat = errors.New("pcapng: invalid format")
+
+// Packet is a captured packet
+type Packet struct {
+	Timestamp time.Time
+	LinkType  uint16
+	Data      []byte
+}
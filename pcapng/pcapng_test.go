@@ -0,0 +1,117 @@
+package pcapng
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestStreamFlows(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1700000000, 123456789)
+	big := bytes.Repeat([]byte("0123456789"), 10000) // more than one segment
+	for _, addrs := range [][2]string{
+		{"127.0.0.1:50000", "127.0.0.1:8080"},
+		{"[::1]:50001", "10.0.0.1:80"}, // mixed families are mapped to IPv6
+	} {
+		s := NewStream(w, netip.MustParseAddrPort(addrs[0]), netip.MustParseAddrPort(addrs[1]))
+		if err := s.Open(start); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write(start.Add(time.Millisecond), true, []byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write(start.Add(2*time.Millisecond), false, big); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(start.Add(3*time.Millisecond), true); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(start.Add(3*time.Millisecond), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flows, err := ReadFlows(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("got %d flows, 2 expected", len(flows))
+	}
+	for i, f := range flows {
+		if i == 0 && (f.Client.String() != "127.0.0.1:50000" || f.Server.String() != "127.0.0.1:8080") {
+			t.Errorf("unexpected addresses %s -> %s", f.Client, f.Server)
+		}
+		if i == 1 && (f.Client.String() != "[::1]:50001" || f.Server.String() != "[::ffff:10.0.0.1]:80") {
+			t.Errorf("unexpected addresses %s -> %s", f.Client, f.Server)
+		}
+		if got := string(f.ClientData()); got != "GET / HTTP/1.1\r\n\r\n" {
+			t.Errorf("unexpected client data %q", got)
+		}
+		if got := f.ServerData(); !bytes.Equal(got, big) {
+			t.Errorf("unexpected server data of %d bytes", len(got))
+		}
+		if len(f.Chunks) != 3 {
+			t.Errorf("got %d chunks, 3 expected", len(f.Chunks))
+		}
+		if ts := f.Chunks[0].Timestamp; !ts.Equal(start.Add(time.Millisecond)) {
+			t.Errorf("unexpected timestamp %v", ts)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStream(w, netip.MustParseAddrPort("192.168.1.2:40000"), netip.MustParseAddrPort("192.168.1.1:443"))
+	if err := s.Write(time.Now(), true, []byte("odd")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checksum over data including checksum field is zero
+	if c := checksum(0, p.Data[:20]); c != 0 {
+		t.Errorf("invalid ip checksum, %#04x", c)
+	}
+	pseudo := append(append([]byte{}, p.Data[12:20]...), 0, 6, 0, byte(len(p.Data)-20))
+	if c := checksum(sum(0, pseudo), p.Data[20:]); c != 0 {
+		t.Errorf("invalid tcp checksum, %#04x", c)
+	}
+}
+
+func TestRetransmission(t *testing.T) {
+	client := netip.MustParseAddrPort("10.0.0.2:1234")
+	server := netip.MustParseAddrPort("10.0.0.1:80")
+	f := &Flow{Client: client, Server: server}
+	for _, s := range []*Segment{
+		{Src: client, Dst: server, Seq: 100, Payload: []byte("hello")},
+		{Src: client, Dst: server, Seq: 100, Payload: []byte("hello")},    // retransmitted
+		{Src: client, Dst: server, Seq: 103, Payload: []byte("lo world")}, // overlapped
+		{Src: server, Dst: client, Seq: 500, Payload: []byte("ok")},       // reply
+	} {
+		f.add(s, s.Src == client)
+	}
+	if got := string(f.ClientData()); got != "hello world" {
+		t.Errorf("unexpected client data %q", got)
+	}
+	if got := string(f.ServerData()); got != "ok" {
+		t.Errorf("unexpected server data %q", got)
+	}
+}
@@ -0,0 +1,177 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// maxBlockSize limits memory allocated for a block of broken file
+const maxBlockSize = 64 << 20
+
+type iface struct {
+	linkType uint16
+	tsResol  uint8 // timestamp unit is 10^-tsResol seconds, or 2^-(tsResol&0x7f) if the most significant bit is set
+}
+
+// Reader reads packets of pcapng file, sections and interfaces are handled transparently
+type Reader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ifaces []iface
+}
+
+// NewReader reads section header from r and returns reader of packets
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: r}
+	typ, _, err := pr.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if typ != blockSectionHeader {
+		return nil, ErrFormat
+	}
+	return pr, nil
+}
+
+// Next returns the next packet, io.EOF is returned at the end of file
+func (r *Reader) Next() (*Packet, error) {
+	for {
+		typ, body, err := r.readBlock()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case blockSectionHeader:
+			// interfaces are scoped to section
+			r.ifaces = nil
+		case blockInterface:
+			if err := r.readInterface(body); err != nil {
+				return nil, err
+			}
+		case blockEnhancedPacket:
+			return r.readEnhancedPacket(body)
+		case blockSimplePacket:
+			if len(body) < 4 || len(r.ifaces) == 0 {
+				return nil, ErrFormat
+			}
+			data := body[4:]
+			if n := int(r.order.Uint32(body)); n < len(data) {
+				data = data[:n]
+			}
+			return &Packet{LinkType: r.ifaces[0].linkType, Data: data}, nil
+		}
+	}
+}
+
+// readBlock reads a block, byte order is detected from section header block
+func (r *Reader) readBlock() (uint32, []byte, error) {
+	var h [12]byte
+	if _, err := io.ReadFull(r.r, h[:8]); err != nil {
+		return 0, nil, err
+	}
+	if r.order == nil || binary.LittleEndian.Uint32(h[:]) == blockSectionHeader {
+		if binary.LittleEndian.Uint32(h[:]) != blockSectionHeader {
+			return 0, nil, ErrFormat
+		}
+		if _, err := io.ReadFull(r.r, h[8:12]); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		switch binary.LittleEndian.Uint32(h[8:]) {
+		case byteOrderMagic:
+			r.order = binary.LittleEndian
+		case byteOrderMagicSwapped:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, ErrFormat
+		}
+		body, err := r.readBody(r.order.Uint32(h[4:]), 12)
+		if err != nil {
+			return 0, nil, err
+		}
+		return blockSectionHeader, append(h[8:12:12], body...), nil
+	}
+
+	typ := r.order.Uint32(h[:])
+	body, err := r.readBody(r.order.Uint32(h[4:]), 8)
+	if err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// readBody reads the rest of block of total length, read bytes of the block are excluded from body
+func (r *Reader) readBody(total uint32, read uint32) ([]byte, error) {
+	if total < read+4 || total%4 != 0 || total > maxBlockSize {
+		return nil, ErrFormat
+	}
+	b := make([]byte, total-read)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if r.order.Uint32(b[len(b)-4:]) != total {
+		return nil, ErrFormat
+	}
+	return b[:len(b)-4], nil
+}
+
+func (r *Reader) readInterface(body []byte) error {
+	if len(body) < 8 {
+		return ErrFormat
+	}
+	ifc := iface{linkType: r.order.Uint16(body), tsResol: 6}
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code, n := r.order.Uint16(opts), int(r.order.Uint16(opts[2:]))
+		if code == optEndOfOpt || 4+n > len(opts) {
+			break
+		}
+		if code == optIfTSResol && n >= 1 {
+			ifc.tsResol = opts[4]
+		}
+		opts = opts[4+n+pad(n):]
+	}
+	r.ifaces = append(r.ifaces, ifc)
+	return nil
+}
+
+func (r *Reader) readEnhancedPacket(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, ErrFormat
+	}
+	id := r.order.Uint32(body)
+	if int(id) >= len(r.ifaces) {
+		return nil, fmt.Errorf("pcapng: unknown interface %d", id)
+	}
+	ifc := r.ifaces[id]
+	ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+	n := int(r.order.Uint32(body[12:]))
+	if 20+n > len(body) {
+		return nil, ErrFormat
+	}
+
+	return &Packet{Timestamp: ifc.time(ts), LinkType: ifc.linkType, Data: body[20 : 20+n]}, nil
+}
+
+// time converts timestamp in units of interface to time
+func (ifc *iface) time(ts uint64) time.Time {
+	if ifc.tsResol&0x80 != 0 {
+		sec := math.Ldexp(float64(ts), -int(ifc.tsResol&0x7f))
+		return time.Unix(0, int64(sec*1e9))
+	}
+	if ifc.tsResol <= 9 {
+		unit := uint64(math.Pow10(9 - int(ifc.tsResol)))
+		return time.Unix(0, int64(ts*unit))
+	}
+	unit := uint64(math.Pow10(int(ifc.tsResol) - 9))
+	return time.Unix(0, int64(ts/unit))
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
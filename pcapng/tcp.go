@@ -0,0 +1,256 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// TCP flags
+const (
+	FlagFIN = 0x01
+	FlagSYN = 0x02
+	FlagRST = 0x04
+	FlagPSH = 0x08
+	FlagACK = 0x10
+)
+
+// maxSegmentSize keeps IPv4 total length and IPv6 payload length in 16 bits
+const maxSegmentSize = 65535 - 60
+
+// Stream synthesizes TCP/IP packets of a connection from its payload,
+// so that the connection is shown as a normal TCP stream by Wireshark.
+// It is not safe for concurrent use.
+type Stream struct {
+	w      *Writer
+	client netip.AddrPort
+	server netip.AddrPort
+	seq    [2]uint32 // next sequence number of client and server
+	ipID   uint16
+	closed [2]bool
+}
+
+// NewStream returns stream from client to server written to w,
+// IPv4 addresses are mapped to IPv6 if the other address is IPv6
+func NewStream(w *Writer, client netip.AddrPort, server netip.AddrPort) *Stream {
+	if client.Addr().Unmap().Is4() && server.Addr().Unmap().Is4() {
+		client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+		server = netip.AddrPortFrom(server.Addr().Unmap(), server.Port())
+	} else {
+		client = netip.AddrPortFrom(netip.AddrFrom16(client.Addr().As16()), client.Port())
+		server = netip.AddrPortFrom(netip.AddrFrom16(server.Addr().As16()), server.Port())
+	}
+	return &Stream{w: w, client: client, server: server}
+}
+
+// Open writes three-way handshake
+func (s *Stream) Open(ts time.Time) error {
+	if err := s.write(ts, true, FlagSYN, nil); err != nil {
+		return err
+	}
+	s.seq[0]++
+	if err := s.write(ts, false, FlagSYN|FlagACK, nil); err != nil {
+		return err
+	}
+	s.seq[1]++
+	return s.write(ts, true, FlagACK, nil)
+}
+
+// Write writes data sent by client, or by server if fromClient is false
+func (s *Stream) Write(ts time.Time, fromClient bool, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), maxSegmentSize)
+		if err := s.write(ts, fromClient, FlagPSH|FlagACK, data[:n]); err != nil {
+			return err
+		}
+		s.seq[dir(fromClient)] += uint32(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+// Close writes FIN sent by client, or by server if fromClient is false, and its acknowledgement
+func (s *Stream) Close(ts time.Time, fromClient bool) error {
+	d := dir(fromClient)
+	if s.closed[d] {
+		return nil
+	}
+	s.closed[d] = true
+	if err := s.write(ts, fromClient, FlagFIN|FlagACK, nil); err != nil {
+		return err
+	}
+	s.seq[d]++
+	return s.write(ts, !fromClient, FlagACK, nil)
+}
+
+func dir(fromClient bool) int {
+	if fromClient {
+		return 0
+	}
+	return 1
+}
+
+// write writes a segment with current sequence numbers
+func (s *Stream) write(ts time.Time, fromClient bool, flags uint8, payload []byte) error {
+	src, dst := s.client, s.server
+	seq, ack := s.seq[0], s.seq[1]
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&FlagACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // data offset
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	tcp = append(tcp, payload...)
+
+	var ip []byte
+	if src.Addr().Is4() {
+		s.ipID++
+		ip = make([]byte, 20, 20+len(tcp))
+		ip[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[4:], s.ipID)
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+		ip[8] = 64                                 // ttl
+		ip[9] = 6                                  // tcp
+		a, b := src.Addr().As4(), dst.Addr().As4()
+		copy(ip[12:], a[:])
+		copy(ip[16:], b[:])
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:], a[:])
+		copy(pseudo[4:], b[:])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+	} else {
+		ip = make([]byte, 40, 40+len(tcp))
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6  // tcp
+		ip[7] = 64 // hop limit
+		a, b := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:], a[:])
+		copy(ip[24:], b[:])
+
+		pseudo := make([]byte, 40)
+		copy(pseudo[0:], a[:])
+		copy(pseudo[16:], b[:])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+		binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+	}
+	return s.w.WritePacket(ts, append(ip, tcp...))
+}
+
+// sum adds b to one's complement sum
+func sum(s uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		s += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+// checksum returns internet checksum of b with initial sum s
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// Segment is TCP segment parsed from packet
+type Segment struct {
+	Timestamp time.Time
+	Src       netip.AddrPort
+	Dst       netip.AddrPort
+	Seq       uint32
+	Flags     uint8
+	Payload   []byte
+}
+
+// ParseSegment parses TCP segment from IPv4 or IPv6 packet of LinkTypeRaw or LinkTypeEthernet,
+// false is returned if the packet is not TCP
+func ParseSegment(p *Packet) (*Segment, bool) {
+	data := p.Data
+	switch p.LinkType {
+	case LinkTypeRaw:
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		if etherType == 0x8100 && len(data) >= 4 { // 802.1Q VLAN tag
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	if len(data) < 1 {
+		return nil, false
+	}
+
+	var src, dst netip.Addr
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0f) * 4
+		if len(data) < 20 || ihl < 20 || len(data) < ihl || data[9] != 6 {
+			return nil, false
+		}
+		if total := int(binary.BigEndian.Uint16(data[2:])); total >= ihl && total < len(data) {
+			data = data[:total] // strip ethernet padding
+		}
+		src = netip.AddrFrom4([4]byte(data[12:16]))
+		dst = netip.AddrFrom4([4]byte(data[16:20]))
+		data = data[ihl:]
+	case 6:
+		// extension headers are not supported
+		if len(data) < 40 || data[6] != 6 {
+			return nil, false
+		}
+		if n := 40 + int(binary.BigEndian.Uint16(data[4:])); n < len(data) {
+			data = data[:n]
+		}
+		src = netip.AddrFrom16([16]byte(data[8:24]))
+		dst = netip.AddrFrom16([16]byte(data[24:40]))
+		data = data[40:]
+	default:
+		return nil, false
+	}
+
+	if len(data) < 20 {
+		return nil, false
+	}
+	off := int(data[12]>>4) * 4
+	if off < 20 || len(data) < off {
+		return nil, false
+	}
+	return &Segment{
+		Timestamp: p.Timestamp,
+		Src:       netip.AddrPortFrom(src, binary.BigEndian.Uint16(data[0:])),
+		Dst:       netip.AddrPortFrom(dst, binary.BigEndian.Uint16(data[2:])),
+		Seq:       binary.BigEndian.Uint32(data[4:]),
+		Flags:     data[13],
+		Payload:   data[off:],
+	}, true
+}
@@ -0,0 +1,88 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// Writer writes packets of one LinkTypeRaw interface, it is safe for concurrent use
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter writes section header and interface description to w and returns writer of packets,
+// comment is stored in section header if it is not empty
+func NewWriter(w io.Writer, comment string) (*Writer, error) {
+	// section header
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1) // major version
+	binary.LittleEndian.PutUint16(body[6:], 0) // minor version
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0))
+	var opts []byte
+	if comment != "" {
+		opts = appendOption(opts, optComment, []byte(comment))
+	}
+	opts = appendOption(opts, optShbUserAppl, []byte("tnet"))
+	opts = appendOption(opts, optEndOfOpt, nil)
+	if err := writeBlock(w, blockSectionHeader, append(body, opts...)); err != nil {
+		return nil, err
+	}
+
+	// interface description
+	body = make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], LinkTypeRaw)
+	binary.LittleEndian.PutUint32(body[4:], 0) // no snap length limit
+	opts = appendOption(nil, optIfTSResol, []byte{tsResolNanosecs})
+	opts = appendOption(opts, optEndOfOpt, nil)
+	if err := writeBlock(w, blockInterface, append(body, opts...)); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes IPv4 or IPv6 packet captured at ts
+func (w *Writer) WritePacket(ts time.Time, data []byte) error {
+	body := make([]byte, 20, 20+len(data)+3)
+	t := uint64(ts.UnixNano())
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(body[4:], uint32(t>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(t))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(data)))
+	body = append(body, data...)
+	body = append(body, make([]byte, pad(len(data)))...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return writeBlock(w.w, blockEnhancedPacket, body)
+}
+
+// pad returns padding length to 32-bit boundary
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	var h [4]byte
+	binary.LittleEndian.PutUint16(h[0:], code)
+	binary.LittleEndian.PutUint16(h[2:], uint16(len(value)))
+	b = append(b, h[:]...)
+	b = append(b, value...)
+	return append(b, make([]byte, pad(len(value)))...)
+}
+
+// writeBlock writes block in a single Write, body must be padded to 32-bit boundary
+func writeBlock(w io.Writer, typ uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	b := make([]byte, 0, total)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,188 @@
+// Package ratelimit provides token bucket rate limiting of byte streams and periodic byte quotas
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket of bytes, it is safe for concurrent use,
+// all methods of nil Limiter do not limit
+type Limiter struct {
+	rate  float64 // bytes per second
+	burst int
+
+	mu     sync.Mutex
+	tokens float64 // negative when reserved by waiting callers
+	last   time.Time
+}
+
+// NewLimiter creates limiter allowing rate bytes per second with bursts of at most burst bytes,
+// burst defaults to rate, it returns nil limiter if rate is not positive
+func NewLimiter(rate int64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(rate)
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Rate returns limit in bytes per second, 0 if l is nil
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return int64(l.rate)
+}
+
+// Burst returns the largest number of bytes allowed at once, 0 if l is nil
+func (l *Limiter) Burst() int {
+	if l == nil {
+		return 0
+	}
+	return l.burst
+}
+
+// WaitN blocks until n bytes are allowed or ctx is done
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		m := n
+		if m > l.burst {
+			m = l.burst
+		}
+		if d := l.reserve(m, time.Now()); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		n -= m
+	}
+	return nil
+}
+
+// reserve takes n tokens and returns how long to wait until they are available
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens += elapsed * l.rate
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+		l.last = now
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// maxChunk returns the smallest burst of limiters, 0 if none limits
+func maxChunk(limiters []*Limiter) int {
+	chunk := 0
+	for _, l := range limiters {
+		if b := l.Burst(); b > 0 && (chunk == 0 || b < chunk) {
+			chunk = b
+		}
+	}
+	return chunk
+}
+
+// compact drops nil limiters
+func compact(limiters []*Limiter) []*Limiter {
+	var list []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			list = append(list, l)
+		}
+	}
+	return list
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+	chunk    int
+}
+
+// NewReader returns reader limited by all of limiters, nil limiters are ignored,
+// r is returned if none limits. Data is returned after waiting for its tokens,
+// waiting is aborted with error when ctx is done.
+func NewReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	limiters = compact(limiters)
+	if len(limiters) == 0 {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, limiters: limiters, chunk: maxChunk(limiters)}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		if werr := l.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type writer struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*Limiter
+	chunk    int
+}
+
+// NewWriter returns writer limited by all of limiters, nil limiters are ignored,
+// w is returned if none limits. Data is written in chunks of at most the smallest burst
+// after waiting for their tokens, waiting is aborted with error when ctx is done.
+func NewWriter(ctx context.Context, w io.Writer, limiters ...*Limiter) io.Writer {
+	limiters = compact(limiters)
+	if len(limiters) == 0 {
+		return w
+	}
+	return &writer{ctx: ctx, w: w, limiters: limiters, chunk: maxChunk(limiters)}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.chunk {
+			chunk = chunk[:w.chunk]
+		}
+		for _, l := range w.limiters {
+			if err := l.WaitN(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,226 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tutils/tnet/counter"
+)
+
+// Period is the length of quota period, periods start at local midnight
+type Period string
+
+// quota periods
+const (
+	Daily   Period = "daily"
+	Monthly Period = "monthly"
+)
+
+// start returns start of period containing t
+func (p Period) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	if p == Monthly {
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// next returns start of period following the one starting at start
+func (p Period) next(start time.Time) time.Time {
+	if p == Monthly {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Quota is limit of bytes transferred in a daily or monthly period,
+// usage is reset when a new period starts. It is safe for concurrent use.
+type Quota struct {
+	limit  int64
+	period Period
+
+	mu    sync.Mutex
+	used  int64
+	start time.Time
+}
+
+// NewQuota creates quota of limit bytes per period, it returns nil quota if limit is not positive
+func NewQuota(limit int64, period Period) *Quota {
+	if limit <= 0 {
+		return nil
+	}
+	return &Quota{
+		limit:  limit,
+		period: period,
+		start:  period.start(time.Now()),
+	}
+}
+
+// roll resets usage if a new period started, q.mu must be held
+func (q *Quota) roll(now time.Time) {
+	if !now.Before(q.period.next(q.start)) {
+		q.start = q.period.start(now)
+		q.used = 0
+	}
+}
+
+// Add counts n bytes transferred
+func (q *Quota) Add(n int64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(time.Now())
+	q.used += n
+}
+
+// Used returns bytes transferred in current period
+func (q *Quota) Used() int64 {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(time.Now())
+	return q.used
+}
+
+// Exceeded tells whether limit of current period is reached, false if q is nil
+func (q *Quota) Exceeded() bool {
+	if q == nil {
+		return false
+	}
+	return q.Used() >= q.limit
+}
+
+// Reset returns the time when current period ends
+func (q *Quota) Reset() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(time.Now())
+	return q.period.next(q.start)
+}
+
+// String returns usage of quota
+func (q *Quota) String() string {
+	return fmt.Sprintf("%s quota %s of %s used", q.period,
+		counter.HumanReadable(uint64(q.Used())), counter.HumanReadable(uint64(q.limit)))
+}
+
+// Exceeded returns the first exceeded quota of quotas, nil if none is exceeded
+func Exceeded(quotas ...*Quota) *Quota {
+	for _, q := range quotas {
+		if q.Exceeded() {
+			return q
+		}
+	}
+	return nil
+}
+
+// QuotaFile keeps usage of quotas in a file, so that they are not reset when process restarts.
+// Usage saved in a past period is ignored. Each process needs its own file.
+type QuotaFile struct {
+	name   string
+	quotas []*Quota
+
+	mu sync.Mutex // serializes saves
+}
+
+// quotaUsage is usage of a quota in file
+type quotaUsage struct {
+	Start time.Time `json:"start"`
+	Used  int64     `json:"used"`
+}
+
+// OpenQuotaFile restores usage of quotas from file name, nil quotas are ignored and missing file is not an error
+func OpenQuotaFile(name string, quotas ...*Quota) (*QuotaFile, error) {
+	f := &QuotaFile{name: name}
+	for _, q := range quotas {
+		if q != nil {
+			f.quotas = append(f.quotas, q)
+		}
+	}
+	b, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var usage map[Period]quotaUsage
+	if err := json.Unmarshal(b, &usage); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for _, q := range f.quotas {
+		if u, ok := usage[q.period]; ok {
+			q.restore(u.Start, u.Used)
+		}
+	}
+	return f, nil
+}
+
+// Save writes usage of quotas to file, the file is replaced at once
+func (f *QuotaFile) Save() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	usage := make(map[Period]quotaUsage)
+	for _, q := range f.quotas {
+		q.mu.Lock()
+		q.roll(time.Now())
+		usage[q.period] = quotaUsage{Start: q.start, Used: q.used}
+		q.mu.Unlock()
+	}
+	b, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.name), filepath.Base(f.name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.name)
+}
+
+// Run saves usage every interval until ctx is done, errors are reported to onError
+func (f *QuotaFile) Run(ctx context.Context, interval time.Duration, onError func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.Save(); err != nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// restore sets usage saved at period starting at start, it is ignored if the period is over
+func (q *Quota) restore(start time.Time, used int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.roll(now)
+	if q.period.start(now).Equal(start) {
+		q.start = start
+		q.used = used
+	}
+}
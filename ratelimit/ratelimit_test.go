@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	l := NewLimiter(1000, 100)
+	now := l.last
+	if d := l.reserve(100, now); d != 0 {
+		t.Errorf("burst waits %v", d)
+	}
+	if d := l.reserve(50, now); d != 50*time.Millisecond {
+		t.Errorf("unexpected wait %v", d)
+	}
+	// reserved tokens are paid back before new ones are available
+	if d := l.reserve(50, now.Add(50*time.Millisecond)); d != 50*time.Millisecond {
+		t.Errorf("unexpected wait %v", d)
+	}
+	// bucket is full after idle
+	if d := l.reserve(100, now.Add(time.Second)); d != 0 {
+		t.Errorf("full bucket waits %v", d)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	if l := NewLimiter(0, 0); l != nil {
+		t.Fatal("zero rate limiter is not nil")
+	}
+	var l *Limiter
+	if err := l.WaitN(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(nil)
+	if NewReader(context.Background(), r, nil, l) != io.Reader(r) {
+		t.Error("unlimited reader is wrapped")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	l := NewLimiter(100<<10, 10<<10)
+	var b bytes.Buffer
+	w := NewWriter(context.Background(), &b, l)
+	start := time.Now()
+	data := bytes.Repeat([]byte("x"), 30<<10)
+	if n, err := w.Write(data); err != nil || n != len(data) {
+		t.Fatal(n, err)
+	}
+	// 10K burst and 20K at 100K/s
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("unexpected elapsed %v", elapsed)
+	}
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Error("data mismatch")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewWriter(ctx, &b, l).Write(data); err != context.Canceled {
+		t.Errorf("unexpected err %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	q := NewQuota(100, Daily)
+	q.Add(60)
+	if q.Exceeded() {
+		t.Fatal("exceeded early")
+	}
+	q.Add(40)
+	if Exceeded(nil, q) != q {
+		t.Fatal("not exceeded")
+	}
+	q.start = q.start.AddDate(0, 0, -1)
+	if q.Exceeded() || q.Used() != 0 {
+		t.Error("usage is not reset in new period")
+	}
+
+	loc := time.FixedZone("X", 8*3600)
+	start := Monthly.start(time.Date(2024, 1, 31, 23, 0, 0, 0, loc))
+	if next := Monthly.next(start); !next.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, loc)) {
+		t.Errorf("unexpected next period %v", next)
+	}
+}
+
+func TestQuotaFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "quota.json")
+	daily, monthly := NewQuota(100, Daily), NewQuota(1000, Monthly)
+	f, err := OpenQuotaFile(name, daily, nil, monthly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daily.Add(30)
+	monthly.Add(300)
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restarted process
+	daily, monthly = NewQuota(100, Daily), NewQuota(1000, Monthly)
+	if _, err := OpenQuotaFile(name, daily, monthly); err != nil {
+		t.Fatal(err)
+	}
+	if daily.Used() != 30 || monthly.Used() != 300 {
+		t.Errorf("unexpected usage %d, %d", daily.Used(), monthly.Used())
+	}
+
+	// usage of past period is ignored
+	past := time.Now().AddDate(0, 0, -1)
+	if err := os.WriteFile(name, []byte(fmt.Sprintf(`{"daily":{"start":%q,"used":50}}`,
+		Daily.start(past).Format(time.RFC3339))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	daily = NewQuota(100, Daily)
+	if _, err := OpenQuotaFile(name, daily); err != nil {
+		t.Fatal(err)
+	}
+	if daily.Used() != 0 {
+		t.Errorf("usage of yesterday is restored, %d", daily.Used())
+	}
+
+	if _, err := OpenQuotaFile(filepath.Join(t.TempDir(), "missing.json"), daily); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	for s, expected := range map[string][2]int64{
+		"":           {0, 0},
+		"1024":       {1024, 1024},
+		"512K":       {512 << 10, 512 << 10},
+		"1M/10MB":    {1 << 20, 10 << 20},
+		"0/1.5g":     {0, 3 << 29},
+		"2MiB/100ki": {2 << 20, 100 << 10},
+	} {
+		up, down, err := ParseLimit(s)
+		if err != nil || up != expected[0] || down != expected[1] {
+			t.Errorf("ParseLimit(%q) = %d, %d, %v", s, up, down, err)
+		}
+	}
+	for _, s := range []string{"x", "1X", "-1", "1M/"} {
+		if _, _, err := ParseLimit(s); err == nil {
+			t.Errorf("ParseLimit(%q) succeeds", s)
+		}
+	}
+}
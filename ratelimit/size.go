@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+}
+
+// ParseSize parses number of bytes with optional binary unit suffix K, M, G or T,
+// e.g. 512K, 10M, 1.5G. Suffix B and IB are accepted, as in 10MB and 10MiB.
+func ParseSize(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	t = strings.TrimSuffix(t, "B")
+	t = strings.TrimSuffix(t, "I")
+	mul := int64(1)
+	if n := len(t); n > 0 {
+		if m, ok := sizeUnits[t[n-1]]; ok {
+			mul = m
+			t = t[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(t, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * float64(mul)), nil
+}
+
+// ParseLimit parses rate limit in bytes per second of form RATE or UPLOAD/DOWNLOAD,
+// rates are sizes accepted by ParseSize, empty string and 0 mean no limit
+func ParseLimit(s string) (upload int64, download int64, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	up, down, ok := strings.Cut(s, "/")
+	if upload, err = ParseSize(up); err != nil {
+		return 0, 0, err
+	}
+	if !ok {
+		return upload, upload, nil
+	}
+	if download, err = ParseSize(down); err != nil {
+		return 0, 0, err
+	}
+	return upload, download, nil
+}
@@ -71,7 +71,8 @@ var ErrClientClosed = errors.New("tnet/tcp: Client closed")
 // ErrConnectionRefused means connection refused
 var ErrConnectionRefused = errors.New("tnet/tcp: Connection refused")
 
-// DialAndServe starts client
+// DialAndServe starts client.
+// It returns the dial error as is if connecting failed.
 func (cli *Client) DialAndServe(ctx context.Context) error {
 	addr := cli.opts.addr
 	if addr == "" {
@@ -80,9 +81,12 @@ func (cli *Client) DialAndServe(ctx context.Context) error {
 
 	ctx = context.WithValue(ctx, ClientContextKey, cli)
 
-	var dialer net.Dialer
+	dialer, err := cli.opts.newDialer()
+	if err != nil {
+		return err
+	}
 	ctx, cancel := context.WithCancel(ctx)
-	d := &onceCancelDialer{Dialer: dialer, cancel: cancel}
+	d := &onceCancelDialer{Dialer: *dialer, cancel: cancel}
 	defer d.Cancel()
 
 	if !cli.trackDialer(d, true) {
@@ -90,14 +94,17 @@ func (cli *Client) DialAndServe(ctx context.Context) error {
 	}
 	defer cli.trackDialer(d, false)
 
-	rw, err := d.DialContext(ctx, "tcp", addr)
+	rw, err := d.DialContext(ctx, cli.opts.network(), addr)
 	if err != nil || rw == nil {
 		select {
 		case <-cli.getDoneChan():
 			return ErrClientClosed
 		default:
+		}
+		if err == nil {
 			return ErrConnectionRefused
 		}
+		return err
 	}
 
 	if period := cli.opts.keepAlivePeriod; period > 0 {
@@ -118,7 +125,7 @@ func (cli *Client) DialAndServe(ctx context.Context) error {
 	}
 	c := cli.newConn(rw)
 	c.setState(StateNew)
-	c.serve(connCtx, cli.opts.handler, cli.opts.errorLogFunc)
+	c.serve(connCtx, cli.opts.handler, cli.opts.logger)
 	return nil
 }
 
@@ -2,7 +2,9 @@ package tcp
 
 import (
 	"context"
+	"log/slog"
 	"net"
+	"syscall"
 	"time"
 )
 
@@ -12,9 +14,18 @@ type ClientOptions struct {
 	handler ConnHandler
 
 	connContext     func(ctx context.Context, c net.Conn) context.Context
-	errorLogFunc    func(fmt string, args ...interface{})
+	logger          *slog.Logger
 	keepAlivePeriod time.Duration
 	keepAliveCount  int
+
+	dialTimeout   time.Duration
+	localAddr     string
+	bindInterface string
+	resolver      *net.Resolver
+	dnsServer     string
+	ipVersion     int
+	fallbackDelay time.Duration
+	control       func(ctx context.Context, network, address string, c syscall.RawConn) error
 }
 
 // ClientOption is option setter for tcp client
@@ -29,8 +40,8 @@ func newClientOptions(opts ...ClientOption) *ClientOptions {
 	if opt.handler == nil {
 		opt.handler = DefaultConnHandler
 	}
-	if opt.errorLogFunc == nil {
-		opt.errorLogFunc = DefaultErrorLogFunc
+	if opt.logger == nil {
+		opt.logger = slog.Default()
 	}
 
 	return opt
@@ -58,9 +69,18 @@ func WithClientConnContextFunc(f func(ctx context.Context, c net.Conn) context.C
 }
 
 // WithClientErrorLogFunc sets error log function opt
+//
+// Deprecated: use WithClientLogger.
 func WithClientErrorLogFunc(errorLogFunc func(fmt string, args ...interface{})) ClientOption {
 	return func(opts *ClientOptions) {
-		opts.errorLogFunc = errorLogFunc
+		opts.logger = slog.New(&printfHandler{logf: errorLogFunc})
+	}
+}
+
+// WithClientLogger sets logger opt, slog.Default() by default
+func WithClientLogger(logger *slog.Logger) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.logger = logger
 	}
 }
 
@@ -77,3 +97,63 @@ func WithClientKeepAliveCount(count int) ClientOption {
 		opts.keepAliveCount = count
 	}
 }
+
+// WithClientDialTimeout sets dial timeout opt
+func WithClientDialTimeout(timeout time.Duration) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.dialTimeout = timeout
+	}
+}
+
+// WithClientLocalAddress sets local source address opt, the port can be omitted
+func WithClientLocalAddress(addr string) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.localAddr = addr
+	}
+}
+
+// WithClientBindInterface sets egress network interface opt
+func WithClientBindInterface(name string) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.bindInterface = name
+	}
+}
+
+// WithClientResolver sets resolver opt
+func WithClientResolver(r *net.Resolver) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.resolver = r
+		opts.dnsServer = ""
+	}
+}
+
+// WithClientDNSServer sets resolver opt which queries the given DNS server address,
+// queries are sent from the local address and interface of dialing
+func WithClientDNSServer(addr string) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.resolver = nil
+		opts.dnsServer = addr
+	}
+}
+
+// WithClientIPVersion sets ip version opt, 4 or 6 restricts dialing to IPv4 or IPv6, 0 allows both
+func WithClientIPVersion(version int) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.ipVersion = version
+	}
+}
+
+// WithClientFallbackDelay sets Happy Eyeballs fallback delay opt, negative value disables fallback
+func WithClientFallbackDelay(delay time.Duration) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.fallbackDelay = delay
+	}
+}
+
+// WithClientControl sets control function opt called with each resolved address before it is dialed,
+// dialing the address fails if it returns an error
+func WithClientControl(f func(ctx context.Context, network, address string, c syscall.RawConn) error) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.control = f
+	}
+}
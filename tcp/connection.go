@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"runtime"
 	"sync"
@@ -367,7 +368,7 @@ func (c *conn) getState() (state ConnState, unixSec int64) {
 // ErrAbortHandler means abort handler error
 var ErrAbortHandler = errors.New("tnet/tcp: abort Handler")
 
-func (c *conn) serve(ctx context.Context, handler ConnHandler, errorLogFunc func(fmt string, args ...interface{})) {
+func (c *conn) serve(ctx context.Context, handler ConnHandler, logger *slog.Logger) {
 	c.remoteAddr = c.rwc.RemoteAddr().String()
 	ctx = context.WithValue(ctx, LocalAddrContextKey, c.rwc.LocalAddr())
 	defer func() {
@@ -375,7 +376,7 @@ func (c *conn) serve(ctx context.Context, handler ConnHandler, errorLogFunc func
 			const size = 64 << 10
 			buf := make([]byte, size)
 			buf = buf[:runtime.Stack(buf, false)]
-			errorLogFunc("tnet/tcp: panic serving %v: %v\n%s", c.remoteAddr, err, buf)
+			logger.Error("tcp panic serving", "remoteAddr", c.remoteAddr, "err", err, "stack", string(buf))
 		}
 		c.close()
 		c.setState(StateClosed)
@@ -0,0 +1,154 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// NewResolver creates a resolver which sends DNS queries to server,
+// the port defaults to 53 if omitted
+func NewResolver(server string) *net.Resolver {
+	return newResolver(server, nil, nil)
+}
+
+// newResolver creates a resolver which sends DNS queries to server from source address src
+// through control, so that queries leave by the same source address and interface as dialing
+func newResolver(server string, src net.IP, control func(network, address string, c syscall.RawConn) error) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Control: control}
+			if src != nil {
+				if strings.HasPrefix(network, "udp") {
+					d.LocalAddr = &net.UDPAddr{IP: src}
+				} else {
+					d.LocalAddr = &net.TCPAddr{IP: src}
+				}
+			}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// DialContextFunc dials a network connection
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// NewDialContextFunc creates a dial function using the dial options of client,
+// the network argument of the returned function is narrowed by WithClientIPVersion
+func NewDialContextFunc(opts ...ClientOption) (DialContextFunc, error) {
+	opt := newClientOptions(opts...)
+	d, err := opt.newDialer()
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" {
+			network = opt.network()
+		}
+		return d.DialContext(ctx, network, addr)
+	}, nil
+}
+
+func (opts *ClientOptions) network() string {
+	switch opts.ipVersion {
+	case 4:
+		return "tcp4"
+	case 6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+func (opts *ClientOptions) newDialer() (*net.Dialer, error) {
+	d := &net.Dialer{
+		Timeout:       opts.dialTimeout,
+		FallbackDelay: opts.fallbackDelay,
+		Resolver:      opts.resolver,
+	}
+	if addr := opts.localAddr; addr != "" {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = addr, "0"
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("tnet/tcp: invalid local address %q", addr)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("tnet/tcp: invalid local address %q", addr)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip, Port: p}
+	}
+	if name := opts.bindInterface; name != "" {
+		if err := bindInterface(d, name, opts.ipVersion); err != nil {
+			return nil, err
+		}
+	}
+	if server := opts.dnsServer; server != "" {
+		var src net.IP
+		if addr, ok := d.LocalAddr.(*net.TCPAddr); ok {
+			src = addr.IP
+		}
+		d.Resolver = newResolver(server, src, d.Control)
+	}
+	if control := opts.control; control != nil {
+		// ControlContext takes precedence over Control set by bindInterface
+		bind := d.Control
+		d.Control = nil
+		d.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if err := control(ctx, network, address, c); err != nil {
+				return err
+			}
+			if bind != nil {
+				return bind(network, address, c)
+			}
+			return nil
+		}
+	}
+	return d, nil
+}
+
+// interfaceAddr returns the first address of interface name matching ipVersion
+func interfaceAddr(name string, ipVersion int) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		is4 := ipNet.IP.To4() != nil
+		if (ipVersion == 4 && !is4) || (ipVersion == 6 && is4) {
+			continue
+		}
+		return ipNet.IP, nil
+	}
+	return nil, fmt.Errorf("tnet/tcp: no usable address on interface %s", name)
+}
+
+// bindInterfaceAddr binds the source address of d to the address of interface name
+func bindInterfaceAddr(d *net.Dialer, name string, ipVersion int) error {
+	if d.LocalAddr != nil {
+		return nil
+	}
+	ip, err := interfaceAddr(name, ipVersion)
+	if err != nil {
+		return err
+	}
+	d.LocalAddr = &net.TCPAddr{IP: ip}
+	return nil
+}
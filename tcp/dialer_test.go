@@ -0,0 +1,223 @@
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// serveDNS answers A queries with ip on a udp socket of 127.0.0.1, source addresses of queries are sent to srcs
+func serveDNS(t *testing.T, ip net.IP) (addr string, srcs <-chan net.IP) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	ch := make(chan net.IP, 16)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := buf[:n]
+			if len(q) < 12 {
+				continue
+			}
+			select {
+			case ch <- from.(*net.UDPAddr).IP:
+			default:
+			}
+			// answer follows the question, additional records like EDNS are dropped
+			end := 12
+			for end < len(q) && q[end] != 0 {
+				end += int(q[end]) + 1
+			}
+			end += 5
+			if end > len(q) {
+				continue
+			}
+			resp := append([]byte(nil), q[:end]...)
+			resp[2] |= 0x80 // response
+			resp[3] = 0x80  // recursion available, no error
+			binary.BigEndian.PutUint32(resp[8:], 0)
+			binary.BigEndian.PutUint16(resp[6:], 0)
+			if qtype := binary.BigEndian.Uint16(q[end-4:]); qtype == 1 {
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, ip.To4()...)
+			}
+			pc.WriteTo(resp, from)
+		}
+	}()
+	return pc.LocalAddr().String(), ch
+}
+
+func TestNewResolver(t *testing.T) {
+	server, srcs := serveDNS(t, net.IPv4(10, 1, 2, 3))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := NewResolver(server).LookupHost(ctx, "target.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "10.1.2.3" {
+		t.Errorf("addrs = %v, want [10.1.2.3]", addrs)
+	}
+	if src := <-srcs; !src.IsLoopback() {
+		t.Errorf("query is sent from %v", src)
+	}
+}
+
+func TestDialerResolverSourceAddress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.2 is not a local address")
+	}
+	server, srcs := serveDNS(t, net.IPv4(127, 0, 0, 1))
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c.RemoteAddr()
+		c.Close()
+	}()
+
+	dial, err := NewDialContextFunc(WithClientLocalAddress("127.0.0.2"), WithClientDNSServer(server), WithClientIPVersion(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	c, err := dial(context.Background(), "tcp", net.JoinHostPort("target.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if src := <-srcs; !src.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("dns query is sent from %v, want 127.0.0.2", src)
+	}
+	if addr := (<-accepted).(*net.TCPAddr); !addr.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("connection is dialed from %v, want 127.0.0.2", addr)
+	}
+}
+
+func TestNewDialerLocalAddress(t *testing.T) {
+	cases := []struct {
+		addr string
+		want string // empty if invalid
+	}{
+		{"127.0.0.1", "127.0.0.1:0"},
+		{"127.0.0.1:1234", "127.0.0.1:1234"},
+		{"::1", "[::1]:0"},
+		{"[::1]:80", "[::1]:80"},
+		{"example.com", ""},
+		{"127.0.0.1:http", ""},
+	}
+	for _, c := range cases {
+		d, err := newClientOptions(WithClientLocalAddress(c.addr)).newDialer()
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("invalid local address %q is accepted", c.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("local address %q: %v", c.addr, err)
+			continue
+		}
+		if got := d.LocalAddr.String(); got != c.want {
+			t.Errorf("local address of %q = %s, want %s", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestNewDialerBindInterface(t *testing.T) {
+	if _, err := newClientOptions(WithClientBindInterface("no-such-if0")).newDialer(); err == nil {
+		t.Error("unknown interface is accepted")
+	}
+	lo := loopbackInterface(t)
+	d, err := newClientOptions(WithClientBindInterface(lo)).newDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Control == nil && d.LocalAddr == nil {
+		t.Errorf("dialer is not bound to %s", lo)
+	}
+}
+
+func TestInterfaceAddr(t *testing.T) {
+	lo := loopbackInterface(t)
+	ip, err := interfaceAddr(lo, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.To4() == nil || !ip.IsLoopback() {
+		t.Errorf("IPv4 address of %s = %v", lo, ip)
+	}
+	if ip, err := interfaceAddr(lo, 6); err == nil && ip.To4() != nil {
+		t.Errorf("IPv6 address of %s = %v", lo, ip)
+	}
+}
+
+func TestIPVersion(t *testing.T) {
+	for v, want := range map[int]string{0: "tcp", 4: "tcp4", 6: "tcp6"} {
+		if got := newClientOptions(WithClientIPVersion(v)).network(); got != want {
+			t.Errorf("network of ip version %d = %s, want %s", v, got, want)
+		}
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	addr := l.Addr().String()
+	for v, ok := range map[int]bool{0: true, 4: true, 6: false} {
+		dial, err := NewDialContextFunc(WithClientIPVersion(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := dial(context.Background(), "tcp", addr)
+		if (err == nil) != ok {
+			t.Errorf("dial %s with ip version %d: %v", addr, v, err)
+		}
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			return ifi.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
@@ -73,7 +73,12 @@ func (srv *Server) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
-	srv.opts.errorLogFunc("tnet/tcp: serve on %s\n", l.Addr().String())
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l, l is closed when Serve returns
+func (srv *Server) Serve(l net.Listener) error {
+	srv.opts.logger.Info("tcp server listen", "addr", l.Addr().String())
 
 	origListener := l
 	l = &onceCloseListener{Listener: l}
@@ -112,7 +117,7 @@ func (srv *Server) ListenAndServe() error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				srv.opts.errorLogFunc("tnet/tcp: Accept error: %v; retrying in %v", err, tempDelay)
+				srv.opts.logger.Warn("tcp accept failed, retrying", "err", err, "delay", tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
@@ -139,7 +144,7 @@ func (srv *Server) ListenAndServe() error {
 
 		c := srv.newConn(rw)
 		c.setState(StateNew) // before serve can return
-		go c.serve(connCtx, srv.opts.handler, srv.opts.errorLogFunc)
+		go c.serve(connCtx, srv.opts.handler, srv.opts.logger)
 	}
 }
 
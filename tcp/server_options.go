@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"context"
+	"log/slog"
 	"net"
 	"time"
 )
@@ -13,7 +14,7 @@ type ServerOptions struct {
 
 	baseContext     func(net.Listener) context.Context
 	connContext     func(ctx context.Context, c net.Conn) context.Context
-	errorLogFunc    func(fmt string, args ...interface{})
+	logger          *slog.Logger
 	keepAlivePeriod time.Duration
 	keepAliveCount  int
 }
@@ -33,8 +34,8 @@ func newServerOptions(opts ...ServerOption) *ServerOptions {
 	if opt.handler == nil {
 		opt.handler = DefaultConnHandler
 	}
-	if opt.errorLogFunc == nil {
-		opt.errorLogFunc = DefaultErrorLogFunc
+	if opt.logger == nil {
+		opt.logger = slog.Default()
 	}
 
 	return opt
@@ -69,9 +70,18 @@ func WithServerConnContextFunc(f func(ctx context.Context, c net.Conn) context.C
 }
 
 // WithServerErrorLogFunc sets error log function opt
+//
+// Deprecated: use WithServerLogger.
 func WithServerErrorLogFunc(errorLogFunc func(fmt string, args ...interface{})) ServerOption {
 	return func(opts *ServerOptions) {
-		opts.errorLogFunc = errorLogFunc
+		opts.logger = slog.New(&printfHandler{logf: errorLogFunc})
+	}
+}
+
+// WithServerLogger sets logger opt, slog.Default() by default
+func WithServerLogger(logger *slog.Logger) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.logger = logger
 	}
 }
 
@@ -1,16 +1,54 @@
 package tcp
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
 // default tcp options
 var (
+	// Deprecated: logs go to slog.Default() unless WithServerLogger or WithClientLogger is given.
 	DefaultErrorLogFunc = log.Printf
 )
 
+// printfHandler is slog handler calling printf style log function, it is used by deprecated error log function options
+type printfHandler struct {
+	logf  func(fmt string, args ...interface{})
+	attrs []slog.Attr
+}
+
+func (h *printfHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *printfHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	h.logf("%s", b.String())
+	return nil
+}
+
+func (h *printfHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &printfHandler{logf: h.logf, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...)}
+}
+
+func (h *printfHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
 type atomicBool int32
 
 func (b *atomicBool) isSet() bool { return atomic.LoadInt32((*int32)(b)) != 0 }
@@ -21,3 +21,20 @@ func SetKeepAliveCount(conn *net.TCPConn, count int) (err error) {
 
 	return err
 }
+
+// bindInterface binds dialer to the network interface name with SO_BINDTODEVICE
+func bindInterface(d *net.Dialer, name string, ipVersion int) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		return err
+	}
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), name)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	return nil
+}
@@ -9,3 +9,8 @@ import (
 func SetKeepAliveCount(conn *net.TCPConn, count int) (err error) {
 	return errors.New("not supported")
 }
+
+// bindInterface binds the source address of dialer to the address of interface name
+func bindInterface(d *net.Dialer, name string, ipVersion int) error {
+	return bindInterfaceAddr(d, name, ipVersion)
+}
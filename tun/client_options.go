@@ -1,9 +1,19 @@
 package tun
 
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+)
+
 // ClientOptions is client options
 type ClientOptions struct {
-	addr    string
-	period  int
+	addr        string
+	period      int
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	tlsConfig   *tls.Config
+	logger      *slog.Logger
 }
 
 // ClientOption is option setter for client
@@ -23,6 +33,9 @@ func newClientOptions(opts ...ClientOption) *ClientOptions {
 	if opt.addr == "" {
 		opt.addr = DefaultConnectAddress
 	}
+	if opt.logger == nil {
+		opt.logger = slog.Default()
+	}
 	return opt
 }
 
@@ -32,3 +45,24 @@ func WithConnectAddress(addr string) ClientOption {
 		opts.addr = addr
 	}
 }
+
+// WithDialContextFunc sets the function dialing the underlying network connection opt
+func WithDialContextFunc(f func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.dialContext = f
+	}
+}
+
+// WithClientTLSConfig sets tls config of wss connect address opt, e.g. root CAs and client certificate
+func WithClientTLSConfig(cfg *tls.Config) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.tlsConfig = cfg
+	}
+}
+
+// WithClientLogger sets client logger opt, slog.Default() by default
+func WithClientLogger(logger *slog.Logger) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.logger = logger
+	}
+}
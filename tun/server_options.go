@@ -1,8 +1,15 @@
 package tun
 
+import (
+	"crypto/tls"
+	"log/slog"
+)
+
 // ServerOptions is server options
 type ServerOptions struct {
-	addr string
+	addr      string
+	tlsConfig *tls.Config
+	logger    *slog.Logger
 }
 
 // ServerOption is option setter for server
@@ -22,6 +29,9 @@ func newServerOptions(opts ...ServerOption) *ServerOptions {
 	if opt.addr == "" {
 		opt.addr = DefaultListenAddress
 	}
+	if opt.logger == nil {
+		opt.logger = slog.Default()
+	}
 	return opt
 }
 
@@ -31,3 +41,18 @@ func WithListenAddress(addr string) ServerOption {
 		opts.addr = addr
 	}
 }
+
+// WithServerTLSConfig sets tls config of wss listen address opt,
+// peers with verified client certificates are identified by their common names
+func WithServerTLSConfig(cfg *tls.Config) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.tlsConfig = cfg
+	}
+}
+
+// WithServerLogger sets server logger opt, slog.Default() by default
+func WithServerLogger(logger *slog.Logger) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.logger = logger
+	}
+}
@@ -2,6 +2,7 @@ package tun
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 )
 
@@ -10,6 +11,32 @@ type Addr interface {
 	String() string
 }
 
+// PeerAddrContextKey is context key of remote address of tunnel connection, the value is string
+type PeerAddrContextKey struct{}
+
+// PeerAddr returns remote address of tunnel connection served with ctx, empty if unknown
+func PeerAddr(ctx context.Context) string {
+	addr, _ := ctx.Value(PeerAddrContextKey{}).(string)
+	return addr
+}
+
+// PeerIdentityContextKey is context key of identity of tunnel peer authenticated by transport, the value is string
+type PeerIdentityContextKey struct{}
+
+// PeerIdentity returns identity of tunnel peer served with ctx, empty if the peer is not authenticated
+func PeerIdentity(ctx context.Context) string {
+	identity, _ := ctx.Value(PeerIdentityContextKey{}).(string)
+	return identity
+}
+
+// tlsIdentity returns common name of verified peer certificate, empty if state is nil or not verified
+func tlsIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
 // Handler is tunnel handler
 type Handler interface {
 	ServeTun(ctx context.Context, r io.Reader, w io.Writer)
@@ -2,6 +2,7 @@ package tun
 
 import (
 	"context"
+	"crypto/tls"
 
 	"github.com/gorilla/websocket"
 )
@@ -13,17 +14,33 @@ type wsClient struct {
 }
 
 func (c *wsClient) DialAndServe(ctx context.Context, h Handler) error {
-	conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.opts.addr, nil)
+	d := *websocket.DefaultDialer
+	if f := c.opts.dialContext; f != nil {
+		d.NetDialContext = f
+	}
+	if c.opts.tlsConfig != nil {
+		d.TLSClientConfig = c.opts.tlsConfig
+	}
+	dialer := &d
+	conn, _, err := dialer.DialContext(ctx, c.opts.addr, nil)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	c.opts.logger.Debug("tunnel connected", "addr", c.opts.addr, "remoteAddr", conn.RemoteAddr().String())
 
 	wsr := newWsReader(conn)
 	wsw := newWsWriter(conn)
 
 	done := make(chan struct{})
 	go startPing(conn, done)
+	ctx = context.WithValue(ctx, PeerAddrContextKey{}, conn.RemoteAddr().String())
+	if tc, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		if identity := tlsIdentity(&state); identity != "" {
+			ctx = context.WithValue(ctx, PeerIdentityContextKey{}, identity)
+		}
+	}
 	h.ServeTun(ctx, wsr, wsw)
 
 	close(done)
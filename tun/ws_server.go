@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -113,13 +114,17 @@ type wsServer struct {
 func (s *wsServer) serveHTTP(h Handler, w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		s.opts.logger.Warn("websocket upgrade failed", "remoteAddr", r.RemoteAddr, "err", err)
 		return
 	}
 	defer conn.Close()
 
 	wsr := newWsReader(conn)
 	wsw := newWsWriter(conn)
-	ctx := r.Context()
+	ctx := context.WithValue(r.Context(), PeerAddrContextKey{}, r.RemoteAddr)
+	if identity := tlsIdentity(r.TLS); identity != "" {
+		ctx = context.WithValue(ctx, PeerIdentityContextKey{}, identity)
+	}
 
 	done := make(chan struct{})
 	go startPing(conn, done)
@@ -133,14 +138,24 @@ func (s *wsServer) ListenAndServe(ctx context.Context, h Handler) error {
 	if addr == nil {
 		return errors.New("invalid address")
 	}
+	secure := addr.url.Scheme == "wss"
+	if secure && s.opts.tlsConfig == nil {
+		return errors.New("wss listen address requires tls config")
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc(addr.uri(), func(w http.ResponseWriter, r *http.Request) {
 		s.serveHTTP(h, w, r)
 	})
 	var connID int64
 	srv := &http.Server{
-		Addr:    addr.host(),
-		Handler: mux,
+		Addr:      addr.host(),
+		Handler:   mux,
+		TLSConfig: s.opts.tlsConfig,
+		ErrorLog:  slog.NewLogLogger(s.opts.logger.Handler(), slog.LevelWarn),
+		// tunnels are hijacked connections not closed by Shutdown, they end with ctx
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
 		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
 			connID++
 			return context.WithValue(ctx, ConnIDContextKey{}, connID)
@@ -149,8 +164,17 @@ func (s *wsServer) ListenAndServe(ctx context.Context, h Handler) error {
 
 	// Start server in a goroutine
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		s.opts.logger.Info("tunnel server listen", "addr", addr.String())
+		var err error
+		if secure {
+			// certificates are in TLSConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			// Don't return error here, we'll handle it via the context cancel
+			s.opts.logger.Error("tunnel server listen failed", "addr", addr.String(), "err", err)
 		}
 	}()
 
@@ -0,0 +1,128 @@
+package tun
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type handlerFunc func(ctx context.Context, r io.Reader, w io.Writer)
+
+func (f handlerFunc) ServeTun(ctx context.Context, r io.Reader, w io.Writer) {
+	f(ctx, r, w)
+}
+
+// issue returns certificate of cn signed by parent, self-signed if parent is nil
+func issue(t *testing.T, cn string, parent *tls.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestWsTLSPeerIdentity(t *testing.T) {
+	ca := issue(t, "ca", nil, x509.ExtKeyUsageAny)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := issue(t, "agent-1", &ca, x509.ExtKeyUsageServerAuth)
+	clientCert := issue(t, "proxy-1", &ca, x509.ExtKeyUsageClientAuth)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "wss://" + l.Addr().String() + "/stream"
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	serverIdentity := make(chan string, 1)
+	s := NewServer(
+		WithListenAddress(addr),
+		WithServerTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}),
+	)
+	go s.ListenAndServe(ctx, handlerFunc(func(ctx context.Context, r io.Reader, w io.Writer) {
+		serverIdentity <- PeerIdentity(ctx)
+	}))
+
+	dial := func(certs []tls.Certificate) (string, error) {
+		var identity string
+		c := NewClient(
+			WithConnectAddress(addr),
+			WithClientTLSConfig(&tls.Config{RootCAs: pool, Certificates: certs}),
+		)
+		err := c.DialAndServe(ctx, handlerFunc(func(ctx context.Context, r io.Reader, w io.Writer) {
+			identity = PeerIdentity(ctx)
+		}))
+		return identity, err
+	}
+
+	var clientIdentity string
+	for {
+		if clientIdentity, err = dial([]tls.Certificate{clientCert}); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal(err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if clientIdentity != "agent-1" {
+		t.Errorf("identity of server = %q, want agent-1", clientIdentity)
+	}
+	if identity := <-serverIdentity; identity != "proxy-1" {
+		t.Errorf("identity of client = %q, want proxy-1", identity)
+	}
+
+	if _, err := dial(nil); err == nil {
+		t.Error("client without certificate is accepted")
+	}
+}
+
+func TestWsServerRequiresTLSConfig(t *testing.T) {
+	s := NewServer(WithListenAddress("wss://127.0.0.1:0/stream"))
+	if err := s.ListenAndServe(context.Background(), nil); err == nil {
+		t.Error("wss listen address without tls config is accepted")
+	}
+}